@@ -26,8 +26,11 @@ import (
 	"os"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/opml"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -39,7 +42,7 @@ type (
 		ln          *net.UnixListener
 		socketPath  string
 		State       chan state
-		db          *database.DB
+		db          database.Store
 		lock        sync.Mutex
 		cmdHandlers map[string]reflect.Value
 		connections []*net.UnixConn
@@ -238,12 +241,77 @@ func (a *Admin) ChangeUserPassword(args args, r *Response) error {
 	return nil
 }
 
+// SetUserRole changes a user's role
+func (a *Admin) SetUserRole(args args, r *Response) error {
+	var userID string
+	var role string
+
+	r.Status = BadArgument
+
+	aVal := reflect.ValueOf(args["userID"])
+	if aVal.Kind() != reflect.String {
+		r.Error = "Bad first argument"
+		return nil
+	}
+
+	bVal := reflect.ValueOf(args["role"])
+	if bVal.Kind() != reflect.String {
+		r.Error = "Bad second argument"
+		return nil
+	}
+
+	userID = aVal.String()
+	role = bVal.String()
+
+	err := a.db.SetUserRole(userID, role)
+	if err != nil {
+		dbError := err.(database.DBError)
+		r.Status = DatabaseError
+		r.Error = dbError.Error()
+		return nil
+	}
+
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// ResetTOTP turns off two-factor authentication for a user
+// who lost their authenticator app and recovery codes
+func (a *Admin) ResetTOTP(args args, r *Response) error {
+	var userID string
+
+	r.Status = BadArgument
+
+	aVal := reflect.ValueOf(args["userID"])
+	if aVal.Kind() != reflect.String {
+		r.Error = "Bad first argument"
+		return nil
+	}
+
+	userID = aVal.String()
+
+	err := a.db.DisableTOTP(userID)
+	if err != nil {
+		dbError := err.(database.DBError)
+		r.Status = DatabaseError
+		r.Error = dbError.Error()
+		return nil
+	}
+
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
 // GetUsers returns a list of all existing users.
 func (a *Admin) GetUsers(args args, r *Response) error {
 	r.Status = OK
 	r.Error = "OK"
 
-	r.Result = a.db.Users("id,created_at,updated_at,uuid,email,username")
+	r.Result = a.db.Users("id,created_at,updated_at,uuid,email,username,role,totp_enabled")
 
 	return nil
 }
@@ -277,8 +345,331 @@ func (a *Admin) GetUser(args args, r *Response) error {
 	return nil
 }
 
+// NewInvite creates an invite code. The optional arguments maxUses,
+// which defaults to one, and expiresIn, in days, limit its use.
+func (a *Admin) NewInvite(args args, r *Response) error {
+	invite := models.Invite{MaxUses: 1}
+
+	r.Status = BadArgument
+
+	if maxUses, ok := args["maxUses"]; ok {
+		aVal := reflect.ValueOf(maxUses)
+		if aVal.Kind() != reflect.Float64 {
+			r.Error = "Bad first argument"
+			return nil
+		}
+		invite.MaxUses = int(aVal.Float())
+	}
+
+	if expiresIn, ok := args["expiresIn"]; ok {
+		bVal := reflect.ValueOf(expiresIn)
+		if bVal.Kind() != reflect.Float64 || bVal.Float() <= 0 {
+			r.Error = "Bad second argument"
+			return nil
+		}
+		invite.ExpiresAt = time.Now().Add(time.Duration(bVal.Float() * float64(time.Hour*24)))
+	}
+
+	err := a.db.NewInvite(&invite)
+	if err != nil {
+		dbError := err.(database.DBError)
+		r.Status = DatabaseError
+		r.Error = dbError.Error()
+		return nil
+	}
+
+	r.Result = invite
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// GetInvites returns every invite code.
+func (a *Admin) GetInvites(args args, r *Response) error {
+	r.Status = OK
+	r.Error = "OK"
+
+	r.Result = a.db.Invites()
+
+	return nil
+}
+
+// DeleteInvite revokes an invite code
+func (a *Admin) DeleteInvite(args args, r *Response) error {
+	r.Status = BadArgument
+	r.Error = "Bad first argument"
+
+	aVal := reflect.ValueOf(args["inviteID"])
+	if aVal.Kind() != reflect.String {
+		return nil
+	}
+
+	err := a.db.DeleteInvite(aVal.String())
+	if err != nil {
+		dbError := err.(database.DBError)
+		r.Status = DatabaseError
+		r.Error = dbError.Error()
+		return nil
+	}
+
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// GetLockouts returns every account and IP address with recent failed logins.
+func (a *Admin) GetLockouts(args args, r *Response) error {
+	r.Status = OK
+	r.Error = "OK"
+
+	r.Result = a.db.Lockouts()
+
+	return nil
+}
+
+// ClearLockout forgets the failed logins of an account or IP address
+func (a *Admin) ClearLockout(args args, r *Response) error {
+	var kind string
+	var subject string
+
+	r.Status = BadArgument
+
+	aVal := reflect.ValueOf(args["kind"])
+	if aVal.Kind() != reflect.String {
+		r.Error = "Bad first argument"
+		return nil
+	}
+
+	bVal := reflect.ValueOf(args["subject"])
+	if bVal.Kind() != reflect.String {
+		r.Error = "Bad second argument"
+		return nil
+	}
+
+	kind = aVal.String()
+	subject = bVal.String()
+
+	err := a.db.ClearLockout(kind, subject)
+	if err != nil {
+		dbError := err.(database.DBError)
+		r.Status = DatabaseError
+		r.Error = dbError.Error()
+		return nil
+	}
+
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// Health reports whether the database can be reached
+func (a *Admin) Health(args args, r *Response) error {
+	if err := a.db.Ping(); err != nil {
+		r.Status = DatabaseError
+		r.Error = err.Error()
+		return nil
+	}
+
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// ArchiveSummary describes the contents of a backup archive
+type ArchiveSummary struct {
+	Version    int `json:"version"`
+	Users      int `json:"users"`
+	Categories int `json:"categories"`
+	Feeds      int `json:"feeds"`
+	Tags       int `json:"tags"`
+	Entries    int `json:"entries"`
+}
+
+func newArchiveSummary(archive database.Archive) ArchiveSummary {
+	return ArchiveSummary{
+		Version:    archive.Version,
+		Users:      len(archive.Users),
+		Categories: len(archive.Categories),
+		Feeds:      len(archive.Feeds),
+		Tags:       len(archive.Tags),
+		Entries:    len(archive.Entries),
+	}
+}
+
+// Backup writes an archive of all users and their data to a file
+func (a *Admin) Backup(args args, r *Response) error {
+	r.Status = BadArgument
+	r.Error = "Bad first argument"
+
+	aVal := reflect.ValueOf(args["path"])
+	if aVal.Kind() != reflect.String {
+		return nil
+	}
+
+	file, err := os.Create(aVal.String())
+	if err != nil {
+		r.Status = InternalError
+		r.Error = err.Error()
+		return nil
+	}
+	defer file.Close()
+
+	archive, err := database.Backup(a.db, file)
+	if err != nil {
+		r.Status = InternalError
+		r.Error = err.Error()
+		return nil
+	}
+
+	r.Result = newArchiveSummary(archive)
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// Restore imports an archive written by Backup from a file
+func (a *Admin) Restore(args args, r *Response) error {
+	r.Status = BadArgument
+	r.Error = "Bad first argument"
+
+	aVal := reflect.ValueOf(args["path"])
+	if aVal.Kind() != reflect.String {
+		return nil
+	}
+
+	file, err := os.Open(aVal.String())
+	if err != nil {
+		r.Status = InternalError
+		r.Error = err.Error()
+		return nil
+	}
+	defer file.Close()
+
+	archive, err := database.Restore(a.db, file, logRestoreProgress)
+	if err != nil {
+		if _, ok := err.(database.DBError); ok {
+			r.Status = DatabaseError
+		} else {
+			r.Status = InternalError
+		}
+		r.Error = err.Error()
+		return nil
+	}
+
+	r.Result = newArchiveSummary(archive)
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// ImportOPML subscribes a user to the feeds of an OPML file
+// and returns the outcome of each feed
+func (a *Admin) ImportOPML(args args, r *Response) error {
+	r.Status = BadArgument
+
+	aVal := reflect.ValueOf(args["userID"])
+	if aVal.Kind() != reflect.String {
+		r.Error = "Bad first argument"
+		return nil
+	}
+
+	bVal := reflect.ValueOf(args["path"])
+	if bVal.Kind() != reflect.String {
+		r.Error = "Bad second argument"
+		return nil
+	}
+
+	user, err := a.db.UserWithUUID(aVal.String())
+	if err != nil {
+		dbError := err.(database.DBError)
+		r.Status = DatabaseError
+		r.Error = dbError.Error()
+		return nil
+	}
+
+	file, err := os.Open(bVal.String())
+	if err != nil {
+		r.Status = InternalError
+		r.Error = err.Error()
+		return nil
+	}
+	defer file.Close()
+
+	report, err := opml.Import(a.db, &user, file)
+	if err != nil {
+		if _, ok := err.(database.DBError); ok {
+			r.Status = DatabaseError
+		}
+		r.Error = err.Error()
+		return nil
+	}
+
+	r.Result = report
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// ExportOPML writes a user's subscriptions to an OPML file
+func (a *Admin) ExportOPML(args args, r *Response) error {
+	r.Status = BadArgument
+
+	aVal := reflect.ValueOf(args["userID"])
+	if aVal.Kind() != reflect.String {
+		r.Error = "Bad first argument"
+		return nil
+	}
+
+	bVal := reflect.ValueOf(args["path"])
+	if bVal.Kind() != reflect.String {
+		r.Error = "Bad second argument"
+		return nil
+	}
+
+	user, err := a.db.UserWithUUID(aVal.String())
+	if err != nil {
+		dbError := err.(database.DBError)
+		r.Status = DatabaseError
+		r.Error = dbError.Error()
+		return nil
+	}
+
+	file, err := os.Create(bVal.String())
+	if err != nil {
+		r.Status = InternalError
+		r.Error = err.Error()
+		return nil
+	}
+	defer file.Close()
+
+	if _, err = opml.Export(a.db, &user, file); err != nil {
+		r.Status = InternalError
+		r.Error = err.Error()
+		return nil
+	}
+
+	r.Status = OK
+	r.Error = "OK"
+
+	return nil
+}
+
+// logRestoreProgress logs every tenth of a restore
+func logRestoreProgress(done, total int) {
+	if done == total || done%(total/10+1) == 0 {
+		log.Infof("Restored %d of %d objects", done, total)
+	}
+}
+
 // NewAdmin creates a new Admin socket and initializes administration handlers
-func NewAdmin(db *database.DB, socketPath string) (a *Admin, err error) {
+func NewAdmin(db database.Store, socketPath string) (a *Admin, err error) {
 	a = &Admin{
 		db:    db,
 		State: make(chan state),
@@ -313,6 +704,18 @@ func NewAdmin(db *database.DB, socketPath string) (a *Admin, err error) {
 		"GetUser":            aVal.MethodByName("GetUser"),
 		"ChangeUserName":     aVal.MethodByName("ChangeUserName"),
 		"ChangeUserPassword": aVal.MethodByName("ChangeUserPassword"),
+		"SetUserRole":        aVal.MethodByName("SetUserRole"),
+		"ResetTOTP":          aVal.MethodByName("ResetTOTP"),
+		"GetLockouts":        aVal.MethodByName("GetLockouts"),
+		"ClearLockout":       aVal.MethodByName("ClearLockout"),
+		"NewInvite":          aVal.MethodByName("NewInvite"),
+		"GetInvites":         aVal.MethodByName("GetInvites"),
+		"DeleteInvite":       aVal.MethodByName("DeleteInvite"),
+		"Backup":             aVal.MethodByName("Backup"),
+		"Restore":            aVal.MethodByName("Restore"),
+		"ImportOPML":         aVal.MethodByName("ImportOPML"),
+		"ExportOPML":         aVal.MethodByName("ExportOPML"),
+		"Health":             aVal.MethodByName("Health"),
 	}
 
 	return
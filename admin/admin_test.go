@@ -22,9 +22,12 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/chavamee/syndication/database"
 	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/opml"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -241,6 +244,169 @@ func (suite *AdminTestSuite) TestChangeUserName() {
 	suite.Equal("gopher", user.Username)
 }
 
+func (suite *AdminTestSuite) TestSetUserRole() {
+	err := suite.db.NewUser("GoTest", "testtesttest")
+	suite.Require().Nil(err)
+
+	user, err := suite.db.UserWithName("GoTest")
+	suite.Require().Nil(err)
+	suite.Equal(models.RoleUser, user.Role)
+
+	req := Request{
+		Command: "SetUserRole",
+		Arguments: map[string]interface{}{
+			"userID": user.UUID,
+			"role":   models.RoleAdmin,
+		},
+	}
+
+	b, err := json.Marshal(req)
+	size, err := suite.conn.Write(b)
+	suite.Require().Nil(err)
+	suite.Equal(len(b), size)
+
+	buff := make([]byte, 512)
+	size, err = suite.conn.Read(buff)
+	suite.Require().Nil(err)
+
+	buff = buff[:size]
+
+	resp := &Response{}
+	err = json.Unmarshal(buff, resp)
+	suite.Require().Nil(err)
+	suite.Equal(OK, resp.Status)
+
+	user, err = suite.db.UserWithUUID(user.UUID)
+	suite.Equal(models.RoleAdmin, user.Role)
+}
+
+func (suite *AdminTestSuite) TestResetTOTP() {
+	err := suite.db.NewUser("GoTest", "testtesttest")
+	suite.Require().Nil(err)
+
+	user, err := suite.db.UserWithName("GoTest")
+	suite.Require().Nil(err)
+
+	secret, _, err := suite.db.NewTOTP("Syndication", &user)
+	suite.Require().Nil(err)
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	suite.Require().Nil(err)
+
+	_, err = suite.db.EnableTOTP(code, &user)
+	suite.Require().Nil(err)
+
+	req := Request{
+		Command: "ResetTOTP",
+		Arguments: map[string]interface{}{
+			"userID": user.UUID,
+		},
+	}
+
+	b, err := json.Marshal(req)
+	size, err := suite.conn.Write(b)
+	suite.Require().Nil(err)
+	suite.Equal(len(b), size)
+
+	buff := make([]byte, 512)
+	size, err = suite.conn.Read(buff)
+	suite.Require().Nil(err)
+
+	buff = buff[:size]
+
+	resp := &Response{}
+	err = json.Unmarshal(buff, resp)
+	suite.Require().Nil(err)
+	suite.Equal(OK, resp.Status)
+
+	user, err = suite.db.UserWithUUID(user.UUID)
+	suite.Require().Nil(err)
+	suite.False(user.TOTPEnabled)
+	suite.Zero(suite.db.RecoveryCodesLeft(&user))
+}
+
+func (suite *AdminTestSuite) TestExportOPML() {
+	err := suite.db.NewUser("GoTest", "testtesttest")
+	suite.Require().Nil(err)
+
+	user, err := suite.db.UserWithName("GoTest")
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err = suite.db.NewFeed(&feed, &user)
+	suite.Require().Nil(err)
+
+	path := "/tmp/syndication-test-admin.opml"
+	defer os.Remove(path)
+
+	req := Request{
+		Command: "ExportOPML",
+		Arguments: map[string]interface{}{
+			"userID": user.UUID,
+			"path":   path,
+		},
+	}
+
+	b, err := json.Marshal(req)
+	size, err := suite.conn.Write(b)
+	suite.Require().Nil(err)
+	suite.Equal(len(b), size)
+
+	buff := make([]byte, 512)
+	size, err = suite.conn.Read(buff)
+	suite.Require().Nil(err)
+
+	buff = buff[:size]
+
+	resp := &Response{}
+	err = json.Unmarshal(buff, resp)
+	suite.Require().Nil(err)
+	suite.Equal(OK, resp.Status)
+
+	file, err := os.Open(path)
+	suite.Require().Nil(err)
+	defer file.Close()
+
+	doc, err := opml.Parse(file)
+	suite.Require().Nil(err)
+	suite.Require().Len(doc.Body.Outlines, 1)
+	suite.Equal("http://example.com", doc.Body.Outlines[0].XMLURL)
+}
+
+func (suite *AdminTestSuite) TestClearLockout() {
+	err := suite.db.RecordLoginFailure("GoTest", "127.0.0.1")
+	suite.Require().Nil(err)
+	suite.Require().Len(suite.db.Lockouts(), 2)
+
+	req := Request{
+		Command: "ClearLockout",
+		Arguments: map[string]interface{}{
+			"kind":    models.LockoutAccount,
+			"subject": "GoTest",
+		},
+	}
+
+	b, err := json.Marshal(req)
+	size, err := suite.conn.Write(b)
+	suite.Require().Nil(err)
+	suite.Equal(len(b), size)
+
+	buff := make([]byte, 512)
+	size, err = suite.conn.Read(buff)
+	suite.Require().Nil(err)
+
+	buff = buff[:size]
+
+	resp := &Response{}
+	err = json.Unmarshal(buff, resp)
+	suite.Require().Nil(err)
+	suite.Equal(OK, resp.Status)
+
+	lockouts := suite.db.Lockouts()
+	suite.Require().Len(lockouts, 1)
+	suite.Equal(models.LockoutIP, lockouts[0].Kind)
+}
+
 func (suite *AdminTestSuite) TestChangeUserPassword() {
 	err := suite.db.NewUser("GoTest", "testtesttest")
 	suite.Require().Nil(err)
@@ -253,7 +419,7 @@ func (suite *AdminTestSuite) TestChangeUserPassword() {
 		Command: "ChangeUserPassword",
 		Arguments: map[string]interface{}{
 			"userID":      user.UUID,
-			"newPassword": "gopher",
+			"newPassword": "gopher123",
 		},
 	}
 
@@ -273,7 +439,7 @@ func (suite *AdminTestSuite) TestChangeUserPassword() {
 	suite.Require().Nil(err)
 	suite.Equal(OK, resp.Status)
 
-	user, err = suite.db.Authenticate("GoTest", "gopher")
+	user, err = suite.db.Authenticate("GoTest", "gopher123")
 	suite.Nil(err)
 	suite.NotEmpty(user.UUID)
 }
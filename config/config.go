@@ -20,35 +20,81 @@ import (
 	"bufio"
 	"github.com/BurntSushi/toml"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	SystemConfigPath = "/etc/syndication/config.toml"
 )
 
+// Password hashing algorithms
+const (
+	PasswordHashScrypt   = "scrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// Registration modes
+const (
+	RegistrationOpen     = "open"
+	RegistrationInvite   = "invite"
+	RegistrationDisabled = "disabled"
+)
+
 type (
 	Server struct {
-		AuthSecret            string        `toml:"auth_secret"`
-		AuthSecreteFilePath   string        `toml:"auth_secret_file_path"`
-		EnableTLS             bool          `toml:"enable_tls"`
-		EnableRequestLogs     bool          `toml:"enable_http_requests_log"`
-		EnablePanicPrintStack bool          `toml:"enable_panic_print_stack"`
-		Domain                string        `toml:"domain"`
-		CertCacheDir          string        `toml:"cert_cache_dir"`
-		MaxShutdownTime       int           `toml:"max_shutdown_time"`
-		HTTPPort              int           `toml:"http_port"`
-		ShutdownTimeout       time.Duration `toml:"shutdown_timeout"`
-		APIKeyExpiration      time.Duration `toml:"api_key_expiration"`
-		TLSPort               int           `toml:"tls_port"`
+		AuthSecret                   string        `toml:"auth_secret"`
+		AuthSecreteFilePath          string        `toml:"auth_secret_file_path"`
+		EnableTLS                    bool          `toml:"enable_tls"`
+		EnableRequestLogs            bool          `toml:"enable_http_requests_log"`
+		EnablePanicPrintStack        bool          `toml:"enable_panic_print_stack"`
+		Domain                       string        `toml:"domain"`
+		CertCacheDir                 string        `toml:"cert_cache_dir"`
+		MaxShutdownTime              int           `toml:"max_shutdown_time"`
+		HTTPPort                     int           `toml:"http_port"`
+		ShutdownTimeout              time.Duration `toml:"shutdown_timeout"`
+		AccessTokenExpirationMinutes int           `toml:"access_token_expiration_minutes"`
+		RefreshTokenExpirationDays   int           `toml:"refresh_token_expiration_days"`
+		LoginAttempts                int           `toml:"login_attempts"`
+		LoginIPAttempts              int           `toml:"login_ip_attempts"`
+		LoginLockoutSeconds          int           `toml:"login_lockout_seconds"`
+		LoginMaxLockoutSeconds       int           `toml:"login_max_lockout_seconds"`
+		TrustedProxies               []string      `toml:"trusted_proxies"`
+		AllowPrivateWebhooks         bool          `toml:"allow_private_webhooks"`
+		Registration                 string        `toml:"registration"`
+		PasswordMinLength            int           `toml:"password_min_length"`
+		PasswordRequireLetter        bool          `toml:"password_require_letter"`
+		PasswordRequireDigit         bool          `toml:"password_require_digit"`
+		PasswordRequireSymbol        bool          `toml:"password_require_symbol"`
+		PasswordHash                 string        `toml:"password_hash"`
+		ScryptN                      int           `toml:"scrypt_n"`
+		ScryptR                      int           `toml:"scrypt_r"`
+		ScryptP                      int           `toml:"scrypt_p"`
+		Argon2Time                   uint32        `toml:"argon2_time"`
+		Argon2Memory                 uint32        `toml:"argon2_memory"`
+		Argon2Threads                uint8         `toml:"argon2_threads"`
+		EnableFever                  bool          `toml:"enable_fever"`
+		EnableGoogleReader           bool          `toml:"enable_google_reader"`
+		TLSPort                      int           `toml:"tls_port"`
 	}
 
 	Database struct {
-		Type       string `toml:"-"`
-		Enable     bool
-		Connection string
+		Type                      string `toml:"-"`
+		Enable                    bool
+		Connection                string
+		TrashRetentionDays        int  `toml:"trash_retention_days"`
+		MaxOpenConnections        int  `toml:"max_open_connections"`
+		MaxIdleConnections        int  `toml:"max_idle_connections"`
+		ConnectionLifetimeSeconds int  `toml:"connection_lifetime_seconds"`
+		ConnectRetries            int  `toml:"connect_retries"`
+		ConnectBackoffSeconds     int  `toml:"connect_backoff_seconds"`
+		WAL                       bool `toml:"wal"`
+		BusyTimeoutMs             int  `toml:"busy_timeout_ms"`
+		ForeignKeys               bool `toml:"foreign_keys"`
 	}
 
 	Sync struct {
@@ -73,8 +119,13 @@ type (
 
 var (
 	DefaultDatabaseConfig = Database{
-		Type:       "sqlite3",
-		Connection: "/var/syndication/syndication.db",
+		Type:                  "sqlite3",
+		Connection:            "/var/syndication/syndication.db",
+		MaxIdleConnections:    2,
+		ConnectBackoffSeconds: 1,
+		WAL:                   true,
+		BusyTimeoutMs:         5000,
+		ForeignKeys:           true,
 	}
 
 	DefaultServerConfig = Server{
@@ -83,6 +134,7 @@ var (
 		AuthSecret:            "",
 		AuthSecreteFilePath:   "",
 		HTTPPort:              80,
+		Registration:          RegistrationOpen,
 	}
 
 	DefaultAdminConfig = Admin{
@@ -114,6 +166,32 @@ func (c *Config) verifyConfig() error {
 		return InvalidFieldValue{"Auth secret should not be empty"}
 	}
 
+	switch c.Server.Registration {
+	case "":
+		c.Server.Registration = RegistrationOpen
+	case RegistrationOpen, RegistrationInvite, RegistrationDisabled:
+	default:
+		return InvalidFieldValue{"Registration must be open, invite or disabled"}
+	}
+
+	switch c.Server.PasswordHash {
+	case "", PasswordHashScrypt, PasswordHashArgon2id:
+	default:
+		return InvalidFieldValue{"Password hash must be scrypt or argon2id"}
+	}
+
+	if n := c.Server.ScryptN; n < 0 || n == 1 || n&(n-1) != 0 {
+		return InvalidFieldValue{"Scrypt N must be a power of two greater than one"}
+	}
+
+	for _, proxy := range c.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return InvalidFieldValue{"Trusted proxies must be IP addresses or CIDR ranges"}
+			}
+		}
+	}
+
 	if len(c.Databases) > 1 {
 		return InvalidFieldValue{"Can only have one database definition"}
 	}
@@ -133,7 +211,7 @@ func (c *Config) verifyConfig() error {
 				return err
 			}
 
-			c.Database.Connection = c.Databases["sqlite"].Connection
+			c.Database = c.Databases["sqlite"]
 			c.Database.Type = "sqlite3"
 		} else if dbType == "mysql" {
 		} else if dbType == "postgres" {
@@ -149,6 +227,34 @@ func (c *Config) verifyConfig() error {
 	return nil
 }
 
+// setDatabaseDefaults fills in the options each database definition
+// leaves out with the ones of DefaultDatabaseConfig
+func (c *Config) setDatabaseDefaults(md toml.MetaData) {
+	for name, db := range c.Databases {
+		if !md.IsDefined("database", name, "max_idle_connections") {
+			db.MaxIdleConnections = DefaultDatabaseConfig.MaxIdleConnections
+		}
+
+		if !md.IsDefined("database", name, "connect_backoff_seconds") {
+			db.ConnectBackoffSeconds = DefaultDatabaseConfig.ConnectBackoffSeconds
+		}
+
+		if !md.IsDefined("database", name, "wal") {
+			db.WAL = DefaultDatabaseConfig.WAL
+		}
+
+		if !md.IsDefined("database", name, "busy_timeout_ms") {
+			db.BusyTimeoutMs = DefaultDatabaseConfig.BusyTimeoutMs
+		}
+
+		if !md.IsDefined("database", name, "foreign_keys") {
+			db.ForeignKeys = DefaultDatabaseConfig.ForeignKeys
+		}
+
+		c.Databases[name] = db
+	}
+}
+
 func (c *Config) getSecretFromFile(path string) error {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -210,6 +316,33 @@ func NewEmptyConfig(path string) Config {
 	}
 }
 
+// readLegacyKeys translates the keys of older configurations,
+// defined in md, to the keys that replaced them
+func (c *Config) readLegacyKeys(md toml.MetaData) error {
+	if !md.IsDefined("server", "api_key_expiration") {
+		return nil
+	}
+
+	var legacy struct {
+		Server struct {
+			APIKeyExpiration int `toml:"api_key_expiration"`
+		} `toml:"server"`
+	}
+	if _, err := toml.DecodeFile(c.path, &legacy); err != nil {
+		return err
+	}
+
+	if md.IsDefined("server", "access_token_expiration_minutes") {
+		log.Warn("api_key_expiration is deprecated and ignored in favor of access_token_expiration_minutes")
+		return nil
+	}
+
+	// api_key_expiration is in hours
+	log.Warn("api_key_expiration is deprecated, use access_token_expiration_minutes instead")
+	c.Server.AccessTokenExpirationMinutes = legacy.Server.APIKeyExpiration * 60
+	return nil
+}
+
 func NewConfig(path string) (config Config, err error) {
 	config.path = path
 
@@ -218,11 +351,18 @@ func NewConfig(path string) (config Config, err error) {
 		return
 	}
 
-	_, err = toml.DecodeFile(path, &config)
+	md, err := toml.DecodeFile(path, &config)
 	if err != nil {
 		return
 	}
 
+	if err = config.readLegacyKeys(md); err != nil {
+		config = Config{}
+		return
+	}
+
+	config.setDatabaseDefaults(md)
+
 	err = config.verifyConfig()
 	if err != nil {
 		config = Config{}
@@ -39,6 +39,23 @@ func (suite *ConfigTestSuite) TestSQLiteConfig() {
 	config, err := NewConfig("with_sqlite.toml")
 	suite.Require().Nil(err)
 	suite.Equal("/tmp/syndication.db", config.Database.Connection)
+	suite.Equal(4, config.Database.MaxOpenConnections)
+	suite.Equal(2, config.Database.ConnectRetries)
+	suite.True(config.Database.WAL)
+	suite.Equal(1000, config.Database.BusyTimeoutMs)
+	suite.True(config.Database.ForeignKeys)
+	suite.Equal(DefaultDatabaseConfig.MaxIdleConnections, config.Database.MaxIdleConnections)
+	suite.Equal(DefaultDatabaseConfig.ConnectBackoffSeconds, config.Database.ConnectBackoffSeconds)
+	suite.Equal(RegistrationInvite, config.Server.Registration)
+	suite.Equal(12, config.Server.PasswordMinLength)
+	suite.Equal(PasswordHashArgon2id, config.Server.PasswordHash)
+	suite.Equal(uint32(32768), config.Server.Argon2Memory)
+}
+
+func (suite *ConfigTestSuite) TestLegacyAPIKeyExpiration() {
+	config, err := NewConfig("with_api_key_expiration.toml")
+	suite.Require().Nil(err)
+	suite.Equal(72*60, config.Server.AccessTokenExpirationMinutes)
 }
 
 func TestConfigTestSuite(t *testing.T) {
@@ -0,0 +1,556 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// ArchiveVersion is the version of the archive format written by Backup
+const ArchiveVersion = 1
+
+type (
+	// Archive holds every object in a Store in a dialect independent form.
+	// Objects reference each other by UUID instead of primary keys so an
+	// archive can be restored into any backend.
+	Archive struct {
+		Version    int                `json:"version"`
+		CreatedAt  time.Time          `json:"created_at"`
+		Users      []ArchivedUser     `json:"users"`
+		Categories []ArchivedCategory `json:"categories"`
+		Feeds      []ArchivedFeed     `json:"feeds"`
+		Tags       []ArchivedTag      `json:"tags"`
+		Entries    []ArchivedEntry    `json:"entries"`
+
+		Publications []ArchivedPublication `json:"publications,omitempty"`
+		Webhooks     []ArchivedWebhook     `json:"webhooks,omitempty"`
+	}
+
+	// ArchivedUser is a User as stored in an Archive
+	ArchivedUser struct {
+		UUID                      string             `json:"id"`
+		CreatedAt                 time.Time          `json:"created_at"`
+		Username                  string             `json:"username"`
+		Email                     string             `json:"email"`
+		Role                      string             `json:"role,omitempty"`
+		Timezone                  string             `json:"timezone,omitempty"`
+		Preferences               models.Preferences `json:"preferences,omitempty"`
+		PasswordHash              []byte             `json:"password_hash"`
+		PasswordSalt              []byte             `json:"password_salt"`
+		PasswordParams            string             `json:"password_params,omitempty"`
+		TOTPSecret                string             `json:"totp_secret,omitempty"`
+		TOTPEnabled               bool               `json:"totp_enabled,omitempty"`
+		RecoveryCodes             []string           `json:"recovery_codes,omitempty"`
+		FeverKey                  string             `json:"fever_key,omitempty"`
+		UncategorizedCategoryUUID string             `json:"uncategorized_category"`
+		SavedCategoryUUID         string             `json:"saved_category"`
+	}
+
+	// ArchivedCategory is a Category as stored in an Archive
+	ArchivedCategory struct {
+		UUID      string     `json:"id"`
+		UserUUID  string     `json:"user"`
+		CreatedAt time.Time  `json:"created_at"`
+		DeletedAt *time.Time `json:"deleted_at,omitempty"`
+		Name      string     `json:"name"`
+	}
+
+	// ArchivedFeed is a Feed as stored in an Archive
+	ArchivedFeed struct {
+		UUID         string     `json:"id"`
+		UserUUID     string     `json:"user"`
+		CategoryUUID string     `json:"category"`
+		CreatedAt    time.Time  `json:"created_at"`
+		DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+		Title        string     `json:"title"`
+		Description  string     `json:"description"`
+		Subscription string     `json:"subscription"`
+		Source       string     `json:"source"`
+		TTL          int        `json:"ttl"`
+		Etag         string     `json:"etag"`
+		LastUpdated  time.Time  `json:"last_updated"`
+		Status       string     `json:"status"`
+	}
+
+	// ArchivedTag is a Tag as stored in an Archive
+	ArchivedTag struct {
+		UUID      string    `json:"id"`
+		UserUUID  string    `json:"user"`
+		CreatedAt time.Time `json:"created_at"`
+		Name      string    `json:"name"`
+	}
+
+	// ArchivedEntry is an Entry, including its mark and tags, as stored in an Archive
+	ArchivedEntry struct {
+		UUID        string        `json:"id"`
+		UserUUID    string        `json:"user"`
+		FeedUUID    string        `json:"feed"`
+		TagUUIDs    []string      `json:"tags,omitempty"`
+		CreatedAt   time.Time     `json:"created_at"`
+		DeletedAt   *time.Time    `json:"deleted_at,omitempty"`
+		GUID        string        `json:"guid"`
+		Title       string        `json:"title"`
+		Link        string        `json:"link"`
+		Description string        `json:"description"`
+		Author      string        `json:"author"`
+		Published   time.Time     `json:"published"`
+		Saved       bool          `json:"saved"`
+		Mark        models.Marker `json:"mark"`
+	}
+
+	// ArchivedPublication is a Publication, including its token, as stored in an Archive
+	ArchivedPublication struct {
+		UUID      string    `json:"id"`
+		UserUUID  string    `json:"user"`
+		CreatedAt time.Time `json:"created_at"`
+		Token     string    `json:"token,omitempty"`
+		Title     string    `json:"title"`
+		Source    string    `json:"source"`
+		SourceID  string    `json:"source_id,omitempty"`
+	}
+
+	// ArchivedWebhook is a Webhook, including its secret, as stored in an Archive.
+	// Its filter references feeds, categories and tags by UUID already.
+	ArchivedWebhook struct {
+		UUID       string    `json:"id"`
+		UserUUID   string    `json:"user"`
+		CreatedAt  time.Time `json:"created_at"`
+		URL        string    `json:"url"`
+		Secret     string    `json:"secret,omitempty"`
+		FeedID     string    `json:"feed_id,omitempty"`
+		CategoryID string    `json:"category_id,omitempty"`
+		TagID      string    `json:"tag_id,omitempty"`
+		Keyword    string    `json:"keyword,omitempty"`
+	}
+
+	// Progress is called as objects are restored with the number
+	// of objects restored so far and the total number of objects
+	Progress func(done, total int)
+)
+
+// Size returns the number of objects in the archive
+func (a *Archive) Size() int {
+	return len(a.Users) + len(a.Categories) + len(a.Feeds) + len(a.Tags) + len(a.Entries) +
+		len(a.Publications) + len(a.Webhooks)
+}
+
+// Verify checks that the archive has a supported version and
+// that every reference between its objects can be resolved
+func (a *Archive) Verify() error {
+	if a.Version != ArchiveVersion {
+		return BadRequest{"Unsupported archive version"}
+	}
+
+	users := map[string]bool{}
+	usernames := map[string]bool{}
+	for _, user := range a.Users {
+		if user.UUID == "" || users[user.UUID] || usernames[user.Username] {
+			return BadRequest{"Archive contains duplicate users"}
+		}
+		users[user.UUID] = true
+		usernames[user.Username] = true
+	}
+
+	categories := map[string]string{}
+	for _, ctg := range a.Categories {
+		if !users[ctg.UserUUID] {
+			return BadRequest{"Archive contains a category without a user"}
+		}
+		if _, ok := categories[ctg.UUID]; ok {
+			return BadRequest{"Archive contains duplicate categories"}
+		}
+		categories[ctg.UUID] = ctg.UserUUID
+	}
+
+	for _, user := range a.Users {
+		if categories[user.UncategorizedCategoryUUID] != user.UUID || categories[user.SavedCategoryUUID] != user.UUID {
+			return BadRequest{"Archive is missing system categories"}
+		}
+	}
+
+	feeds := map[string]string{}
+	for _, feed := range a.Feeds {
+		if !users[feed.UserUUID] || categories[feed.CategoryUUID] != feed.UserUUID {
+			return BadRequest{"Archive contains a feed with an invalid owner"}
+		}
+		if _, ok := feeds[feed.UUID]; ok {
+			return BadRequest{"Archive contains duplicate feeds"}
+		}
+		feeds[feed.UUID] = feed.UserUUID
+	}
+
+	tags := map[string]string{}
+	for _, tag := range a.Tags {
+		if !users[tag.UserUUID] {
+			return BadRequest{"Archive contains a tag without a user"}
+		}
+		if _, ok := tags[tag.UUID]; ok {
+			return BadRequest{"Archive contains duplicate tags"}
+		}
+		tags[tag.UUID] = tag.UserUUID
+	}
+
+	entries := map[string]bool{}
+	for _, entry := range a.Entries {
+		// Saved entries can outlive their feed
+		owner, ok := feeds[entry.FeedUUID]
+		if !users[entry.UserUUID] || (ok && owner != entry.UserUUID) {
+			return BadRequest{"Archive contains an entry with an invalid owner"}
+		}
+		if entries[entry.UUID] {
+			return BadRequest{"Archive contains duplicate entries"}
+		}
+		entries[entry.UUID] = true
+
+		for _, tagID := range entry.TagUUIDs {
+			if tags[tagID] != entry.UserUUID {
+				return BadRequest{"Archive contains an entry with an invalid tag"}
+			}
+		}
+	}
+
+	pubs := map[string]bool{}
+	tokens := map[string]bool{}
+	for _, pub := range a.Publications {
+		if !users[pub.UserUUID] {
+			return BadRequest{"Archive contains a publication without a user"}
+		}
+		if pub.UUID == "" || pubs[pub.UUID] || (pub.Token != "" && tokens[pub.Token]) {
+			return BadRequest{"Archive contains duplicate publications"}
+		}
+		pubs[pub.UUID] = true
+		tokens[pub.Token] = true
+
+		switch pub.Source {
+		case models.PublishCategory:
+			if categories[pub.SourceID] != pub.UserUUID {
+				return BadRequest{"Archive contains a publication with an invalid source"}
+			}
+		case models.PublishTag:
+			if tags[pub.SourceID] != pub.UserUUID {
+				return BadRequest{"Archive contains a publication with an invalid source"}
+			}
+		case models.PublishSaved:
+		default:
+			return BadRequest{"Archive contains a publication with an invalid source"}
+		}
+	}
+
+	hooks := map[string]bool{}
+	for _, hook := range a.Webhooks {
+		if !users[hook.UserUUID] {
+			return BadRequest{"Archive contains a webhook without a user"}
+		}
+		if hook.UUID == "" || hooks[hook.UUID] {
+			return BadRequest{"Archive contains duplicate webhooks"}
+		}
+		hooks[hook.UUID] = true
+
+		if (hook.FeedID != "" && feeds[hook.FeedID] != hook.UserUUID) ||
+			(hook.CategoryID != "" && categories[hook.CategoryID] != hook.UserUUID) ||
+			(hook.TagID != "" && tags[hook.TagID] != hook.UserUUID) {
+			return BadRequest{"Archive contains a webhook with an invalid filter"}
+		}
+	}
+
+	return nil
+}
+
+// Backup writes a compressed archive of every object in store to w
+func Backup(store Store, w io.Writer) (Archive, error) {
+	archive, err := store.Export()
+	if err != nil {
+		return archive, err
+	}
+
+	archive.Version = ArchiveVersion
+	archive.CreatedAt = time.Now().UTC()
+
+	zw := gzip.NewWriter(w)
+	if err = json.NewEncoder(zw).Encode(archive); err != nil {
+		return archive, err
+	}
+
+	return archive, zw.Close()
+}
+
+// Restore reads an archive written by Backup from r, verifies it and
+// imports its objects into store. Nothing is imported if the archive
+// is invalid or conflicts with objects that already exist in store.
+func Restore(store Store, r io.Reader, progress Progress) (Archive, error) {
+	archive := Archive{}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return archive, BadRequest{"Archive is corrupted"}
+	}
+
+	if err = json.NewDecoder(zr).Decode(&archive); err != nil {
+		return archive, BadRequest{"Archive is corrupted"}
+	}
+
+	// Read up to the end of the stream so the gzip checksum is verified
+	if _, err = io.Copy(ioutil.Discard, zr); err != nil {
+		return archive, BadRequest{"Archive is corrupted"}
+	}
+
+	if err = archive.Verify(); err != nil {
+		return archive, err
+	}
+
+	if progress == nil {
+		progress = func(done, total int) {}
+	}
+
+	return archive, store.Import(archive, progress)
+}
+
+func archivedUser(user *models.User, recoveryCodes []string) ArchivedUser {
+	return ArchivedUser{
+		UUID:                      user.UUID,
+		CreatedAt:                 user.CreatedAt,
+		Username:                  user.Username,
+		Email:                     user.Email,
+		Role:                      user.Role,
+		Timezone:                  user.Timezone,
+		Preferences:               user.Preferences,
+		PasswordHash:              user.PasswordHash,
+		PasswordSalt:              user.PasswordSalt,
+		PasswordParams:            user.PasswordParams,
+		TOTPSecret:                user.TOTPSecret,
+		TOTPEnabled:               user.TOTPEnabled,
+		RecoveryCodes:             recoveryCodes,
+		FeverKey:                  user.FeverKey,
+		UncategorizedCategoryUUID: user.UncategorizedCategoryUUID,
+		SavedCategoryUUID:         user.SavedCategoryUUID,
+	}
+}
+
+func (a ArchivedUser) user() models.User {
+	role := a.Role
+	if role == "" {
+		role = models.RoleUser
+	}
+
+	return models.User{
+		UUID:                      a.UUID,
+		CreatedAt:                 a.CreatedAt,
+		Username:                  a.Username,
+		Email:                     a.Email,
+		Role:                      role,
+		Timezone:                  a.Timezone,
+		Preferences:               a.Preferences,
+		PasswordHash:              a.PasswordHash,
+		PasswordSalt:              a.PasswordSalt,
+		PasswordParams:            a.PasswordParams,
+		TOTPSecret:                a.TOTPSecret,
+		TOTPEnabled:               a.TOTPEnabled,
+		FeverKey:                  a.FeverKey,
+		UncategorizedCategoryUUID: a.UncategorizedCategoryUUID,
+		SavedCategoryUUID:         a.SavedCategoryUUID,
+	}
+}
+
+func archivedCategory(ctg *models.Category, userUUID string) ArchivedCategory {
+	return ArchivedCategory{
+		UUID:      ctg.UUID,
+		UserUUID:  userUUID,
+		CreatedAt: ctg.CreatedAt,
+		DeletedAt: ctg.DeletedAt,
+		Name:      ctg.Name,
+	}
+}
+
+func (a ArchivedCategory) category(userID uint) models.Category {
+	return models.Category{
+		UUID:      a.UUID,
+		UserID:    userID,
+		CreatedAt: a.CreatedAt,
+		DeletedAt: a.DeletedAt,
+		Name:      a.Name,
+	}
+}
+
+func archivedFeed(feed *models.Feed, userUUID, ctgUUID string) ArchivedFeed {
+	return ArchivedFeed{
+		UUID:         feed.UUID,
+		UserUUID:     userUUID,
+		CategoryUUID: ctgUUID,
+		CreatedAt:    feed.CreatedAt,
+		DeletedAt:    feed.DeletedAt,
+		Title:        feed.Title,
+		Description:  feed.Description,
+		Subscription: feed.Subscription,
+		Source:       feed.Source,
+		TTL:          feed.TTL,
+		Etag:         feed.Etag,
+		LastUpdated:  feed.LastUpdated,
+		Status:       feed.Status,
+	}
+}
+
+func (a ArchivedFeed) feed(userID, ctgID uint) models.Feed {
+	return models.Feed{
+		UUID:         a.UUID,
+		UserID:       userID,
+		CategoryID:   ctgID,
+		CreatedAt:    a.CreatedAt,
+		DeletedAt:    a.DeletedAt,
+		Title:        a.Title,
+		Description:  a.Description,
+		Subscription: a.Subscription,
+		Source:       a.Source,
+		TTL:          a.TTL,
+		Etag:         a.Etag,
+		LastUpdated:  a.LastUpdated,
+		Status:       a.Status,
+	}
+}
+
+func archivedTag(tag *models.Tag, userUUID string) ArchivedTag {
+	return ArchivedTag{
+		UUID:      tag.UUID,
+		UserUUID:  userUUID,
+		CreatedAt: tag.CreatedAt,
+		Name:      tag.Name,
+	}
+}
+
+func (a ArchivedTag) tag(userID uint) models.Tag {
+	return models.Tag{
+		UUID:      a.UUID,
+		UserID:    userID,
+		CreatedAt: a.CreatedAt,
+		Name:      a.Name,
+	}
+}
+
+func archivedEntry(entry *models.Entry, userUUID, feedUUID string, tagUUIDs []string) ArchivedEntry {
+	return ArchivedEntry{
+		UUID:        entry.UUID,
+		UserUUID:    userUUID,
+		FeedUUID:    feedUUID,
+		TagUUIDs:    tagUUIDs,
+		CreatedAt:   entry.CreatedAt,
+		DeletedAt:   entry.DeletedAt,
+		GUID:        entry.GUID,
+		Title:       entry.Title,
+		Link:        entry.Link,
+		Description: entry.Description,
+		Author:      entry.Author,
+		Published:   entry.Published,
+		Saved:       entry.Saved,
+		Mark:        entry.Mark,
+	}
+}
+
+func (a ArchivedEntry) entry(userID, feedID uint) models.Entry {
+	return models.Entry{
+		UUID:        a.UUID,
+		UserID:      userID,
+		FeedID:      feedID,
+		CreatedAt:   a.CreatedAt,
+		DeletedAt:   a.DeletedAt,
+		GUID:        a.GUID,
+		Title:       a.Title,
+		Link:        a.Link,
+		Description: a.Description,
+		Author:      a.Author,
+		Published:   a.Published,
+		Saved:       a.Saved,
+		Mark:        a.Mark,
+	}
+}
+
+func archivedPublication(pub *models.Publication, userUUID string) ArchivedPublication {
+	return ArchivedPublication{
+		UUID:      pub.UUID,
+		UserUUID:  userUUID,
+		CreatedAt: pub.CreatedAt,
+		Token:     pub.Token,
+		Title:     pub.Title,
+		Source:    pub.Source,
+		SourceID:  pub.SourceID,
+	}
+}
+
+func (a ArchivedPublication) publication(userID uint) (models.Publication, error) {
+	pub := models.Publication{
+		UUID:      a.UUID,
+		UserID:    userID,
+		CreatedAt: a.CreatedAt,
+		Token:     a.Token,
+		Title:     a.Title,
+		Source:    a.Source,
+		SourceID:  a.SourceID,
+	}
+
+	// Exports of a single user leave tokens out, so new ones are made
+	if pub.Token == "" {
+		token, err := newPublicationToken()
+		if err != nil {
+			return pub, err
+		}
+		pub.Token = token
+	}
+	return pub, nil
+}
+
+func archivedWebhook(hook *models.Webhook, userUUID string) ArchivedWebhook {
+	return ArchivedWebhook{
+		UUID:       hook.UUID,
+		UserUUID:   userUUID,
+		CreatedAt:  hook.CreatedAt,
+		URL:        hook.URL,
+		Secret:     hook.Secret,
+		FeedID:     hook.FeedID,
+		CategoryID: hook.CategoryID,
+		TagID:      hook.TagID,
+		Keyword:    hook.Keyword,
+	}
+}
+
+func (a ArchivedWebhook) webhook(userID uint) (models.Webhook, error) {
+	hook := models.Webhook{
+		UUID:       a.UUID,
+		UserID:     userID,
+		CreatedAt:  a.CreatedAt,
+		URL:        a.URL,
+		Secret:     a.Secret,
+		FeedID:     a.FeedID,
+		CategoryID: a.CategoryID,
+		TagID:      a.TagID,
+		Keyword:    a.Keyword,
+	}
+
+	// Exports of a single user leave secrets out, so new ones are made
+	if hook.Secret == "" {
+		id := hook.UUID
+		if err := initWebhook(&hook); err != nil {
+			return hook, err
+		}
+		hook.UUID = id
+	}
+	return hook, nil
+}
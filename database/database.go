@@ -20,8 +20,6 @@
 package database
 
 import (
-	"crypto/rand"
-	"io"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -31,8 +29,8 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	uuid "github.com/satori/go.uuid"
-	"golang.org/x/crypto/scrypt"
 
+	"github.com/chavamee/syndication/events"
 	"github.com/chavamee/syndication/models"
 )
 
@@ -42,23 +40,64 @@ const (
 	PWHashBytes = 64
 )
 
+// DefaultTrashRetention is how long deleted feeds and categories
+// are kept in the trash before being purged
+const DefaultTrashRetention = time.Hour * 24 * 30
+
+// DefaultAPIKeyExpiration is how long an APIKey is valid for.
+// Clients use a RefreshToken to obtain a new one.
+const DefaultAPIKeyExpiration = time.Minute * 15
+
+// apiKeyUseResolution is how often an APIKey's last use is recorded
+const apiKeyUseResolution = time.Minute
+
 // DB represents a connectin to a SQL database
 type DB struct {
-	db         *gorm.DB
-	Connection string
-	Type       string
+	db                     *gorm.DB
+	Connection             string
+	Type                   string
+	TrashRetention         time.Duration
+	APIKeyExpiration       time.Duration
+	RefreshTokenExpiration time.Duration
+	LockoutPolicy          LockoutPolicy
+	PasswordPolicy         PasswordPolicy
+	PasswordHashing        HashParams
+	AllowPrivateWebhooks   bool
+
+	events *events.Bus
 }
 
-// NewDB creates a new DB instance
+// NewDB creates a new DB instance using DefaultOptions
 func NewDB(dbType, conn string) (db *DB, err error) {
-	gormDB, err := gorm.Open(dbType, conn)
+	return NewDBWithOptions(dbType, conn, DefaultOptions)
+}
+
+// NewDBWithOptions creates a new DB instance with connections configured by opts
+func NewDBWithOptions(dbType, conn string, opts Options) (db *DB, err error) {
+	dsn := conn
+	if dbType == "sqlite3" {
+		dsn = sqliteConnection(conn, opts)
+	}
+
+	gormDB, err := openWithRetry(dbType, dsn, opts)
 	if err != nil {
 		return
 	}
 
+	gormDB.DB().SetMaxOpenConns(opts.MaxOpenConns)
+	gormDB.DB().SetMaxIdleConns(opts.MaxIdleConns)
+	gormDB.DB().SetConnMaxLifetime(opts.ConnMaxLifetime)
+
 	db = &DB{
-		Connection: conn,
-		Type:       dbType,
+		Connection:             conn,
+		Type:                   dbType,
+		TrashRetention:         DefaultTrashRetention,
+		APIKeyExpiration:       DefaultAPIKeyExpiration,
+		RefreshTokenExpiration: DefaultRefreshTokenExpiration,
+		LockoutPolicy:          DefaultLockoutPolicy,
+		PasswordPolicy:         DefaultPasswordPolicy,
+		PasswordHashing:        DefaultPasswordHashing,
+		events:                 events.NewBus(),
 	}
 
 	gormDB.AutoMigrate(&models.Feed{})
@@ -67,41 +106,141 @@ func NewDB(dbType, conn string) (db *DB, err error) {
 	gormDB.AutoMigrate(&models.Entry{})
 	gormDB.AutoMigrate(&models.Tag{})
 	gormDB.AutoMigrate(&models.APIKey{})
+	gormDB.AutoMigrate(&models.RefreshToken{})
+	gormDB.AutoMigrate(&models.SharedFeed{})
+	gormDB.AutoMigrate(&models.Item{})
+	gormDB.AutoMigrate(&models.Lockout{})
+	gormDB.AutoMigrate(&models.Invite{})
+	gormDB.AutoMigrate(&models.RecoveryCode{})
+	gormDB.AutoMigrate(&models.LoginChallenge{})
+	gormDB.AutoMigrate(&models.Publication{})
+	gormDB.AutoMigrate(&models.Webhook{})
+	gormDB.AutoMigrate(&models.WebhookDelivery{})
 
 	db.db = gormDB
 
+	if err = db.migrateSharedFeeds(); err != nil {
+		return
+	}
+
+	if err = db.migrateAPIKeyExpiry(); err != nil {
+		return
+	}
+
+	if err = db.migrateAPIKeyHashes(); err != nil {
+		return
+	}
+
+	err = db.addIndexes()
 	return
 }
 
-// Close ends connections with the database
-func (db *DB) Close() error {
-	return db.db.Close()
+// addIndexes creates the composite indexes used to ingest and list entries
+func (db *DB) addIndexes() error {
+	entries := db.db.Model(&models.Entry{})
+	if err := entries.AddUniqueIndex("idx_entries_user_feed_item", "user_id", "feed_id", "item_id").Error; err != nil {
+		return err
+	}
+	if err := entries.AddIndex("idx_entries_user_mark_created", "user_id", "mark", "created_at").Error; err != nil {
+		return err
+	}
+
+	items := db.db.Model(&models.Item{})
+	if err := items.AddIndex("idx_items_feed_guid", "shared_feed_id", "guid").Error; err != nil {
+		return err
+	}
+	return items.AddIndex("idx_items_feed_published", "shared_feed_id", "published").Error
+}
+
+// legacyAPIKeyExpiration is how long the keys handed out before their
+// expiry was stored are valid for, as enforced by their exp claim
+const legacyAPIKeyExpiration = time.Hour * 72
+
+// migrateAPIKeyExpiry stores the expiry of keys created by older versions,
+// which would otherwise never be valid nor deleted once expired
+func (db *DB) migrateAPIKeyExpiry() error {
+	var keys []models.APIKey
+	if err := db.db.Select("id, created_at").Where("expires_at IS NULL").Find(&keys).Error; err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := db.db.Model(&models.APIKey{}).Where("id = ?", key.ID).
+			UpdateColumn("expires_at", key.CreatedAt.Add(legacyAPIKeyExpiration)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func createPasswordHashAndSalt(password string) (hash []byte, salt []byte, err error) {
-	salt = make([]byte, PWSaltBytes)
-	_, err = io.ReadFull(rand.Reader, salt)
+// migrateAPIKeyHashes replaces the keys older versions stored in
+// plain text with their hash
+func (db *DB) migrateAPIKeyHashes() error {
+	table := db.db.NewScope(&models.APIKey{}).TableName()
+
+	// The dialects' HasColumn mistakes PRIMARY KEY for a key column
+	rows, err := db.db.Table(table).Limit(1).Rows()
 	if err != nil {
-		return
+		return err
 	}
 
-	hash, err = scrypt.Key([]byte(password), salt, 1<<14, 8, 1, PWHashBytes)
+	columns, err := rows.Columns()
+	rows.Close()
 	if err != nil {
-		return
+		return err
 	}
 
-	return
+	legacy := false
+	for _, column := range columns {
+		legacy = legacy || column == "key"
+	}
+
+	if !legacy {
+		return nil
+	}
+
+	var keys []struct {
+		ID  uint
+		Key string
+	}
+	err = db.db.Table(table).Select("id, key").Where("key IS NOT NULL AND key <> ''").Scan(&keys).Error
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = db.db.Table(table).Where("id = ?", key.ID).UpdateColumns(map[string]interface{}{
+			"hash": hashRefreshToken(key.Key),
+			"key":  "",
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close ends connections with the database
+func (db *DB) Close() error {
+	return db.db.Close()
 }
 
-// NewUser creates a new User object
+// NewUser creates a new User object.
+// The password must follow PasswordPolicy.
 func (db *DB) NewUser(username, password string) error {
+	if err := db.PasswordPolicy.checkCredentials(username, password); err != nil {
+		return err
+	}
+
 	user := &models.User{}
 	if !db.db.Where("username = ?", username).First(user).RecordNotFound() {
 		return Conflict{"User already exists"}
 	}
 
-	hash, salt, err := createPasswordHashAndSalt(password)
-	if err != nil {
+	if err := setPassword(user, password, db.PasswordHashing); err != nil {
 		return err
 	}
 
@@ -121,55 +260,146 @@ func (db *DB) NewUser(username, password string) error {
 	user.SavedCategoryUUID = savedUUID
 
 	user.UUID = uuid.NewV4().String()
-	user.PasswordHash = hash
-	user.PasswordSalt = salt
 	user.Username = username
+	user.Role = models.RoleUser
 
 	db.db.Create(&user).Related(&user.Categories)
 	return nil
 }
 
-// DeleteUser deletes a User object
+// DeleteUser permanently deletes a User object along with
+// all of its Categories, Feeds, Entries, Tags and APIKeys
 func (db *DB) DeleteUser(userID string) error {
 	user := &models.User{}
 	if db.db.Where("uuid = ?", userID).First(user).RecordNotFound() {
 		return BadRequest{"User does not exists"}
 	}
 
-	db.db.Delete(user)
-	return nil
+	tx := db.db.Begin()
+	tx.Exec("DELETE FROM entry_tags WHERE entry_id IN (SELECT id FROM entries WHERE user_id = ?)", user.ID)
+	tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Entry{})
+	tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Feed{})
+	tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Category{})
+	tx.Where("user_id = ?", user.ID).Delete(&models.Tag{})
+	tx.Where("user_id = ?", user.ID).Delete(&models.APIKey{})
+	tx.Where("user_id = ?", user.ID).Delete(&models.RefreshToken{})
+	tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{})
+	tx.Where("user_id = ?", user.ID).Delete(&models.LoginChallenge{})
+	tx.Where("user_id = ?", user.ID).Delete(&models.Publication{})
+	tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id = ?)", user.ID)
+	tx.Where("user_id = ?", user.ID).Delete(&models.Webhook{})
+	tx.Unscoped().Delete(user)
+	pruneShared(tx)
+	return tx.Commit().Error
 }
 
 // ChangeUserName for user with userID
 func (db *DB) ChangeUserName(userID, newName string) error {
+	if err := checkUsername(newName); err != nil {
+		return err
+	}
+
 	user := &models.User{}
 	if db.db.Where("uuid = ?", userID).First(user).RecordNotFound() {
 		return BadRequest{"User does not exists"}
 	}
 
-	db.db.Model(user).Update("username", newName)
-	return nil
+	// The Fever key hashes the username, so it must be set again
+	return db.db.Model(user).Updates(map[string]interface{}{
+		"username":  newName,
+		"fever_key": "",
+	}).Error
+}
+
+// EditUser applies changes to the profile of the User with userID
+// and returns the edited User
+func (db *DB) EditUser(userID string, changes ProfileChanges) (models.User, error) {
+	if err := changes.check(); err != nil {
+		return models.User{}, err
+	}
+
+	user := models.User{}
+	if db.db.Where("uuid = ?", userID).First(&user).RecordNotFound() {
+		return models.User{}, NotFound{"User does not exist"}
+	}
+
+	if changes.Username != nil && *changes.Username != user.Username &&
+		!db.db.Where("username = ?", *changes.Username).First(&models.User{}).RecordNotFound() {
+		return models.User{}, Conflict{"Username already exists"}
+	}
+
+	columns := map[string]interface{}{}
+	if changes.Username != nil && *changes.Username != user.Username {
+		// The Fever key hashes the username, so it must be set again
+		columns["username"] = *changes.Username
+		columns["fever_key"] = ""
+	}
+	if changes.Email != nil {
+		columns["email"] = *changes.Email
+	}
+	if changes.Timezone != nil {
+		columns["timezone"] = *changes.Timezone
+	}
+	if changes.Preferences != nil {
+		columns["preferences"] = *changes.Preferences
+	}
+
+	if err := db.db.Model(&user).Updates(columns).Error; err != nil {
+		return models.User{}, err
+	}
+
+	return db.UserWithUUID(userID)
 }
 
-// ChangeUserPassword for user with userID
+// ChangeUserPassword for user with userID.
+// The new password must follow PasswordPolicy.
 func (db *DB) ChangeUserPassword(userID, newPassword string) error {
+	if err := db.PasswordPolicy.check(newPassword); err != nil {
+		return err
+	}
+
 	user := &models.User{}
 	if db.db.Where("uuid = ?", userID).First(user).RecordNotFound() {
 		return BadRequest{"User does not exists"}
 	}
 
-	hash, salt, err := createPasswordHashAndSalt(newPassword)
-	if err != nil {
+	if err := setPassword(user, newPassword, db.PasswordHashing); err != nil {
 		return err
 	}
 
-	db.db.Model(user).Update(models.User{
-		PasswordHash: hash,
-		PasswordSalt: salt,
+	db.db.Model(user).Updates(map[string]interface{}{
+		"password_hash":   user.PasswordHash,
+		"password_salt":   user.PasswordSalt,
+		"password_params": user.PasswordParams,
 	})
 	return nil
 }
 
+// SetUserRole gives the user with userID role
+func (db *DB) SetUserRole(userID, role string) error {
+	if role != models.RoleUser && role != models.RoleAdmin {
+		return BadRequest{"Unknown role " + role}
+	}
+
+	user := &models.User{}
+	if db.db.Where("uuid = ?", userID).First(user).RecordNotFound() {
+		return NotFound{"User does not exist"}
+	}
+
+	db.db.Model(user).Update("role", role)
+	return nil
+}
+
+// InstanceStats counts the Users, Feeds and Entries of every user
+func (db *DB) InstanceStats() (stats models.InstanceStats) {
+	db.db.Model(&models.User{}).Count(&stats.Users)
+	db.db.Model(&models.Feed{}).Count(&stats.Feeds)
+	db.db.Model(&models.SharedFeed{}).Count(&stats.Sources)
+	db.db.Model(&models.Entry{}).Count(&stats.Entries)
+	db.db.Model(&models.APIKey{}).Where("expires_at > ?", time.Now()).Count(&stats.APIKeys)
+	return
+}
+
 // Users returns a list of all User entries.
 // The parameter fields provides a way to select
 // which fields are populated in the returned models.
@@ -209,62 +439,170 @@ func (db *DB) UserWithUUID(uuid string) (user models.User, err error) {
 	return
 }
 
-// Authenticate a user and return its respective User model if successful
+// Authenticate a user and return its respective User model if successful.
+// Passwords hashed with weaker parameters than PasswordHashing are rehashed.
 func (db *DB) Authenticate(username, password string) (user models.User, err error) {
 	user, err = db.UserWithName(username)
 	if err != nil {
-		return
+		return models.User{}, rejectUnknownUser(db.PasswordHashing, password)
 	}
 
-	hash, err := scrypt.Key([]byte(password), user.PasswordSalt, 1<<14, 8, 1, PWHashBytes)
-	if err != nil {
+	if err = checkPassword(&user, password); err != nil {
 		return
 	}
 
-	for i, hashByte := range hash {
-		if hashByte != user.PasswordHash[i] {
-			err = Unauthorized{"Invalid credentials"}
-		}
+	if needsRehash(&user, db.PasswordHashing) {
+		db.rehashPassword(&user, password)
 	}
-
 	return
 }
 
-// NewAPIKey creates a new APIKey object owned by user
-func (db *DB) NewAPIKey(secret string, user *models.User) (models.APIKey, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
+// rehashPassword stores password hashed with PasswordHashing for user.
+// Failing to do so is not an error, it is tried again on the next login.
+func (db *DB) rehashPassword(user *models.User, password string) {
+	rehashed := *user
+	if err := setPassword(&rehashed, password, db.PasswordHashing); err != nil {
+		return
+	}
 
-	claims := token.Claims.(jwt.MapClaims)
-	claims["id"] = user.UUID
-	claims["admin"] = false
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	err := db.db.Model(user).Updates(map[string]interface{}{
+		"password_hash":   rehashed.PasswordHash,
+		"password_salt":   rehashed.PasswordSalt,
+		"password_params": rehashed.PasswordParams,
+	}).Error
+	if err == nil {
+		*user = rehashed
+	}
+}
 
-	t, err := token.SignedString([]byte(secret))
-	if err != nil {
-		return models.APIKey{}, err
+// NewAPIKey creates a new APIKey object owned by user.
+// The key expires after APIKeyExpiration.
+func (db *DB) NewAPIKey(secret string, key *models.APIKey, user *models.User) error {
+	if key.Family == "" {
+		key.Family = newFamily()
 	}
 
-	key := &models.APIKey{
-		Key:    t,
-		User:   *user,
-		UserID: user.ID,
+	return db.newAPIKey(secret, key, time.Now().Add(db.APIKeyExpiration), user)
+}
+
+func (db *DB) newAPIKey(secret string, key *models.APIKey, expiresAt time.Time, user *models.User) error {
+	key.UUID = uuid.NewV4().String()
+	key.ExpiresAt = expiresAt
+
+	t, err := newAPIToken(secret, key, user)
+	if err != nil {
+		return err
 	}
 
+	key.Key = t
+	key.Hash = hashRefreshToken(t)
+	key.User = *user
+	key.UserID = user.ID
+
 	db.db.Model(user).Association("APIKeys").Append(key)
 
-	return *key, nil
+	return nil
+}
+
+func newAPIToken(secret string, key *models.APIKey, user *models.User) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+
+	claims := token.Claims.(jwt.MapClaims)
+	claims["jti"] = key.UUID
+	claims["id"] = user.UUID
+	claims["admin"] = user.Role == models.RoleAdmin
+	claims["exp"] = key.ExpiresAt.Unix()
+
+	if key.Personal {
+		claims["scope"] = key.Scope
+	}
+
+	return token.SignedString([]byte(secret))
 }
 
-// KeyBelongsToUser returns true if the given APIKey is owned by user
+// KeyBelongsToUser returns true if the given APIKey is owned by user and has not expired
 func (db *DB) KeyBelongsToUser(key *models.APIKey, user *models.User) (bool, error) {
 	if key.Key == "" {
 		return false, BadRequest{"No key provided"}
 	}
 
-	found := !db.db.Model(user).Where("key = ?", key.Key).Related(&models.APIKey{}).RecordNotFound()
+	found := !db.db.Model(user).Where("hash = ? AND expires_at > ?", hashRefreshToken(key.Key), time.Now()).Related(&models.APIKey{}).RecordNotFound()
 	return found, nil
 }
 
+// APIKeys returns all APIKeys owned by user that have not expired
+func (db *DB) APIKeys(user *models.User) (keys []models.APIKey) {
+	db.db.Model(user).Where("expires_at > ?", time.Now()).Order("created_at ASC").Related(&keys)
+	return
+}
+
+// DeleteAPIKey with id and owned by user, along with the RefreshTokens issued with it
+func (db *DB) DeleteAPIKey(id string, user *models.User) error {
+	key := &models.APIKey{}
+	if db.db.Model(user).Where("uuid = ?", id).Related(key).RecordNotFound() {
+		return NotFound{"API key does not exist"}
+	}
+
+	db.db.Delete(key)
+	db.revokeFamily(key.Family)
+	return nil
+}
+
+// RevokeAPIKey deletes the APIKey with token owned by user, along with the RefreshTokens issued with it
+func (db *DB) RevokeAPIKey(token string, user *models.User) error {
+	key := &models.APIKey{}
+	if db.db.Model(user).Where("hash = ?", hashRefreshToken(token)).Related(key).RecordNotFound() {
+		return NotFound{"API key does not exist"}
+	}
+
+	db.db.Delete(key)
+	db.revokeFamily(key.Family)
+	return nil
+}
+
+// RevokeOtherAPIKeys deletes every APIKey obtained by logging in as user, and
+// their RefreshTokens, except the one with token and those refreshed from it.
+// Personal access tokens are kept.
+func (db *DB) RevokeOtherAPIKeys(token string, user *models.User) error {
+	key := &models.APIKey{}
+	if db.db.Model(user).Where("hash = ?", hashRefreshToken(token)).Related(key).RecordNotFound() {
+		return NotFound{"API key does not exist"}
+	}
+
+	keys := db.db.Where("user_id = ? AND id <> ? AND personal = ?", user.ID, key.ID, false)
+	refreshTokens := db.db.Where("user_id = ?", user.ID)
+	if key.Family != "" {
+		keys = keys.Where("family <> ?", key.Family)
+		refreshTokens = refreshTokens.Where("family <> ?", key.Family)
+	}
+
+	if err := keys.Delete(&models.APIKey{}).Error; err != nil {
+		return err
+	}
+	return refreshTokens.Delete(&models.RefreshToken{}).Error
+}
+
+// TouchAPIKey records that the APIKey with token owned by user was just used
+func (db *DB) TouchAPIKey(token string, user *models.User) error {
+	now := time.Now()
+	return db.db.Model(&models.APIKey{}).
+		Where("user_id = ? AND hash = ?", user.ID, hashRefreshToken(token)).
+		Where("last_used_at IS NULL OR last_used_at < ?", now.Add(-apiKeyUseResolution)).
+		UpdateColumn("last_used_at", now).Error
+}
+
+// DeleteExpiredAPIKeys permanently deletes every APIKey, RefreshToken and LoginChallenge that has expired
+func (db *DB) DeleteExpiredAPIKeys() error {
+	now := time.Now()
+	if err := db.db.Where("expires_at <= ?", now).Delete(&models.APIKey{}).Error; err != nil {
+		return err
+	}
+	if err := db.db.Where("expires_at <= ?", now).Delete(&models.RefreshToken{}).Error; err != nil {
+		return err
+	}
+	return db.db.Where("expires_at <= ?", now).Delete(&models.LoginChallenge{}).Error
+}
+
 // NewFeed creates a new Feed object owned by user
 func (db *DB) NewFeed(feed *models.Feed, user *models.User) error {
 	feed.UUID = uuid.NewV4().String()
@@ -284,15 +622,29 @@ func (db *DB) NewFeed(feed *models.Feed, user *models.User) error {
 	feed.CategoryID = ctg.ID
 	feed.Category.UUID = ctg.UUID
 
+	source, created, err := sharedFeed(db.db, feed)
+	if err != nil {
+		return err
+	}
+
+	feed.SharedFeedID = source.ID
+	setFeedSource(feed, &source)
+
 	db.db.Model(user).Association("Feeds").Append(feed)
 	db.db.Model(&ctg).Association("Feeds").Append(feed)
 
+	if !created {
+		db.subscribeToItems(feed, user)
+	}
+
+	db.events.Publish(user.ID, events.FeedAdded, events.Data{Feed: feed.UUID, Title: feed.Title})
 	return nil
 }
 
 // Feeds returns a list of all Feeds owned by a user
 func (db *DB) Feeds(user *models.User) (feeds []models.Feed) {
 	db.db.Model(user).Association("Feeds").Find(&feeds)
+	db.loadFeedSources(feeds)
 	return
 }
 
@@ -304,6 +656,7 @@ func (db *DB) FeedsFromCategory(categoryID string, user *models.User) (feeds []m
 	}
 
 	db.db.Model(ctg).Association("Feeds").Find(&feeds)
+	db.loadFeedSources(feeds)
 	return
 }
 
@@ -315,14 +668,17 @@ func (db *DB) Feed(id string, user *models.User) (feed models.Feed, err error) {
 	}
 
 	db.db.Model(&feed).Related(&feed.Category)
+	db.loadFeedSource(&feed)
 	return
 }
 
-// DeleteFeed with id and owned by user
+// DeleteFeed with id and owned by user.
+// The feed and its entries are moved to the trash.
 func (db *DB) DeleteFeed(id string, user *models.User) error {
 	foundFeed := &models.Feed{}
 	if !db.db.Model(user).Where("uuid = ?", id).Related(foundFeed).RecordNotFound() {
-		db.db.Delete(foundFeed)
+		db.trashFeed(foundFeed, trashTime())
+		db.events.Publish(user.ID, events.FeedDeleted, events.Data{Feed: id})
 		return nil
 	}
 	return NotFound{"Feed does not exist"}
@@ -366,8 +722,10 @@ func (db *DB) EditCategory(ctg *models.Category, user *models.User) error {
 	return NotFound{"Category does not exist"}
 }
 
-// DeleteCategory with id and owned by user
-func (db *DB) DeleteCategory(id string, user *models.User) error {
+// DeleteCategory with id and owned by user. The category's feeds are
+// moved to the user's uncategorized category unless deleteFeeds is set,
+// in which case they are deleted along with it.
+func (db *DB) DeleteCategory(id string, deleteFeeds bool, user *models.User) error {
 	if id == user.UncategorizedCategoryUUID || id == user.SavedCategoryUUID {
 		return BadRequest{"Cannot delete system categories"}
 	}
@@ -377,10 +735,108 @@ func (db *DB) DeleteCategory(id string, user *models.User) error {
 		return NotFound{"Category does not exist"}
 	}
 
-	db.db.Delete(ctg)
+	deletedAt := trashTime()
+
+	if deleteFeeds {
+		var feeds []models.Feed
+		db.db.Model(ctg).Related(&feeds)
+		for _, feed := range feeds {
+			db.trashFeed(&feed, deletedAt)
+		}
+	} else {
+		unctg := &models.Category{}
+		db.db.Model(user).Where("uuid = ?", user.UncategorizedCategoryUUID).Related(unctg)
+		db.db.Model(&models.Feed{}).Where("category_id = ?", ctg.ID).UpdateColumn("category_id", unctg.ID)
+	}
+
+	db.db.Model(ctg).UpdateColumn("deleted_at", deletedAt)
+	return nil
+}
+
+// trashTime returns the deletion time shared by every object trashed
+// together. It is truncated so it compares equal across SQL dialects.
+func trashTime() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// trashFeed soft deletes feed along with its entries.
+// Saved entries outlive the feed they came from.
+func (db *DB) trashFeed(feed *models.Feed, deletedAt time.Time) {
+	db.db.Model(&models.Entry{}).
+		Where("feed_id = ? AND saved = ?", feed.ID, false).
+		UpdateColumn("deleted_at", deletedAt)
+	db.db.Model(feed).UpdateColumn("deleted_at", deletedAt)
+}
+
+// Trash returns all Feeds and Categories owned by user that were deleted
+// and have not been purged yet.
+func (db *DB) Trash(user *models.User) (trash models.Trash) {
+	db.db.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", user.ID).Find(&trash.Feeds)
+	db.loadFeedSources(trash.Feeds)
+	db.db.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", user.ID).Find(&trash.Categories)
+	return
+}
+
+// RestoreFromTrash restores a deleted Feed or Category with id and owned by user.
+// Restoring a category also restores the feeds that were deleted with it.
+func (db *DB) RestoreFromTrash(id string, user *models.User) error {
+	feed := &models.Feed{}
+	if !db.db.Unscoped().Where("user_id = ? AND uuid = ? AND deleted_at IS NOT NULL", user.ID, id).First(feed).RecordNotFound() {
+		db.restoreFeed(feed, user)
+		return nil
+	}
+
+	ctg := &models.Category{}
+	if db.db.Unscoped().Where("user_id = ? AND uuid = ? AND deleted_at IS NOT NULL", user.ID, id).First(ctg).RecordNotFound() {
+		return NotFound{"Item is not in the trash"}
+	}
+
+	if !db.db.Model(user).Where("name = ?", ctg.Name).Related(&models.Category{}).RecordNotFound() {
+		return Conflict{"Category already exists"}
+	}
+
+	var feeds []models.Feed
+	db.db.Unscoped().Where("category_id = ? AND deleted_at = ?", ctg.ID, ctg.DeletedAt).Find(&feeds)
+
+	db.db.Unscoped().Model(ctg).UpdateColumn("deleted_at", gorm.Expr("NULL"))
+
+	for _, feed := range feeds {
+		db.restoreFeed(&feed, user)
+	}
+
 	return nil
 }
 
+func (db *DB) restoreFeed(feed *models.Feed, user *models.User) {
+	// A feed restored on its own whose category is still deleted
+	// falls back to the user's uncategorized category.
+	if db.db.First(&models.Category{}, feed.CategoryID).RecordNotFound() {
+		ctg := models.Category{}
+		db.db.Model(user).Where("uuid = ?", user.UncategorizedCategoryUUID).Related(&ctg)
+		db.db.Unscoped().Model(feed).UpdateColumn("category_id", ctg.ID)
+	}
+
+	db.db.Unscoped().Model(&models.Entry{}).
+		Where("feed_id = ? AND deleted_at = ?", feed.ID, feed.DeletedAt).
+		UpdateColumn("deleted_at", gorm.Expr("NULL"))
+	db.db.Unscoped().Model(feed).UpdateColumn("deleted_at", gorm.Expr("NULL"))
+	db.backfillItems(feed)
+}
+
+// PurgeTrash permanently deletes all Feeds, Categories and Entries
+// that have been in the trash for longer than TrashRetention
+func (db *DB) PurgeTrash() error {
+	cutoff := time.Now().UTC().Add(-db.TrashRetention)
+
+	tx := db.db.Begin()
+	tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(&models.Entry{})
+	tx.Exec("DELETE FROM entry_tags WHERE entry_id NOT IN (SELECT id FROM entries)")
+	tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(&models.Feed{})
+	tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(&models.Category{})
+	pruneShared(tx)
+	return tx.Commit().Error
+}
+
 // Category returns a Category with id and owned by user
 func (db *DB) Category(id string, user *models.User) (ctg models.Category, err error) {
 	if db.db.Model(user).Where("uuid = ?", id).Related(&ctg).RecordNotFound() {
@@ -431,41 +887,49 @@ func (db *DB) NewEntry(entry *models.Entry, user *models.User) error {
 		return NotFound{"Feed does not exist"}
 	}
 
-	entry.UUID = uuid.NewV4().String()
-	entry.Feed = feed
-	entry.FeedID = feed.ID
-
-	db.db.Model(user).Association("Entries").Append(entry)
-	db.db.Model(&feed).Association("Entries").Append(entry)
-
-	return nil
+	db.loadFeedSource(&feed)
+	return db.newEntry(entry, &feed, user)
 }
 
 // NewEntries creates multiple new Entry objects which
-// are all owned by feed with feedUUID and user
-func (db *DB) NewEntries(entries []models.Entry, feed models.Feed, user *models.User) error {
+// are all owned by feed with feedUUID and user. It returns the Feeds of
+// other users subscribed to the same source that received entries too,
+// each with its User and the Entries it received.
+func (db *DB) NewEntries(entries []models.Entry, feed models.Feed, user *models.User) ([]models.Feed, error) {
 	if feed.UUID == "" {
-		return BadRequest{"Entry should have a feed"}
+		return nil, BadRequest{"Entry should have a feed"}
 	}
 
 	if len(entries) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	if db.db.Model(user).Where("uuid = ?", feed.UUID).Related(&feed).RecordNotFound() {
-		return NotFound{"Feed does not exist"}
+		return nil, NotFound{"Feed does not exist"}
 	}
 
-	for _, entry := range entries {
-		entry.UUID = uuid.NewV4().String()
-		entry.Feed = feed
-		entry.FeedID = feed.ID
+	tx := db.db.Begin()
+	added, subscriptions, err := insertEntries(tx, entries, &feed, user)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
-		db.db.Model(user).Association("Entries").Append(&entry)
-		db.db.Model(&feed).Association("Entries").Append(&entry)
+	if err = tx.Commit().Error; err != nil {
+		return nil, err
 	}
 
-	return nil
+	if added > 0 {
+		db.events.Publish(user.ID, events.EntriesNew, events.Data{Feed: feed.UUID, NewEntries: added})
+	}
+
+	for _, subscription := range subscriptions {
+		db.events.Publish(subscription.UserID, events.EntriesNew, events.Data{
+			Feed:       subscription.UUID,
+			NewEntries: len(subscription.Entries),
+		})
+	}
+	return subscriptions, nil
 }
 
 // Entry returns an Entry with id and owned by user
@@ -476,12 +940,69 @@ func (db *DB) Entry(id string, user *models.User) (entry models.Entry, err error
 	}
 
 	db.db.Model(&entry).Related(&entry.Feed)
+	db.loadEntryItem(&entry)
+	db.loadFeedSource(&entry.Feed)
 	return
 }
 
 // EntryWithGUIDExists returns true if an Entry exists with the given guid and is owned by user
 func (db *DB) EntryWithGUIDExists(guid string, user *models.User) bool {
-	return !db.db.Model(user).Where("guid = ?", guid).Related(&models.Entry{}).RecordNotFound()
+	return !db.db.Joins("JOIN items ON items.id = entries.item_id").
+		Where("entries.user_id = ? AND items.guid = ?", user.ID, guid).
+		First(&models.Entry{}).RecordNotFound()
+}
+
+// ExistingEntryGUIDs returns which of guids already have an Entry in a feed with feedID owned by user
+func (db *DB) ExistingEntryGUIDs(feedID string, guids []string, user *models.User) (map[string]bool, error) {
+	feed := &models.Feed{}
+	if db.db.Model(user).Where("uuid = ?", feedID).Related(feed).RecordNotFound() {
+		return nil, NotFound{"Feed does not exist"}
+	}
+
+	existing := make(map[string]bool)
+	for _, chunk := range chunkStrings(guids) {
+		var found []string
+		err := db.db.Table("entries").
+			Joins("JOIN items ON items.id = entries.item_id").
+			Where("entries.feed_id = ? AND items.guid in (?)", feed.ID, chunk).
+			Pluck("items.guid", &found).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, guid := range found {
+			existing[guid] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// EntriesWithGUIDs returns the Entries of a Feed with feedID, owned by user,
+// that were published with one of guids
+func (db *DB) EntriesWithGUIDs(feedID string, guids []string, user *models.User) ([]models.Entry, error) {
+	feed := &models.Feed{}
+	if db.db.Model(user).Where("uuid = ?", feedID).Related(feed).RecordNotFound() {
+		return nil, NotFound{"Feed does not exist"}
+	}
+
+	var entries []models.Entry
+	for _, chunk := range chunkStrings(guids) {
+		var found []models.Entry
+		err := db.db.Table("entries").Select("entries.*").
+			Joins("JOIN items ON items.id = entries.item_id").
+			Where("entries.feed_id = ? AND items.guid in (?)", feed.ID, chunk).
+			Order("entries.id ASC").
+			Find(&found).Error
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, found...)
+	}
+
+	db.loadEntryItems(entries)
+	return entries, nil
 }
 
 // Entries returns a list of all entries owned by user
@@ -497,6 +1018,7 @@ func (db *DB) Entries(orderByDesc bool, marker models.Marker, user *models.User)
 	}
 
 	query.Association("Entries").Find(&entries)
+	db.loadEntryItems(entries)
 	return
 }
 
@@ -519,26 +1041,17 @@ func (db *DB) EntriesFromFeed(feedID string, orderByDesc bool, marker models.Mar
 	}
 
 	query.Association("Entries").Find(&entries)
-
+	db.loadEntryItems(entries)
 	return
 }
 
-// EntriesFromCategory returns all Entries that are related to a Category with categoryID by the entries' owning Feed
-func (db *DB) EntriesFromCategory(categoryID string, orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+// SavedEntries returns all Entries owned by user that are saved
+func (db *DB) SavedEntries(orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
 	if marker == models.None {
 		err = BadRequest{"Request should include a valid marker"}
 		return
 	}
 
-	category := &models.Category{}
-	if db.db.Model(user).Where("uuid = ?", categoryID).Related(category).RecordNotFound() {
-		err = NotFound{"Category not found"}
-		return
-	}
-
-	var feeds []models.Feed
-	db.db.Model(category).Related(&feeds)
-
 	var order *gorm.DB
 	if orderByDesc {
 		order = db.db.Model(user).Order("created_at DESC")
@@ -550,21 +1063,217 @@ func (db *DB) EntriesFromCategory(categoryID string, orderByDesc bool, marker mo
 		order = order.Where("mark = ?", marker)
 	}
 
-	feedIds := make([]uint, len(feeds))
-	for i, feed := range feeds {
-		feedIds[i] = feed.ID
-	}
-
+	order.Where("saved = ?", true).Association("Entries").Find(&entries)
+	db.loadEntryItems(entries)
+	return
+}
+
+// EntriesFromCategory returns all Entries that are related to a Category with categoryID by the entries' owning Feed
+func (db *DB) EntriesFromCategory(categoryID string, orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+	if marker == models.None {
+		err = BadRequest{"Request should include a valid marker"}
+		return
+	}
+
+	category := &models.Category{}
+	if db.db.Model(user).Where("uuid = ?", categoryID).Related(category).RecordNotFound() {
+		err = NotFound{"Category not found"}
+		return
+	}
+
+	if categoryID == user.SavedCategoryUUID {
+		return db.SavedEntries(orderByDesc, marker, user)
+	}
+
+	var feeds []models.Feed
+	db.db.Model(category).Related(&feeds)
+
+	var order *gorm.DB
+	if orderByDesc {
+		order = db.db.Model(user).Order("created_at DESC")
+	} else {
+		order = db.db.Model(user).Order("created_at ASC")
+	}
+
+	if marker != models.Any {
+		order = order.Where("mark = ?", marker)
+	}
+
+	feedIds := make([]uint, len(feeds))
+	for i, feed := range feeds {
+		feedIds[i] = feed.ID
+	}
+
 	order.Where("feed_id in (?)", feedIds).Association("Entries").Find(&entries)
+	db.loadEntryItems(entries)
+	return
+}
+
+// NewTag creates a new Tag object owned by user
+func (db *DB) NewTag(tag *models.Tag, user *models.User) error {
+	if tag.Name == "" {
+		return BadRequest{"Tag name should not be empty"}
+	}
+
+	tmpTag := &models.Tag{}
+	if db.db.Model(user).Where("name = ?", tag.Name).Related(tmpTag).RecordNotFound() {
+		tag.UUID = uuid.NewV4().String()
+		db.db.Model(user).Association("Tags").Append(tag)
+		return nil
+	}
+
+	return Conflict{"Tag already exists"}
+}
+
+// Tags returns a list of all Tags owned by user
+func (db *DB) Tags(user *models.User) (tags []models.Tag) {
+	db.db.Model(user).Association("Tags").Find(&tags)
+	return
+}
+
+// Tag returns a Tag with id and owned by user
+func (db *DB) Tag(id string, user *models.User) (tag models.Tag, err error) {
+	if db.db.Model(user).Where("uuid = ?", id).Related(&tag).RecordNotFound() {
+		err = NotFound{"Tag does not exist"}
+	}
+	return
+}
+
+// EditTag owned by user
+func (db *DB) EditTag(tag *models.Tag, user *models.User) error {
+	if tag.Name == "" {
+		return BadRequest{"Tag name should not be empty"}
+	}
+
+	foundTag := &models.Tag{}
+	if db.db.Model(user).Where("uuid = ?", tag.UUID).Related(foundTag).RecordNotFound() {
+		return NotFound{"Tag does not exist"}
+	}
+
+	if !db.db.Model(user).Where("name = ? AND uuid != ?", tag.Name, tag.UUID).Related(&models.Tag{}).RecordNotFound() {
+		return Conflict{"Tag already exists"}
+	}
+
+	foundTag.Name = tag.Name
+	db.db.Model(tag).Save(foundTag)
+	return nil
+}
+
+// DeleteTag with id and owned by user
+func (db *DB) DeleteTag(id string, user *models.User) error {
+	tag := &models.Tag{}
+	if db.db.Model(user).Where("uuid = ?", id).Related(tag).RecordNotFound() {
+		return NotFound{"Tag does not exist"}
+	}
+
+	db.db.Model(tag).Association("Entries").Clear()
+	db.db.Delete(tag)
+	return nil
+}
+
+// TagEntries adds a Tag with tagID to a list of entries
+func (db *DB) TagEntries(tagID string, entryIDs []string, user *models.User) error {
+	tag, entries, err := db.tagAndEntries(tagID, entryIDs, user)
+	if err != nil {
+		return err
+	}
+
+	db.db.Model(&tag).Association("Entries").Append(entries)
+	return nil
+}
+
+// UntagEntries removes a Tag with tagID from a list of entries
+func (db *DB) UntagEntries(tagID string, entryIDs []string, user *models.User) error {
+	tag, entries, err := db.tagAndEntries(tagID, entryIDs, user)
+	if err != nil {
+		return err
+	}
+
+	db.db.Model(&tag).Association("Entries").Delete(entries)
+	return nil
+}
+
+func (db *DB) tagAndEntries(tagID string, entryIDs []string, user *models.User) (tag models.Tag, entries []models.Entry, err error) {
+	if len(entryIDs) == 0 {
+		err = BadRequest{"Request should include at least one entry"}
+		return
+	}
+
+	tag, err = db.Tag(tagID, user)
+	if err != nil {
+		return
+	}
+
+	entryIDs = uniqueStrings(entryIDs)
+	db.db.Model(user).Where("uuid in (?)", entryIDs).Association("Entries").Find(&entries)
+	if len(entries) != len(entryIDs) {
+		err = NotFound{"Entry does not exist"}
+	}
+
 	return
 }
 
 // EntriesFromTag returns all Entries which are tagged with tagID
-func (db *DB) EntriesFromTag(tagID string, makrer models.Marker, orderByDesc bool, user *models.User) (entries []models.Entry, err error) {
-	// TODO
+func (db *DB) EntriesFromTag(tagID string, orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+	if marker == models.None {
+		err = BadRequest{"Request should include a valid marker"}
+		return
+	}
+
+	tag := &models.Tag{}
+	if db.db.Model(user).Where("uuid = ?", tagID).Related(tag).RecordNotFound() {
+		err = NotFound{"Tag not found"}
+		return
+	}
+
+	var order *gorm.DB
+	if orderByDesc {
+		order = db.db.Model(tag).Order("created_at DESC")
+	} else {
+		order = db.db.Model(tag).Order("created_at ASC")
+	}
+
+	if marker != models.Any {
+		order = order.Where("mark = ?", marker)
+	}
+
+	order.Association("Entries").Find(&entries)
+	db.loadEntryItems(entries)
+	return
+}
+
+// statsColumns aggregates every Stats field in a single pass over entries
+const statsColumns = "COALESCE(SUM(CASE WHEN entries.mark = ? THEN 1 ELSE 0 END), 0), " +
+	"COALESCE(SUM(CASE WHEN entries.mark = ? THEN 1 ELSE 0 END), 0), " +
+	"COALESCE(SUM(CASE WHEN entries.saved = ? THEN 1 ELSE 0 END), 0), " +
+	"COUNT(*)"
+
+func (db *DB) entryStats(query *gorm.DB) (stats models.Stats, err error) {
+	row := query.Select(statsColumns, models.Unread, models.Read, true).Row()
+	err = row.Scan(&stats.Unread, &stats.Read, &stats.Saved, &stats.Total)
 	return
 }
 
+func (db *DB) groupedEntryStats(key string, query *gorm.DB, result map[string]models.Stats) error {
+	rows, err := query.Select(key+", "+statsColumns, models.Unread, models.Read, true).Group(key).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var stats models.Stats
+		err = rows.Scan(&id, &stats.Unread, &stats.Read, &stats.Saved, &stats.Total)
+		if err != nil {
+			return err
+		}
+		result[id] = stats
+	}
+
+	return rows.Err()
+}
+
 // CategoryStats returns all Stats for a Category with the given id and that is owned by user
 func (db *DB) CategoryStats(id string, user *models.User) (stats models.Stats, err error) {
 	ctg := &models.Category{}
@@ -573,21 +1282,14 @@ func (db *DB) CategoryStats(id string, user *models.User) (stats models.Stats, e
 		return
 	}
 
-	var feeds []models.Feed
-	db.db.Model(&ctg).Association("Feeds").Find(&feeds)
-
-	feedIds := make([]uint, len(feeds))
-	for i, feed := range feeds {
-		feedIds[i] = feed.ID
+	query := db.db.Model(&models.Entry{}).Where("entries.user_id = ?", user.ID)
+	if id == user.SavedCategoryUUID {
+		query = query.Where("entries.saved = ?", true)
+	} else {
+		query = query.Joins("JOIN feeds ON feeds.id = entries.feed_id AND feeds.deleted_at IS NULL").Where("feeds.category_id = ?", ctg.ID)
 	}
 
-	query := db.db.Model(user).Where("feed_id in (?)", feedIds)
-
-	stats.Unread = query.Where("mark = ?", models.Unread).Association("Entries").Count()
-	stats.Read = query.Where("mark = ?", models.Read).Association("Entries").Count()
-	stats.Saved = query.Where("saved = ?", true).Association("Entries").Count()
-	stats.Total = query.Association("Entries").Count()
-	return
+	return db.entryStats(query)
 }
 
 // FeedStats returns all Stats for a Feed with the given id and that is owned by user
@@ -598,35 +1300,97 @@ func (db *DB) FeedStats(id string, user *models.User) (stats models.Stats, err e
 		return
 	}
 
-	stats.Unread = db.db.Model(user).Where("feed_id = ? AND mark = ?", feed.ID, models.Unread).Association("Entries").Count()
-	stats.Read = db.db.Model(user).Where("feed_id = ? AND mark = ?", feed.ID, models.Read).Association("Entries").Count()
-	stats.Saved = db.db.Model(user).Where("feed_id = ? AND saved = ?", feed.ID, true).Association("Entries").Count()
-	stats.Total = db.db.Model(user).Where("feed_id = ?", feed.ID).Association("Entries").Count()
-	return
+	return db.entryStats(db.db.Model(&models.Entry{}).Where("entries.user_id = ? AND entries.feed_id = ?", user.ID, feed.ID))
+}
+
+// TagStats returns all Stats for a Tag with the given id and that is owned by user
+func (db *DB) TagStats(id string, user *models.User) (stats models.Stats, err error) {
+	tag := &models.Tag{}
+	if db.db.Model(user).Where("uuid = ?", id).Related(tag).RecordNotFound() {
+		err = NotFound{"Tag not found"}
+		return
+	}
+
+	return db.entryStats(db.db.Model(&models.Entry{}).
+		Joins("JOIN entry_tags ON entry_tags.entry_id = entries.id").
+		Where("entries.user_id = ? AND entry_tags.tag_id = ?", user.ID, tag.ID))
 }
 
 // Stats returns all Stats for the given user
 func (db *DB) Stats(user *models.User) (stats models.Stats) {
-	stats.Unread = db.db.Model(user).Where("mark = ?", models.Unread).Association("Entries").Count()
-	stats.Read = db.db.Model(user).Where("mark = ?", models.Read).Association("Entries").Count()
-	stats.Saved = db.db.Model(user).Where("saved = ?", true).Association("Entries").Count()
-	stats.Total = db.db.Model(user).Association("Entries").Count()
+	stats, _ = db.entryStats(db.db.Model(&models.Entry{}).Where("entries.user_id = ?", user.ID))
 	return
 }
 
-// MarkFeed applies marker to a Feed with id and owned by user
-func (db *DB) MarkFeed(id string, marker models.Marker, user *models.User) error {
+// StatsTree returns Stats for every Feed and Category owned by user
+// along with the user's overall Stats.
+func (db *DB) StatsTree(user *models.User) (tree models.StatsTree, err error) {
+	tree.Feeds = map[string]models.Stats{}
+	for _, feed := range db.Feeds(user) {
+		tree.Feeds[feed.UUID] = models.Stats{}
+	}
+
+	tree.Categories = map[string]models.Stats{}
+	for _, ctg := range db.Categories(user) {
+		tree.Categories[ctg.UUID] = models.Stats{}
+	}
+
+	tree.Total, err = db.entryStats(db.db.Model(&models.Entry{}).Where("entries.user_id = ?", user.ID))
+	if err != nil {
+		return
+	}
+
+	err = db.groupedEntryStats("feeds.uuid", db.db.Model(&models.Entry{}).
+		Joins("JOIN feeds ON feeds.id = entries.feed_id AND feeds.deleted_at IS NULL").
+		Where("entries.user_id = ?", user.ID), tree.Feeds)
+	if err != nil {
+		return
+	}
+
+	err = db.groupedEntryStats("categories.uuid", db.db.Model(&models.Entry{}).
+		Joins("JOIN feeds ON feeds.id = entries.feed_id AND feeds.deleted_at IS NULL").
+		Joins("JOIN categories ON categories.id = feeds.category_id AND categories.deleted_at IS NULL").
+		Where("entries.user_id = ?", user.ID), tree.Categories)
+	if err != nil {
+		return
+	}
+
+	tree.Categories[user.SavedCategoryUUID], err = db.entryStats(db.db.Model(&models.Entry{}).
+		Where("entries.user_id = ? AND entries.saved = ?", user.ID, true))
+	return
+}
+
+// markedBefore limits query to entries created up to before, taking
+// their published time when they have one. A zero before is no limit.
+func markedBefore(query *gorm.DB, before time.Time) *gorm.DB {
+	if before.IsZero() {
+		return query
+	}
+
+	var zero time.Time
+	return query.Where(
+		"(item_id IN (SELECT id FROM items WHERE published > ? AND published <= ?)) OR "+
+			"(item_id NOT IN (SELECT id FROM items WHERE published > ?) AND created_at <= ?)",
+		zero, before, zero, before)
+}
+
+// MarkFeed applies marker to the entries of a Feed with id and owned by user
+// that were created up to before
+func (db *DB) MarkFeed(id string, marker models.Marker, before time.Time, user *models.User) error {
 	feed, err := db.Feed(id, user)
 	if err != nil {
 		return err
 	}
 
-	db.db.Model(&models.Entry{}).Where("user_id = ? AND feed_id = ?", user.ID, feed.ID).Update(models.Entry{Mark: marker})
+	markedBefore(db.db.Model(&models.Entry{}).Where("user_id = ? AND feed_id = ?", user.ID, feed.ID), before).
+		Update(models.Entry{Mark: marker})
+	db.events.Publish(user.ID, events.EntriesMarked, events.Data{Feed: id, Marker: marker.String()})
 	return nil
 }
 
-// MarkCategory applies marker to a category with id and owned by user
-func (db *DB) MarkCategory(id string, marker models.Marker, user *models.User) error {
+// MarkCategory applies marker to the entries of a category with id and
+// owned by user that were created up to before
+func (db *DB) MarkCategory(id string, marker models.Marker, before time.Time, user *models.User) error {
 	ctg, err := db.Category(id, user)
 	if err != nil {
 		return err
@@ -640,7 +1404,18 @@ func (db *DB) MarkCategory(id string, marker models.Marker, user *models.User) e
 		feedIds[i] = feed.ID
 	}
 
-	db.db.Model(&models.Entry{}).Where("user_id = ?", user.ID).Where("feed_id in (?)", feedIds).Update(models.Entry{Mark: marker})
+	markedBefore(db.db.Model(&models.Entry{}).Where("user_id = ?", user.ID).Where("feed_id in (?)", feedIds), before).
+		Update(models.Entry{Mark: marker})
+	db.events.Publish(user.ID, events.EntriesMarked, events.Data{Category: id, Marker: marker.String()})
+	return nil
+}
+
+// MarkAllEntries applies marker to every entry owned by user that was
+// created up to before
+func (db *DB) MarkAllEntries(marker models.Marker, before time.Time, user *models.User) error {
+	markedBefore(db.db.Model(&models.Entry{}).Where("user_id = ?", user.ID), before).
+		Update(models.Entry{Mark: marker})
+	db.events.Publish(user.ID, events.EntriesMarked, events.Data{Marker: marker.String()})
 	return nil
 }
 
@@ -652,15 +1427,331 @@ func (db *DB) MarkEntry(id string, marker models.Marker, user *models.User) erro
 	}
 
 	db.db.Model(&entry).Update(models.Entry{Mark: marker})
+	db.events.Publish(user.ID, events.EntriesMarked, events.Data{Entries: []string{id}, Marker: marker.String()})
 	return nil
 }
 
+// SaveEntry marks an entry with id and owned by user as saved
+func (db *DB) SaveEntry(id string, user *models.User) error {
+	return db.SaveEntries([]string{id}, user)
+}
+
+// UnsaveEntry removes the saved mark from an entry with id and owned by user
+func (db *DB) UnsaveEntry(id string, user *models.User) error {
+	return db.UnsaveEntries([]string{id}, user)
+}
+
+// SaveEntries marks a list of entries owned by user as saved
+func (db *DB) SaveEntries(ids []string, user *models.User) error {
+	return db.setEntriesSaved(ids, true, user)
+}
+
+// UnsaveEntries removes the saved mark from a list of entries owned by user
+func (db *DB) UnsaveEntries(ids []string, user *models.User) error {
+	return db.setEntriesSaved(ids, false, user)
+}
+
+func (db *DB) setEntriesSaved(ids []string, saved bool, user *models.User) error {
+	if len(ids) == 0 {
+		return BadRequest{"Request should include at least one entry"}
+	}
+
+	ids = uniqueStrings(ids)
+
+	count := 0
+	db.db.Model(&models.Entry{}).Where("user_id = ? AND uuid in (?)", user.ID, ids).Count(&count)
+	if count != len(ids) {
+		return NotFound{"Entry does not exist"}
+	}
+
+	db.db.Model(&models.Entry{}).Where("user_id = ? AND uuid in (?)", user.ID, ids).Update("saved", saved)
+
+	if saved {
+		db.events.Publish(user.ID, events.EntriesSaved, events.Data{Entries: ids})
+	} else {
+		db.events.Publish(user.ID, events.EntriesUnsaved, events.Data{Entries: ids})
+	}
+	return nil
+}
+
+// Events returns the Bus that changes to the data of users are published on
+func (db *DB) Events() *events.Bus {
+	return db.events
+}
+
 // DeleteAll records in the database
 func (db *DB) DeleteAll() {
-	db.db.Delete(&models.Feed{})
-	db.db.Delete(&models.Category{})
-	db.db.Delete(&models.User{})
-	db.db.Delete(&models.Entry{})
+	db.db.Unscoped().Delete(&models.Feed{})
+	db.db.Unscoped().Delete(&models.Category{})
+	db.db.Unscoped().Delete(&models.User{})
+	db.db.Unscoped().Delete(&models.Entry{})
 	db.db.Delete(&models.Tag{})
 	db.db.Delete(&models.APIKey{})
+	db.db.Delete(&models.RefreshToken{})
+	db.db.Delete(&models.Item{})
+	db.db.Delete(&models.SharedFeed{})
+	db.db.Delete(&models.Lockout{})
+	db.db.Delete(&models.Invite{})
+	db.db.Delete(&models.RecoveryCode{})
+	db.db.Delete(&models.LoginChallenge{})
+	db.db.Delete(&models.Publication{})
+	db.db.Delete(&models.Webhook{})
+	db.db.Delete(&models.WebhookDelivery{})
+	db.db.Exec("DELETE FROM entry_tags")
+}
+
+// Export returns every User, along with the objects they own, as an Archive
+func (db *DB) Export() (Archive, error) {
+	return db.export(nil)
+}
+
+// ExportUser returns user, along with the objects they own, as an Archive
+func (db *DB) ExportUser(user *models.User) (Archive, error) {
+	return db.export(user)
+}
+
+// export returns the objects owned by user as an Archive,
+// or those owned by every User if user is nil.
+func (db *DB) export(user *models.User) (archive Archive, err error) {
+	users, owned := db.db, db.db
+	if user != nil {
+		users = db.db.Where("id = ?", user.ID)
+		owned = db.db.Where("user_id = ?", user.ID)
+	}
+
+	var usrs []models.User
+	if err = users.Find(&usrs).Error; err != nil {
+		return
+	}
+
+	var recoveryCodes []models.RecoveryCode
+	if err = owned.Find(&recoveryCodes).Error; err != nil {
+		return
+	}
+
+	userCodes := map[uint][]string{}
+	for _, code := range recoveryCodes {
+		userCodes[code.UserID] = append(userCodes[code.UserID], code.Hash)
+	}
+
+	userUUIDs := map[uint]string{}
+	for _, usr := range usrs {
+		userUUIDs[usr.ID] = usr.UUID
+		archive.Users = append(archive.Users, archivedUser(&usr, userCodes[usr.ID]))
+	}
+
+	var categories []models.Category
+	if err = owned.Unscoped().Find(&categories).Error; err != nil {
+		return
+	}
+
+	ctgUUIDs := map[uint]string{}
+	for _, ctg := range categories {
+		if userUUID, ok := userUUIDs[ctg.UserID]; ok {
+			ctgUUIDs[ctg.ID] = ctg.UUID
+			archive.Categories = append(archive.Categories, archivedCategory(&ctg, userUUID))
+		}
+	}
+
+	var feeds []models.Feed
+	if err = owned.Unscoped().Find(&feeds).Error; err != nil {
+		return
+	}
+	db.loadFeedSources(feeds)
+
+	feedUUIDs := map[uint]string{}
+	for _, feed := range feeds {
+		if userUUID, ok := userUUIDs[feed.UserID]; ok {
+			feedUUIDs[feed.ID] = feed.UUID
+			archive.Feeds = append(archive.Feeds, archivedFeed(&feed, userUUID, ctgUUIDs[feed.CategoryID]))
+		}
+	}
+
+	var tags []models.Tag
+	if err = owned.Find(&tags).Error; err != nil {
+		return
+	}
+
+	tagUUIDs := map[uint]string{}
+	for _, tag := range tags {
+		if userUUID, ok := userUUIDs[tag.UserID]; ok {
+			tagUUIDs[tag.ID] = tag.UUID
+			archive.Tags = append(archive.Tags, archivedTag(&tag, userUUID))
+		}
+	}
+
+	entryTags := map[uint][]string{}
+	rows, err := db.db.Table("entry_tags").Select("entry_id, tag_id").Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entryID, tagID uint
+		if err = rows.Scan(&entryID, &tagID); err != nil {
+			return
+		}
+		if tagUUID, ok := tagUUIDs[tagID]; ok {
+			entryTags[entryID] = append(entryTags[entryID], tagUUID)
+		}
+	}
+
+	var entries []models.Entry
+	if err = owned.Unscoped().Find(&entries).Error; err != nil {
+		return
+	}
+	db.loadEntryItems(entries)
+
+	for _, entry := range entries {
+		if userUUID, ok := userUUIDs[entry.UserID]; ok {
+			archive.Entries = append(archive.Entries, archivedEntry(&entry, userUUID, feedUUIDs[entry.FeedID], entryTags[entry.ID]))
+		}
+	}
+
+	var pubs []models.Publication
+	if err = owned.Find(&pubs).Error; err != nil {
+		return
+	}
+
+	for _, pub := range pubs {
+		if userUUID, ok := userUUIDs[pub.UserID]; ok {
+			archive.Publications = append(archive.Publications, archivedPublication(&pub, userUUID))
+		}
+	}
+
+	var hooks []models.Webhook
+	if err = owned.Find(&hooks).Error; err != nil {
+		return
+	}
+
+	for _, hook := range hooks {
+		if userUUID, ok := userUUIDs[hook.UserID]; ok {
+			archive.Webhooks = append(archive.Webhooks, archivedWebhook(&hook, userUUID))
+		}
+	}
+
+	return
+}
+
+// Import creates every object in archive. Nothing is imported if
+// any of the archived users already exist.
+func (db *DB) Import(archive Archive, progress Progress) error {
+	for _, user := range archive.Users {
+		if !db.db.Where("uuid = ? OR username = ?", user.UUID, user.Username).First(&models.User{}).RecordNotFound() {
+			return Conflict{"User " + user.Username + " already exists"}
+		}
+	}
+
+	done, total := 0, archive.Size()
+	tx := db.db.Begin()
+	create := func(value interface{}) error {
+		if err := tx.Create(value).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		done++
+		progress(done, total)
+		return nil
+	}
+
+	userIDs := map[string]uint{}
+	for _, archived := range archive.Users {
+		user := archived.user()
+		if err := create(&user); err != nil {
+			return err
+		}
+		userIDs[archived.UUID] = user.ID
+
+		for _, hash := range archived.RecoveryCodes {
+			if err := tx.Create(&models.RecoveryCode{Hash: hash, UserID: user.ID}).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	ctgIDs := map[string]uint{}
+	for _, archived := range archive.Categories {
+		ctg := archived.category(userIDs[archived.UserUUID])
+		if err := create(&ctg); err != nil {
+			return err
+		}
+		ctgIDs[archived.UUID] = ctg.ID
+	}
+
+	feedIDs := map[string]uint{}
+	sharedFeedIDs := map[string]uint{}
+	for _, archived := range archive.Feeds {
+		feed := archived.feed(userIDs[archived.UserUUID], ctgIDs[archived.CategoryUUID])
+		source, _, err := sharedFeed(tx, &feed)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		feed.SharedFeedID = source.ID
+		if err := create(&feed); err != nil {
+			return err
+		}
+		feedIDs[archived.UUID] = feed.ID
+		sharedFeedIDs[archived.UUID] = source.ID
+	}
+
+	tagIDs := map[string]uint{}
+	for _, archived := range archive.Tags {
+		tag := archived.tag(userIDs[archived.UserUUID])
+		if err := create(&tag); err != nil {
+			return err
+		}
+		tagIDs[archived.UUID] = tag.ID
+	}
+
+	for _, archived := range archive.Entries {
+		entry := archived.entry(userIDs[archived.UserUUID], feedIDs[archived.FeedUUID])
+		item, _, err := sharedItem(tx, sharedFeedIDs[archived.FeedUUID], &entry)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		entry.ItemID = item.ID
+		if err := create(&entry); err != nil {
+			return err
+		}
+
+		for _, tagUUID := range archived.TagUUIDs {
+			err := tx.Exec("INSERT INTO entry_tags (tag_id, entry_id) VALUES (?, ?)", tagIDs[tagUUID], entry.ID).Error
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	for _, archived := range archive.Publications {
+		pub, err := archived.publication(userIDs[archived.UserUUID])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := create(&pub); err != nil {
+			return err
+		}
+	}
+
+	for _, archived := range archive.Webhooks {
+		hook, err := archived.webhook(userIDs[archived.UserUUID])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := create(&hook); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit().Error
 }
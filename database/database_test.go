@@ -18,12 +18,18 @@
 package database
 
 import (
+	"bytes"
+	"fmt"
 	uuid "github.com/satori/go.uuid"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/chavamee/syndication/events"
 	"github.com/chavamee/syndication/models"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -33,7 +39,9 @@ type (
 	DatabaseTestSuite struct {
 		suite.Suite
 
-		db   *DB
+		newStore func() (Store, error)
+
+		db   Store
 		user models.User
 	}
 )
@@ -42,11 +50,59 @@ const TestDatabasePath = "/tmp/syndication-test-db.db"
 
 func (suite *DatabaseTestSuite) SetupTest() {
 	var err error
-	suite.db, err = NewDB("sqlite3", TestDatabasePath)
+	suite.db, err = suite.newStore()
 	suite.Require().NotNil(suite.db)
 	suite.Require().Nil(err)
 
-	err = suite.db.NewUser("test", "golang")
+	err = suite.db.NewUser("test", "golang123")
+	suite.Require().Nil(err)
+
+	suite.user, err = suite.db.UserWithName("test")
+	suite.Require().Nil(err)
+}
+
+func (suite *DatabaseTestSuite) TestRestoredSharedFeedReceivesItems() {
+	db, ok := suite.db.(*DB)
+	if !ok {
+		suite.T().Skip("feeds are only shared by the sql backend")
+	}
+
+	err := db.NewUser("other", "golang123")
+	suite.Require().Nil(err)
+
+	other, err := db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Subscription: "http://example.com"}
+	err = db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	otherFeed := models.Feed{Subscription: "http://example.com"}
+	err = db.NewFeed(&otherFeed, &other)
+	suite.Require().Nil(err)
+
+	err = db.DeleteFeed(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{
+		Title: "Item",
+		GUID:  "item",
+		Feed:  otherFeed,
+		Mark:  models.Unread,
+	}
+
+	err = db.NewEntry(&entry, &other)
+	suite.Require().Nil(err)
+
+	err = db.RestoreFromTrash(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err := db.EntriesFromFeed(feed.UUID, true, models.Unread, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 1)
+	suite.Equal("Item", entries[0].Title)
+
+	err = db.DeleteUser(other.UUID)
 	suite.Require().Nil(err)
 
 	suite.user, err = suite.db.UserWithName("test")
@@ -56,8 +112,71 @@ func (suite *DatabaseTestSuite) SetupTest() {
 func (suite *DatabaseTestSuite) TearDownTest() {
 	err := suite.db.Close()
 	suite.Nil(err)
-	err = os.Remove(suite.db.Connection)
-	suite.Nil(err)
+
+	if db, ok := suite.db.(*DB); ok {
+		err = os.Remove(db.Connection)
+		suite.Nil(err)
+	}
+}
+
+func (suite *DatabaseTestSuite) countEntries(marker models.Marker) int {
+	entries, err := suite.db.Entries(false, marker, &suite.user)
+	suite.Require().Nil(err)
+	return len(entries)
+}
+
+func (suite *DatabaseTestSuite) setAPIKeyExpiration(expiration time.Duration) {
+	switch db := suite.db.(type) {
+	case *DB:
+		db.APIKeyExpiration = expiration
+	case *MemoryDB:
+		db.APIKeyExpiration = expiration
+	}
+}
+
+func (suite *DatabaseTestSuite) setRefreshTokenExpiration(expiration time.Duration) {
+	switch db := suite.db.(type) {
+	case *DB:
+		db.RefreshTokenExpiration = expiration
+	case *MemoryDB:
+		db.RefreshTokenExpiration = expiration
+	}
+}
+
+func (suite *DatabaseTestSuite) setLockoutPolicy(policy LockoutPolicy) {
+	switch db := suite.db.(type) {
+	case *DB:
+		db.LockoutPolicy = policy
+	case *MemoryDB:
+		db.LockoutPolicy = policy
+	}
+}
+
+func (suite *DatabaseTestSuite) setPasswordPolicy(policy PasswordPolicy) {
+	switch db := suite.db.(type) {
+	case *DB:
+		db.PasswordPolicy = policy
+	case *MemoryDB:
+		db.PasswordPolicy = policy
+	}
+}
+
+func (suite *DatabaseTestSuite) setPasswordHashing(params HashParams) {
+	switch db := suite.db.(type) {
+	case *DB:
+		db.PasswordHashing = params
+	case *MemoryDB:
+		db.PasswordHashing = params
+	}
+}
+
+func (suite *DatabaseTestSuite) setTrashRetention(retention time.Duration) {
+	switch db := suite.db.(type) {
+	case *DB:
+		db.TrashRetention = retention
+	case *MemoryDB:
+		db.TrashRetention = retention
+	}
 }
 
 func (suite *DatabaseTestSuite) TestNewCategory() {
@@ -136,7 +255,7 @@ func (suite *DatabaseTestSuite) TestDeleteCategory() {
 	suite.Nil(err)
 	suite.NotEmpty(query.UUID)
 
-	err = suite.db.DeleteCategory(ctg.UUID, &suite.user)
+	err = suite.db.DeleteCategory(ctg.UUID, false, &suite.user)
 	suite.Nil(err)
 
 	_, err = suite.db.Category(ctg.UUID, &suite.user)
@@ -144,15 +263,157 @@ func (suite *DatabaseTestSuite) TestDeleteCategory() {
 }
 
 func (suite *DatabaseTestSuite) TestDeleteNonExistingCategory() {
-	err := suite.db.DeleteCategory(uuid.NewV4().String(), &suite.user)
+	err := suite.db.DeleteCategory(uuid.NewV4().String(), false, &suite.user)
 	suite.IsType(NotFound{}, err)
 }
 
 func (suite *DatabaseTestSuite) TestDeleteSystemCategory() {
-	err := suite.db.DeleteCategory(suite.user.SavedCategoryUUID, &suite.user)
+	err := suite.db.DeleteCategory(suite.user.SavedCategoryUUID, false, &suite.user)
 	suite.IsType(BadRequest{}, err)
 }
 
+func (suite *DatabaseTestSuite) TestDeleteCategoryMovesFeeds() {
+	ctg := models.Category{
+		Name: "News",
+	}
+
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+		Category:     ctg,
+	}
+
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteCategory(ctg.UUID, false, &suite.user)
+	suite.Require().Nil(err)
+
+	feeds, err := suite.db.FeedsFromCategory(suite.user.UncategorizedCategoryUUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(feeds, 1)
+	suite.Equal(feed.UUID, feeds[0].UUID)
+
+	trash := suite.db.Trash(&suite.user)
+	suite.Empty(trash.Feeds)
+	suite.Len(trash.Categories, 1)
+}
+
+func (suite *DatabaseTestSuite) TestDeleteCategoryWithFeeds() {
+	ctg := models.Category{
+		Name: "News",
+	}
+
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+		Category:     ctg,
+	}
+
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{
+		Title: "Item",
+		Feed:  feed,
+		Mark:  models.Unread,
+	}
+
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteCategory(ctg.UUID, true, &suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.Feed(feed.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	_, err = suite.db.Entry(entry.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	suite.Empty(suite.db.Feeds(&suite.user))
+}
+
+func (suite *DatabaseTestSuite) TestDeleteUser() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{
+		Title: "Item",
+		Feed:  feed,
+		Saved: true,
+	}
+
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	tag := models.Tag{
+		Name: "Tech",
+	}
+
+	err = suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.TagEntries(tag.UUID, []string{entry.UUID}, &suite.user)
+	suite.Require().Nil(err)
+
+	key := models.APIKey{}
+	err = suite.db.NewAPIKey("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteUser(suite.user.UUID)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.UserWithName(suite.user.Username)
+	suite.NotNil(err)
+
+	found, err := suite.db.KeyBelongsToUser(&key, &suite.user)
+	suite.Nil(err)
+	suite.False(found)
+
+	suite.Empty(suite.db.Users())
+	suite.Empty(suite.db.Feeds(&suite.user))
+	suite.Empty(suite.db.Categories(&suite.user))
+	suite.Empty(suite.db.Tags(&suite.user))
+	suite.Empty(suite.db.Trash(&suite.user).Feeds)
+	suite.Zero(suite.countEntries(models.Any))
+
+	db, ok := suite.db.(*DB)
+	if !ok {
+		return
+	}
+
+	for _, model := range []interface{}{
+		&models.User{},
+		&models.Category{},
+		&models.Feed{},
+		&models.Entry{},
+		&models.Tag{},
+		&models.APIKey{},
+		&models.SharedFeed{},
+		&models.Item{},
+	} {
+		count := 0
+		db.db.Unscoped().Model(model).Count(&count)
+		suite.Zero(count)
+	}
+
+	count := 0
+	db.db.Table("entry_tags").Count(&count)
+	suite.Zero(count)
+}
+
 func (suite *DatabaseTestSuite) TestNewFeedWithDefaults() {
 	feed := models.Feed{
 		Title:        "Test site",
@@ -695,27 +956,27 @@ func (suite *DatabaseTestSuite) TestMarkCategory() {
 		suite.Require().Nil(err)
 	}
 
-	suite.Require().Equal(suite.db.db.Model(&suite.user).Association("Entries").Count(), 10)
-	suite.Require().Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Read).Association("Entries").Count(), 5)
-	suite.Require().Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Unread).Association("Entries").Count(), 5)
+	suite.Require().Equal(suite.countEntries(models.Any), 10)
+	suite.Require().Equal(suite.countEntries(models.Read), 5)
+	suite.Require().Equal(suite.countEntries(models.Unread), 5)
 
-	err = suite.db.MarkCategory(firstCtg.UUID, models.Read, &suite.user)
+	err = suite.db.MarkCategory(firstCtg.UUID, models.Read, time.Time{}, &suite.user)
 	suite.Nil(err)
 
 	entries, err := suite.db.EntriesFromCategory(firstCtg.UUID, true, models.Any, &suite.user)
 	suite.Nil(err)
 	suite.Len(entries, 5)
 
-	suite.Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Read).Association("Entries").Count(), 10)
+	suite.Equal(suite.countEntries(models.Read), 10)
 
 	for _, entry := range entries {
 		suite.EqualValues(entry.Mark, models.Read)
 	}
 
-	err = suite.db.MarkCategory(secondCtg.UUID, models.Unread, &suite.user)
+	err = suite.db.MarkCategory(secondCtg.UUID, models.Unread, time.Time{}, &suite.user)
 	suite.Nil(err)
 
-	suite.Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Unread).Association("Entries").Count(), 5)
+	suite.Equal(suite.countEntries(models.Unread), 5)
 
 	entries, err = suite.db.EntriesFromCategory(secondCtg.UUID, true, models.Any, &suite.user)
 	suite.Nil(err)
@@ -771,27 +1032,27 @@ func (suite *DatabaseTestSuite) TestMarkFeed() {
 		suite.Require().Nil(err)
 	}
 
-	suite.Require().Equal(suite.db.db.Model(&suite.user).Association("Entries").Count(), 10)
-	suite.Require().Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Read).Association("Entries").Count(), 5)
-	suite.Require().Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Unread).Association("Entries").Count(), 5)
+	suite.Require().Equal(suite.countEntries(models.Any), 10)
+	suite.Require().Equal(suite.countEntries(models.Read), 5)
+	suite.Require().Equal(suite.countEntries(models.Unread), 5)
 
-	err = suite.db.MarkFeed(firstFeed.UUID, models.Read, &suite.user)
+	err = suite.db.MarkFeed(firstFeed.UUID, models.Read, time.Time{}, &suite.user)
 	suite.Nil(err)
 
 	entries, err := suite.db.EntriesFromFeed(firstFeed.UUID, true, models.Any, &suite.user)
 	suite.Nil(err)
 	suite.Len(entries, 5)
 
-	suite.Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Read).Association("Entries").Count(), 10)
+	suite.Equal(suite.countEntries(models.Read), 10)
 
 	for _, entry := range entries {
 		suite.EqualValues(entry.Mark, models.Read)
 	}
 
-	err = suite.db.MarkFeed(secondFeed.UUID, models.Unread, &suite.user)
+	err = suite.db.MarkFeed(secondFeed.UUID, models.Unread, time.Time{}, &suite.user)
 	suite.Nil(err)
 
-	suite.Equal(suite.db.db.Model(&suite.user).Where("mark = ?", models.Unread).Association("Entries").Count(), 5)
+	suite.Equal(suite.countEntries(models.Unread), 5)
 
 	entries, err = suite.db.EntriesFromFeed(secondFeed.UUID, true, models.Any, &suite.user)
 	suite.Nil(err)
@@ -802,6 +1063,47 @@ func (suite *DatabaseTestSuite) TestMarkFeed() {
 	}
 }
 
+func (suite *DatabaseTestSuite) TestMarkBefore() {
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	cutoff := time.Now().Add(-time.Hour)
+
+	// Entries without a published time count as created when stored
+	newEntries := []models.Entry{
+		{Title: "Old", GUID: "old", Published: cutoff.Add(-time.Hour)},
+		{Title: "New", GUID: "new", Published: cutoff.Add(time.Minute)},
+		{Title: "Undated", GUID: "undated"},
+	}
+	_, err = suite.db.NewEntries(newEntries, feed, &suite.user)
+	suite.Require().Nil(err)
+
+	sub, _, _ := suite.db.Events().Subscribe(suite.user.ID, 0)
+	defer suite.db.Events().Unsubscribe(sub)
+
+	err = suite.db.MarkFeed(feed.UUID, models.Read, cutoff, &suite.user)
+	suite.Require().Nil(err)
+
+	event := <-sub.C
+	suite.Equal(events.EntriesMarked, event.Type)
+	suite.Equal(feed.UUID, event.Data.Feed)
+
+	entries, err := suite.db.EntriesFromFeed(feed.UUID, true, models.Read, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 1)
+	suite.Equal("Old", entries[0].Title)
+
+	err = suite.db.MarkAllEntries(models.Read, time.Now().Add(time.Minute), &suite.user)
+	suite.Require().Nil(err)
+
+	event = <-sub.C
+	suite.Equal(events.EntriesMarked, event.Type)
+	suite.Equal("read", event.Data.Marker)
+
+	suite.Equal(3, suite.countEntries(models.Read))
+}
+
 func (suite *DatabaseTestSuite) TestMarkEntry() {
 	feed := models.Feed{
 		Title:        "News",
@@ -836,6 +1138,48 @@ func (suite *DatabaseTestSuite) TestMarkEntry() {
 	suite.Require().Len(entries, 1)
 }
 
+func (suite *DatabaseTestSuite) TestInstanceStats() {
+	err := suite.db.NewUser("other", "testtesttest")
+	suite.Require().Nil(err)
+
+	other, err := suite.db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{
+		Title: "Item",
+		Link:  "http://example.com",
+		Feed:  feed,
+	}
+
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.NewFeed(&models.Feed{
+		Title:        "Blog",
+		Subscription: "http://example.org",
+	}, &other)
+	suite.Require().Nil(err)
+
+	key := models.APIKey{}
+	err = suite.db.NewAPIKey("secret", &key, &other)
+	suite.Require().Nil(err)
+
+	stats := suite.db.InstanceStats()
+	suite.Equal(2, stats.Users)
+	suite.Equal(2, stats.Feeds)
+	suite.Equal(2, stats.Sources)
+	suite.Equal(1, stats.Entries)
+	suite.Equal(1, stats.APIKeys)
+}
+
 func (suite *DatabaseTestSuite) TestStats() {
 	feed := models.Feed{
 		Title:        "News",
@@ -974,74 +1318,2313 @@ func (suite *DatabaseTestSuite) TestCategoryStats() {
 	suite.Equal(10, stats.Total)
 }
 
-func (suite *DatabaseTestSuite) TestKeyBelongsToUser() {
-	key, err := suite.db.NewAPIKey("secret", &suite.user)
-	suite.Require().Nil(err)
+func (suite *DatabaseTestSuite) TestNewTag() {
+	tag := models.Tag{
+		Name: "Tech",
+	}
 
-	found, err := suite.db.KeyBelongsToUser(&models.APIKey{Key: key.Key}, &suite.user)
+	err := suite.db.NewTag(&tag, &suite.user)
 	suite.Require().Nil(err)
-	suite.True(found)
-}
+	suite.NotEmpty(tag.UUID)
+	suite.NotZero(tag.ID)
+	suite.NotZero(tag.UserID)
 
-func (suite *DatabaseTestSuite) TestKeyDoesNotBelongToUser() {
-	key := models.APIKey{
-		Key: "123456789",
-	}
+	query, err := suite.db.Tag(tag.UUID, &suite.user)
+	suite.Nil(err)
+	suite.Equal(query.Name, "Tech")
 
-	found, err := suite.db.KeyBelongsToUser(&key, &suite.user)
-	suite.Require().Nil(err)
-	suite.False(found)
-}
+	err = suite.db.NewTag(&models.Tag{Name: "Tech"}, &suite.user)
+	suite.IsType(Conflict{}, err)
 
-func TestNewDB(t *testing.T) {
-	_, err := NewDB("sqlite3", TestDatabasePath)
-	assert.Nil(t, err)
-	err = os.Remove(TestDatabasePath)
-	assert.Nil(t, err)
-}
+	err = suite.db.NewTag(&models.Tag{}, &suite.user)
+	suite.IsType(BadRequest{}, err)
 
-func TestNewDBWithBadOptions(t *testing.T) {
-	_, err := NewDB("bogus", TestDatabasePath)
-	assert.NotNil(t, err)
+	suite.Len(suite.db.Tags(&suite.user), 1)
 }
 
-func TestNewUser(t *testing.T) {
-	db, err := NewDB("sqlite3", TestDatabasePath)
-	require.Nil(t, err)
+func (suite *DatabaseTestSuite) TestEditTag() {
+	tag := models.Tag{
+		Name: "Tech",
+	}
 
-	err = db.NewUser("test", "golang")
-	assert.Nil(t, err)
+	err := suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
 
-	user, err := db.UserWithName("test")
-	assert.Nil(t, err)
-	assert.NotZero(t, user.ID)
+	tag.Name = "Technology"
+	err = suite.db.EditTag(&tag, &suite.user)
+	suite.Require().Nil(err)
 
-	err = os.Remove(TestDatabasePath)
-	assert.Nil(t, err)
+	query, err := suite.db.Tag(tag.UUID, &suite.user)
+	suite.Nil(err)
+	suite.Equal(query.Name, "Technology")
+
+	err = suite.db.EditTag(&models.Tag{UUID: uuid.NewV4().String(), Name: "News"}, &suite.user)
+	suite.IsType(NotFound{}, err)
 }
 
-func TestUsers(t *testing.T) {
-	db, err := NewDB("sqlite3", TestDatabasePath)
-	require.Nil(t, err)
+func (suite *DatabaseTestSuite) TestDeleteTag() {
+	tag := models.Tag{
+		Name: "Tech",
+	}
 
-	err = db.NewUser("test_one", "golang")
-	assert.Nil(t, err)
+	err := suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
 
-	err = db.NewUser("test_two", "password")
-	assert.Nil(t, err)
+	err = suite.db.DeleteTag(tag.UUID, &suite.user)
+	suite.Nil(err)
 
-	users := db.Users()
-	assert.Len(t, users, 2)
+	_, err = suite.db.Tag(tag.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
 
-	err = os.Remove(TestDatabasePath)
-	assert.Nil(t, err)
+	err = suite.db.DeleteTag(tag.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
 }
 
-func TestUsersWithFields(t *testing.T) {
-	db, err := NewDB("sqlite3", TestDatabasePath)
-	require.Nil(t, err)
-
-	err = db.NewUser("test_one", "golang")
+func (suite *DatabaseTestSuite) TestTagEntries() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	tag := models.Tag{
+		Name: "Tech",
+	}
+
+	err = suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
+
+	var entryIDs []string
+	for i := 0; i < 5; i++ {
+		entry := models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			Feed:  feed,
+			Mark:  models.Unread,
+		}
+
+		if i < 2 {
+			entry.Mark = models.Read
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+
+		entryIDs = append(entryIDs, entry.UUID)
+	}
+
+	err = suite.db.TagEntries(tag.UUID, entryIDs, &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err := suite.db.EntriesFromTag(tag.UUID, false, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 5)
+	suite.Equal(entries[0].Title, "Item 0")
+
+	entries, err = suite.db.EntriesFromTag(tag.UUID, true, models.Unread, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(entries, 3)
+
+	stats, err := suite.db.TagStats(tag.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal(3, stats.Unread)
+	suite.Equal(2, stats.Read)
+	suite.Equal(5, stats.Total)
+
+	// Repeated IDs are only counted once
+	err = suite.db.UntagEntries(tag.UUID, []string{entryIDs[0], entryIDs[1], entryIDs[0]}, &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err = suite.db.EntriesFromTag(tag.UUID, true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(entries, 3)
+
+	err = suite.db.TagEntries(tag.UUID, []string{entryIDs[0], entryIDs[0]}, &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err = suite.db.EntriesFromTag(tag.UUID, true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(entries, 4)
+
+	err = suite.db.UntagEntries(tag.UUID, entryIDs[:1], &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.TagEntries(tag.UUID, []string{uuid.NewV4().String()}, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	_, err = suite.db.EntriesFromTag(uuid.NewV4().String(), true, models.Any, &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestSaveEntries() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	var entryIDs []string
+	for i := 0; i < 5; i++ {
+		entry := models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			Feed:  feed,
+			Mark:  models.Unread,
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+
+		entryIDs = append(entryIDs, entry.UUID)
+	}
+
+	err = suite.db.SaveEntry(entryIDs[0], &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.SaveEntries(entryIDs[1:3], &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err := suite.db.SavedEntries(false, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 3)
+	suite.True(entries[0].Saved)
+
+	entries, err = suite.db.EntriesFromCategory(suite.user.SavedCategoryUUID, true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(entries, 3)
+
+	err = suite.db.UnsaveEntry(entryIDs[0], &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err = suite.db.SavedEntries(true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(entries, 2)
+
+	err = suite.db.SaveEntries([]string{entryIDs[0], uuid.NewV4().String()}, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	err = suite.db.SaveEntries([]string{entryIDs[3], entryIDs[3]}, &suite.user)
+	suite.Require().Nil(err)
+
+	stats := suite.db.Stats(&suite.user)
+	suite.Equal(3, stats.Saved)
+}
+
+func (suite *DatabaseTestSuite) TestDeleteFeedKeepsSavedEntries() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	saved := models.Entry{
+		Title: "Saved Item",
+		Feed:  feed,
+		Mark:  models.Read,
+		Saved: true,
+	}
+
+	err = suite.db.NewEntry(&saved, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{
+		Title: "Item",
+		Feed:  feed,
+		Mark:  models.Unread,
+	}
+
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteFeed(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.Entry(entry.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	query, err := suite.db.Entry(saved.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(query.Saved)
+
+	entries, err := suite.db.SavedEntries(true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(entries, 1)
+}
+
+func (suite *DatabaseTestSuite) TestStatsTree() {
+	category := models.Category{
+		Name: "World",
+	}
+
+	err := suite.db.NewCategory(&category, &suite.user)
+	suite.Require().Nil(err)
+
+	firstFeed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+		Category:     category,
+	}
+
+	err = suite.db.NewFeed(&firstFeed, &suite.user)
+	suite.Require().Nil(err)
+
+	secondFeed := models.Feed{
+		Title:        "Blog",
+		Subscription: "http://example.com/blog",
+	}
+
+	err = suite.db.NewFeed(&secondFeed, &suite.user)
+	suite.Require().Nil(err)
+
+	emptyFeed := models.Feed{
+		Title:        "Empty",
+		Subscription: "http://example.com/empty",
+	}
+
+	err = suite.db.NewFeed(&emptyFeed, &suite.user)
+	suite.Require().Nil(err)
+
+	for i := 0; i < 10; i++ {
+		entry := models.Entry{
+			Title: "Item",
+			Feed:  firstFeed,
+			Mark:  models.Unread,
+		}
+
+		if i < 3 {
+			entry.Mark = models.Read
+			entry.Saved = true
+		}
+
+		if i >= 6 {
+			entry.Feed = secondFeed
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+	}
+
+	tree, err := suite.db.StatsTree(&suite.user)
+	suite.Require().Nil(err)
+
+	suite.Equal(models.Stats{Unread: 7, Read: 3, Saved: 3, Total: 10}, tree.Total)
+	suite.Equal(models.Stats{Unread: 3, Read: 3, Saved: 3, Total: 6}, tree.Feeds[firstFeed.UUID])
+	suite.Equal(models.Stats{Unread: 4, Total: 4}, tree.Feeds[secondFeed.UUID])
+	suite.Contains(tree.Feeds, emptyFeed.UUID)
+	suite.Equal(models.Stats{}, tree.Feeds[emptyFeed.UUID])
+
+	suite.Equal(tree.Feeds[firstFeed.UUID], tree.Categories[category.UUID])
+	suite.Equal(models.Stats{Unread: 4, Total: 4}, tree.Categories[suite.user.UncategorizedCategoryUUID])
+	suite.Equal(models.Stats{Read: 3, Saved: 3, Total: 3}, tree.Categories[suite.user.SavedCategoryUUID])
+
+	stats, err := suite.db.CategoryStats(suite.user.SavedCategoryUUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal(tree.Categories[suite.user.SavedCategoryUUID], stats)
+}
+
+func (suite *DatabaseTestSuite) TestRestoreFeedFromTrash() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{
+		Title: "Item",
+		Feed:  feed,
+		Mark:  models.Unread,
+	}
+
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteFeed(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.Feed(feed.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	trash := suite.db.Trash(&suite.user)
+	suite.Require().Len(trash.Feeds, 1)
+	suite.Equal(feed.UUID, trash.Feeds[0].UUID)
+	suite.NotNil(trash.Feeds[0].DeletedAt)
+	suite.Empty(trash.Categories)
+
+	err = suite.db.RestoreFromTrash(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.Feed(feed.UUID, &suite.user)
+	suite.Nil(err)
+
+	_, err = suite.db.Entry(entry.UUID, &suite.user)
+	suite.Nil(err)
+
+	suite.Empty(suite.db.Trash(&suite.user).Feeds)
+
+	err = suite.db.RestoreFromTrash(feed.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestRestoreCategoryFromTrash() {
+	ctg := models.Category{
+		Name: "News",
+	}
+
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+		Category:     ctg,
+	}
+
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteCategory(ctg.UUID, true, &suite.user)
+	suite.Require().Nil(err)
+
+	trash := suite.db.Trash(&suite.user)
+	suite.Len(trash.Feeds, 1)
+	suite.Len(trash.Categories, 1)
+
+	err = suite.db.RestoreFromTrash(ctg.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	feeds, err := suite.db.FeedsFromCategory(ctg.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(feeds, 1)
+	suite.Equal(feed.UUID, feeds[0].UUID)
+
+	trash = suite.db.Trash(&suite.user)
+	suite.Empty(trash.Feeds)
+	suite.Empty(trash.Categories)
+}
+
+func (suite *DatabaseTestSuite) TestRestoreFeedWithoutCategory() {
+	ctg := models.Category{
+		Name: "News",
+	}
+
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+		Category:     ctg,
+	}
+
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteCategory(ctg.UUID, true, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.RestoreFromTrash(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	feeds, err := suite.db.FeedsFromCategory(suite.user.UncategorizedCategoryUUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(feeds, 1)
+	suite.Equal(feed.UUID, feeds[0].UUID)
+}
+
+func (suite *DatabaseTestSuite) TestPurgeTrash() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	saved := models.Entry{
+		Title: "Saved Item",
+		Feed:  feed,
+		Saved: true,
+	}
+
+	err = suite.db.NewEntry(&saved, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteFeed(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.PurgeTrash()
+	suite.Require().Nil(err)
+	suite.Len(suite.db.Trash(&suite.user).Feeds, 1)
+
+	suite.setTrashRetention(-time.Second)
+	err = suite.db.PurgeTrash()
+	suite.Require().Nil(err)
+	suite.Empty(suite.db.Trash(&suite.user).Feeds)
+
+	err = suite.db.RestoreFromTrash(feed.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	_, err = suite.db.Entry(saved.UUID, &suite.user)
+	suite.Nil(err)
+}
+
+func (suite *DatabaseTestSuite) TestBackupAndRestore() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{
+		Title: "Item",
+		Feed:  feed,
+		Mark:  models.Read,
+		Saved: true,
+	}
+
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	tag := models.Tag{
+		Name: "Tech",
+	}
+
+	err = suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.TagEntries(tag.UUID, []string{entry.UUID}, &suite.user)
+	suite.Require().Nil(err)
+
+	pub := models.Publication{Source: models.PublishTag, SourceID: tag.UUID}
+	err = suite.db.NewPublication(&pub, &suite.user)
+	suite.Require().Nil(err)
+
+	hook := models.Webhook{URL: "http://example.com/hook", FeedID: feed.UUID, Keyword: "go"}
+	err = suite.db.NewWebhook(&hook, &suite.user)
+	suite.Require().Nil(err)
+
+	buf := &bytes.Buffer{}
+	archive, err := Backup(suite.db, buf)
+	suite.Require().Nil(err)
+	suite.Equal(ArchiveVersion, archive.Version)
+
+	sqlDB, err := NewDB("sqlite3", "/tmp/syndication-test-restore.db")
+	suite.Require().Nil(err)
+	defer os.Remove(sqlDB.Connection)
+	defer sqlDB.Close()
+
+	for _, restored := range []Store{NewMemoryDB(), sqlDB} {
+		calls := 0
+		_, err = Restore(restored, bytes.NewReader(buf.Bytes()), func(done, total int) {
+			calls++
+			suite.Equal(archive.Size(), total)
+		})
+		suite.Require().Nil(err)
+		suite.Equal(archive.Size(), calls)
+
+		user, err := restored.Authenticate("test", "golang123")
+		suite.Require().Nil(err)
+		suite.Equal(suite.user.UUID, user.UUID)
+
+		query, err := restored.Feed(feed.UUID, &user)
+		suite.Require().Nil(err)
+		suite.Equal(suite.user.UncategorizedCategoryUUID, query.Category.UUID)
+
+		entries, err := restored.EntriesFromTag(tag.UUID, true, models.Read, &user)
+		suite.Require().Nil(err)
+		suite.Require().Len(entries, 1)
+		suite.Equal(entry.UUID, entries[0].UUID)
+		suite.True(entries[0].Saved)
+
+		restoredPub, owner, err := restored.PublicationWithToken(pub.Token)
+		suite.Require().Nil(err)
+		suite.Equal(pub.UUID, restoredPub.UUID)
+		suite.Equal(tag.UUID, restoredPub.SourceID)
+		suite.Equal(user.UUID, owner.UUID)
+
+		restoredHook, err := restored.Webhook(hook.UUID, &user)
+		suite.Require().Nil(err)
+		suite.Equal(hook.URL, restoredHook.URL)
+		suite.Equal(hook.Secret, restoredHook.Secret)
+		suite.Equal(feed.UUID, restoredHook.FeedID)
+		suite.Equal("go", restoredHook.Keyword)
+	}
+
+	_, err = Restore(suite.db, bytes.NewReader(buf.Bytes()), nil)
+	suite.IsType(Conflict{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestRestoreCorruptedArchive() {
+	_, err := Restore(suite.db, bytes.NewReader([]byte("not an archive")), nil)
+	suite.IsType(BadRequest{}, err)
+
+	buf := &bytes.Buffer{}
+	_, err = Backup(NewMemoryDB(), buf)
+	suite.Require().Nil(err)
+
+	data := buf.Bytes()
+	data[len(data)-5]++
+	_, err = Restore(suite.db, bytes.NewReader(data), nil)
+	suite.IsType(BadRequest{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestRestoreInvalidArchive() {
+	archive := Archive{
+		Version: ArchiveVersion + 1,
+	}
+	suite.IsType(BadRequest{}, archive.Verify())
+
+	archive = Archive{
+		Version: ArchiveVersion,
+		Users: []ArchivedUser{
+			{UUID: "user", Username: "restored"},
+		},
+	}
+	suite.IsType(BadRequest{}, archive.Verify())
+
+	archive = Archive{
+		Version: ArchiveVersion,
+		Users: []ArchivedUser{
+			{UUID: "user", Username: "restored", UncategorizedCategoryUUID: "uncategorized", SavedCategoryUUID: "saved"},
+		},
+		Categories: []ArchivedCategory{
+			{UUID: "uncategorized", UserUUID: "user"},
+			{UUID: "saved", UserUUID: "user"},
+		},
+		Publications: []ArchivedPublication{
+			{UUID: "pub", UserUUID: "user", Token: "token", Source: models.PublishSaved},
+		},
+	}
+	suite.Nil(archive.Verify())
+
+	archive.Publications[0].Source = models.PublishTag
+	archive.Publications[0].SourceID = "missing"
+	suite.IsType(BadRequest{}, archive.Verify())
+
+	archive.Publications = nil
+	archive.Webhooks = []ArchivedWebhook{
+		{UUID: "hook", UserUUID: "user", URL: "http://example.com", CategoryID: "saved"},
+	}
+	suite.Nil(archive.Verify())
+
+	archive.Webhooks[0].FeedID = "missing"
+	suite.IsType(BadRequest{}, archive.Verify())
+}
+
+func (suite *DatabaseTestSuite) TestUpdateFeedSource() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.UpdateFeedSource(&models.Feed{
+		Title:        "Example News",
+		Subscription: "http://example.com",
+		Description:  "All the news",
+		Etag:         "abc",
+	})
+	suite.Require().Nil(err)
+
+	found, err := suite.db.Feed(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal("News", found.Title)
+	suite.Equal("All the news", found.Description)
+	suite.Equal("abc", found.Etag)
+
+	err = suite.db.UpdateFeedSource(&models.Feed{Subscription: "http://bogus.com"})
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestSharedFeedSubscriptions() {
+	db, ok := suite.db.(*DB)
+	if !ok {
+		suite.T().Skip("feeds are only shared by the sql backend")
+	}
+
+	err := db.NewUser("other", "golang123")
+	suite.Require().Nil(err)
+
+	other, err := db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err = db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	otherFeed := models.Feed{
+		Title:        "My News",
+		Subscription: "http://example.com",
+	}
+
+	err = db.NewFeed(&otherFeed, &other)
+	suite.Require().Nil(err)
+
+	count := 0
+	db.db.Model(&models.SharedFeed{}).Count(&count)
+	suite.Equal(1, count)
+
+	entry := models.Entry{
+		Title: "Item",
+		GUID:  "item",
+		Feed:  feed,
+		Mark:  models.Read,
+	}
+
+	err = db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	count = 0
+	db.db.Model(&models.Item{}).Count(&count)
+	suite.Equal(1, count)
+
+	suite.True(db.EntryWithGUIDExists("item", &other))
+
+	entries, err := db.EntriesFromFeed(otherFeed.UUID, true, models.Any, &other)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 1)
+	suite.Equal("Item", entries[0].Title)
+	suite.EqualValues(models.Unread, entries[0].Mark)
+
+	err = db.MarkEntry(entries[0].UUID, models.Read, &other)
+	suite.Require().Nil(err)
+
+	found, err := db.Entry(entry.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.EqualValues(models.Read, found.Mark)
+	suite.Equal("http://example.com", found.Feed.Subscription)
+
+	err = db.NewUser("late", "golang123")
+	suite.Require().Nil(err)
+
+	late, err := db.UserWithName("late")
+	suite.Require().Nil(err)
+
+	lateFeed := models.Feed{Subscription: "http://example.com"}
+	err = db.NewFeed(&lateFeed, &late)
+	suite.Require().Nil(err)
+	suite.Equal("News", lateFeed.Title)
+
+	entries, err = db.EntriesFromFeed(lateFeed.UUID, true, models.Unread, &late)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 1)
+	suite.Equal("Item", entries[0].Title)
+
+	err = db.DeleteUser(other.UUID)
+	suite.Require().Nil(err)
+
+	count = 0
+	db.db.Model(&models.Item{}).Count(&count)
+	suite.Equal(1, count)
+}
+
+func (suite *DatabaseTestSuite) TestNewEntriesReachSubscribers() {
+	db, ok := suite.db.(*DB)
+	if !ok {
+		suite.T().Skip("feeds are only shared by the sql backend")
+	}
+
+	err := db.NewUser("other", "golang123")
+	suite.Require().Nil(err)
+
+	other, err := db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Subscription: "http://example.com"}
+	err = db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	otherFeed := models.Feed{Subscription: "http://example.com"}
+	err = db.NewFeed(&otherFeed, &other)
+	suite.Require().Nil(err)
+
+	sub, _, _ := db.Events().Subscribe(other.ID, 0)
+	defer db.Events().Unsubscribe(sub)
+
+	subscriptions, err := db.NewEntries([]models.Entry{
+		{Title: "First", GUID: "first"},
+		{Title: "Second", GUID: "second"},
+	}, feed, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(subscriptions, 1)
+	suite.Equal(otherFeed.UUID, subscriptions[0].UUID)
+	suite.Equal(other.UUID, subscriptions[0].User.UUID)
+	suite.Len(subscriptions[0].Entries, 2)
+
+	event := <-sub.C
+	suite.Equal(events.EntriesNew, event.Type)
+	suite.Equal(otherFeed.UUID, event.Data.Feed)
+	suite.Equal(2, event.Data.NewEntries)
+
+	// Entries the other user already has are not handed out again
+	subscriptions, err = db.NewEntries([]models.Entry{{Title: "First", GUID: "first"}}, feed, &suite.user)
+	suite.Require().Nil(err)
+	suite.Empty(subscriptions)
+
+	entry := models.Entry{Title: "Third", GUID: "third", Feed: feed}
+	err = db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	event = <-sub.C
+	suite.Equal(events.EntriesNew, event.Type)
+	suite.Equal(otherFeed.UUID, event.Data.Feed)
+	suite.Equal(1, event.Data.NewEntries)
+}
+
+func (suite *DatabaseTestSuite) TestExistingEntryGUIDs() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entries := []models.Entry{
+		{Title: "First", GUID: "first", Mark: models.Unread},
+		{Title: "Second", GUID: "second", Mark: models.Unread},
+	}
+
+	_, err = suite.db.NewEntries(entries, feed, &suite.user)
+	suite.Require().Nil(err)
+
+	existing, err := suite.db.ExistingEntryGUIDs(feed.UUID, []string{"first", "second", "third"}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal(map[string]bool{"first": true, "second": true}, existing)
+
+	_, err = suite.db.ExistingEntryGUIDs("bogus", []string{"first"}, &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestNewEntriesInBulk() {
+	db, ok := suite.db.(*DB)
+	if !ok {
+		suite.T().Skip("bulk inserts are specific to the sql backend")
+	}
+
+	err := db.NewUser("other", "golang123")
+	suite.Require().Nil(err)
+
+	other, err := db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Subscription: "http://example.com"}
+	err = db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	otherFeed := models.Feed{Subscription: "http://example.com"}
+	err = db.NewFeed(&otherFeed, &other)
+	suite.Require().Nil(err)
+
+	entries := make([]models.Entry, 1200)
+	for i := range entries {
+		entries[i] = models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			GUID:  strconv.Itoa(i),
+			Mark:  models.Unread,
+		}
+	}
+	entries = append(entries, models.Entry{Title: "Duplicate", GUID: "0", Mark: models.Unread})
+	entries = append(entries, models.Entry{Title: "No GUID", Mark: models.Read})
+
+	_, err = db.NewEntries(entries, feed, &suite.user)
+	suite.Require().Nil(err)
+
+	// Entries the feed already has are skipped
+	_, err = db.NewEntries(entries[:10], feed, &suite.user)
+	suite.Require().Nil(err)
+
+	found, err := db.EntriesFromFeed(feed.UUID, true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(found, 1201)
+
+	found, err = db.EntriesFromFeed(otherFeed.UUID, true, models.Unread, &other)
+	suite.Require().Nil(err)
+	suite.Require().Len(found, 1201)
+	suite.NotEmpty(found[0].Title)
+}
+
+func (suite *DatabaseTestSuite) TestPing() {
+	suite.Nil(suite.db.Ping())
+}
+
+func (suite *DatabaseTestSuite) TestKeyBelongsToUser() {
+	key := models.APIKey{}
+	err := suite.db.NewAPIKey("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	found, err := suite.db.KeyBelongsToUser(&models.APIKey{Key: key.Key}, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+}
+
+func (suite *DatabaseTestSuite) TestNewAPIKey() {
+	suite.setAPIKeyExpiration(time.Hour)
+
+	key := models.APIKey{
+		Label:  "Laptop",
+		Device: "Firefox",
+	}
+
+	err := suite.db.NewAPIKey("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+	suite.NotEmpty(key.UUID)
+	suite.NotEmpty(key.Key)
+	suite.WithinDuration(time.Now().Add(time.Hour), key.ExpiresAt, time.Minute)
+
+	keys := suite.db.APIKeys(&suite.user)
+	suite.Require().Len(keys, 1)
+	suite.Equal(key.UUID, keys[0].UUID)
+	suite.Equal("Laptop", keys[0].Label)
+	suite.Equal("Firefox", keys[0].Device)
+	suite.Nil(keys[0].LastUsedAt)
+
+	err = suite.db.TouchAPIKey(key.Key, &suite.user)
+	suite.Require().Nil(err)
+
+	keys = suite.db.APIKeys(&suite.user)
+	suite.Require().Len(keys, 1)
+	suite.Require().NotNil(keys[0].LastUsedAt)
+	suite.WithinDuration(time.Now(), *keys[0].LastUsedAt, time.Minute)
+}
+
+func (suite *DatabaseTestSuite) TestExpiredAPIKey() {
+	suite.setAPIKeyExpiration(-time.Hour)
+
+	expired := models.APIKey{}
+	err := suite.db.NewAPIKey("secret", &expired, &suite.user)
+	suite.Require().Nil(err)
+
+	suite.setAPIKeyExpiration(time.Hour)
+
+	key := models.APIKey{}
+	err = suite.db.NewAPIKey("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	found, err := suite.db.KeyBelongsToUser(&expired, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(found)
+
+	keys := suite.db.APIKeys(&suite.user)
+	suite.Require().Len(keys, 1)
+	suite.Equal(key.UUID, keys[0].UUID)
+
+	err = suite.db.DeleteExpiredAPIKeys()
+	suite.Require().Nil(err)
+
+	err = suite.db.RevokeAPIKey(expired.Key, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	found, err = suite.db.KeyBelongsToUser(&key, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+}
+
+func (suite *DatabaseTestSuite) TestDeleteAPIKey() {
+	key := models.APIKey{}
+	err := suite.db.NewAPIKey("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteAPIKey(key.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	found, err := suite.db.KeyBelongsToUser(&key, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(found)
+
+	err = suite.db.DeleteAPIKey(key.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestRevokeAPIKey() {
+	key := models.APIKey{}
+	err := suite.db.NewAPIKey("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.RevokeAPIKey(key.Key, &suite.user)
+	suite.Require().Nil(err)
+
+	suite.Empty(suite.db.APIKeys(&suite.user))
+}
+
+func (suite *DatabaseTestSuite) newSession() (models.APIKey, models.RefreshToken) {
+	key := models.APIKey{Label: "Laptop"}
+	err := suite.db.NewAPIKey("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	refresh, err := suite.db.NewRefreshToken(key.Family, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().NotEmpty(refresh.Token)
+	suite.NotEqual(refresh.Token, refresh.Hash)
+
+	return key, refresh
+}
+
+func (suite *DatabaseTestSuite) TestRefreshAPIKey() {
+	key, refresh := suite.newSession()
+
+	newKey, newRefresh, err := suite.db.RefreshAPIKey("secret", refresh.Token)
+	suite.Require().Nil(err)
+	suite.NotEqual(key.Key, newKey.Key)
+	suite.NotEqual(refresh.Token, newRefresh.Token)
+	suite.Equal("Laptop", newKey.Label)
+
+	found, err := suite.db.KeyBelongsToUser(&key, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(found)
+
+	found, err = suite.db.KeyBelongsToUser(&newKey, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", newRefresh.Token)
+	suite.Nil(err)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", "bogus")
+	suite.IsType(Unauthorized{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestRefreshTokenReuse() {
+	_, refresh := suite.newSession()
+	otherKey, otherRefresh := suite.newSession()
+
+	newKey, newRefresh, err := suite.db.RefreshAPIKey("secret", refresh.Token)
+	suite.Require().Nil(err)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", refresh.Token)
+	suite.IsType(Unauthorized{}, err)
+
+	// Every token in the family is revoked
+	found, err := suite.db.KeyBelongsToUser(&newKey, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(found)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", newRefresh.Token)
+	suite.IsType(Unauthorized{}, err)
+
+	// Other logins are not
+	found, err = suite.db.KeyBelongsToUser(&otherKey, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", otherRefresh.Token)
+	suite.Nil(err)
+}
+
+func (suite *DatabaseTestSuite) TestExpiredRefreshToken() {
+	suite.setRefreshTokenExpiration(-time.Hour)
+	_, refresh := suite.newSession()
+
+	_, _, err := suite.db.RefreshAPIKey("secret", refresh.Token)
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.DeleteExpiredAPIKeys()
+	suite.Require().Nil(err)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", refresh.Token)
+	suite.IsType(Unauthorized{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestRevokeAPIKeyRevokesRefreshToken() {
+	key, refresh := suite.newSession()
+
+	err := suite.db.RevokeAPIKey(key.Key, &suite.user)
+	suite.Require().Nil(err)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", refresh.Token)
+	suite.IsType(Unauthorized{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestNewPersonalAccessToken() {
+	session := models.APIKey{}
+	err := suite.db.NewAPIKey("secret", &session, &suite.user)
+	suite.Require().Nil(err)
+
+	key := models.APIKey{
+		Label: "Dashboard",
+		Scope: "entries:read feeds:read entries:read",
+	}
+
+	err = suite.db.NewPersonalAccessToken("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(key.Personal)
+	suite.Equal("feeds:read entries:read", key.Scope)
+	suite.Empty(key.Family)
+	suite.WithinDuration(time.Now().Add(DefaultPersonalAccessTokenExpiration), key.ExpiresAt, time.Minute)
+
+	found, err := suite.db.KeyBelongsToUser(&models.APIKey{Key: key.Key}, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+
+	tokens := suite.db.PersonalAccessTokens(&suite.user)
+	suite.Require().Len(tokens, 1)
+	suite.Equal(key.UUID, tokens[0].UUID)
+	suite.Equal("Dashboard", tokens[0].Label)
+	suite.Equal("feeds:read entries:read", tokens[0].Scope)
+
+	// Only the hash of the token is stored
+	suite.Empty(tokens[0].Key)
+	suite.Equal(hashRefreshToken(key.Key), tokens[0].Hash)
+
+	suite.Len(suite.db.APIKeys(&suite.user), 2)
+
+	err = suite.db.DeleteAPIKey(key.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Empty(suite.db.PersonalAccessTokens(&suite.user))
+}
+
+func (suite *DatabaseTestSuite) TestNewPersonalAccessTokenWithExpiration() {
+	expiresAt := time.Now().Add(time.Hour * 24 * 7)
+	key := models.APIKey{
+		Scope:     models.ScopeEntriesMark,
+		ExpiresAt: expiresAt,
+	}
+
+	err := suite.db.NewPersonalAccessToken("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+	suite.WithinDuration(expiresAt, key.ExpiresAt, time.Second)
+
+	key = models.APIKey{
+		Scope:     models.ScopeEntriesMark,
+		ExpiresAt: time.Now().Add(-time.Hour),
+	}
+
+	err = suite.db.NewPersonalAccessToken("secret", &key, &suite.user)
+	suite.IsType(BadRequest{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestNewPersonalAccessTokenWithBadScope() {
+	key := models.APIKey{}
+	err := suite.db.NewPersonalAccessToken("secret", &key, &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	key = models.APIKey{Scope: "entries:read feeds:delete"}
+	err = suite.db.NewPersonalAccessToken("secret", &key, &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	suite.Empty(suite.db.PersonalAccessTokens(&suite.user))
+}
+
+func (suite *DatabaseTestSuite) TestSetUserRole() {
+	suite.Equal(models.RoleUser, suite.user.Role)
+
+	err := suite.db.SetUserRole(suite.user.UUID, models.RoleAdmin)
+	suite.Require().Nil(err)
+
+	user, err := suite.db.UserWithUUID(suite.user.UUID)
+	suite.Require().Nil(err)
+	suite.Equal(models.RoleAdmin, user.Role)
+
+	err = suite.db.SetUserRole(suite.user.UUID, "superuser")
+	suite.IsType(BadRequest{}, err)
+
+	err = suite.db.SetUserRole("bogus", models.RoleUser)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestAccountLockout() {
+	suite.setLockoutPolicy(LockoutPolicy{
+		AccountAttempts: 3,
+		IPAttempts:      10,
+		Backoff:         time.Minute,
+		MaxBackoff:      time.Hour,
+	})
+
+	for i := 0; i < 2; i++ {
+		err := suite.db.RecordLoginFailure("test", "10.0.0.1")
+		suite.Require().Nil(err)
+	}
+
+	_, locked := suite.db.LockedOut("test", "10.0.0.1")
+	suite.False(locked)
+
+	err := suite.db.RecordLoginFailure("test", "10.0.0.1")
+	suite.Require().Nil(err)
+
+	// The account is locked from every address
+	until, locked := suite.db.LockedOut("test", "10.0.0.2")
+	suite.True(locked)
+	suite.WithinDuration(time.Now().Add(time.Minute), until, 5*time.Second)
+
+	err = suite.db.RecordLoginFailure("test", "10.0.0.1")
+	suite.Require().Nil(err)
+
+	until, locked = suite.db.LockedOut("test", "10.0.0.2")
+	suite.True(locked)
+	suite.WithinDuration(time.Now().Add(2*time.Minute), until, 5*time.Second)
+
+	_, locked = suite.db.LockedOut("other", "10.0.0.1")
+	suite.False(locked)
+
+	err = suite.db.ClearLoginFailures("test")
+	suite.Require().Nil(err)
+
+	_, locked = suite.db.LockedOut("test", "10.0.0.1")
+	suite.False(locked)
+
+	lockouts := suite.db.Lockouts()
+	suite.Require().Len(lockouts, 1)
+	suite.Equal(models.LockoutIP, lockouts[0].Kind)
+	suite.Equal("10.0.0.1", lockouts[0].Subject)
+	suite.Equal(4, lockouts[0].Failures)
+}
+
+func (suite *DatabaseTestSuite) TestIPLockout() {
+	suite.setLockoutPolicy(LockoutPolicy{
+		AccountAttempts: 10,
+		IPAttempts:      2,
+		Backoff:         time.Minute,
+		MaxBackoff:      time.Hour,
+	})
+
+	err := suite.db.RecordLoginFailure("alice", "10.0.0.1")
+	suite.Require().Nil(err)
+
+	err = suite.db.RecordLoginFailure("bob", "10.0.0.1")
+	suite.Require().Nil(err)
+
+	_, locked := suite.db.LockedOut("test", "10.0.0.1")
+	suite.True(locked)
+
+	_, locked = suite.db.LockedOut("test", "10.0.0.2")
+	suite.False(locked)
+
+	err = suite.db.ClearLockout(models.LockoutIP, "10.0.0.1")
+	suite.Require().Nil(err)
+
+	_, locked = suite.db.LockedOut("test", "10.0.0.1")
+	suite.False(locked)
+
+	err = suite.db.ClearLockout(models.LockoutIP, "10.0.0.1")
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestDeleteExpiredLockouts() {
+	policy := LockoutPolicy{
+		AccountAttempts: 3,
+		IPAttempts:      10,
+		Backoff:         time.Minute,
+		MaxBackoff:      time.Hour,
+	}
+	suite.setLockoutPolicy(policy)
+
+	err := suite.db.RecordLoginFailure("nobody", "10.0.0.1")
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteExpiredLockouts()
+	suite.Require().Nil(err)
+	suite.Len(suite.db.Lockouts(), 2)
+
+	expired := policy
+	expired.MaxBackoff = -time.Second
+	suite.setLockoutPolicy(expired)
+
+	err = suite.db.DeleteExpiredLockouts()
+	suite.Require().Nil(err)
+
+	suite.setLockoutPolicy(policy)
+	suite.Empty(suite.db.Lockouts())
+}
+
+func (suite *DatabaseTestSuite) TestNewUserValidation() {
+	for _, username := range []string{"", "has space", ".dot", "waytoolongusernamethatkeepsgoingon"} {
+		err := suite.db.NewUser(username, "password123")
+		suite.IsType(BadRequest{}, err, username)
+	}
+
+	err := suite.db.NewUser("short", "pass")
+	suite.IsType(BadRequest{}, err)
+
+	suite.setPasswordPolicy(PasswordPolicy{
+		MinLength:     8,
+		RequireLetter: true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	})
+
+	err = suite.db.NewUser("strict", "password123")
+	suite.IsType(BadRequest{}, err)
+
+	err = suite.db.NewUser("strict", "password123!")
+	suite.Nil(err)
+
+	err = suite.db.ChangeUserPassword(suite.user.UUID, "12345678")
+	suite.IsType(BadRequest{}, err)
+
+	err = suite.db.ChangeUserName(suite.user.UUID, "")
+	suite.IsType(BadRequest{}, err)
+
+	_, err = suite.db.Authenticate("test", "golang123")
+	suite.Nil(err)
+}
+
+func (suite *DatabaseTestSuite) TestEditUser() {
+	email := "test@example.com"
+	timezone := "America/New_York"
+	user, err := suite.db.EditUser(suite.user.UUID, ProfileChanges{
+		Email:       &email,
+		Timezone:    &timezone,
+		Preferences: &models.Preferences{"theme": "dark"},
+	})
+	suite.Require().Nil(err)
+	suite.Equal("test", user.Username)
+	suite.Equal("test@example.com", user.Email)
+	suite.Equal(suite.user.ID, user.ID)
+
+	found, err := suite.db.UserWithUUID(suite.user.UUID)
+	suite.Require().Nil(err)
+	suite.Equal("test@example.com", found.Email)
+	suite.Equal("America/New_York", found.Timezone)
+	suite.Equal(models.Preferences{"theme": "dark"}, found.Preferences)
+	suite.Equal(models.RoleUser, found.Role)
+
+	username := "renamed"
+	_, err = suite.db.EditUser(suite.user.UUID, ProfileChanges{Username: &username})
+	suite.Require().Nil(err)
+
+	found, err = suite.db.UserWithUUID(suite.user.UUID)
+	suite.Require().Nil(err)
+	suite.Equal("renamed", found.Username)
+	suite.Equal("test@example.com", found.Email)
+
+	empty := ""
+	user, err = suite.db.EditUser(suite.user.UUID, ProfileChanges{Email: &empty})
+	suite.Require().Nil(err)
+	suite.Empty(user.Email)
+	suite.Equal("America/New_York", user.Timezone)
+
+	err = suite.db.NewUser("other", "password123")
+	suite.Require().Nil(err)
+
+	username = "other"
+	_, err = suite.db.EditUser(suite.user.UUID, ProfileChanges{Username: &username})
+	suite.IsType(Conflict{}, err)
+
+	badEmail, badTimezone, badUsername := "not an email", "Mars/Olympus_Mons", "has space"
+	for _, bad := range []ProfileChanges{
+		{Email: &badEmail},
+		{Timezone: &badTimezone},
+		{Username: &badUsername},
+		{Username: &empty},
+	} {
+		_, err = suite.db.EditUser(suite.user.UUID, bad)
+		suite.IsType(BadRequest{}, err)
+	}
+
+	_, err = suite.db.EditUser("bogus", ProfileChanges{Email: &email})
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestRevokeOtherAPIKeys() {
+	key, _ := suite.newSession()
+	current, err := suite.db.NewRefreshToken(key.Family, &suite.user)
+	suite.Require().Nil(err)
+
+	otherKey, otherRefresh := suite.newSession()
+
+	personal := models.APIKey{Scope: models.ScopeFeedsRead}
+	err = suite.db.NewPersonalAccessToken("secret", &personal, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.RevokeOtherAPIKeys(key.Key, &suite.user)
+	suite.Require().Nil(err)
+
+	found, err := suite.db.KeyBelongsToUser(&key, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+
+	found, err = suite.db.KeyBelongsToUser(&personal, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+
+	found, err = suite.db.KeyBelongsToUser(&otherKey, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(found)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", otherRefresh.Token)
+	suite.IsType(Unauthorized{}, err)
+
+	_, _, err = suite.db.RefreshAPIKey("secret", current.Token)
+	suite.Nil(err)
+
+	err = suite.db.RevokeOtherAPIKeys("bogus", &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestExportUser() {
+	err := suite.db.NewUser("other", "password123")
+	suite.Require().Nil(err)
+
+	other, err := suite.db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Title: "Mine", Subscription: "http://example.com/mine"}
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	otherFeed := models.Feed{Title: "Theirs", Subscription: "http://example.com/theirs"}
+	err = suite.db.NewFeed(&otherFeed, &other)
+	suite.Require().Nil(err)
+
+	archive, err := suite.db.ExportUser(&suite.user)
+	suite.Require().Nil(err)
+
+	suite.Require().Len(archive.Users, 1)
+	suite.Equal(suite.user.UUID, archive.Users[0].UUID)
+	suite.Require().Len(archive.Feeds, 1)
+	suite.Equal(feed.UUID, archive.Feeds[0].UUID)
+
+	for _, ctg := range archive.Categories {
+		suite.Equal(suite.user.UUID, ctg.UserUUID)
+	}
+
+	archive, err = suite.db.Export()
+	suite.Require().Nil(err)
+	suite.Len(archive.Users, 2)
+	suite.Len(archive.Feeds, 2)
+}
+
+func (suite *DatabaseTestSuite) TestPasswordRehash() {
+	suite.Equal(DefaultPasswordHashing.String(), suite.user.PasswordParams)
+
+	argon2id := HashParams{Algorithm: Argon2id, Time: 1, Memory: 1024, Threads: 1}
+	suite.setPasswordHashing(argon2id)
+
+	_, err := suite.db.Authenticate("test", "wrong")
+	suite.IsType(Unauthorized{}, err)
+
+	user, err := suite.db.UserWithName("test")
+	suite.Require().Nil(err)
+	suite.Equal(DefaultPasswordHashing.String(), user.PasswordParams)
+
+	user, err = suite.db.Authenticate("test", "golang123")
+	suite.Require().Nil(err)
+	suite.Equal(argon2id.String(), user.PasswordParams)
+
+	user, err = suite.db.UserWithName("test")
+	suite.Require().Nil(err)
+	suite.Equal(argon2id.String(), user.PasswordParams)
+
+	_, err = suite.db.Authenticate("test", "golang123")
+	suite.Nil(err)
+
+	// Switching back to a weaker algorithm keeps existing hashes
+	suite.setPasswordHashing(DefaultScryptParams)
+	user, err = suite.db.Authenticate("test", "golang123")
+	suite.Require().Nil(err)
+	suite.Equal(argon2id.String(), user.PasswordParams)
+
+	// Higher costs rehash
+	argon2id.Memory = 2048
+	suite.setPasswordHashing(argon2id)
+	user, err = suite.db.Authenticate("test", "golang123")
+	suite.Require().Nil(err)
+	suite.Equal(argon2id.String(), user.PasswordParams)
+
+	// New passwords use the configured parameters
+	err = suite.db.NewUser("other", "password123")
+	suite.Require().Nil(err)
+
+	user, err = suite.db.UserWithName("other")
+	suite.Require().Nil(err)
+	suite.Equal(argon2id.String(), user.PasswordParams)
+}
+
+func (suite *DatabaseTestSuite) TestTOTP() {
+	err := suite.db.CheckTOTP("123456", &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	_, err = suite.db.EnableTOTP("123456", &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	secret, uri, err := suite.db.NewTOTP("Syndication", &suite.user)
+	suite.Require().Nil(err)
+	suite.NotEmpty(secret)
+	suite.Contains(uri, "otpauth://totp/Syndication:test")
+
+	now := time.Now()
+	code, err := totp.GenerateCode(secret, now)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.EnableTOTP("000000", &suite.user)
+	suite.IsType(Unauthorized{}, err)
+
+	codes, err := suite.db.EnableTOTP(code, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(codes, RecoveryCodeCount)
+	suite.Equal(RecoveryCodeCount, suite.db.RecoveryCodesLeft(&suite.user))
+
+	user, err := suite.db.UserWithUUID(suite.user.UUID)
+	suite.Require().Nil(err)
+	suite.True(user.TOTPEnabled)
+
+	_, _, err = suite.db.NewTOTP("Syndication", &suite.user)
+	suite.IsType(Conflict{}, err)
+
+	// Codes cannot be used twice
+	err = suite.db.CheckTOTP(code, &suite.user)
+	suite.IsType(Unauthorized{}, err)
+
+	next, err := totp.GenerateCode(secret, now.Add(30*time.Second))
+	suite.Require().Nil(err)
+
+	err = suite.db.CheckTOTP(next, &suite.user)
+	suite.Nil(err)
+
+	err = suite.db.CheckTOTP(next, &suite.user)
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.UseRecoveryCode(codes[0], &suite.user)
+	suite.Nil(err)
+
+	err = suite.db.UseRecoveryCode(codes[0], &suite.user)
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.UseRecoveryCode(strings.ToUpper(strings.Replace(codes[1], "-", "", -1)), &suite.user)
+	suite.Nil(err)
+	suite.Equal(RecoveryCodeCount-2, suite.db.RecoveryCodesLeft(&suite.user))
+
+	newCodes, err := suite.db.NewRecoveryCodes(&suite.user)
+	suite.Require().Nil(err)
+	suite.Len(newCodes, RecoveryCodeCount)
+
+	err = suite.db.UseRecoveryCode(codes[2], &suite.user)
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.DisableTOTP(suite.user.UUID)
+	suite.Require().Nil(err)
+
+	user, err = suite.db.UserWithUUID(suite.user.UUID)
+	suite.Require().Nil(err)
+	suite.False(user.TOTPEnabled)
+	suite.Empty(user.TOTPSecret)
+	suite.Zero(suite.db.RecoveryCodesLeft(&suite.user))
+
+	err = suite.db.DisableTOTP("bogus")
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestLoginChallenge() {
+	challenge, err := suite.db.NewLoginChallenge(&suite.user)
+	suite.Require().Nil(err)
+	suite.Require().NotEmpty(challenge.Token)
+	suite.WithinDuration(time.Now().Add(DefaultLoginChallengeExpiration), challenge.ExpiresAt, time.Minute)
+
+	user, err := suite.db.LoginChallengeUser(challenge.Token)
+	suite.Require().Nil(err)
+	suite.Equal(suite.user.UUID, user.UUID)
+
+	err = suite.db.DeleteLoginChallenge(challenge.Token)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.LoginChallengeUser(challenge.Token)
+	suite.IsType(Unauthorized{}, err)
+
+	_, err = suite.db.LoginChallengeUser("bogus")
+	suite.IsType(Unauthorized{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestFeverPassword() {
+	_, err := suite.db.UserWithFeverKey("")
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.SetFeverPassword("golang123", &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	err = suite.db.SetFeverPassword("short", &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	err = suite.db.SetFeverPassword("feverpass", &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal(FeverKey("test", "feverpass"), suite.user.FeverKey)
+
+	user, err := suite.db.UserWithFeverKey(strings.ToUpper(FeverKey("test", "feverpass")))
+	suite.Require().Nil(err)
+	suite.Equal(suite.user.UUID, user.UUID)
+
+	_, err = suite.db.UserWithFeverKey(FeverKey("test", "golang123"))
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.DisableFever(&suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.UserWithFeverKey(FeverKey("test", "feverpass"))
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.SetFeverPassword("feverpass", &suite.user)
+	suite.Require().Nil(err)
+
+	// Renaming invalidates the key, which hashes the username
+	username := "renamed"
+	_, err = suite.db.EditUser(suite.user.UUID, ProfileChanges{Username: &username})
+	suite.Require().Nil(err)
+
+	_, err = suite.db.UserWithFeverKey(FeverKey("test", "feverpass"))
+	suite.IsType(Unauthorized{}, err)
+
+	_, err = suite.db.UserWithFeverKey(FeverKey("renamed", "feverpass"))
+	suite.IsType(Unauthorized{}, err)
+
+	// So does renaming through the administration commands
+	err = suite.db.SetFeverPassword("feverpass", &suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.UserWithFeverKey(FeverKey("renamed", "feverpass"))
+	suite.Require().Nil(err)
+
+	err = suite.db.ChangeUserName(suite.user.UUID, "admin-renamed")
+	suite.Require().Nil(err)
+
+	_, err = suite.db.UserWithFeverKey(FeverKey("renamed", "feverpass"))
+	suite.IsType(Unauthorized{}, err)
+
+	_, err = suite.db.UserWithFeverKey(FeverKey("admin-renamed", "feverpass"))
+	suite.IsType(Unauthorized{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestEntryPrimaryKeys() {
+	feed := models.Feed{Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	var entries []models.Entry
+	for i := 0; i < 5; i++ {
+		entry := models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			Feed:  feed,
+			Mark:  models.Unread,
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+
+		entries = append(entries, entry)
+	}
+
+	err = suite.db.MarkEntry(entries[1].UUID, models.Read, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.SaveEntry(entries[2].UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	page := suite.db.EntryPage(0, 0, 3, &suite.user)
+	suite.Require().Len(page, 3)
+	suite.Equal(entries[0].UUID, page[0].UUID)
+	suite.Equal("Item 0", page[0].Title)
+	suite.Equal(entries[2].UUID, page[2].UUID)
+
+	page = suite.db.EntryPage(page[2].ID, 0, 3, &suite.user)
+	suite.Require().Len(page, 2)
+	suite.Equal(entries[3].UUID, page[0].UUID)
+
+	page = suite.db.EntryPage(0, page[1].ID, 2, &suite.user)
+	suite.Require().Len(page, 2)
+	suite.Equal(entries[3].UUID, page[0].UUID)
+	suite.Equal(entries[2].UUID, page[1].UUID)
+
+	found := suite.db.EntriesWithPrimaryKeys([]uint{page[0].ID, page[1].ID, 0}, &suite.user)
+	suite.Require().Len(found, 2)
+	suite.Equal(entries[2].UUID, found[0].UUID)
+	suite.True(found[0].Saved)
+	suite.Empty(suite.db.EntriesWithPrimaryKeys(nil, &suite.user))
+
+	unread := suite.db.EntryPrimaryKeys(models.Unread, false, &suite.user)
+	suite.Len(unread, 4)
+	suite.NotContains(unread, entries[1].ID)
+
+	saved := suite.db.EntryPrimaryKeys(models.Any, true, &suite.user)
+	suite.Equal([]uint{entries[2].ID}, saved)
+
+	err = suite.db.NewUser("other", "golang123")
+	suite.Require().Nil(err)
+
+	other, err := suite.db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	suite.Empty(suite.db.EntryPage(0, 0, 10, &other))
+	suite.Empty(suite.db.EntriesWithPrimaryKeys([]uint{page[0].ID}, &other))
+	suite.Empty(suite.db.EntryPrimaryKeys(models.Any, false, &other))
+}
+
+func (suite *DatabaseTestSuite) TestQueryEntries() {
+	ctg := models.Category{Name: "News"}
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Subscription: "http://example.com", Category: ctg}
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	other := models.Feed{Subscription: "http://example.org"}
+	err = suite.db.NewFeed(&other, &suite.user)
+	suite.Require().Nil(err)
+
+	var entries []models.Entry
+	for i := 0; i < 5; i++ {
+		entry := models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			Feed:  feed,
+			Mark:  models.Unread,
+		}
+
+		if i == 4 {
+			entry.Feed = other
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+
+		entries = append(entries, entry)
+	}
+
+	err = suite.db.SaveEntry(entries[1].UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	page, err := suite.db.QueryEntries(EntryQuery{Limit: 2}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(page, 2)
+	suite.Equal(entries[4].UUID, page[0].UUID)
+	suite.Equal(entries[3].UUID, page[1].UUID)
+
+	page, err = suite.db.QueryEntries(EntryQuery{Continuation: page[1].ID}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(page, 3)
+	suite.Equal(entries[2].UUID, page[0].UUID)
+
+	page, err = suite.db.QueryEntries(EntryQuery{CategoryID: ctg.UUID, OldestFirst: true}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(page, 4)
+	suite.Equal(entries[0].UUID, page[0].UUID)
+
+	page, err = suite.db.QueryEntries(EntryQuery{FeedID: other.UUID}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(page, 1)
+	suite.Equal("Item 4", page[0].Title)
+
+	page, err = suite.db.QueryEntries(EntryQuery{CategoryID: suite.user.SavedCategoryUUID}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(page, 1)
+	suite.Equal(entries[1].UUID, page[0].UUID)
+
+	err = suite.db.MarkEntriesWithPrimaryKeys([]uint{entries[0].ID, entries[2].ID}, models.Read, &suite.user)
+	suite.Require().Nil(err)
+
+	page, err = suite.db.QueryEntries(EntryQuery{Marker: models.Unread, FeedID: feed.UUID}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Len(page, 2)
+
+	page, err = suite.db.QueryEntries(EntryQuery{OlderThan: time.Now().Add(-time.Hour)}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Empty(page)
+
+	err = suite.db.MarkEntriesWithPrimaryKeys([]uint{entries[0].ID}, models.Any, &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	_, err = suite.db.QueryEntries(EntryQuery{FeedID: "bogus"}, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	_, err = suite.db.QueryEntries(EntryQuery{CategoryID: "bogus"}, &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestPublications() {
+	ctg := models.Category{Name: "News"}
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	tag := models.Tag{Name: "Reading"}
+	err = suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
+
+	pub := models.Publication{Source: models.PublishCategory, SourceID: ctg.UUID}
+	err = suite.db.NewPublication(&pub, &suite.user)
+	suite.Require().Nil(err)
+	suite.NotEmpty(pub.UUID)
+	suite.NotEmpty(pub.Token)
+	suite.Equal("News", pub.Title)
+
+	saved := models.Publication{Source: models.PublishSaved, SourceID: "ignored", Title: "Picks"}
+	err = suite.db.NewPublication(&saved, &suite.user)
+	suite.Require().Nil(err)
+	suite.Empty(saved.SourceID)
+	suite.Equal("Picks", saved.Title)
+	suite.NotEqual(pub.Token, saved.Token)
+
+	tagged := models.Publication{Source: models.PublishTag, SourceID: tag.UUID}
+	err = suite.db.NewPublication(&tagged, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal("Reading", tagged.Title)
+
+	err = suite.db.NewPublication(&models.Publication{Source: models.PublishTag, SourceID: "bogus"}, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	err = suite.db.NewPublication(&models.Publication{Source: models.PublishCategory}, &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	err = suite.db.NewPublication(&models.Publication{Source: "feed"}, &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	suite.Len(suite.db.Publications(&suite.user), 3)
+
+	found, owner, err := suite.db.PublicationWithToken(pub.Token)
+	suite.Require().Nil(err)
+	suite.Equal(pub.UUID, found.UUID)
+	suite.Equal(suite.user.UUID, owner.UUID)
+
+	_, _, err = suite.db.PublicationWithToken("")
+	suite.IsType(NotFound{}, err)
+
+	err = suite.db.NewUser("other", "golang123")
+	suite.Require().Nil(err)
+
+	other, err := suite.db.UserWithName("other")
+	suite.Require().Nil(err)
+
+	_, err = suite.db.Publication(pub.UUID, &other)
+	suite.IsType(NotFound{}, err)
+
+	err = suite.db.DeletePublication(pub.UUID, &other)
+	suite.IsType(NotFound{}, err)
+
+	err = suite.db.DeletePublication(pub.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	_, _, err = suite.db.PublicationWithToken(pub.Token)
+	suite.IsType(NotFound{}, err)
+
+	err = suite.db.DeleteUser(suite.user.UUID)
+	suite.Require().Nil(err)
+
+	_, _, err = suite.db.PublicationWithToken(saved.Token)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestQueryEntriesWithTag() {
+	feed := models.Feed{Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	tag := models.Tag{Name: "Reading"}
+	err = suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
+
+	var entries []models.Entry
+	for i := 0; i < 3; i++ {
+		entry := models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			Feed:  feed,
+			Mark:  models.Unread,
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+
+		entries = append(entries, entry)
+	}
+
+	err = suite.db.TagEntries(tag.UUID, []string{entries[0].UUID, entries[2].UUID}, &suite.user)
+	suite.Require().Nil(err)
+
+	found, err := suite.db.QueryEntries(EntryQuery{TagID: tag.UUID}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(found, 2)
+	suite.Equal(entries[2].UUID, found[0].UUID)
+	suite.Equal("Item 0", found[1].Title)
+
+	_, err = suite.db.QueryEntries(EntryQuery{TagID: "bogus"}, &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestInvites() {
+	invite := models.Invite{MaxUses: 2}
+	err := suite.db.NewInvite(&invite)
+	suite.Require().Nil(err)
+	suite.NotEmpty(invite.UUID)
+	suite.NotEmpty(invite.Code)
+	suite.WithinDuration(time.Now().Add(DefaultInviteExpiration), invite.ExpiresAt, time.Minute)
+
+	// Failed registrations do not use up the invite
+	err = suite.db.NewUserWithInvite("test", "password123", invite.Code)
+	suite.IsType(Conflict{}, err)
+
+	err = suite.db.NewUserWithInvite("first", "password123", invite.Code)
+	suite.Require().Nil(err)
+
+	err = suite.db.NewUserWithInvite("second", "password123", invite.Code)
+	suite.Require().Nil(err)
+
+	err = suite.db.NewUserWithInvite("third", "password123", invite.Code)
+	suite.IsType(Unauthorized{}, err)
+
+	err = suite.db.NewUserWithInvite("third", "password123", "bogus")
+	suite.IsType(Unauthorized{}, err)
+
+	_, err = suite.db.UserWithName("second")
+	suite.Nil(err)
+
+	invites := suite.db.Invites()
+	suite.Require().Len(invites, 1)
+	suite.Equal(2, invites[0].Uses)
+
+	err = suite.db.DeleteInvite(invite.UUID)
+	suite.Require().Nil(err)
+	suite.Empty(suite.db.Invites())
+
+	err = suite.db.DeleteInvite(invite.UUID)
+	suite.IsType(NotFound{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestExpiredInvite() {
+	invite := models.Invite{ExpiresAt: time.Now().Add(-time.Hour)}
+	err := suite.db.NewInvite(&invite)
+	suite.IsType(BadRequest{}, err)
+
+	invite = models.Invite{MaxUses: -1}
+	err = suite.db.NewInvite(&invite)
+	suite.IsType(BadRequest{}, err)
+}
+
+func (suite *DatabaseTestSuite) TestKeyDoesNotBelongToUser() {
+	key := models.APIKey{
+		Key: "123456789",
+	}
+
+	found, err := suite.db.KeyBelongsToUser(&key, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(found)
+}
+
+func (suite *DatabaseTestSuite) TestEvents() {
+	sub, _, _ := suite.db.Events().Subscribe(suite.user.ID, 0)
+	defer suite.db.Events().Unsubscribe(sub)
+
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	event := <-sub.C
+	suite.Equal(events.FeedAdded, event.Type)
+	suite.Equal(feed.UUID, event.Data.Feed)
+
+	_, err = suite.db.NewEntries([]models.Entry{{Title: "Item", GUID: "item"}}, feed, &suite.user)
+	suite.Require().Nil(err)
+
+	event = <-sub.C
+	suite.Equal(events.EntriesNew, event.Type)
+	suite.Equal(1, event.Data.NewEntries)
+
+	entries, err := suite.db.EntriesFromFeed(feed.UUID, true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 1)
+
+	err = suite.db.MarkEntry(entries[0].UUID, models.Read, &suite.user)
+	suite.Require().Nil(err)
+
+	event = <-sub.C
+	suite.Equal(events.EntriesMarked, event.Type)
+	suite.Equal([]string{entries[0].UUID}, event.Data.Entries)
+	suite.Equal("read", event.Data.Marker)
+
+	err = suite.db.SaveEntry(entries[0].UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	event = <-sub.C
+	suite.Equal(events.EntriesSaved, event.Type)
+
+	err = suite.db.DeleteFeed(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	event = <-sub.C
+	suite.Equal(events.FeedDeleted, event.Type)
+	suite.Equal(feed.UUID, event.Data.Feed)
+}
+
+func (suite *DatabaseTestSuite) TestWebhooks() {
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.NewWebhook(&models.Webhook{URL: "ftp://example.com"}, &suite.user)
+	suite.IsType(BadRequest{}, err)
+
+	for _, url := range []string{"http://localhost/hook", "http://127.0.0.1:8080", "http://[::1]/hook", "http://169.254.169.254", "https://10.1.2.3"} {
+		err = suite.db.NewWebhook(&models.Webhook{URL: url}, &suite.user)
+		suite.IsType(BadRequest{}, err, url)
+	}
+
+	err = suite.db.NewWebhook(&models.Webhook{URL: "http://example.com", FeedID: "bogus"}, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	hook := models.Webhook{URL: "http://example.com/hook", FeedID: feed.UUID, Keyword: " golang ", LastStatus: 200}
+	err = suite.db.NewWebhook(&hook, &suite.user)
+	suite.Require().Nil(err)
+	suite.NotEmpty(hook.UUID)
+	suite.Len(hook.Secret, WebhookSecretBytes*2)
+	suite.Equal("golang", hook.Keyword)
+	suite.Zero(hook.LastStatus)
+
+	hooks := suite.db.Webhooks(&suite.user)
+	suite.Require().Len(hooks, 1)
+	suite.Equal(hook.UUID, hooks[0].UUID)
+	suite.Equal(feed.UUID, hooks[0].FeedID)
+
+	for i := 0; i < WebhookDeliveryLogSize+2; i++ {
+		delivery := models.WebhookDelivery{Event: models.WebhookPing, Attempts: 1, Status: 500 + i}
+		err = suite.db.NewWebhookDelivery(&delivery, &hook)
+		suite.Require().Nil(err)
+
+		err = suite.db.UpdateWebhookDelivery(&delivery)
+		suite.Require().Nil(err)
+	}
+
+	deliveries, err := suite.db.WebhookDeliveries(hook.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(deliveries, WebhookDeliveryLogSize)
+	suite.Equal(500+WebhookDeliveryLogSize+1, deliveries[0].Status)
+	suite.Equal(502, deliveries[len(deliveries)-1].Status)
+
+	found, err := suite.db.Webhook(hook.UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal(500+WebhookDeliveryLogSize+1, found.LastStatus)
+	suite.NotNil(found.LastDeliveredAt)
+
+	err = suite.db.DeleteWebhook(hook.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.Webhook(hook.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	_, err = suite.db.WebhookDeliveries(hook.UUID, &suite.user)
+	suite.IsType(NotFound{}, err)
+
+	// Deliveries in progress are not saved again once deleted
+	deliveries[0].Attempts++
+	err = suite.db.UpdateWebhookDelivery(&deliveries[0])
+	suite.IsType(NotFound{}, err)
+
+	if db, ok := suite.db.(*DB); ok {
+		count := -1
+		db.db.Model(&models.WebhookDelivery{}).Count(&count)
+		suite.Zero(count)
+	}
+}
+
+func (suite *DatabaseTestSuite) TestEntriesWithGUIDs() {
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	_, err = suite.db.NewEntries([]models.Entry{
+		{Title: "First", GUID: "1"},
+		{Title: "Second", GUID: "2"},
+	}, feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err := suite.db.EntriesWithGUIDs(feed.UUID, []string{"2", "3"}, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 1)
+	suite.Equal("Second", entries[0].Title)
+	suite.NotEmpty(entries[0].UUID)
+
+	_, err = suite.db.EntriesWithGUIDs("bogus", []string{"1"}, &suite.user)
+	suite.IsType(NotFound{}, err)
+}
+
+func TestNewDB(t *testing.T) {
+	_, err := NewDB("sqlite3", TestDatabasePath)
+	assert.Nil(t, err)
+	err = os.Remove(TestDatabasePath)
+	assert.Nil(t, err)
+}
+
+func TestMigrateSharedFeeds(t *testing.T) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(t, err)
+	defer os.Remove(TestDatabasePath)
+	defer db.Close()
+
+	for _, stmt := range []string{
+		"ALTER TABLE feeds ADD COLUMN subscription varchar(255)",
+		"ALTER TABLE feeds ADD COLUMN description varchar(255)",
+		"ALTER TABLE feeds ADD COLUMN source varchar(255)",
+		"ALTER TABLE feeds ADD COLUMN ttl integer",
+		"ALTER TABLE feeds ADD COLUMN etag varchar(255)",
+		"ALTER TABLE feeds ADD COLUMN last_updated datetime",
+		"ALTER TABLE feeds ADD COLUMN status varchar(255)",
+		"ALTER TABLE entries ADD COLUMN guid varchar(255)",
+		"ALTER TABLE entries ADD COLUMN title varchar(255)",
+		"ALTER TABLE entries ADD COLUMN link varchar(255)",
+		"ALTER TABLE entries ADD COLUMN description varchar(255)",
+		"ALTER TABLE entries ADD COLUMN author varchar(255)",
+		"ALTER TABLE entries ADD COLUMN published datetime",
+	} {
+		require.Nil(t, db.db.Exec(stmt).Error)
+	}
+
+	var users []models.User
+	for _, name := range []string{"first", "second"} {
+		require.Nil(t, db.NewUser(name, "golang123"))
+		user, err := db.UserWithName(name)
+		require.Nil(t, err)
+		users = append(users, user)
+	}
+
+	now := time.Now()
+	for i, user := range users {
+		feedUUID := fmt.Sprintf("feed-%d", i)
+		err = db.db.Exec("INSERT INTO feeds (uuid, title, subscription, description, source, ttl, etag, "+
+			"last_updated, status, user_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			feedUUID, "News", "http://example.com", "All the news", "http://example.com/news",
+			0, "", now, "", user.ID).Error
+		require.Nil(t, err)
+
+		feed := models.Feed{}
+		require.Nil(t, db.db.Where("uuid = ?", feedUUID).First(&feed).Error)
+
+		err = db.db.Exec("INSERT INTO entries (uuid, guid, title, link, description, author, published, "+
+			"mark, saved, user_id, feed_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			fmt.Sprintf("entry-%d", i), "item", "Item", "http://example.com/item", "", "",
+			now, models.Unread, false, user.ID, feed.ID).Error
+		require.Nil(t, err)
+	}
+
+	err = db.migrateSharedFeeds()
+	require.Nil(t, err)
+
+	count := 0
+	db.db.Model(&models.SharedFeed{}).Count(&count)
+	assert.Equal(t, 1, count)
+
+	count = 0
+	db.db.Model(&models.Item{}).Count(&count)
+	assert.Equal(t, 1, count)
+
+	for i, user := range users {
+		feed, err := db.Feed(fmt.Sprintf("feed-%d", i), &user)
+		require.Nil(t, err)
+		assert.Equal(t, "News", feed.Title)
+		assert.Equal(t, "http://example.com", feed.Subscription)
+		assert.Equal(t, "All the news", feed.Description)
+
+		entry, err := db.Entry(fmt.Sprintf("entry-%d", i), &user)
+		require.Nil(t, err)
+		assert.Equal(t, "item", entry.GUID)
+		assert.Equal(t, "Item", entry.Title)
+		assert.Equal(t, "http://example.com/item", entry.Link)
+	}
+
+	count = 0
+	db.db.Table("feeds").Where("subscription IS NOT NULL").Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestMigrateAPIKeyExpiry(t *testing.T) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(t, err)
+	defer os.Remove(TestDatabasePath)
+	defer db.Close()
+
+	require.Nil(t, db.NewUser("test", "golang123"))
+	user, err := db.UserWithName("test")
+	require.Nil(t, err)
+
+	created := time.Now().Add(-time.Hour)
+	for i, uuid := range []string{"recent", "old"} {
+		err = db.db.Exec("INSERT INTO api_keys (uuid, hash, created_at, user_id) VALUES (?, ?, ?, ?)",
+			uuid, hashRefreshToken(uuid), created.Add(-legacyAPIKeyExpiration*time.Duration(i)), user.ID).Error
+		require.Nil(t, err)
+	}
+
+	err = db.migrateAPIKeyExpiry()
+	require.Nil(t, err)
+
+	found, err := db.KeyBelongsToUser(&models.APIKey{Key: "recent"}, &user)
+	require.Nil(t, err)
+	assert.True(t, found)
+
+	found, err = db.KeyBelongsToUser(&models.APIKey{Key: "old"}, &user)
+	require.Nil(t, err)
+	assert.False(t, found)
+
+	err = db.DeleteExpiredAPIKeys()
+	require.Nil(t, err)
+
+	count := 0
+	db.db.Model(&models.APIKey{}).Count(&count)
+	assert.Equal(t, 1, count)
+}
+
+func TestMigrateAPIKeyHashes(t *testing.T) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(t, err)
+	defer os.Remove(TestDatabasePath)
+	defer db.Close()
+
+	require.Nil(t, db.NewUser("test", "golang123"))
+	user, err := db.UserWithName("test")
+	require.Nil(t, err)
+
+	// Older versions stored keys in plain text
+	require.Nil(t, db.db.Exec("ALTER TABLE api_keys ADD COLUMN key varchar(255)").Error)
+	err = db.db.Exec("INSERT INTO api_keys (uuid, key, expires_at, user_id) VALUES (?, ?, ?, ?)",
+		"legacy", "token", time.Now().Add(time.Hour), user.ID).Error
+	require.Nil(t, err)
+
+	err = db.migrateAPIKeyHashes()
+	require.Nil(t, err)
+
+	found, err := db.KeyBelongsToUser(&models.APIKey{Key: "token"}, &user)
+	require.Nil(t, err)
+	assert.True(t, found)
+
+	count := 0
+	db.db.Table("api_keys").Where("key = ?", "token").Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestNewDBWithOptions(t *testing.T) {
+	opts := DefaultOptions
+	opts.MaxOpenConns = 4
+	opts.SQLiteWAL = true
+	opts.SQLiteBusyTimeout = time.Second
+
+	db, err := NewDBWithOptions("sqlite3", TestDatabasePath, opts)
+	require.Nil(t, err)
+	defer os.Remove(TestDatabasePath + "-shm")
+	defer os.Remove(TestDatabasePath + "-wal")
+	defer os.Remove(TestDatabasePath)
+	defer db.Close()
+
+	assert.Nil(t, db.Ping())
+	assert.Equal(t, 4, db.db.DB().Stats().MaxOpenConnections)
+
+	var journalMode string
+	require.Nil(t, db.db.Raw("PRAGMA journal_mode").Row().Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+
+	var busyTimeout int
+	require.Nil(t, db.db.Raw("PRAGMA busy_timeout").Row().Scan(&busyTimeout))
+	assert.Equal(t, 1000, busyTimeout)
+
+	var foreignKeys bool
+	require.Nil(t, db.db.Raw("PRAGMA foreign_keys").Row().Scan(&foreignKeys))
+	assert.True(t, foreignKeys)
+}
+
+func TestNewDBRetriesConnecting(t *testing.T) {
+	opts := DefaultOptions
+	opts.ConnectRetries = 2
+	opts.ConnectBackoff = 10 * time.Millisecond
+
+	start := time.Now()
+	_, err := NewDBWithOptions("sqlite3", "/nonexistent/syndication.db", opts)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+}
+
+func TestNewDBWithBadOptions(t *testing.T) {
+	_, err := NewDB("bogus", TestDatabasePath)
+	assert.NotNil(t, err)
+}
+
+func TestNewUser(t *testing.T) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(t, err)
+
+	err = db.NewUser("test", "golang123")
+	assert.Nil(t, err)
+
+	user, err := db.UserWithName("test")
+	assert.Nil(t, err)
+	assert.NotZero(t, user.ID)
+
+	err = os.Remove(TestDatabasePath)
+	assert.Nil(t, err)
+}
+
+func TestLegacyPasswordHash(t *testing.T) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(t, err)
+	defer os.Remove(TestDatabasePath)
+
+	err = db.NewUser("test", "golang123")
+	require.Nil(t, err)
+
+	// Hashes made before parameters were stored
+	err = db.db.Model(&models.User{}).Where("username = ?", "test").UpdateColumn("password_params", "").Error
+	require.Nil(t, err)
+
+	user, err := db.Authenticate("test", "golang123")
+	require.Nil(t, err)
+	assert.Empty(t, user.PasswordParams)
+
+	db.PasswordHashing.N = 1 << 15
+	user, err = db.Authenticate("test", "golang123")
+	require.Nil(t, err)
+	assert.Equal(t, "scrypt$n=32768,r=8,p=1", user.PasswordParams)
+
+	_, err = db.Authenticate("test", "golang123")
+	assert.Nil(t, err)
+}
+
+func TestHashParams(t *testing.T) {
+	for _, params := range []HashParams{LegacyHashParams, DefaultArgon2idParams} {
+		parsed, err := parseHashParams(params.String())
+		require.Nil(t, err)
+		assert.Equal(t, params, parsed)
+	}
+
+	parsed, err := parseHashParams("")
+	require.Nil(t, err)
+	assert.Equal(t, LegacyHashParams, parsed)
+
+	for _, encoded := range []string{"bcrypt$cost=10", "scrypt", "scrypt$n=many", "argon2id$v=16,m=1,t=1,p=1"} {
+		_, err = parseHashParams(encoded)
+		assert.NotNil(t, err, encoded)
+	}
+
+	assert.True(t, LegacyHashParams.weakerThan(DefaultArgon2idParams))
+	assert.False(t, DefaultArgon2idParams.weakerThan(LegacyHashParams))
+	assert.False(t, LegacyHashParams.weakerThan(LegacyHashParams))
+	assert.True(t, LegacyHashParams.weakerThan(HashParams{Algorithm: Scrypt, N: 1 << 15, R: 8, P: 1}))
+}
+
+func TestUsers(t *testing.T) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(t, err)
+
+	err = db.NewUser("test_one", "golang123")
+	assert.Nil(t, err)
+
+	err = db.NewUser("test_two", "password")
+	assert.Nil(t, err)
+
+	users := db.Users()
+	assert.Len(t, users, 2)
+
+	err = os.Remove(TestDatabasePath)
+	assert.Nil(t, err)
+}
+
+func TestUsersWithFields(t *testing.T) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(t, err)
+
+	err = db.NewUser("test_one", "golang123")
 	assert.Nil(t, err)
 
 	err = db.NewUser("test_two", "password")
@@ -1060,7 +3643,7 @@ func TestNewConflictingUsers(t *testing.T) {
 	db, err := NewDB("sqlite3", TestDatabasePath)
 	require.Nil(t, err)
 
-	err = db.NewUser("test", "golang")
+	err = db.NewUser("test", "golang123")
 	assert.Nil(t, err)
 
 	err = db.NewUser("test", "password")
@@ -1074,14 +3657,14 @@ func TestSuccessfulAuthentication(t *testing.T) {
 	db, err := NewDB("sqlite3", TestDatabasePath)
 	require.Nil(t, err)
 
-	err = db.NewUser("test", "golang")
+	err = db.NewUser("test", "golang123")
 	assert.Nil(t, err)
 
 	user, err := db.UserWithName("test")
 	assert.Nil(t, err)
 	assert.NotZero(t, user.ID)
 
-	user, err = db.Authenticate("test", "golang")
+	user, err = db.Authenticate("test", "golang123")
 	assert.Nil(t, err)
 	assert.NotZero(t, user.ID)
 
@@ -1093,7 +3676,7 @@ func TestBadPasswordAuthentication(t *testing.T) {
 	db, err := NewDB("sqlite3", TestDatabasePath)
 	require.Nil(t, err)
 
-	err = db.NewUser("test", "golang")
+	err = db.NewUser("test", "golang123")
 	assert.Nil(t, err)
 
 	user, err := db.UserWithName("test")
@@ -1111,13 +3694,97 @@ func TestBadUserAuthentication(t *testing.T) {
 	db, err := NewDB("sqlite3", TestDatabasePath)
 	require.Nil(t, err)
 
-	_, err = db.Authenticate("test", "golang")
-	assert.IsType(t, NotFound{}, err)
+	_, err = db.Authenticate("test", "golang123")
+	assert.IsType(t, Unauthorized{}, err)
+	assert.Equal(t, "Invalid credentials", err.Error())
 
 	err = os.Remove(TestDatabasePath)
 	assert.Nil(t, err)
 }
 
+func benchmarkEntries(count int) []models.Entry {
+	entries := make([]models.Entry, count)
+	for i := range entries {
+		entries[i] = models.Entry{
+			Title:       "Item " + strconv.Itoa(i),
+			Link:        "http://example.com/" + strconv.Itoa(i),
+			Description: "A benchmark item",
+			GUID:        "item-" + strconv.Itoa(i),
+			Mark:        models.Unread,
+		}
+	}
+	return entries
+}
+
+func benchmarkNewEntries(b *testing.B, count int) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(b, err)
+	defer os.Remove(TestDatabasePath)
+	defer db.Close()
+
+	require.Nil(b, db.NewUser("test", "golang123"))
+	user, err := db.UserWithName("test")
+	require.Nil(b, err)
+
+	entries := benchmarkEntries(count)
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		feed := models.Feed{Subscription: "http://example.com/" + strconv.Itoa(i)}
+		require.Nil(b, db.NewFeed(&feed, &user))
+		_, err := db.NewEntries(entries, feed, &user)
+		require.Nil(b, err)
+	}
+
+	b.ReportMetric(float64(count*b.N)/time.Since(start).Seconds(), "entries/s")
+}
+
+func BenchmarkNewEntries1000(b *testing.B) { benchmarkNewEntries(b, 1000) }
+func BenchmarkNewEntries5000(b *testing.B) { benchmarkNewEntries(b, 5000) }
+
+func BenchmarkExistingEntryGUIDs(b *testing.B) {
+	db, err := NewDB("sqlite3", TestDatabasePath)
+	require.Nil(b, err)
+	defer os.Remove(TestDatabasePath)
+	defer db.Close()
+
+	require.Nil(b, db.NewUser("test", "golang123"))
+	user, err := db.UserWithName("test")
+	require.Nil(b, err)
+
+	feed := models.Feed{Subscription: "http://example.com"}
+	require.Nil(b, db.NewFeed(&feed, &user))
+
+	entries := benchmarkEntries(5000)
+	_, err = db.NewEntries(entries, feed, &user)
+	require.Nil(b, err)
+
+	guids := make([]string, len(entries))
+	for i, entry := range entries {
+		guids[i] = entry.GUID
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		existing, err := db.ExistingEntryGUIDs(feed.UUID, guids, &user)
+		require.Nil(b, err)
+		require.Len(b, existing, len(guids))
+	}
+}
+
 func TestDatabaseTestSuite(t *testing.T) {
-	suite.Run(t, new(DatabaseTestSuite))
+	suite.Run(t, &DatabaseTestSuite{
+		newStore: func() (Store, error) {
+			return NewDB("sqlite3", TestDatabasePath)
+		},
+	})
+}
+
+func TestMemoryDatabaseTestSuite(t *testing.T) {
+	suite.Run(t, &DatabaseTestSuite{
+		newStore: func() (Store, error) {
+			return NewMemoryDB(), nil
+		},
+	})
 }
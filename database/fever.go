@@ -0,0 +1,131 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// FeverKey returns the API key Fever clients send for username and
+// password, the hex encoded MD5 of "username:password"
+func FeverKey(username, password string) string {
+	sum := md5.Sum([]byte(username + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetFeverPassword lets user log in to the Fever API with password.
+// Fever keys are plain MD5 hashes so password must be different
+// from the account's password.
+func (db *DB) SetFeverPassword(password string, user *models.User) error {
+	found := models.User{}
+	if db.db.First(&found, user.ID).RecordNotFound() {
+		return NotFound{"User does not exist"}
+	}
+
+	if err := db.PasswordPolicy.check(password); err != nil {
+		return err
+	}
+
+	if checkPassword(&found, password) == nil {
+		return BadRequest{"Fever password should differ from the account password"}
+	}
+
+	key := FeverKey(found.Username, password)
+	if err := db.db.Model(&found).UpdateColumn("fever_key", key).Error; err != nil {
+		return err
+	}
+
+	user.FeverKey = key
+	return nil
+}
+
+// DisableFever stops user from logging in to the Fever API
+func (db *DB) DisableFever(user *models.User) error {
+	found := models.User{}
+	if db.db.First(&found, user.ID).RecordNotFound() {
+		return NotFound{"User does not exist"}
+	}
+
+	user.FeverKey = ""
+	return db.db.Model(&found).UpdateColumn("fever_key", "").Error
+}
+
+// UserWithFeverKey returns the User who logs in to the Fever API with key
+func (db *DB) UserWithFeverKey(key string) (user models.User, err error) {
+	key = strings.ToLower(key)
+	if key == "" || db.db.First(&user, "fever_key = ?", key).RecordNotFound() {
+		err = Unauthorized{"Invalid Fever API key"}
+	}
+	return
+}
+
+// EntryPage returns up to limit Entries owned by user, identified by their
+// primary key. Entries after sinceID are returned oldest first, while
+// those before maxID are returned newest first.
+func (db *DB) EntryPage(sinceID, maxID uint, limit int, user *models.User) (entries []models.Entry) {
+	query := db.db.Where("user_id = ?", user.ID).Limit(limit)
+	if sinceID > 0 {
+		query = query.Where("id > ?", sinceID)
+	}
+
+	if maxID > 0 {
+		query = query.Where("id < ?", maxID).Order("id DESC")
+	} else {
+		query = query.Order("id ASC")
+	}
+
+	query.Find(&entries)
+	db.loadEntryItems(entries)
+	return
+}
+
+// EntriesWithPrimaryKeys returns the Entries owned by user with ids
+func (db *DB) EntriesWithPrimaryKeys(ids []uint, user *models.User) (entries []models.Entry) {
+	if len(ids) == 0 {
+		return
+	}
+
+	for _, chunk := range chunkIDs(ids) {
+		var found []models.Entry
+		db.db.Where("user_id = ? AND id in (?)", user.ID, chunk).Order("id ASC").Find(&found)
+		entries = append(entries, found...)
+	}
+
+	db.loadEntryItems(entries)
+	return
+}
+
+// EntryPrimaryKeys returns the primary keys of every Entry owned by user
+// that is marked with marker, and saved if saved is set
+func (db *DB) EntryPrimaryKeys(marker models.Marker, saved bool, user *models.User) (ids []uint) {
+	query := db.db.Model(&models.Entry{}).Where("user_id = ?", user.ID)
+	if marker != models.Any {
+		query = query.Where("mark = ?", marker)
+	}
+
+	if saved {
+		query = query.Where("saved = ?", true)
+	}
+
+	query.Order("id ASC").Pluck("id", &ids)
+	return
+}
@@ -0,0 +1,159 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"time"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// LockoutPolicy decides when failed logins lock out an account or an IP address
+type LockoutPolicy struct {
+	// AccountAttempts and IPAttempts are how many failures are
+	// allowed before locking out, zero disables the limit
+	AccountAttempts int
+	IPAttempts      int
+
+	// Backoff is how long the first lockout lasts. Every further
+	// failure doubles it, up to MaxBackoff. Failures are forgotten
+	// once MaxBackoff passes without a new one.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultLockoutPolicy is the LockoutPolicy used by NewDB
+var DefaultLockoutPolicy = LockoutPolicy{
+	AccountAttempts: 5,
+	IPAttempts:      20,
+	Backoff:         time.Minute,
+	MaxBackoff:      time.Hour,
+}
+
+// attempts returns how many failures are allowed for kind
+func (p LockoutPolicy) attempts(kind string) int {
+	if kind == models.LockoutIP {
+		return p.IPAttempts
+	}
+	return p.AccountAttempts
+}
+
+// fail records a failure at now in lockout and locks it if needed
+func (p LockoutPolicy) fail(lockout *models.Lockout, now time.Time) {
+	if lockout.LastFailureAt.Add(p.MaxBackoff).Before(now) {
+		lockout.Failures = 0
+	}
+
+	lockout.Failures++
+	lockout.LastFailureAt = now
+
+	attempts := p.attempts(lockout.Kind)
+	if attempts == 0 || lockout.Failures < attempts {
+		return
+	}
+
+	backoff := p.Backoff
+	for i := attempts; i < lockout.Failures && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	lockout.LockedUntil = now.Add(backoff)
+}
+
+// loginSubjects returns the kind and subject of the Lockouts a login
+// attempt for username from ip counts against. Attempts without a
+// username, such as with a Fever key, only count against ip.
+func loginSubjects(username, ip string) map[string]string {
+	subjects := map[string]string{models.LockoutIP: ip}
+	if username != "" {
+		subjects[models.LockoutAccount] = username
+	}
+	return subjects
+}
+
+// LockedOut returns when logging in as username from ip will be allowed
+// again, and false if it is allowed now
+func (db *DB) LockedOut(username, ip string) (until time.Time, locked bool) {
+	for kind, subject := range loginSubjects(username, ip) {
+		lockout := models.Lockout{}
+		if db.db.Where("kind = ? AND subject = ? AND locked_until > ?", kind, subject, time.Now()).
+			First(&lockout).RecordNotFound() {
+			continue
+		}
+
+		if lockout.LockedUntil.After(until) {
+			until = lockout.LockedUntil
+			locked = true
+		}
+	}
+	return
+}
+
+// RecordLoginFailure counts a failed login as username from ip
+// against both the account and the IP address
+func (db *DB) RecordLoginFailure(username, ip string) error {
+	now := time.Now()
+
+	tx := db.db.Begin()
+	for kind, subject := range loginSubjects(username, ip) {
+		lockout := models.Lockout{}
+		tx.Where(models.Lockout{Kind: kind, Subject: subject}).FirstOrInit(&lockout)
+
+		db.LockoutPolicy.fail(&lockout, now)
+		if err := tx.Save(&lockout).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// ClearLoginFailures forgets the failed logins of username after it logs in
+func (db *DB) ClearLoginFailures(username string) error {
+	return db.db.Where("kind = ? AND subject = ?", models.LockoutAccount, username).
+		Delete(&models.Lockout{}).Error
+}
+
+// Lockouts returns every account and IP address with recent failed logins
+func (db *DB) Lockouts() (lockouts []models.Lockout) {
+	db.db.Where("last_failure_at > ?", time.Now().Add(-db.LockoutPolicy.MaxBackoff)).
+		Order("last_failure_at DESC").
+		Find(&lockouts)
+	return
+}
+
+// DeleteExpiredLockouts permanently deletes the failed logins that are
+// forgotten, having had no new failure for MaxBackoff
+func (db *DB) DeleteExpiredLockouts() error {
+	return db.db.Where("last_failure_at <= ?", time.Now().Add(-db.LockoutPolicy.MaxBackoff)).
+		Delete(&models.Lockout{}).Error
+}
+
+// ClearLockout forgets the failed logins of an account or IP address
+func (db *DB) ClearLockout(kind, subject string) error {
+	lockout := models.Lockout{}
+	if db.db.Where("kind = ? AND subject = ?", kind, subject).First(&lockout).RecordNotFound() {
+		return NotFound{"Lockout does not exist"}
+	}
+
+	return db.db.Delete(&lockout).Error
+}
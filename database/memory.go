@@ -0,0 +1,3080 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/chavamee/syndication/events"
+	"github.com/chavamee/syndication/models"
+)
+
+// MemoryDB is a Store that keeps every object in memory.
+// It behaves like DB but nothing outlives the process, which makes
+// it suitable for tests and for embedding syndication.
+type MemoryDB struct {
+	TrashRetention         time.Duration
+	APIKeyExpiration       time.Duration
+	RefreshTokenExpiration time.Duration
+	LockoutPolicy          LockoutPolicy
+	PasswordPolicy         PasswordPolicy
+	PasswordHashing        HashParams
+	AllowPrivateWebhooks   bool
+
+	lock          sync.RWMutex
+	lastID        uint
+	users         []*models.User
+	apiKeys       []*models.APIKey
+	refreshTokens []*models.RefreshToken
+	categories    []*models.Category
+	feeds         []*models.Feed
+	entries       []*models.Entry
+	tags          []*models.Tag
+	lockouts      []*models.Lockout
+	invites       []*models.Invite
+
+	recoveryCodes   []*models.RecoveryCode
+	loginChallenges []*models.LoginChallenge
+	publications    []*models.Publication
+
+	webhooks          []*models.Webhook
+	webhookDeliveries []*models.WebhookDelivery
+
+	// entryTags maps a tag's ID to the IDs of the entries tagged with it
+	entryTags map[uint]map[uint]bool
+
+	events *events.Bus
+}
+
+// NewMemoryDB creates a new, empty MemoryDB instance
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		TrashRetention:         DefaultTrashRetention,
+		APIKeyExpiration:       DefaultAPIKeyExpiration,
+		RefreshTokenExpiration: DefaultRefreshTokenExpiration,
+		LockoutPolicy:          DefaultLockoutPolicy,
+		PasswordPolicy:         DefaultPasswordPolicy,
+		PasswordHashing:        DefaultPasswordHashing,
+		entryTags:              map[uint]map[uint]bool{},
+		events:                 events.NewBus(),
+	}
+}
+
+// Close is a no-op for MemoryDB
+func (m *MemoryDB) Close() error {
+	return nil
+}
+
+// Ping always succeeds for MemoryDB
+func (m *MemoryDB) Ping() error {
+	return nil
+}
+
+// Events returns the Bus that changes to the data of users are published on
+func (m *MemoryDB) Events() *events.Bus {
+	return m.events
+}
+
+func (m *MemoryDB) nextID() uint {
+	m.lastID++
+	return m.lastID
+}
+
+func matchesMarker(entry *models.Entry, marker models.Marker) bool {
+	return marker == models.Any || entry.Mark == marker
+}
+
+func entryValues(entries []*models.Entry) []models.Entry {
+	values := make([]models.Entry, len(entries))
+	for i, entry := range entries {
+		values[i] = *entry
+	}
+	return values
+}
+
+func sortedEntryValues(entries []*models.Entry, orderByDesc bool) []models.Entry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if orderByDesc {
+			return entries[i].CreatedAt.After(entries[j].CreatedAt)
+		}
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entryValues(entries)
+}
+
+func entryStatsOf(entries []*models.Entry) (stats models.Stats) {
+	for _, entry := range entries {
+		switch entry.Mark {
+		case models.Unread:
+			stats.Unread++
+		case models.Read:
+			stats.Read++
+		}
+
+		if entry.Saved {
+			stats.Saved++
+		}
+
+		stats.Total++
+	}
+	return
+}
+
+func (m *MemoryDB) userWith(match func(*models.User) bool) *models.User {
+	for _, user := range m.users {
+		if match(user) {
+			return user
+		}
+	}
+	return nil
+}
+
+// NewUser creates a new User object.
+// The password must follow PasswordPolicy.
+func (m *MemoryDB) NewUser(username, password string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.newUser(username, password)
+}
+
+func (m *MemoryDB) newUser(username, password string) error {
+	if err := m.PasswordPolicy.checkCredentials(username, password); err != nil {
+		return err
+	}
+
+	if m.userWith(func(u *models.User) bool { return u.Username == username }) != nil {
+		return Conflict{"User already exists"}
+	}
+
+	now := time.Now()
+	user := &models.User{
+		ID:        m.nextID(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		UUID:      uuid.NewV4().String(),
+		Username:  username,
+		Role:      models.RoleUser,
+	}
+
+	if err := setPassword(user, password, m.PasswordHashing); err != nil {
+		return err
+	}
+
+	// Construct the user system categories
+	unctg := m.newCategory(models.Uncategorized, user)
+	user.UncategorizedCategoryUUID = unctg.UUID
+
+	saved := m.newCategory("Saved", user)
+	user.SavedCategoryUUID = saved.UUID
+
+	m.users = append(m.users, user)
+	return nil
+}
+
+// DeleteUser permanently deletes a User object along with
+// all of its Categories, Feeds, Entries, Tags and APIKeys
+func (m *MemoryDB) DeleteUser(userID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user := m.userWith(func(u *models.User) bool { return u.UUID == userID })
+	if user == nil {
+		return BadRequest{"User does not exists"}
+	}
+
+	m.removeEntries(func(e *models.Entry) bool { return e.UserID == user.ID })
+
+	var feeds []*models.Feed
+	for _, feed := range m.feeds {
+		if feed.UserID != user.ID {
+			feeds = append(feeds, feed)
+		}
+	}
+	m.feeds = feeds
+
+	var categories []*models.Category
+	for _, ctg := range m.categories {
+		if ctg.UserID != user.ID {
+			categories = append(categories, ctg)
+		}
+	}
+	m.categories = categories
+
+	var tags []*models.Tag
+	for _, tag := range m.tags {
+		if tag.UserID != user.ID {
+			tags = append(tags, tag)
+		} else {
+			delete(m.entryTags, tag.ID)
+		}
+	}
+	m.tags = tags
+
+	m.removeAPIKeys(func(k *models.APIKey) bool { return k.UserID == user.ID })
+	m.removeRefreshTokens(func(t *models.RefreshToken) bool { return t.UserID == user.ID })
+	m.removeRecoveryCodes(func(c *models.RecoveryCode) bool { return c.UserID == user.ID })
+	m.removeLoginChallenges(func(c *models.LoginChallenge) bool { return c.UserID == user.ID })
+	m.removePublications(func(p *models.Publication) bool { return p.UserID == user.ID })
+	m.removeWebhooks(func(h *models.Webhook) bool { return h.UserID == user.ID })
+
+	var users []*models.User
+	for _, u := range m.users {
+		if u != user {
+			users = append(users, u)
+		}
+	}
+	m.users = users
+
+	return nil
+}
+
+// ChangeUserName for user with userID
+func (m *MemoryDB) ChangeUserName(userID, newName string) error {
+	if err := checkUsername(newName); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user := m.userWith(func(u *models.User) bool { return u.UUID == userID })
+	if user == nil {
+		return BadRequest{"User does not exists"}
+	}
+
+	// The Fever key hashes the username, so it must be set again
+	user.Username = newName
+	user.FeverKey = ""
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+// EditUser applies changes to the profile of the User with userID
+// and returns the edited User
+func (m *MemoryDB) EditUser(userID string, changes ProfileChanges) (models.User, error) {
+	if err := changes.check(); err != nil {
+		return models.User{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	existing := m.userWith(func(u *models.User) bool { return u.UUID == userID })
+	if existing == nil {
+		return models.User{}, NotFound{"User does not exist"}
+	}
+
+	if changes.Username != nil && *changes.Username != existing.Username &&
+		m.userWith(func(u *models.User) bool { return u.Username == *changes.Username }) != nil {
+		return models.User{}, Conflict{"Username already exists"}
+	}
+
+	if changes.Username != nil && *changes.Username != existing.Username {
+		// The Fever key hashes the username, so it must be set again
+		existing.Username = *changes.Username
+		existing.FeverKey = ""
+	}
+	if changes.Email != nil {
+		existing.Email = *changes.Email
+	}
+	if changes.Timezone != nil {
+		existing.Timezone = *changes.Timezone
+	}
+	if changes.Preferences != nil {
+		existing.Preferences = models.Preferences{}
+		for key, value := range *changes.Preferences {
+			existing.Preferences[key] = value
+		}
+	}
+	existing.UpdatedAt = time.Now()
+
+	return *existing, nil
+}
+
+// ChangeUserPassword for user with userID.
+// The new password must follow PasswordPolicy.
+func (m *MemoryDB) ChangeUserPassword(userID, newPassword string) error {
+	if err := m.PasswordPolicy.check(newPassword); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user := m.userWith(func(u *models.User) bool { return u.UUID == userID })
+	if user == nil {
+		return BadRequest{"User does not exists"}
+	}
+
+	if err := setPassword(user, newPassword, m.PasswordHashing); err != nil {
+		return err
+	}
+
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+// SetUserRole gives the user with userID role
+func (m *MemoryDB) SetUserRole(userID, role string) error {
+	if role != models.RoleUser && role != models.RoleAdmin {
+		return BadRequest{"Unknown role " + role}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user := m.userWith(func(u *models.User) bool { return u.UUID == userID })
+	if user == nil {
+		return NotFound{"User does not exist"}
+	}
+
+	user.Role = role
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+// InstanceStats counts the Users, Feeds and Entries of every user
+func (m *MemoryDB) InstanceStats() (stats models.InstanceStats) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now()
+	sources := map[string]bool{}
+
+	stats.Users = len(m.users)
+	for _, feed := range m.feeds {
+		if feed.DeletedAt == nil {
+			stats.Feeds++
+			sources[feed.Subscription] = true
+		}
+	}
+	stats.Sources = len(sources)
+
+	for _, entry := range m.entries {
+		if entry.DeletedAt == nil {
+			stats.Entries++
+		}
+	}
+
+	for _, key := range m.apiKeys {
+		if key.ExpiresAt.After(now) {
+			stats.APIKeys++
+		}
+	}
+	return
+}
+
+// Users returns a list of all User entries.
+// MemoryDB always populates every field so fields is ignored.
+func (m *MemoryDB) Users(fields ...string) (users []models.User) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, user := range m.users {
+		users = append(users, *user)
+	}
+	return
+}
+
+// UserPrimaryKey returns the primary key of a User with a uuid
+func (m *MemoryDB) UserPrimaryKey(uuid string) (uint, error) {
+	user, err := m.UserWithUUID(uuid)
+	return user.ID, err
+}
+
+// UserWithName returns a User with username
+func (m *MemoryDB) UserWithName(username string) (user models.User, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.Username == username })
+	if found == nil {
+		err = NotFound{"User does not exist"}
+		return
+	}
+	return *found, nil
+}
+
+// UserWithUUID returns a User with id
+func (m *MemoryDB) UserWithUUID(uuid string) (user models.User, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.UUID == uuid })
+	if found == nil {
+		err = NotFound{"User does not exist"}
+		return
+	}
+	return *found, nil
+}
+
+// Authenticate a user and return its respective User model if successful.
+// Passwords hashed with weaker parameters than PasswordHashing are rehashed.
+func (m *MemoryDB) Authenticate(username, password string) (user models.User, err error) {
+	user, err = m.UserWithName(username)
+	if err != nil {
+		return models.User{}, rejectUnknownUser(m.PasswordHashing, password)
+	}
+
+	if err = checkPassword(&user, password); err != nil {
+		return
+	}
+
+	if needsRehash(&user, m.PasswordHashing) {
+		m.rehashPassword(&user, password)
+	}
+	return
+}
+
+// rehashPassword stores password hashed with PasswordHashing for user.
+// Failing to do so is not an error, it is tried again on the next login.
+func (m *MemoryDB) rehashPassword(user *models.User, password string) {
+	rehashed := *user
+	if err := setPassword(&rehashed, password, m.PasswordHashing); err != nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stored := m.userWith(func(u *models.User) bool { return u.ID == user.ID })
+	if stored == nil {
+		return
+	}
+
+	stored.PasswordHash = rehashed.PasswordHash
+	stored.PasswordSalt = rehashed.PasswordSalt
+	stored.PasswordParams = rehashed.PasswordParams
+	*user = rehashed
+}
+
+// NewAPIKey creates a new APIKey object owned by user.
+// The key expires after APIKeyExpiration.
+func (m *MemoryDB) NewAPIKey(secret string, key *models.APIKey, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if key.Family == "" {
+		key.Family = newFamily()
+	}
+
+	return m.newAPIKey(secret, key, time.Now().Add(m.APIKeyExpiration), user)
+}
+
+func (m *MemoryDB) newAPIKey(secret string, key *models.APIKey, expiresAt time.Time, user *models.User) error {
+	key.UUID = uuid.NewV4().String()
+	key.ExpiresAt = expiresAt
+
+	t, err := newAPIToken(secret, key, user)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	key.ID = m.nextID()
+	key.CreatedAt = now
+	key.UpdatedAt = now
+	key.Key = t
+	key.Hash = hashRefreshToken(t)
+	key.UserID = user.ID
+
+	stored := *key
+	stored.Key = ""
+	m.apiKeys = append(m.apiKeys, &stored)
+
+	key.User = *user
+	return nil
+}
+
+func (m *MemoryDB) apiKeyWith(match func(*models.APIKey) bool) *models.APIKey {
+	for _, key := range m.apiKeys {
+		if match(key) {
+			return key
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) removeAPIKeys(match func(*models.APIKey) bool) {
+	var keys []*models.APIKey
+	for _, key := range m.apiKeys {
+		if !match(key) {
+			keys = append(keys, key)
+		}
+	}
+	m.apiKeys = keys
+}
+
+// KeyBelongsToUser returns true if the given APIKey is owned by user and has not expired
+func (m *MemoryDB) KeyBelongsToUser(key *models.APIKey, user *models.User) (bool, error) {
+	if key.Key == "" {
+		return false, BadRequest{"No key provided"}
+	}
+
+	hash := hashRefreshToken(key.Key)
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now()
+	found := m.apiKeyWith(func(k *models.APIKey) bool {
+		return k.UserID == user.ID && k.Hash == hash && k.ExpiresAt.After(now)
+	})
+	return found != nil, nil
+}
+
+// APIKeys returns all APIKeys owned by user that have not expired
+func (m *MemoryDB) APIKeys(user *models.User) (keys []models.APIKey) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now()
+	for _, key := range m.apiKeys {
+		if key.UserID == user.ID && key.ExpiresAt.After(now) {
+			keys = append(keys, *key)
+		}
+	}
+	return
+}
+
+// NewPersonalAccessToken creates a new APIKey owned by user that is
+// limited to key.Scope. The key expires at key.ExpiresAt or, if it
+// is not set, after DefaultPersonalAccessTokenExpiration.
+func (m *MemoryDB) NewPersonalAccessToken(secret string, key *models.APIKey, user *models.User) error {
+	scope, err := normalizeScope(key.Scope)
+	if err != nil {
+		return err
+	}
+
+	expiresAt, err := personalTokenExpiration(key.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key.Personal = true
+	key.Scope = scope
+	key.Family = ""
+
+	return m.newAPIKey(secret, key, expiresAt, user)
+}
+
+// PersonalAccessTokens returns all personal access tokens owned by user that have not expired
+func (m *MemoryDB) PersonalAccessTokens(user *models.User) (keys []models.APIKey) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now()
+	for _, key := range m.apiKeys {
+		if key.UserID == user.ID && key.Personal && key.ExpiresAt.After(now) {
+			keys = append(keys, *key)
+		}
+	}
+	return
+}
+
+// DeleteAPIKey with id and owned by user, along with the RefreshTokens issued with it
+func (m *MemoryDB) DeleteAPIKey(id string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := m.apiKeyWith(func(k *models.APIKey) bool { return k.UserID == user.ID && k.UUID == id })
+	if key == nil {
+		return NotFound{"API key does not exist"}
+	}
+
+	m.removeAPIKeys(func(k *models.APIKey) bool { return k == key })
+	m.revokeFamily(key.Family)
+	return nil
+}
+
+// RevokeAPIKey deletes the APIKey with token owned by user, along with the RefreshTokens issued with it
+func (m *MemoryDB) RevokeAPIKey(token string, user *models.User) error {
+	hash := hashRefreshToken(token)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := m.apiKeyWith(func(k *models.APIKey) bool { return k.UserID == user.ID && k.Hash == hash })
+	if key == nil {
+		return NotFound{"API key does not exist"}
+	}
+
+	m.removeAPIKeys(func(k *models.APIKey) bool { return k == key })
+	m.revokeFamily(key.Family)
+	return nil
+}
+
+// RevokeOtherAPIKeys deletes every APIKey obtained by logging in as user, and
+// their RefreshTokens, except the one with token and those refreshed from it.
+// Personal access tokens are kept.
+func (m *MemoryDB) RevokeOtherAPIKeys(token string, user *models.User) error {
+	hash := hashRefreshToken(token)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := m.apiKeyWith(func(k *models.APIKey) bool { return k.UserID == user.ID && k.Hash == hash })
+	if key == nil {
+		return NotFound{"API key does not exist"}
+	}
+
+	other := func(family string) bool { return key.Family == "" || family != key.Family }
+	m.removeAPIKeys(func(k *models.APIKey) bool {
+		return k.UserID == user.ID && k != key && !k.Personal && other(k.Family)
+	})
+	m.removeRefreshTokens(func(t *models.RefreshToken) bool { return t.UserID == user.ID && other(t.Family) })
+	return nil
+}
+
+// TouchAPIKey records that the APIKey with token owned by user was just used
+func (m *MemoryDB) TouchAPIKey(token string, user *models.User) error {
+	hash := hashRefreshToken(token)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	key := m.apiKeyWith(func(k *models.APIKey) bool { return k.UserID == user.ID && k.Hash == hash })
+	if key != nil && (key.LastUsedAt == nil || key.LastUsedAt.Before(now.Add(-apiKeyUseResolution))) {
+		key.LastUsedAt = &now
+	}
+	return nil
+}
+
+// DeleteExpiredAPIKeys permanently deletes every APIKey, RefreshToken and LoginChallenge that has expired
+func (m *MemoryDB) DeleteExpiredAPIKeys() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	m.removeAPIKeys(func(k *models.APIKey) bool { return !k.ExpiresAt.After(now) })
+	m.removeRefreshTokens(func(t *models.RefreshToken) bool { return !t.ExpiresAt.After(now) })
+	m.removeLoginChallenges(func(c *models.LoginChallenge) bool { return !c.ExpiresAt.After(now) })
+	return nil
+}
+
+func (m *MemoryDB) removeRefreshTokens(match func(*models.RefreshToken) bool) {
+	var tokens []*models.RefreshToken
+	for _, token := range m.refreshTokens {
+		if !match(token) {
+			tokens = append(tokens, token)
+		}
+	}
+	m.refreshTokens = tokens
+}
+
+// revokeFamily deletes every APIKey and RefreshToken in family
+func (m *MemoryDB) revokeFamily(family string) {
+	if family == "" {
+		return
+	}
+
+	m.removeAPIKeys(func(k *models.APIKey) bool { return k.Family == family })
+	m.removeRefreshTokens(func(t *models.RefreshToken) bool { return t.Family == family })
+}
+
+// NewRefreshToken creates a new RefreshToken in family owned by user.
+// The plain token is only available in the returned RefreshToken.
+func (m *MemoryDB) NewRefreshToken(family string, user *models.User) (models.RefreshToken, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.newRefreshToken(family, user)
+}
+
+func (m *MemoryDB) newRefreshToken(family string, user *models.User) (models.RefreshToken, error) {
+	token, hash, err := newRefreshTokenValue()
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+
+	now := time.Now()
+	refresh := &models.RefreshToken{
+		ID:        m.nextID(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Hash:      hash,
+		Family:    family,
+		ExpiresAt: now.Add(m.RefreshTokenExpiration),
+		UserID:    user.ID,
+	}
+	m.refreshTokens = append(m.refreshTokens, refresh)
+
+	result := *refresh
+	result.Token = token
+	return result, nil
+}
+
+// RefreshAPIKey exchanges a RefreshToken for a new APIKey and a new RefreshToken.
+// Presenting a token that was already exchanged revokes its whole family.
+func (m *MemoryDB) RefreshAPIKey(secret, token string) (key models.APIKey, refresh models.RefreshToken, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hash := hashRefreshToken(token)
+	var found *models.RefreshToken
+	for _, t := range m.refreshTokens {
+		if t.Hash == hash {
+			found = t
+			break
+		}
+	}
+
+	if found == nil {
+		err = Unauthorized{"Invalid refresh token"}
+		return
+	}
+
+	if found.Used {
+		m.revokeFamily(found.Family)
+		err = Unauthorized{"Refresh token was already used"}
+		return
+	}
+
+	if !found.ExpiresAt.After(time.Now()) {
+		err = Unauthorized{"Refresh token has expired"}
+		return
+	}
+
+	found.Used = true
+
+	user := m.userWith(func(u *models.User) bool { return u.ID == found.UserID })
+	if user == nil {
+		err = Unauthorized{"Invalid refresh token"}
+		return
+	}
+
+	key = models.APIKey{Family: found.Family}
+	var newest *models.APIKey
+	for _, k := range m.apiKeys {
+		if k.Family == found.Family && (newest == nil || k.CreatedAt.After(newest.CreatedAt)) {
+			newest = k
+		}
+	}
+	if newest != nil {
+		key.Label = newest.Label
+		key.Device = newest.Device
+	}
+	m.removeAPIKeys(func(k *models.APIKey) bool { return k.Family == found.Family })
+
+	if err = m.newAPIKey(secret, &key, time.Now().Add(m.APIKeyExpiration), user); err != nil {
+		return
+	}
+
+	refresh, err = m.newRefreshToken(found.Family, user)
+	return
+}
+
+// NewTOTP starts enrolling user in two-factor authentication. It returns
+// a new secret and its otpauth URI, which EnableTOTP confirms.
+func (m *MemoryDB) NewTOTP(issuer string, user *models.User) (secret, uri string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.ID == user.ID })
+	if found == nil {
+		err = NotFound{"User does not exist"}
+		return
+	}
+
+	if found.TOTPEnabled {
+		err = Conflict{"Two-factor authentication is already enabled"}
+		return
+	}
+
+	secret, uri, err = newTOTPKey(issuer, found)
+	if err != nil {
+		return
+	}
+
+	found.TOTPSecret = secret
+	return
+}
+
+// EnableTOTP enables two-factor authentication for user once code proves
+// the secret from NewTOTP was enrolled. It returns the new RecoveryCodes.
+func (m *MemoryDB) EnableTOTP(code string, user *models.User) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.ID == user.ID })
+	if found == nil {
+		return nil, NotFound{"User does not exist"}
+	}
+
+	if found.TOTPEnabled {
+		return nil, Conflict{"Two-factor authentication is already enabled"}
+	}
+
+	if found.TOTPSecret == "" {
+		return nil, BadRequest{"Two-factor authentication enrollment was not started"}
+	}
+
+	counter, err := checkTOTP(found.TOTPSecret, code, 0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	found.TOTPEnabled = true
+	found.TOTPLastCounter = counter
+	return m.newRecoveryCodes(found)
+}
+
+// DisableTOTP turns off two-factor authentication for the user with userID
+// and deletes their RecoveryCodes
+func (m *MemoryDB) DisableTOTP(userID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user := m.userWith(func(u *models.User) bool { return u.UUID == userID })
+	if user == nil {
+		return NotFound{"User does not exist"}
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastCounter = 0
+	m.removeRecoveryCodes(func(c *models.RecoveryCode) bool { return c.UserID == user.ID })
+	m.removeLoginChallenges(func(c *models.LoginChallenge) bool { return c.UserID == user.ID })
+	return nil
+}
+
+// CheckTOTP returns an Unauthorized error unless code is a TOTP code
+// for user that was not used before
+func (m *MemoryDB) CheckTOTP(code string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.ID == user.ID })
+	if found == nil {
+		return NotFound{"User does not exist"}
+	}
+
+	if !found.TOTPEnabled {
+		return BadRequest{"Two-factor authentication is not enabled"}
+	}
+
+	counter, err := checkTOTP(found.TOTPSecret, code, found.TOTPLastCounter, time.Now())
+	if err != nil {
+		return err
+	}
+
+	found.TOTPLastCounter = counter
+	return nil
+}
+
+// NewRecoveryCodes replaces the RecoveryCodes of user with new ones.
+// The plain codes are only available in the returned list.
+func (m *MemoryDB) NewRecoveryCodes(user *models.User) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.ID == user.ID })
+	if found == nil {
+		return nil, NotFound{"User does not exist"}
+	}
+
+	if !found.TOTPEnabled {
+		return nil, BadRequest{"Two-factor authentication is not enabled"}
+	}
+
+	return m.newRecoveryCodes(found)
+}
+
+func (m *MemoryDB) newRecoveryCodes(user *models.User) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	m.removeRecoveryCodes(func(c *models.RecoveryCode) bool { return c.UserID == user.ID })
+	for _, hash := range hashes {
+		m.recoveryCodes = append(m.recoveryCodes, &models.RecoveryCode{
+			ID:        m.nextID(),
+			CreatedAt: time.Now(),
+			Hash:      hash,
+			UserID:    user.ID,
+		})
+	}
+
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns how many unused RecoveryCodes user has
+func (m *MemoryDB) RecoveryCodesLeft(user *models.User) (count int) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, code := range m.recoveryCodes {
+		if code.UserID == user.ID {
+			count++
+		}
+	}
+	return
+}
+
+// UseRecoveryCode deletes the RecoveryCode code of user, or
+// returns an Unauthorized error if user has no such code
+func (m *MemoryDB) UseRecoveryCode(code string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hash := hashRecoveryCode(code)
+	left := len(m.recoveryCodes)
+	m.removeRecoveryCodes(func(c *models.RecoveryCode) bool { return c.UserID == user.ID && c.Hash == hash })
+	if len(m.recoveryCodes) == left {
+		return Unauthorized{"Invalid recovery code"}
+	}
+	return nil
+}
+
+func (m *MemoryDB) removeRecoveryCodes(match func(*models.RecoveryCode) bool) {
+	var codes []*models.RecoveryCode
+	for _, code := range m.recoveryCodes {
+		if !match(code) {
+			codes = append(codes, code)
+		}
+	}
+	m.recoveryCodes = codes
+}
+
+// NewLoginChallenge creates a LoginChallenge for user.
+// The plain token is only available in the returned LoginChallenge.
+func (m *MemoryDB) NewLoginChallenge(user *models.User) (models.LoginChallenge, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token, hash, err := newRefreshTokenValue()
+	if err != nil {
+		return models.LoginChallenge{}, err
+	}
+
+	now := time.Now()
+	challenge := &models.LoginChallenge{
+		ID:        m.nextID(),
+		CreatedAt: now,
+		Hash:      hash,
+		ExpiresAt: now.Add(DefaultLoginChallengeExpiration),
+		UserID:    user.ID,
+	}
+	m.loginChallenges = append(m.loginChallenges, challenge)
+
+	result := *challenge
+	result.Token = token
+	return result, nil
+}
+
+// LoginChallengeUser returns the User a LoginChallenge with token was issued to
+func (m *MemoryDB) LoginChallengeUser(token string) (models.User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	hash := hashRefreshToken(token)
+	now := time.Now()
+	for _, challenge := range m.loginChallenges {
+		if challenge.Hash == hash && challenge.ExpiresAt.After(now) {
+			user := m.userWith(func(u *models.User) bool { return u.ID == challenge.UserID })
+			if user != nil {
+				return *user, nil
+			}
+		}
+	}
+
+	return models.User{}, Unauthorized{"Invalid or expired login challenge"}
+}
+
+// DeleteLoginChallenge with token so that it cannot be used again
+func (m *MemoryDB) DeleteLoginChallenge(token string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hash := hashRefreshToken(token)
+	m.removeLoginChallenges(func(c *models.LoginChallenge) bool { return c.Hash == hash })
+	return nil
+}
+
+// SetFeverPassword lets user log in to the Fever API with password.
+// Fever keys are plain MD5 hashes so password must be different
+// from the account's password.
+func (m *MemoryDB) SetFeverPassword(password string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.ID == user.ID })
+	if found == nil {
+		return NotFound{"User does not exist"}
+	}
+
+	if err := m.PasswordPolicy.check(password); err != nil {
+		return err
+	}
+
+	if checkPassword(found, password) == nil {
+		return BadRequest{"Fever password should differ from the account password"}
+	}
+
+	found.FeverKey = FeverKey(found.Username, password)
+	user.FeverKey = found.FeverKey
+	return nil
+}
+
+// DisableFever stops user from logging in to the Fever API
+func (m *MemoryDB) DisableFever(user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.userWith(func(u *models.User) bool { return u.ID == user.ID })
+	if found == nil {
+		return NotFound{"User does not exist"}
+	}
+
+	found.FeverKey = ""
+	user.FeverKey = ""
+	return nil
+}
+
+// UserWithFeverKey returns the User who logs in to the Fever API with key
+func (m *MemoryDB) UserWithFeverKey(key string) (models.User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key = strings.ToLower(key)
+	found := m.userWith(func(u *models.User) bool { return key != "" && u.FeverKey == key })
+	if found == nil {
+		return models.User{}, Unauthorized{"Invalid Fever API key"}
+	}
+
+	return *found, nil
+}
+
+func (m *MemoryDB) removeLoginChallenges(match func(*models.LoginChallenge) bool) {
+	var challenges []*models.LoginChallenge
+	for _, challenge := range m.loginChallenges {
+		if !match(challenge) {
+			challenges = append(challenges, challenge)
+		}
+	}
+	m.loginChallenges = challenges
+}
+
+// NewInvite creates an Invite that expires at invite.ExpiresAt or, if it
+// is not set, after DefaultInviteExpiration
+func (m *MemoryDB) NewInvite(invite *models.Invite) error {
+	if err := initInvite(invite); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	invite.ID = m.nextID()
+	invite.CreatedAt = now
+	invite.UpdatedAt = now
+
+	stored := *invite
+	m.invites = append(m.invites, &stored)
+	return nil
+}
+
+// Invites returns every Invite, including used up and expired ones
+func (m *MemoryDB) Invites() (invites []models.Invite) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, invite := range m.invites {
+		invites = append(invites, *invite)
+	}
+	return
+}
+
+// DeleteInvite with id
+func (m *MemoryDB) DeleteInvite(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, invite := range m.invites {
+		if invite.UUID == id {
+			m.invites = append(m.invites[:i], m.invites[i+1:]...)
+			return nil
+		}
+	}
+	return NotFound{"Invite does not exist"}
+}
+
+// NewUserWithInvite creates a new User if code belongs to an Invite
+// that has not expired or been used up
+func (m *MemoryDB) NewUserWithInvite(username, password, code string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.PasswordPolicy.checkCredentials(username, password); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var found *models.Invite
+	for _, invite := range m.invites {
+		if invite.Code == code && invite.ExpiresAt.After(now) && (invite.MaxUses == 0 || invite.Uses < invite.MaxUses) {
+			found = invite
+			break
+		}
+	}
+
+	if found == nil {
+		return Unauthorized{"Invalid invite code"}
+	}
+
+	if err := m.newUser(username, password); err != nil {
+		return err
+	}
+
+	found.Uses++
+	found.UpdatedAt = now
+	return nil
+}
+
+func (m *MemoryDB) lockoutWith(kind, subject string) *models.Lockout {
+	for _, lockout := range m.lockouts {
+		if lockout.Kind == kind && lockout.Subject == subject {
+			return lockout
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) removeLockouts(match func(*models.Lockout) bool) {
+	var lockouts []*models.Lockout
+	for _, lockout := range m.lockouts {
+		if !match(lockout) {
+			lockouts = append(lockouts, lockout)
+		}
+	}
+	m.lockouts = lockouts
+}
+
+// LockedOut returns when logging in as username from ip will be allowed
+// again, and false if it is allowed now
+func (m *MemoryDB) LockedOut(username, ip string) (until time.Time, locked bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now()
+	for kind, subject := range loginSubjects(username, ip) {
+		lockout := m.lockoutWith(kind, subject)
+		if lockout != nil && lockout.LockedUntil.After(now) && lockout.LockedUntil.After(until) {
+			until = lockout.LockedUntil
+			locked = true
+		}
+	}
+	return
+}
+
+// RecordLoginFailure counts a failed login as username from ip
+// against both the account and the IP address
+func (m *MemoryDB) RecordLoginFailure(username, ip string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	for kind, subject := range loginSubjects(username, ip) {
+		lockout := m.lockoutWith(kind, subject)
+		if lockout == nil {
+			lockout = &models.Lockout{
+				ID:        m.nextID(),
+				CreatedAt: now,
+				Kind:      kind,
+				Subject:   subject,
+			}
+			m.lockouts = append(m.lockouts, lockout)
+		}
+
+		m.LockoutPolicy.fail(lockout, now)
+		lockout.UpdatedAt = now
+	}
+	return nil
+}
+
+// ClearLoginFailures forgets the failed logins of username after it logs in
+func (m *MemoryDB) ClearLoginFailures(username string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.removeLockouts(func(l *models.Lockout) bool {
+		return l.Kind == models.LockoutAccount && l.Subject == username
+	})
+	return nil
+}
+
+// Lockouts returns every account and IP address with recent failed logins
+func (m *MemoryDB) Lockouts() (lockouts []models.Lockout) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	since := time.Now().Add(-m.LockoutPolicy.MaxBackoff)
+	for _, lockout := range m.lockouts {
+		if lockout.LastFailureAt.After(since) {
+			lockouts = append(lockouts, *lockout)
+		}
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].LastFailureAt.After(lockouts[j].LastFailureAt)
+	})
+	return
+}
+
+// DeleteExpiredLockouts permanently deletes the failed logins that are
+// forgotten, having had no new failure for MaxBackoff
+func (m *MemoryDB) DeleteExpiredLockouts() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cutoff := time.Now().Add(-m.LockoutPolicy.MaxBackoff)
+	m.removeLockouts(func(l *models.Lockout) bool {
+		return !l.LastFailureAt.After(cutoff)
+	})
+	return nil
+}
+
+// ClearLockout forgets the failed logins of an account or IP address
+func (m *MemoryDB) ClearLockout(kind, subject string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	lockout := m.lockoutWith(kind, subject)
+	if lockout == nil {
+		return NotFound{"Lockout does not exist"}
+	}
+
+	m.removeLockouts(func(l *models.Lockout) bool { return l == lockout })
+	return nil
+}
+
+func (m *MemoryDB) newCategory(name string, user *models.User) *models.Category {
+	now := time.Now()
+	ctg := &models.Category{
+		ID:        m.nextID(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		UUID:      uuid.NewV4().String(),
+		UserID:    user.ID,
+		Name:      name,
+	}
+	m.categories = append(m.categories, ctg)
+	return ctg
+}
+
+func (m *MemoryDB) categoryWith(match func(*models.Category) bool) *models.Category {
+	for _, ctg := range m.categories {
+		if ctg.DeletedAt == nil && match(ctg) {
+			return ctg
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) category(id string, user *models.User) *models.Category {
+	return m.categoryWith(func(c *models.Category) bool {
+		return c.UserID == user.ID && c.UUID == id
+	})
+}
+
+func (m *MemoryDB) feedsWith(match func(*models.Feed) bool) (feeds []*models.Feed) {
+	for _, feed := range m.feeds {
+		if feed.DeletedAt == nil && match(feed) {
+			feeds = append(feeds, feed)
+		}
+	}
+	return
+}
+
+func (m *MemoryDB) feed(id string, user *models.User) *models.Feed {
+	feeds := m.feedsWith(func(f *models.Feed) bool {
+		return f.UserID == user.ID && f.UUID == id
+	})
+	if len(feeds) == 0 {
+		return nil
+	}
+	return feeds[0]
+}
+
+func (m *MemoryDB) feedIDsInCategory(ctg *models.Category) map[uint]bool {
+	ids := map[uint]bool{}
+	for _, feed := range m.feedsWith(func(f *models.Feed) bool { return f.CategoryID == ctg.ID }) {
+		ids[feed.ID] = true
+	}
+	return ids
+}
+
+func (m *MemoryDB) entriesWith(match func(*models.Entry) bool) (entries []*models.Entry) {
+	for _, entry := range m.entries {
+		if entry.DeletedAt == nil && match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+func (m *MemoryDB) entry(id string, user *models.User) *models.Entry {
+	entries := m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && e.UUID == id
+	})
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries[0]
+}
+
+func (m *MemoryDB) entriesWithIDs(ids []string, user *models.User) []*models.Entry {
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	return m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && wanted[e.UUID]
+	})
+}
+
+// removeEntries permanently deletes every entry, deleted or not, that matches
+func (m *MemoryDB) removeEntries(match func(*models.Entry) bool) {
+	var entries []*models.Entry
+	for _, entry := range m.entries {
+		if !match(entry) {
+			entries = append(entries, entry)
+			continue
+		}
+
+		for _, tagged := range m.entryTags {
+			delete(tagged, entry.ID)
+		}
+	}
+	m.entries = entries
+}
+
+// NewFeed creates a new Feed object owned by user
+func (m *MemoryDB) NewFeed(feed *models.Feed, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	feed.UUID = uuid.NewV4().String()
+
+	var ctg *models.Category
+	if feed.Category.UUID != "" {
+		ctg = m.category(feed.Category.UUID, user)
+		if ctg == nil {
+			return BadRequest{"Feed has invalid category"}
+		}
+	} else {
+		ctg = m.categoryWith(func(c *models.Category) bool {
+			return c.UserID == user.ID && c.Name == models.Uncategorized
+		})
+	}
+
+	now := time.Now()
+	feed.ID = m.nextID()
+	feed.CreatedAt = now
+	feed.UpdatedAt = now
+	feed.UserID = user.ID
+	feed.Category = *ctg
+	feed.CategoryID = ctg.ID
+
+	stored := *feed
+	stored.Category = models.Category{}
+	stored.User = models.User{}
+	stored.Entries = nil
+	m.feeds = append(m.feeds, &stored)
+
+	m.events.Publish(user.ID, events.FeedAdded, events.Data{Feed: feed.UUID, Title: feed.Title})
+	return nil
+}
+
+// Feeds returns a list of all Feeds owned by a user
+func (m *MemoryDB) Feeds(user *models.User) (feeds []models.Feed) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, feed := range m.feedsWith(func(f *models.Feed) bool { return f.UserID == user.ID }) {
+		feeds = append(feeds, *feed)
+	}
+	return
+}
+
+// FeedsFromCategory returns all Feeds that belong to a category with categoryID
+func (m *MemoryDB) FeedsFromCategory(categoryID string, user *models.User) (feeds []models.Feed, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ctg := m.category(categoryID, user)
+	if ctg == nil {
+		err = NotFound{"Category does not exist"}
+		return
+	}
+
+	for _, feed := range m.feedsWith(func(f *models.Feed) bool { return f.CategoryID == ctg.ID }) {
+		feeds = append(feeds, *feed)
+	}
+	return
+}
+
+// Feed returns a Feed with id and owned by user
+func (m *MemoryDB) Feed(id string, user *models.User) (feed models.Feed, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	found := m.feed(id, user)
+	if found == nil {
+		err = NotFound{"Feed does not exist"}
+		return
+	}
+
+	feed = *found
+	if ctg := m.categoryWith(func(c *models.Category) bool { return c.ID == feed.CategoryID }); ctg != nil {
+		feed.Category = *ctg
+	}
+	return
+}
+
+// DeleteFeed with id and owned by user.
+// The feed and its entries are moved to the trash.
+func (m *MemoryDB) DeleteFeed(id string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	feed := m.feed(id, user)
+	if feed == nil {
+		return NotFound{"Feed does not exist"}
+	}
+
+	m.trashFeed(feed, trashTime())
+	m.events.Publish(user.ID, events.FeedDeleted, events.Data{Feed: id})
+	return nil
+}
+
+// trashFeed soft deletes feed along with its unsaved entries.
+func (m *MemoryDB) trashFeed(feed *models.Feed, deletedAt time.Time) {
+	for _, entry := range m.entriesWith(func(e *models.Entry) bool { return e.FeedID == feed.ID && !e.Saved }) {
+		entry.DeletedAt = &deletedAt
+	}
+	feed.DeletedAt = &deletedAt
+}
+
+// EditFeed owned by user
+func (m *MemoryDB) EditFeed(feed *models.Feed, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.feed(feed.UUID, user)
+	if found == nil {
+		return NotFound{"Feed does not exist"}
+	}
+
+	found.Title = feed.Title
+	found.UpdatedAt = time.Now()
+	return nil
+}
+
+// UpdateFeedSource updates the data shared by every Feed with feed's subscription.
+// Titles are kept since every copy of the feed is owned by a single user.
+func (m *MemoryDB) UpdateFeedSource(feed *models.Feed) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := false
+	for _, f := range m.feeds {
+		if f.Subscription != feed.Subscription {
+			continue
+		}
+
+		f.Description = feed.Description
+		f.Source = feed.Source
+		f.TTL = feed.TTL
+		f.Etag = feed.Etag
+		f.LastUpdated = feed.LastUpdated
+		f.Status = feed.Status
+		found = true
+	}
+
+	if !found {
+		return NotFound{"Feed does not exist"}
+	}
+	return nil
+}
+
+// createdBefore reports whether entry was created up to before, taking its
+// published time when it has one. A zero before is no limit.
+func createdBefore(entry *models.Entry, before time.Time) bool {
+	if before.IsZero() {
+		return true
+	}
+
+	created := entry.Published
+	if created.IsZero() {
+		created = entry.CreatedAt
+	}
+	return !created.After(before)
+}
+
+// MarkFeed applies marker to the entries of a Feed with id and owned by user
+// that were created up to before
+func (m *MemoryDB) MarkFeed(id string, marker models.Marker, before time.Time, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	feed := m.feed(id, user)
+	if feed == nil {
+		return NotFound{"Feed does not exist"}
+	}
+
+	for _, entry := range m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && e.FeedID == feed.ID && createdBefore(e, before)
+	}) {
+		entry.Mark = marker
+	}
+
+	m.events.Publish(user.ID, events.EntriesMarked, events.Data{Feed: id, Marker: marker.String()})
+	return nil
+}
+
+// NewCategory creates a new Category object owned by user
+func (m *MemoryDB) NewCategory(ctg *models.Category, user *models.User) error {
+	if ctg.Name == "" {
+		return BadRequest{"Category name should not be empty"}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.categoryWith(func(c *models.Category) bool { return c.UserID == user.ID && c.Name == ctg.Name }) != nil {
+		return Conflict{"Category already exists"}
+	}
+
+	stored := m.newCategory(ctg.Name, user)
+	ctg.ID = stored.ID
+	ctg.CreatedAt = stored.CreatedAt
+	ctg.UpdatedAt = stored.UpdatedAt
+	ctg.UUID = stored.UUID
+	ctg.UserID = user.ID
+	return nil
+}
+
+// EditCategory owned by user
+func (m *MemoryDB) EditCategory(ctg *models.Category, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.category(ctg.UUID, user)
+	if found == nil {
+		return NotFound{"Category does not exist"}
+	}
+
+	found.Name = ctg.Name
+	found.UpdatedAt = time.Now()
+	return nil
+}
+
+// DeleteCategory with id and owned by user. The category's feeds are
+// moved to the user's uncategorized category unless deleteFeeds is set,
+// in which case they are deleted along with it.
+func (m *MemoryDB) DeleteCategory(id string, deleteFeeds bool, user *models.User) error {
+	if id == user.UncategorizedCategoryUUID || id == user.SavedCategoryUUID {
+		return BadRequest{"Cannot delete system categories"}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ctg := m.category(id, user)
+	if ctg == nil {
+		return NotFound{"Category does not exist"}
+	}
+
+	deletedAt := trashTime()
+
+	feeds := m.feedsWith(func(f *models.Feed) bool { return f.CategoryID == ctg.ID })
+	if deleteFeeds {
+		for _, feed := range feeds {
+			m.trashFeed(feed, deletedAt)
+		}
+	} else {
+		unctg := m.category(user.UncategorizedCategoryUUID, user)
+		for _, feed := range feeds {
+			feed.CategoryID = unctg.ID
+		}
+	}
+
+	ctg.DeletedAt = &deletedAt
+	return nil
+}
+
+// Category returns a Category with id and owned by user
+func (m *MemoryDB) Category(id string, user *models.User) (ctg models.Category, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	found := m.category(id, user)
+	if found == nil {
+		err = NotFound{"Category does not exist"}
+		return
+	}
+	return *found, nil
+}
+
+// Categories returns a list of all Categories owned by user
+func (m *MemoryDB) Categories(user *models.User) (categories []models.Category) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, ctg := range m.categories {
+		if ctg.DeletedAt == nil && ctg.UserID == user.ID {
+			categories = append(categories, *ctg)
+		}
+	}
+	return
+}
+
+// ChangeFeedCategory changes the category a feed belongs to
+func (m *MemoryDB) ChangeFeedCategory(feedID string, ctgID string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	feed := m.feed(feedID, user)
+	if feed == nil {
+		return NotFound{"Feed does not exist"}
+	}
+
+	ctg := m.category(ctgID, user)
+	if ctg == nil {
+		return NotFound{"Category does not exist"}
+	}
+
+	feed.CategoryID = ctg.ID
+	return nil
+}
+
+// MarkCategory applies marker to the entries of a category with id and
+// owned by user that were created up to before
+func (m *MemoryDB) MarkCategory(id string, marker models.Marker, before time.Time, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ctg := m.category(id, user)
+	if ctg == nil {
+		return NotFound{"Category does not exist"}
+	}
+
+	feedIDs := m.feedIDsInCategory(ctg)
+	for _, entry := range m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && feedIDs[e.FeedID] && createdBefore(e, before)
+	}) {
+		entry.Mark = marker
+	}
+
+	m.events.Publish(user.ID, events.EntriesMarked, events.Data{Category: id, Marker: marker.String()})
+	return nil
+}
+
+// MarkAllEntries applies marker to every entry owned by user that was
+// created up to before
+func (m *MemoryDB) MarkAllEntries(marker models.Marker, before time.Time, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, entry := range m.entriesWith(func(e *models.Entry) bool { return e.UserID == user.ID && createdBefore(e, before) }) {
+		entry.Mark = marker
+	}
+
+	m.events.Publish(user.ID, events.EntriesMarked, events.Data{Marker: marker.String()})
+	return nil
+}
+
+func (m *MemoryDB) newEntry(entry *models.Entry, feed *models.Feed, user *models.User) {
+	now := time.Now()
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = now
+	}
+	entry.UpdatedAt = now
+	entry.ID = m.nextID()
+	entry.UUID = uuid.NewV4().String()
+	entry.UserID = user.ID
+	entry.Feed = *feed
+	entry.FeedID = feed.ID
+
+	stored := *entry
+	stored.Feed = models.Feed{}
+	stored.User = models.User{}
+	stored.Tags = nil
+	m.entries = append(m.entries, &stored)
+}
+
+// NewEntry creates a new Entry object owned by user
+func (m *MemoryDB) NewEntry(entry *models.Entry, user *models.User) error {
+	if entry.Feed.UUID == "" {
+		return BadRequest{"Entry should have a feed"}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	feed := m.feed(entry.Feed.UUID, user)
+	if feed == nil {
+		return NotFound{"Feed does not exist"}
+	}
+
+	m.newEntry(entry, feed, user)
+	return nil
+}
+
+// NewEntries creates multiple new Entry objects which
+// are all owned by feed with feedUUID and user. Feeds are not
+// shared between users, so no other Feeds receive them.
+func (m *MemoryDB) NewEntries(entries []models.Entry, feed models.Feed, user *models.User) ([]models.Feed, error) {
+	if feed.UUID == "" {
+		return nil, BadRequest{"Entry should have a feed"}
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.feed(feed.UUID, user)
+	if found == nil {
+		return nil, NotFound{"Feed does not exist"}
+	}
+
+	for _, entry := range entries {
+		m.newEntry(&entry, found, user)
+	}
+
+	m.events.Publish(user.ID, events.EntriesNew, events.Data{Feed: feed.UUID, NewEntries: len(entries)})
+	return nil, nil
+}
+
+// Entry returns an Entry with id and owned by user
+func (m *MemoryDB) Entry(id string, user *models.User) (entry models.Entry, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	found := m.entry(id, user)
+	if found == nil {
+		err = NotFound{"Feed does not exists"}
+		return
+	}
+
+	entry = *found
+	if feeds := m.feedsWith(func(f *models.Feed) bool { return f.ID == entry.FeedID }); len(feeds) != 0 {
+		entry.Feed = *feeds[0]
+	}
+	return
+}
+
+// EntryWithGUIDExists returns true if an Entry exists with the given guid and is owned by user
+func (m *MemoryDB) EntryWithGUIDExists(guid string, user *models.User) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.entriesWith(func(e *models.Entry) bool { return e.UserID == user.ID && e.GUID == guid })) != 0
+}
+
+// ExistingEntryGUIDs returns which of guids already have an Entry in a feed with feedID owned by user
+func (m *MemoryDB) ExistingEntryGUIDs(feedID string, guids []string, user *models.User) (map[string]bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	feed := m.feed(feedID, user)
+	if feed == nil {
+		return nil, NotFound{"Feed does not exist"}
+	}
+
+	wanted := make(map[string]bool, len(guids))
+	for _, guid := range guids {
+		wanted[guid] = true
+	}
+
+	existing := make(map[string]bool)
+	for _, entry := range m.entries {
+		if entry.FeedID == feed.ID && wanted[entry.GUID] {
+			existing[entry.GUID] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// EntriesWithGUIDs returns the Entries of a Feed with feedID, owned by user,
+// that were published with one of guids
+func (m *MemoryDB) EntriesWithGUIDs(feedID string, guids []string, user *models.User) ([]models.Entry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	feed := m.feed(feedID, user)
+	if feed == nil {
+		return nil, NotFound{"Feed does not exist"}
+	}
+
+	wanted := make(map[string]bool, len(guids))
+	for _, guid := range guids {
+		wanted[guid] = true
+	}
+
+	return entryValues(m.entriesWith(func(e *models.Entry) bool {
+		return e.FeedID == feed.ID && wanted[e.GUID]
+	})), nil
+}
+
+// Entries returns a list of all entries owned by user
+func (m *MemoryDB) Entries(orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+	if marker == models.None {
+		err = BadRequest{"Request should include a valid marker"}
+		return
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entries = entryValues(m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && matchesMarker(e, marker)
+	}))
+	return
+}
+
+// EntriesFromFeed returns all Entries that belong to a feed with feedID
+func (m *MemoryDB) EntriesFromFeed(feedID string, orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+	if marker == models.None {
+		err = BadRequest{"Request should include a valid marker"}
+		return
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	feed := m.feed(feedID, user)
+	if feed == nil {
+		err = NotFound{"Feed not found"}
+		return
+	}
+
+	entries = entryValues(m.entriesWith(func(e *models.Entry) bool {
+		return e.FeedID == feed.ID && matchesMarker(e, marker)
+	}))
+	return
+}
+
+func (m *MemoryDB) savedEntries(orderByDesc bool, marker models.Marker, user *models.User) []models.Entry {
+	return sortedEntryValues(m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && e.Saved && matchesMarker(e, marker)
+	}), orderByDesc)
+}
+
+// SavedEntries returns all Entries owned by user that are saved
+func (m *MemoryDB) SavedEntries(orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+	if marker == models.None {
+		err = BadRequest{"Request should include a valid marker"}
+		return
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.savedEntries(orderByDesc, marker, user), nil
+}
+
+// EntriesFromCategory returns all Entries that are related to a Category with categoryID by the entries' owning Feed
+func (m *MemoryDB) EntriesFromCategory(categoryID string, orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+	if marker == models.None {
+		err = BadRequest{"Request should include a valid marker"}
+		return
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ctg := m.category(categoryID, user)
+	if ctg == nil {
+		err = NotFound{"Category not found"}
+		return
+	}
+
+	if categoryID == user.SavedCategoryUUID {
+		return m.savedEntries(orderByDesc, marker, user), nil
+	}
+
+	feedIDs := m.feedIDsInCategory(ctg)
+	entries = sortedEntryValues(m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && feedIDs[e.FeedID] && matchesMarker(e, marker)
+	}), orderByDesc)
+	return
+}
+
+// MarkEntry applies marker to an entry with id and owned by user
+func (m *MemoryDB) MarkEntry(id string, marker models.Marker, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := m.entry(id, user)
+	if entry == nil {
+		return NotFound{"Feed does not exists"}
+	}
+
+	entry.Mark = marker
+	m.events.Publish(user.ID, events.EntriesMarked, events.Data{Entries: []string{id}, Marker: marker.String()})
+	return nil
+}
+
+// SaveEntry marks an entry with id and owned by user as saved
+func (m *MemoryDB) SaveEntry(id string, user *models.User) error {
+	return m.SaveEntries([]string{id}, user)
+}
+
+// UnsaveEntry removes the saved mark from an entry with id and owned by user
+func (m *MemoryDB) UnsaveEntry(id string, user *models.User) error {
+	return m.UnsaveEntries([]string{id}, user)
+}
+
+// SaveEntries marks a list of entries owned by user as saved
+func (m *MemoryDB) SaveEntries(ids []string, user *models.User) error {
+	return m.setEntriesSaved(ids, true, user)
+}
+
+// UnsaveEntries removes the saved mark from a list of entries owned by user
+func (m *MemoryDB) UnsaveEntries(ids []string, user *models.User) error {
+	return m.setEntriesSaved(ids, false, user)
+}
+
+func (m *MemoryDB) setEntriesSaved(ids []string, saved bool, user *models.User) error {
+	if len(ids) == 0 {
+		return BadRequest{"Request should include at least one entry"}
+	}
+
+	ids = uniqueStrings(ids)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := m.entriesWithIDs(ids, user)
+	if len(entries) != len(ids) {
+		return NotFound{"Entry does not exist"}
+	}
+
+	for _, entry := range entries {
+		entry.Saved = saved
+	}
+
+	if saved {
+		m.events.Publish(user.ID, events.EntriesSaved, events.Data{Entries: ids})
+	} else {
+		m.events.Publish(user.ID, events.EntriesUnsaved, events.Data{Entries: ids})
+	}
+	return nil
+}
+
+// EntryPage returns up to limit Entries owned by user, identified by their
+// primary key. Entries after sinceID are returned oldest first, while
+// those before maxID are returned newest first.
+func (m *MemoryDB) EntryPage(sinceID, maxID uint, limit int, user *models.User) []models.Entry {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entries := m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && e.ID > sinceID && (maxID == 0 || e.ID < maxID)
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		if maxID > 0 {
+			return entries[i].ID > entries[j].ID
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entryValues(entries)
+}
+
+// EntriesWithPrimaryKeys returns the Entries owned by user with ids
+func (m *MemoryDB) EntriesWithPrimaryKeys(ids []uint, user *models.User) []models.Entry {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	wanted := map[uint]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	return entryValues(m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && wanted[e.ID]
+	}))
+}
+
+// EntryPrimaryKeys returns the primary keys of every Entry owned by user
+// that is marked with marker, and saved if saved is set
+func (m *MemoryDB) EntryPrimaryKeys(marker models.Marker, saved bool, user *models.User) (ids []uint) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, entry := range m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && matchesMarker(e, marker) && (!saved || e.Saved)
+	}) {
+		ids = append(ids, entry.ID)
+	}
+	return
+}
+
+// QueryEntries returns the Entries owned by user selected by query
+func (m *MemoryDB) QueryEntries(query EntryQuery, user *models.User) ([]models.Entry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var feed *models.Feed
+	if query.FeedID != "" {
+		if feed = m.feed(query.FeedID, user); feed == nil {
+			return nil, NotFound{"Feed not found"}
+		}
+	}
+
+	var feedIDs map[uint]bool
+	if query.CategoryID != "" {
+		ctg := m.category(query.CategoryID, user)
+		if ctg == nil {
+			return nil, NotFound{"Category not found"}
+		}
+
+		if ctg.UUID == user.SavedCategoryUUID {
+			query.Saved = true
+		} else {
+			feedIDs = m.feedIDsInCategory(ctg)
+		}
+	}
+
+	var tagged map[uint]bool
+	if query.TagID != "" {
+		tag := m.tag(query.TagID, user)
+		if tag == nil {
+			return nil, NotFound{"Tag not found"}
+		}
+		tagged = m.entryTags[tag.ID]
+	}
+
+	entries := m.entriesWith(func(e *models.Entry) bool {
+		switch {
+		case e.UserID != user.ID:
+			return false
+		case feed != nil && e.FeedID != feed.ID:
+			return false
+		case feedIDs != nil && !feedIDs[e.FeedID]:
+			return false
+		case query.TagID != "" && !tagged[e.ID]:
+			return false
+		case query.Saved && !e.Saved:
+			return false
+		case query.Marker != models.None && !matchesMarker(e, query.Marker):
+			return false
+		case !query.NewerThan.IsZero() && !e.CreatedAt.After(query.NewerThan):
+			return false
+		case !query.OlderThan.IsZero() && !e.CreatedAt.Before(query.OlderThan):
+			return false
+		case query.Continuation > 0 && query.OldestFirst && e.ID <= query.Continuation:
+			return false
+		case query.Continuation > 0 && !query.OldestFirst && e.ID >= query.Continuation:
+			return false
+		}
+		return true
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		if query.OldestFirst {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].ID > entries[j].ID
+	})
+
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+	return entryValues(entries), nil
+}
+
+// MarkEntriesWithPrimaryKeys applies marker to the Entries owned by user with ids
+func (m *MemoryDB) MarkEntriesWithPrimaryKeys(ids []uint, marker models.Marker, user *models.User) error {
+	if marker != models.Read && marker != models.Unread {
+		return BadRequest{"Request should include a valid marker"}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	wanted := map[uint]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var marked []string
+	for _, entry := range m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && wanted[e.ID]
+	}) {
+		entry.Mark = marker
+		marked = append(marked, entry.UUID)
+	}
+
+	if len(marked) > 0 {
+		m.events.Publish(user.ID, events.EntriesMarked, events.Data{Entries: marked, Marker: marker.String()})
+	}
+	return nil
+}
+
+func (m *MemoryDB) tag(id string, user *models.User) *models.Tag {
+	for _, tag := range m.tags {
+		if tag.UserID == user.ID && tag.UUID == id {
+			return tag
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) tagWithName(name string, user *models.User) *models.Tag {
+	for _, tag := range m.tags {
+		if tag.UserID == user.ID && tag.Name == name {
+			return tag
+		}
+	}
+	return nil
+}
+
+// NewTag creates a new Tag object owned by user
+func (m *MemoryDB) NewTag(tag *models.Tag, user *models.User) error {
+	if tag.Name == "" {
+		return BadRequest{"Tag name should not be empty"}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.tagWithName(tag.Name, user) != nil {
+		return Conflict{"Tag already exists"}
+	}
+
+	now := time.Now()
+	tag.ID = m.nextID()
+	tag.CreatedAt = now
+	tag.UpdatedAt = now
+	tag.UUID = uuid.NewV4().String()
+	tag.UserID = user.ID
+
+	stored := *tag
+	stored.User = models.User{}
+	stored.Entries = nil
+	m.tags = append(m.tags, &stored)
+	m.entryTags[stored.ID] = map[uint]bool{}
+	return nil
+}
+
+// Tags returns a list of all Tags owned by user
+func (m *MemoryDB) Tags(user *models.User) (tags []models.Tag) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, tag := range m.tags {
+		if tag.UserID == user.ID {
+			tags = append(tags, *tag)
+		}
+	}
+	return
+}
+
+// Tag returns a Tag with id and owned by user
+func (m *MemoryDB) Tag(id string, user *models.User) (tag models.Tag, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	found := m.tag(id, user)
+	if found == nil {
+		err = NotFound{"Tag does not exist"}
+		return
+	}
+	return *found, nil
+}
+
+// EditTag owned by user
+func (m *MemoryDB) EditTag(tag *models.Tag, user *models.User) error {
+	if tag.Name == "" {
+		return BadRequest{"Tag name should not be empty"}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	found := m.tag(tag.UUID, user)
+	if found == nil {
+		return NotFound{"Tag does not exist"}
+	}
+
+	if other := m.tagWithName(tag.Name, user); other != nil && other != found {
+		return Conflict{"Tag already exists"}
+	}
+
+	found.Name = tag.Name
+	found.UpdatedAt = time.Now()
+	return nil
+}
+
+// DeleteTag with id and owned by user
+func (m *MemoryDB) DeleteTag(id string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tag := m.tag(id, user)
+	if tag == nil {
+		return NotFound{"Tag does not exist"}
+	}
+
+	var tags []*models.Tag
+	for _, t := range m.tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	m.tags = tags
+	delete(m.entryTags, tag.ID)
+	return nil
+}
+
+// TagEntries adds a Tag with tagID to a list of entries
+func (m *MemoryDB) TagEntries(tagID string, entryIDs []string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tag, entries, err := m.tagAndEntries(tagID, entryIDs, user)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		m.entryTags[tag.ID][entry.ID] = true
+	}
+	return nil
+}
+
+// UntagEntries removes a Tag with tagID from a list of entries
+func (m *MemoryDB) UntagEntries(tagID string, entryIDs []string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tag, entries, err := m.tagAndEntries(tagID, entryIDs, user)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		delete(m.entryTags[tag.ID], entry.ID)
+	}
+	return nil
+}
+
+func (m *MemoryDB) tagAndEntries(tagID string, entryIDs []string, user *models.User) (tag *models.Tag, entries []*models.Entry, err error) {
+	if len(entryIDs) == 0 {
+		err = BadRequest{"Request should include at least one entry"}
+		return
+	}
+
+	tag = m.tag(tagID, user)
+	if tag == nil {
+		err = NotFound{"Tag does not exist"}
+		return
+	}
+
+	entryIDs = uniqueStrings(entryIDs)
+	entries = m.entriesWithIDs(entryIDs, user)
+	if len(entries) != len(entryIDs) {
+		err = NotFound{"Entry does not exist"}
+	}
+
+	return
+}
+
+// EntriesFromTag returns all Entries which are tagged with tagID
+func (m *MemoryDB) EntriesFromTag(tagID string, orderByDesc bool, marker models.Marker, user *models.User) (entries []models.Entry, err error) {
+	if marker == models.None {
+		err = BadRequest{"Request should include a valid marker"}
+		return
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	tag := m.tag(tagID, user)
+	if tag == nil {
+		err = NotFound{"Tag not found"}
+		return
+	}
+
+	tagged := m.entryTags[tag.ID]
+	entries = sortedEntryValues(m.entriesWith(func(e *models.Entry) bool {
+		return tagged[e.ID] && matchesMarker(e, marker)
+	}), orderByDesc)
+	return
+}
+
+func (m *MemoryDB) removePublications(match func(*models.Publication) bool) {
+	var pubs []*models.Publication
+	for _, pub := range m.publications {
+		if !match(pub) {
+			pubs = append(pubs, pub)
+		}
+	}
+	m.publications = pubs
+}
+
+// NewPublication creates a Publication of a category, a tag or the
+// saved entries owned by user
+func (m *MemoryDB) NewPublication(pub *models.Publication, user *models.User) error {
+	if err := checkPublicationSource(pub); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sourceName := SavedPublicationTitle
+	switch pub.Source {
+	case models.PublishCategory:
+		ctg := m.category(pub.SourceID, user)
+		if ctg == nil {
+			return NotFound{"Category does not exist"}
+		}
+		sourceName = ctg.Name
+	case models.PublishTag:
+		tag := m.tag(pub.SourceID, user)
+		if tag == nil {
+			return NotFound{"Tag does not exist"}
+		}
+		sourceName = tag.Name
+	}
+
+	if err := initPublication(pub, sourceName); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	pub.ID = m.nextID()
+	pub.CreatedAt = now
+	pub.UpdatedAt = now
+	pub.UserID = user.ID
+
+	stored := *pub
+	m.publications = append(m.publications, &stored)
+	return nil
+}
+
+// Publications returns every Publication owned by user
+func (m *MemoryDB) Publications(user *models.User) (pubs []models.Publication) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, pub := range m.publications {
+		if pub.UserID == user.ID {
+			pubs = append(pubs, *pub)
+		}
+	}
+	return
+}
+
+// Publication returns the Publication with id owned by user
+func (m *MemoryDB) Publication(id string, user *models.User) (models.Publication, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, pub := range m.publications {
+		if pub.UserID == user.ID && pub.UUID == id {
+			return *pub, nil
+		}
+	}
+	return models.Publication{}, NotFound{"Publication does not exist"}
+}
+
+// DeletePublication revokes the Publication with id owned by user
+func (m *MemoryDB) DeletePublication(id string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, pub := range m.publications {
+		if pub.UserID == user.ID && pub.UUID == id {
+			m.publications = append(m.publications[:i], m.publications[i+1:]...)
+			return nil
+		}
+	}
+	return NotFound{"Publication does not exist"}
+}
+
+// PublicationWithToken returns the Publication with token along with the User who owns it
+func (m *MemoryDB) PublicationWithToken(token string) (models.Publication, models.User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, pub := range m.publications {
+		if token == "" || pub.Token != token {
+			continue
+		}
+
+		user := m.userWith(func(u *models.User) bool { return u.ID == pub.UserID })
+		if user != nil {
+			return *pub, *user, nil
+		}
+	}
+	return models.Publication{}, models.User{}, NotFound{"Publication does not exist"}
+}
+
+func (m *MemoryDB) webhook(id string, user *models.User) *models.Webhook {
+	for _, hook := range m.webhooks {
+		if hook.UserID == user.ID && hook.UUID == id {
+			return hook
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) removeWebhooks(match func(*models.Webhook) bool) {
+	removed := map[uint]bool{}
+	var hooks []*models.Webhook
+	for _, hook := range m.webhooks {
+		if match(hook) {
+			removed[hook.ID] = true
+		} else {
+			hooks = append(hooks, hook)
+		}
+	}
+	m.webhooks = hooks
+
+	var deliveries []*models.WebhookDelivery
+	for _, delivery := range m.webhookDeliveries {
+		if !removed[delivery.WebhookID] {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	m.webhookDeliveries = deliveries
+}
+
+// NewWebhook creates a Webhook owned by user. The feed,
+// category and tag it filters on should be owned by user.
+func (m *MemoryDB) NewWebhook(hook *models.Webhook, user *models.User) error {
+	if err := checkWebhook(hook, m.AllowPrivateWebhooks); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if hook.FeedID != "" && m.feed(hook.FeedID, user) == nil {
+		return NotFound{"Feed does not exist"}
+	}
+
+	if hook.CategoryID != "" && m.category(hook.CategoryID, user) == nil {
+		return NotFound{"Category does not exist"}
+	}
+
+	if hook.TagID != "" && m.tag(hook.TagID, user) == nil {
+		return NotFound{"Tag does not exist"}
+	}
+
+	if err := initWebhook(hook); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	hook.ID = m.nextID()
+	hook.CreatedAt = now
+	hook.UpdatedAt = now
+	hook.UserID = user.ID
+
+	stored := *hook
+	m.webhooks = append(m.webhooks, &stored)
+	return nil
+}
+
+// Webhooks returns every Webhook owned by user
+func (m *MemoryDB) Webhooks(user *models.User) (hooks []models.Webhook) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, hook := range m.webhooks {
+		if hook.UserID == user.ID {
+			hooks = append(hooks, *hook)
+		}
+	}
+	return
+}
+
+// Webhook returns the Webhook with id owned by user
+func (m *MemoryDB) Webhook(id string, user *models.User) (models.Webhook, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	hook := m.webhook(id, user)
+	if hook == nil {
+		return models.Webhook{}, NotFound{"Webhook does not exist"}
+	}
+	return *hook, nil
+}
+
+// DeleteWebhook with id owned by user, along with its deliveries
+func (m *MemoryDB) DeleteWebhook(id string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hook := m.webhook(id, user)
+	if hook == nil {
+		return NotFound{"Webhook does not exist"}
+	}
+
+	m.removeWebhooks(func(h *models.Webhook) bool { return h == hook })
+	return nil
+}
+
+// NewWebhookDelivery logs a delivery of hook. Only the last
+// WebhookDeliveryLogSize deliveries of a Webhook are kept.
+func (m *MemoryDB) NewWebhookDelivery(delivery *models.WebhookDelivery, hook *models.Webhook) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	delivery.ID = m.nextID()
+	delivery.CreatedAt = now
+	delivery.UpdatedAt = now
+	delivery.UUID = uuid.NewV4().String()
+	delivery.WebhookID = hook.ID
+
+	stored := *delivery
+	stored.Webhook = models.Webhook{}
+	m.webhookDeliveries = append(m.webhookDeliveries, &stored)
+
+	expired := -WebhookDeliveryLogSize
+	for _, d := range m.webhookDeliveries {
+		if d.WebhookID == hook.ID {
+			expired++
+		}
+	}
+
+	var deliveries []*models.WebhookDelivery
+	for _, d := range m.webhookDeliveries {
+		if d.WebhookID == hook.ID && expired > 0 {
+			expired--
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	m.webhookDeliveries = deliveries
+	return nil
+}
+
+// UpdateWebhookDelivery saves the outcome of the last attempt at
+// delivery, which becomes the last status of its Webhook. Deliveries
+// deleted along with their Webhook, or dropped from its log, are
+// not found.
+func (m *MemoryDB) UpdateWebhookDelivery(delivery *models.WebhookDelivery) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var found *models.WebhookDelivery
+	for _, d := range m.webhookDeliveries {
+		if d.ID == delivery.ID {
+			found = d
+		}
+	}
+
+	if found == nil {
+		return NotFound{"Webhook delivery does not exist"}
+	}
+
+	delivery.UpdatedAt = time.Now()
+	found.UpdatedAt = delivery.UpdatedAt
+	found.Attempts = delivery.Attempts
+	found.Status = delivery.Status
+	found.Error = delivery.Error
+
+	for _, hook := range m.webhooks {
+		if hook.ID == delivery.WebhookID {
+			deliveredAt := delivery.UpdatedAt
+			hook.LastStatus = delivery.Status
+			hook.LastDeliveredAt = &deliveredAt
+		}
+	}
+	return nil
+}
+
+// WebhookDeliveries returns the logged deliveries of the Webhook
+// with id owned by user, newest first
+func (m *MemoryDB) WebhookDeliveries(id string, user *models.User) ([]models.WebhookDelivery, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	hook := m.webhook(id, user)
+	if hook == nil {
+		return nil, NotFound{"Webhook does not exist"}
+	}
+
+	var deliveries []models.WebhookDelivery
+	for i := len(m.webhookDeliveries) - 1; i >= 0; i-- {
+		if m.webhookDeliveries[i].WebhookID == hook.ID {
+			deliveries = append(deliveries, *m.webhookDeliveries[i])
+		}
+	}
+	return deliveries, nil
+}
+
+// Stats returns all Stats for the given user
+func (m *MemoryDB) Stats(user *models.User) models.Stats {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return entryStatsOf(m.entriesWith(func(e *models.Entry) bool { return e.UserID == user.ID }))
+}
+
+// FeedStats returns all Stats for a Feed with the given id and that is owned by user
+func (m *MemoryDB) FeedStats(id string, user *models.User) (stats models.Stats, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	feed := m.feed(id, user)
+	if feed == nil {
+		err = NotFound{"Feed not found"}
+		return
+	}
+
+	return entryStatsOf(m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && e.FeedID == feed.ID
+	})), nil
+}
+
+// CategoryStats returns all Stats for a Category with the given id and that is owned by user
+func (m *MemoryDB) CategoryStats(id string, user *models.User) (stats models.Stats, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ctg := m.category(id, user)
+	if ctg == nil {
+		err = NotFound{"Category not found"}
+		return
+	}
+
+	if id == user.SavedCategoryUUID {
+		return entryStatsOf(m.entriesWith(func(e *models.Entry) bool {
+			return e.UserID == user.ID && e.Saved
+		})), nil
+	}
+
+	feedIDs := m.feedIDsInCategory(ctg)
+	return entryStatsOf(m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && feedIDs[e.FeedID]
+	})), nil
+}
+
+// TagStats returns all Stats for a Tag with the given id and that is owned by user
+func (m *MemoryDB) TagStats(id string, user *models.User) (stats models.Stats, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	tag := m.tag(id, user)
+	if tag == nil {
+		err = NotFound{"Tag not found"}
+		return
+	}
+
+	tagged := m.entryTags[tag.ID]
+	return entryStatsOf(m.entriesWith(func(e *models.Entry) bool {
+		return e.UserID == user.ID && tagged[e.ID]
+	})), nil
+}
+
+// StatsTree returns Stats for every Feed and Category owned by user
+// along with the user's overall Stats.
+func (m *MemoryDB) StatsTree(user *models.User) (tree models.StatsTree, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entries := m.entriesWith(func(e *models.Entry) bool { return e.UserID == user.ID })
+	tree.Total = entryStatsOf(entries)
+
+	byFeed := map[uint][]*models.Entry{}
+	var saved []*models.Entry
+	for _, entry := range entries {
+		byFeed[entry.FeedID] = append(byFeed[entry.FeedID], entry)
+		if entry.Saved {
+			saved = append(saved, entry)
+		}
+	}
+
+	tree.Feeds = map[string]models.Stats{}
+	byCategory := map[uint][]*models.Entry{}
+	for _, feed := range m.feedsWith(func(f *models.Feed) bool { return f.UserID == user.ID }) {
+		tree.Feeds[feed.UUID] = entryStatsOf(byFeed[feed.ID])
+		byCategory[feed.CategoryID] = append(byCategory[feed.CategoryID], byFeed[feed.ID]...)
+	}
+
+	tree.Categories = map[string]models.Stats{}
+	for _, ctg := range m.categories {
+		if ctg.DeletedAt == nil && ctg.UserID == user.ID {
+			tree.Categories[ctg.UUID] = entryStatsOf(byCategory[ctg.ID])
+		}
+	}
+
+	tree.Categories[user.SavedCategoryUUID] = entryStatsOf(saved)
+	return
+}
+
+// Trash returns all Feeds and Categories owned by user that were deleted
+// and have not been purged yet.
+func (m *MemoryDB) Trash(user *models.User) (trash models.Trash) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, feed := range m.feeds {
+		if feed.DeletedAt != nil && feed.UserID == user.ID {
+			trash.Feeds = append(trash.Feeds, *feed)
+		}
+	}
+
+	for _, ctg := range m.categories {
+		if ctg.DeletedAt != nil && ctg.UserID == user.ID {
+			trash.Categories = append(trash.Categories, *ctg)
+		}
+	}
+	return
+}
+
+// RestoreFromTrash restores a deleted Feed or Category with id and owned by user.
+// Restoring a category also restores the feeds that were deleted with it.
+func (m *MemoryDB) RestoreFromTrash(id string, user *models.User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, feed := range m.feeds {
+		if feed.DeletedAt != nil && feed.UserID == user.ID && feed.UUID == id {
+			m.restoreFeed(feed, user)
+			return nil
+		}
+	}
+
+	var ctg *models.Category
+	for _, c := range m.categories {
+		if c.DeletedAt != nil && c.UserID == user.ID && c.UUID == id {
+			ctg = c
+			break
+		}
+	}
+
+	if ctg == nil {
+		return NotFound{"Item is not in the trash"}
+	}
+
+	if m.categoryWith(func(c *models.Category) bool { return c.UserID == user.ID && c.Name == ctg.Name }) != nil {
+		return Conflict{"Category already exists"}
+	}
+
+	var feeds []*models.Feed
+	for _, feed := range m.feeds {
+		if feed.CategoryID == ctg.ID && feed.DeletedAt != nil && feed.DeletedAt.Equal(*ctg.DeletedAt) {
+			feeds = append(feeds, feed)
+		}
+	}
+
+	ctg.DeletedAt = nil
+
+	for _, feed := range feeds {
+		m.restoreFeed(feed, user)
+	}
+
+	return nil
+}
+
+func (m *MemoryDB) restoreFeed(feed *models.Feed, user *models.User) {
+	// A feed restored on its own whose category is still deleted
+	// falls back to the user's uncategorized category.
+	if m.categoryWith(func(c *models.Category) bool { return c.ID == feed.CategoryID }) == nil {
+		feed.CategoryID = m.category(user.UncategorizedCategoryUUID, user).ID
+	}
+
+	for _, entry := range m.entries {
+		if entry.FeedID == feed.ID && entry.DeletedAt != nil && entry.DeletedAt.Equal(*feed.DeletedAt) {
+			entry.DeletedAt = nil
+		}
+	}
+	feed.DeletedAt = nil
+}
+
+// PurgeTrash permanently deletes all Feeds, Categories and Entries
+// that have been in the trash for longer than TrashRetention
+func (m *MemoryDB) PurgeTrash() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cutoff := time.Now().UTC().Add(-m.TrashRetention)
+
+	m.removeEntries(func(e *models.Entry) bool {
+		return e.DeletedAt != nil && e.DeletedAt.Before(cutoff)
+	})
+
+	var feeds []*models.Feed
+	for _, feed := range m.feeds {
+		if feed.DeletedAt == nil || !feed.DeletedAt.Before(cutoff) {
+			feeds = append(feeds, feed)
+		}
+	}
+	m.feeds = feeds
+
+	var categories []*models.Category
+	for _, ctg := range m.categories {
+		if ctg.DeletedAt == nil || !ctg.DeletedAt.Before(cutoff) {
+			categories = append(categories, ctg)
+		}
+	}
+	m.categories = categories
+
+	return nil
+}
+
+// DeleteAll objects in the store
+func (m *MemoryDB) DeleteAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.users = nil
+	m.apiKeys = nil
+	m.refreshTokens = nil
+	m.categories = nil
+	m.feeds = nil
+	m.entries = nil
+	m.tags = nil
+	m.lockouts = nil
+	m.invites = nil
+	m.recoveryCodes = nil
+	m.loginChallenges = nil
+	m.publications = nil
+	m.webhooks = nil
+	m.webhookDeliveries = nil
+	m.entryTags = map[uint]map[uint]bool{}
+}
+
+// Export returns every User, along with the objects they own, as an Archive
+func (m *MemoryDB) Export() (Archive, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.export(func(uint) bool { return true }), nil
+}
+
+// ExportUser returns user, along with the objects they own, as an Archive
+func (m *MemoryDB) ExportUser(user *models.User) (Archive, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.export(func(userID uint) bool { return userID == user.ID }), nil
+}
+
+// export returns the objects owned by the users with an ID matching owned as an Archive
+func (m *MemoryDB) export(owned func(userID uint) bool) (archive Archive) {
+	userUUIDs := map[uint]string{}
+	for _, user := range m.users {
+		if owned(user.ID) {
+			userUUIDs[user.ID] = user.UUID
+			var codes []string
+			for _, code := range m.recoveryCodes {
+				if code.UserID == user.ID {
+					codes = append(codes, code.Hash)
+				}
+			}
+
+			archive.Users = append(archive.Users, archivedUser(user, codes))
+		}
+	}
+
+	ctgUUIDs := map[uint]string{}
+	for _, ctg := range m.categories {
+		if !owned(ctg.UserID) {
+			continue
+		}
+		ctgUUIDs[ctg.ID] = ctg.UUID
+		archive.Categories = append(archive.Categories, archivedCategory(ctg, userUUIDs[ctg.UserID]))
+	}
+
+	feedUUIDs := map[uint]string{}
+	for _, feed := range m.feeds {
+		if !owned(feed.UserID) {
+			continue
+		}
+		feedUUIDs[feed.ID] = feed.UUID
+		archive.Feeds = append(archive.Feeds, archivedFeed(feed, userUUIDs[feed.UserID], ctgUUIDs[feed.CategoryID]))
+	}
+
+	for _, tag := range m.tags {
+		if !owned(tag.UserID) {
+			continue
+		}
+		archive.Tags = append(archive.Tags, archivedTag(tag, userUUIDs[tag.UserID]))
+	}
+
+	for _, entry := range m.entries {
+		if !owned(entry.UserID) {
+			continue
+		}
+
+		var tagUUIDs []string
+		for _, tag := range m.tags {
+			if m.entryTags[tag.ID][entry.ID] {
+				tagUUIDs = append(tagUUIDs, tag.UUID)
+			}
+		}
+
+		archive.Entries = append(archive.Entries, archivedEntry(entry, userUUIDs[entry.UserID], feedUUIDs[entry.FeedID], tagUUIDs))
+	}
+
+	for _, pub := range m.publications {
+		if owned(pub.UserID) {
+			archive.Publications = append(archive.Publications, archivedPublication(pub, userUUIDs[pub.UserID]))
+		}
+	}
+
+	for _, hook := range m.webhooks {
+		if owned(hook.UserID) {
+			archive.Webhooks = append(archive.Webhooks, archivedWebhook(hook, userUUIDs[hook.UserID]))
+		}
+	}
+
+	return
+}
+
+// Import creates every object in archive. Nothing is imported if
+// any of the archived users already exist.
+func (m *MemoryDB) Import(archive Archive, progress Progress) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, user := range archive.Users {
+		if m.userWith(func(u *models.User) bool { return u.UUID == user.UUID || u.Username == user.Username }) != nil {
+			return Conflict{"User " + user.Username + " already exists"}
+		}
+	}
+
+	done, total := 0, archive.Size()
+	step := func() {
+		done++
+		progress(done, total)
+	}
+
+	now := time.Now()
+
+	userIDs := map[string]uint{}
+	for _, archived := range archive.Users {
+		user := archived.user()
+		user.ID = m.nextID()
+		user.UpdatedAt = now
+		m.users = append(m.users, &user)
+		userIDs[archived.UUID] = user.ID
+
+		for _, hash := range archived.RecoveryCodes {
+			m.recoveryCodes = append(m.recoveryCodes, &models.RecoveryCode{
+				ID:        m.nextID(),
+				CreatedAt: now,
+				Hash:      hash,
+				UserID:    user.ID,
+			})
+		}
+		step()
+	}
+
+	ctgIDs := map[string]uint{}
+	for _, archived := range archive.Categories {
+		ctg := archived.category(userIDs[archived.UserUUID])
+		ctg.ID = m.nextID()
+		ctg.UpdatedAt = now
+		m.categories = append(m.categories, &ctg)
+		ctgIDs[archived.UUID] = ctg.ID
+		step()
+	}
+
+	feedIDs := map[string]uint{}
+	for _, archived := range archive.Feeds {
+		feed := archived.feed(userIDs[archived.UserUUID], ctgIDs[archived.CategoryUUID])
+		feed.ID = m.nextID()
+		feed.UpdatedAt = now
+		m.feeds = append(m.feeds, &feed)
+		feedIDs[archived.UUID] = feed.ID
+		step()
+	}
+
+	tagIDs := map[string]uint{}
+	for _, archived := range archive.Tags {
+		tag := archived.tag(userIDs[archived.UserUUID])
+		tag.ID = m.nextID()
+		tag.UpdatedAt = now
+		m.tags = append(m.tags, &tag)
+		m.entryTags[tag.ID] = map[uint]bool{}
+		tagIDs[archived.UUID] = tag.ID
+		step()
+	}
+
+	for _, archived := range archive.Entries {
+		entry := archived.entry(userIDs[archived.UserUUID], feedIDs[archived.FeedUUID])
+		entry.ID = m.nextID()
+		entry.UpdatedAt = now
+		m.entries = append(m.entries, &entry)
+
+		for _, tagUUID := range archived.TagUUIDs {
+			m.entryTags[tagIDs[tagUUID]][entry.ID] = true
+		}
+		step()
+	}
+
+	for _, archived := range archive.Publications {
+		pub, err := archived.publication(userIDs[archived.UserUUID])
+		if err != nil {
+			return err
+		}
+
+		pub.ID = m.nextID()
+		pub.UpdatedAt = now
+		m.publications = append(m.publications, &pub)
+		step()
+	}
+
+	for _, archived := range archive.Webhooks {
+		hook, err := archived.webhook(userIDs[archived.UserUUID])
+		if err != nil {
+			return err
+		}
+
+		hook.ID = m.nextID()
+		hook.UpdatedAt = now
+		m.webhooks = append(m.webhooks, &hook)
+		step()
+	}
+
+	return nil
+}
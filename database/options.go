@@ -0,0 +1,96 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Options configure the connections a DB keeps to its database
+type Options struct {
+	// MaxOpenConns limits the number of open connections, zero means no limit
+	MaxOpenConns int
+
+	// MaxIdleConns limits the number of idle connections kept in the pool
+	MaxIdleConns int
+
+	// ConnMaxLifetime is how long a connection may be reused, zero means forever
+	ConnMaxLifetime time.Duration
+
+	// ConnectRetries is how many more times connecting is attempted
+	// at startup. The wait between attempts starts at ConnectBackoff
+	// and doubles after every attempt.
+	ConnectRetries int
+	ConnectBackoff time.Duration
+
+	// SQLite specific settings
+	SQLiteWAL         bool
+	SQLiteBusyTimeout time.Duration
+	SQLiteForeignKeys bool
+}
+
+// DefaultOptions are the Options used by NewDB
+var DefaultOptions = Options{
+	MaxIdleConns:      2,
+	ConnectBackoff:    time.Second,
+	SQLiteBusyTimeout: 5 * time.Second,
+	SQLiteForeignKeys: true,
+}
+
+// openWithRetry opens a connection to the database, which gorm pings,
+// retrying with an exponential backoff as configured by opts
+func openWithRetry(dbType, conn string, opts Options) (gormDB *gorm.DB, err error) {
+	backoff := opts.ConnectBackoff
+	for attempt := 0; ; attempt++ {
+		gormDB, err = gorm.Open(dbType, conn)
+		if err == nil || attempt >= opts.ConnectRetries {
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// sqliteConnection adds the SQLite settings in opts to conn
+func sqliteConnection(conn string, opts Options) string {
+	params := []string{
+		"_busy_timeout=" + strconv.FormatInt(int64(opts.SQLiteBusyTimeout/time.Millisecond), 10),
+		"_foreign_keys=" + strconv.FormatBool(opts.SQLiteForeignKeys),
+	}
+
+	if opts.SQLiteWAL {
+		params = append(params, "_journal_mode=WAL")
+	}
+
+	separator := "?"
+	if strings.Contains(conn, "?") {
+		separator = "&"
+	}
+
+	return conn + separator + strings.Join(params, "&")
+}
+
+// Ping checks that the database can still be reached
+func (db *DB) Ping() error {
+	return db.db.DB().Ping()
+}
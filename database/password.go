@@ -0,0 +1,207 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// Password hashing algorithms
+const (
+	Scrypt   = "scrypt"
+	Argon2id = "argon2id"
+)
+
+// algorithmStrength orders the hashing algorithms from weakest to strongest
+var algorithmStrength = map[string]int{
+	Scrypt:   1,
+	Argon2id: 2,
+}
+
+// HashParams are the algorithm and costs a password is hashed with.
+// They are stored along with every hash, see String.
+type HashParams struct {
+	Algorithm string
+
+	// N, R and P are the CPU/memory cost, block size and
+	// parallelization of scrypt. N must be a power of two.
+	N int
+	R int
+	P int
+
+	// Time, Memory, in KiB, and Threads are the costs of argon2id
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// LegacyHashParams are the parameters passwords were hashed with before
+// they were stored. Users without stored parameters use them.
+var LegacyHashParams = HashParams{Algorithm: Scrypt, N: 1 << 14, R: 8, P: 1}
+
+// DefaultScryptParams are the scrypt costs used when none are configured
+var DefaultScryptParams = LegacyHashParams
+
+// DefaultArgon2idParams are the argon2id costs used when none are configured
+var DefaultArgon2idParams = HashParams{Algorithm: Argon2id, Time: 3, Memory: 64 * 1024, Threads: 2}
+
+// DefaultPasswordHashing is the HashParams used by NewDB
+var DefaultPasswordHashing = DefaultScryptParams
+
+// String encodes p as stored in models.User.PasswordParams
+func (p HashParams) String() string {
+	switch p.Algorithm {
+	case Argon2id:
+		return fmt.Sprintf("%s$v=%d,m=%d,t=%d,p=%d", Argon2id, argon2.Version, p.Memory, p.Time, p.Threads)
+	default:
+		return fmt.Sprintf("%s$n=%d,r=%d,p=%d", p.Algorithm, p.N, p.R, p.P)
+	}
+}
+
+// parseHashParams decodes HashParams encoded by String.
+// An empty string decodes to LegacyHashParams.
+func parseHashParams(encoded string) (HashParams, error) {
+	if encoded == "" {
+		return LegacyHashParams, nil
+	}
+
+	parts := strings.SplitN(encoded, "$", 2)
+	if len(parts) != 2 {
+		return HashParams{}, errors.New("malformed password hash parameters " + encoded)
+	}
+
+	values := map[string]int{}
+	for _, pair := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return HashParams{}, errors.New("malformed password hash parameters " + encoded)
+		}
+
+		value, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return HashParams{}, errors.New("malformed password hash parameters " + encoded)
+		}
+		values[kv[0]] = value
+	}
+
+	params := HashParams{Algorithm: parts[0]}
+	switch params.Algorithm {
+	case Scrypt:
+		params.N, params.R, params.P = values["n"], values["r"], values["p"]
+	case Argon2id:
+		if values["v"] != argon2.Version {
+			return HashParams{}, errors.New("unsupported argon2 version in " + encoded)
+		}
+		params.Memory, params.Time, params.Threads = uint32(values["m"]), uint32(values["t"]), uint8(values["p"])
+	default:
+		return HashParams{}, errors.New("unknown password hashing algorithm " + params.Algorithm)
+	}
+
+	return params, nil
+}
+
+// weakerThan returns true if a hash made with p should be
+// replaced by one made with stronger
+func (p HashParams) weakerThan(stronger HashParams) bool {
+	if p.Algorithm != stronger.Algorithm {
+		return algorithmStrength[p.Algorithm] < algorithmStrength[stronger.Algorithm]
+	}
+
+	if p.Algorithm == Argon2id {
+		return p.Time < stronger.Time || p.Memory < stronger.Memory || p.Threads < stronger.Threads
+	}
+	return p.N < stronger.N || p.R < stronger.R || p.P < stronger.P
+}
+
+// key derives the hash of password with salt
+func (p HashParams) key(password string, salt []byte) ([]byte, error) {
+	switch p.Algorithm {
+	case Scrypt:
+		return scrypt.Key([]byte(password), salt, p.N, p.R, p.P, PWHashBytes)
+	case Argon2id:
+		if p.Time < 1 || p.Threads < 1 {
+			return nil, errors.New("argon2id time and threads must be at least 1")
+		}
+		return argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, PWHashBytes), nil
+	default:
+		return nil, errors.New("unknown password hashing algorithm " + p.Algorithm)
+	}
+}
+
+// setPassword hashes password with a new salt using params and stores it in user
+func setPassword(user *models.User, password string, params HashParams) error {
+	salt := make([]byte, PWSaltBytes)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	hash, err := params.key(password, salt)
+	if err != nil {
+		return err
+	}
+
+	user.PasswordHash = hash
+	user.PasswordSalt = salt
+	user.PasswordParams = params.String()
+	return nil
+}
+
+// checkPassword returns an Unauthorized error if password is not user's
+func checkPassword(user *models.User, password string) error {
+	params, err := parseHashParams(user.PasswordParams)
+	if err != nil {
+		return err
+	}
+
+	hash, err := params.key(password, user.PasswordSalt)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(hash, user.PasswordHash) != 1 {
+		return Unauthorized{"Invalid credentials"}
+	}
+
+	return nil
+}
+
+// needsRehash returns true if user's password hash is weaker than one made with params.
+// Hashes with parameters that cannot be decoded are never replaced.
+func needsRehash(user *models.User, params HashParams) bool {
+	stored, err := parseHashParams(user.PasswordParams)
+	return err == nil && stored.weakerThan(params)
+}
+
+// rejectUnknownUser fails to authenticate a user that does not exist
+// after doing as much work, and with the same error, as a bad password
+// would so that usernames cannot be discovered by logging in
+func rejectUnknownUser(params HashParams, password string) error {
+	params.key(password, make([]byte, PWSaltBytes))
+	return Unauthorized{"Invalid credentials"}
+}
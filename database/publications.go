@@ -0,0 +1,142 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// PublicationTokenBytes is the number of random bytes in the token of a Publication
+const PublicationTokenBytes = 24
+
+// SavedPublicationTitle is the default title of Publications of saved entries
+const SavedPublicationTitle = "Saved entries"
+
+func newPublicationToken() (string, error) {
+	b := make([]byte, PublicationTokenBytes)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// checkPublicationSource makes sure pub has a valid source
+func checkPublicationSource(pub *models.Publication) error {
+	switch pub.Source {
+	case models.PublishCategory, models.PublishTag:
+		if pub.SourceID == "" {
+			return BadRequest{"Publication should include a source id"}
+		}
+	case models.PublishSaved:
+		pub.SourceID = ""
+	default:
+		return BadRequest{"Publication should include a valid source"}
+	}
+	return nil
+}
+
+// initPublication fills in the id and token of pub, and its title
+// with the name of its source if it has none
+func initPublication(pub *models.Publication, sourceName string) error {
+	token, err := newPublicationToken()
+	if err != nil {
+		return err
+	}
+
+	if pub.Title == "" {
+		pub.Title = sourceName
+	}
+
+	pub.UUID = uuid.NewV4().String()
+	pub.Token = token
+	return nil
+}
+
+// NewPublication creates a Publication of a category, a tag or the
+// saved entries owned by user
+func (db *DB) NewPublication(pub *models.Publication, user *models.User) error {
+	if err := checkPublicationSource(pub); err != nil {
+		return err
+	}
+
+	sourceName := SavedPublicationTitle
+	switch pub.Source {
+	case models.PublishCategory:
+		ctg, err := db.Category(pub.SourceID, user)
+		if err != nil {
+			return err
+		}
+		sourceName = ctg.Name
+	case models.PublishTag:
+		tag, err := db.Tag(pub.SourceID, user)
+		if err != nil {
+			return err
+		}
+		sourceName = tag.Name
+	}
+
+	if err := initPublication(pub, sourceName); err != nil {
+		return err
+	}
+
+	pub.UserID = user.ID
+	return db.db.Create(pub).Error
+}
+
+// Publications returns every Publication owned by user
+func (db *DB) Publications(user *models.User) (pubs []models.Publication) {
+	db.db.Where("user_id = ?", user.ID).Order("created_at ASC").Find(&pubs)
+	return
+}
+
+// Publication returns the Publication with id owned by user
+func (db *DB) Publication(id string, user *models.User) (pub models.Publication, err error) {
+	if db.db.Where("uuid = ? AND user_id = ?", id, user.ID).First(&pub).RecordNotFound() {
+		err = NotFound{"Publication does not exist"}
+	}
+	return
+}
+
+// DeletePublication revokes the Publication with id owned by user
+func (db *DB) DeletePublication(id string, user *models.User) error {
+	pub, err := db.Publication(id, user)
+	if err != nil {
+		return err
+	}
+
+	return db.db.Delete(&pub).Error
+}
+
+// PublicationWithToken returns the Publication with token along with the User who owns it
+func (db *DB) PublicationWithToken(token string) (pub models.Publication, user models.User, err error) {
+	if token == "" || db.db.Where("token = ?", token).First(&pub).RecordNotFound() {
+		err = NotFound{"Publication does not exist"}
+		return
+	}
+
+	if db.db.First(&user, pub.UserID).RecordNotFound() {
+		err = NotFound{"Publication does not exist"}
+	}
+	return
+}
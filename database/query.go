@@ -0,0 +1,154 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"time"
+
+	"github.com/chavamee/syndication/events"
+	"github.com/chavamee/syndication/models"
+)
+
+// EntryQuery selects a page of the Entries owned by a user.
+// Fields left empty do not filter entries.
+type EntryQuery struct {
+	// FeedID and CategoryID are the UUIDs of the feed, or the
+	// category of the feeds, entries belong to
+	FeedID     string
+	CategoryID string
+
+	// TagID is the UUID of a tag entries are tagged with
+	TagID string
+
+	// Saved only selects saved entries
+	Saved bool
+
+	// Marker selects entries marked with it, unless it is None or Any
+	Marker models.Marker
+
+	// NewerThan and OlderThan bound when entries were created
+	NewerThan time.Time
+	OlderThan time.Time
+
+	// Entries are returned newest first, or oldest first if OldestFirst
+	// is set, starting after the entry with the primary key Continuation
+	OldestFirst  bool
+	Continuation uint
+
+	// Limit is the most entries returned, zero means no limit
+	Limit int
+}
+
+// QueryEntries returns the Entries owned by user selected by query
+func (db *DB) QueryEntries(query EntryQuery, user *models.User) (entries []models.Entry, err error) {
+	q := db.db.Where("user_id = ?", user.ID)
+
+	if query.FeedID != "" {
+		feed := models.Feed{}
+		if db.db.Model(user).Where("uuid = ?", query.FeedID).Related(&feed).RecordNotFound() {
+			err = NotFound{"Feed not found"}
+			return
+		}
+		q = q.Where("feed_id = ?", feed.ID)
+	}
+
+	if query.CategoryID != "" {
+		ctg := models.Category{}
+		if db.db.Model(user).Where("uuid = ?", query.CategoryID).Related(&ctg).RecordNotFound() {
+			err = NotFound{"Category not found"}
+			return
+		}
+
+		if ctg.UUID == user.SavedCategoryUUID {
+			query.Saved = true
+		} else {
+			var feedIDs []uint
+			db.db.Model(&models.Feed{}).Where("category_id = ?", ctg.ID).Pluck("id", &feedIDs)
+			q = q.Where("feed_id in (?)", feedIDs)
+		}
+	}
+
+	if query.TagID != "" {
+		tag := models.Tag{}
+		if db.db.Model(user).Where("uuid = ?", query.TagID).Related(&tag).RecordNotFound() {
+			err = NotFound{"Tag not found"}
+			return
+		}
+		q = q.Where("id in (?)", db.db.Table("entry_tags").Select("entry_id").Where("tag_id = ?", tag.ID).QueryExpr())
+	}
+
+	if query.Saved {
+		q = q.Where("saved = ?", true)
+	}
+
+	if query.Marker != models.None && query.Marker != models.Any {
+		q = q.Where("mark = ?", query.Marker)
+	}
+
+	if !query.NewerThan.IsZero() {
+		q = q.Where("created_at > ?", query.NewerThan)
+	}
+
+	if !query.OlderThan.IsZero() {
+		q = q.Where("created_at < ?", query.OlderThan)
+	}
+
+	if query.OldestFirst {
+		if query.Continuation > 0 {
+			q = q.Where("id > ?", query.Continuation)
+		}
+		q = q.Order("id ASC")
+	} else {
+		if query.Continuation > 0 {
+			q = q.Where("id < ?", query.Continuation)
+		}
+		q = q.Order("id DESC")
+	}
+
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+
+	q.Find(&entries)
+	db.loadEntryItems(entries)
+	return
+}
+
+// MarkEntriesWithPrimaryKeys applies marker to the Entries owned by user with ids
+func (db *DB) MarkEntriesWithPrimaryKeys(ids []uint, marker models.Marker, user *models.User) error {
+	if marker != models.Read && marker != models.Unread {
+		return BadRequest{"Request should include a valid marker"}
+	}
+
+	var marked []string
+	for _, chunk := range chunkIDs(ids) {
+		entries := db.db.Model(&models.Entry{}).Where("user_id = ? AND id in (?)", user.ID, chunk)
+		if err := entries.UpdateColumn("mark", marker).Error; err != nil {
+			return err
+		}
+
+		var uuids []string
+		entries.Pluck("uuid", &uuids)
+		marked = append(marked, uuids...)
+	}
+
+	if len(marked) > 0 {
+		db.events.Publish(user.ID, events.EntriesMarked, events.Data{Entries: marked, Marker: marker.String()})
+	}
+	return nil
+}
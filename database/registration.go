@@ -0,0 +1,234 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// DefaultInviteExpiration is how long an Invite is valid for when no expiration is requested
+const DefaultInviteExpiration = time.Hour * 24 * 7
+
+// InviteCodeBytes is the number of random bytes in an Invite code
+const InviteCodeBytes = 12
+
+// usernamePattern matches valid usernames
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,31}$`)
+
+// PasswordPolicy decides which passwords users can choose
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLetter bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// DefaultPasswordPolicy is the PasswordPolicy used by NewDB.
+// Long passwords are refused since hashing them is expensive.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 8,
+	MaxLength: 256,
+}
+
+// check returns a BadRequest describing why password does not follow the policy
+func (p PasswordPolicy) check(password string) error {
+	length := len([]rune(password))
+	if length < p.MinLength {
+		return BadRequest{"Password must be at least " + strconv.Itoa(p.MinLength) + " characters long"}
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return BadRequest{"Password must be at most " + strconv.Itoa(p.MaxLength) + " characters long"}
+	}
+
+	var letter, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	if p.RequireLetter && !letter {
+		return BadRequest{"Password must contain a letter"}
+	}
+
+	if p.RequireDigit && !digit {
+		return BadRequest{"Password must contain a digit"}
+	}
+
+	if p.RequireSymbol && !symbol {
+		return BadRequest{"Password must contain a symbol"}
+	}
+
+	return nil
+}
+
+// checkUsername returns a BadRequest if username is not valid
+func checkUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return BadRequest{"Username must be 1 to 32 letters, digits, '.', '_' or '-' and start with a letter or digit"}
+	}
+	return nil
+}
+
+// MaxPreferences is the number of Preferences a User can have
+const MaxPreferences = 100
+
+// ProfileChanges are the changes made to the profile of a User.
+// Nil fields are left unchanged, while empty ones clear the field.
+type ProfileChanges struct {
+	Username    *string             `json:"username"`
+	Email       *string             `json:"email"`
+	Timezone    *string             `json:"timezone"`
+	Preferences *models.Preferences `json:"preferences"`
+}
+
+// check returns a BadRequest if the changes are not valid
+func (p ProfileChanges) check() error {
+	if p.Username != nil {
+		if err := checkUsername(*p.Username); err != nil {
+			return err
+		}
+	}
+
+	if p.Email != nil && *p.Email != "" {
+		address, err := mail.ParseAddress(*p.Email)
+		if err != nil || address.Address != *p.Email {
+			return BadRequest{"Email address is not valid"}
+		}
+	}
+
+	if p.Timezone != nil && *p.Timezone != "" {
+		if _, err := time.LoadLocation(*p.Timezone); err != nil {
+			return BadRequest{"Unknown timezone " + *p.Timezone}
+		}
+	}
+
+	if p.Preferences != nil && len(*p.Preferences) > MaxPreferences {
+		return BadRequest{"A user can have at most " + strconv.Itoa(MaxPreferences) + " preferences"}
+	}
+
+	return nil
+}
+
+// checkCredentials returns a BadRequest if a user cannot be created with username and password
+func (p PasswordPolicy) checkCredentials(username, password string) error {
+	if err := checkUsername(username); err != nil {
+		return err
+	}
+	return p.check(password)
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, InviteCodeBytes)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// initInvite fills in the code of invite and checks its limits
+func initInvite(invite *models.Invite) error {
+	if invite.MaxUses < 0 {
+		return BadRequest{"Maximum uses cannot be negative"}
+	}
+
+	if invite.ExpiresAt.IsZero() {
+		invite.ExpiresAt = time.Now().Add(DefaultInviteExpiration)
+	} else if !invite.ExpiresAt.After(time.Now()) {
+		return BadRequest{"Expiration must be in the future"}
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		return err
+	}
+
+	invite.UUID = uuid.NewV4().String()
+	invite.Code = code
+	invite.Uses = 0
+	return nil
+}
+
+// NewInvite creates an Invite that expires at invite.ExpiresAt or, if it
+// is not set, after DefaultInviteExpiration
+func (db *DB) NewInvite(invite *models.Invite) error {
+	if err := initInvite(invite); err != nil {
+		return err
+	}
+
+	return db.db.Create(invite).Error
+}
+
+// Invites returns every Invite, including used up and expired ones
+func (db *DB) Invites() (invites []models.Invite) {
+	db.db.Order("created_at ASC").Find(&invites)
+	return
+}
+
+// DeleteInvite with id
+func (db *DB) DeleteInvite(id string) error {
+	invite := models.Invite{}
+	if db.db.Where("uuid = ?", id).First(&invite).RecordNotFound() {
+		return NotFound{"Invite does not exist"}
+	}
+
+	return db.db.Delete(&invite).Error
+}
+
+// NewUserWithInvite creates a new User if code belongs to an Invite
+// that has not expired or been used up
+func (db *DB) NewUserWithInvite(username, password, code string) error {
+	if err := db.PasswordPolicy.checkCredentials(username, password); err != nil {
+		return err
+	}
+
+	// Claim a use first so concurrent registrations cannot exceed the limit
+	claimed := db.db.Model(&models.Invite{}).
+		Where("code = ? AND expires_at > ?", code, time.Now()).
+		Where("max_uses = 0 OR uses < max_uses").
+		UpdateColumn("uses", gorm.Expr("uses + 1")).RowsAffected
+	if claimed == 0 {
+		return Unauthorized{"Invalid invite code"}
+	}
+
+	if err := db.NewUser(username, password); err != nil {
+		db.db.Model(&models.Invite{}).Where("code = ?", code).UpdateColumn("uses", gorm.Expr("uses - 1"))
+		return err
+	}
+
+	return nil
+}
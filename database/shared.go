@@ -0,0 +1,614 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/chavamee/syndication/events"
+	"github.com/chavamee/syndication/models"
+)
+
+// sharedFeed returns the SharedFeed for feed's subscription,
+// creating it from feed if no user has subscribed to it yet.
+func sharedFeed(tx *gorm.DB, feed *models.Feed) (source models.SharedFeed, created bool, err error) {
+	if !tx.Where("subscription = ?", feed.Subscription).First(&source).RecordNotFound() {
+		return
+	}
+
+	source = models.SharedFeed{
+		Subscription: feed.Subscription,
+		Title:        feed.Title,
+		Description:  feed.Description,
+		Source:       feed.Source,
+		TTL:          feed.TTL,
+		Etag:         feed.Etag,
+		LastUpdated:  feed.LastUpdated,
+		Status:       feed.Status,
+	}
+
+	err = tx.Create(&source).Error
+	created = true
+	return
+}
+
+// sharedItem returns the Item with entry's GUID published by the
+// SharedFeed with sharedFeedID, creating it from entry if needed.
+func sharedItem(tx *gorm.DB, sharedFeedID uint, entry *models.Entry) (item models.Item, created bool, err error) {
+	if entry.GUID != "" && !tx.Where("shared_feed_id = ? AND guid = ?", sharedFeedID, entry.GUID).First(&item).RecordNotFound() {
+		return
+	}
+
+	item = models.Item{
+		SharedFeedID: sharedFeedID,
+		GUID:         entry.GUID,
+		Title:        entry.Title,
+		Link:         entry.Link,
+		Description:  entry.Description,
+		Author:       entry.Author,
+		Published:    entry.Published,
+	}
+
+	err = tx.Create(&item).Error
+	created = true
+	return
+}
+
+// maxQueryParams bounds the number of parameters bound to a
+// single statement, which some backends limit
+const maxQueryParams = 500
+
+func chunkIDs(ids []uint) (chunks [][]uint) {
+	for len(ids) > maxQueryParams {
+		chunks = append(chunks, ids[:maxQueryParams])
+		ids = ids[maxQueryParams:]
+	}
+	return append(chunks, ids)
+}
+
+// uniqueStrings returns values without duplicates, keeping their order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+func chunkStrings(values []string) (chunks [][]string) {
+	for len(values) > maxQueryParams {
+		chunks = append(chunks, values[:maxQueryParams])
+		values = values[maxQueryParams:]
+	}
+	return append(chunks, values)
+}
+
+// insertRows inserts rows into table using as few statements as possible
+func insertRows(tx *gorm.DB, table string, columns []string, rows [][]interface{}) error {
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	prefix := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES "
+	perStatement := maxQueryParams / len(columns)
+
+	for len(rows) > 0 {
+		count := perStatement
+		if len(rows) < count {
+			count = len(rows)
+		}
+
+		values := make([]string, count)
+		args := make([]interface{}, 0, count*len(columns))
+		for i, row := range rows[:count] {
+			values[i] = placeholder
+			args = append(args, row...)
+		}
+
+		if err := tx.Exec(prefix+strings.Join(values, ", "), args...).Error; err != nil {
+			return err
+		}
+
+		rows = rows[count:]
+	}
+
+	return nil
+}
+
+func setFeedSource(feed *models.Feed, source *models.SharedFeed) {
+	if feed.Title == "" {
+		feed.Title = source.Title
+	}
+
+	feed.Description = source.Description
+	feed.Subscription = source.Subscription
+	feed.Source = source.Source
+	feed.TTL = source.TTL
+	feed.Etag = source.Etag
+	feed.LastUpdated = source.LastUpdated
+	feed.Status = source.Status
+}
+
+func setEntryItem(entry *models.Entry, item *models.Item) {
+	entry.GUID = item.GUID
+	entry.Title = item.Title
+	entry.Link = item.Link
+	entry.Description = item.Description
+	entry.Author = item.Author
+	entry.Published = item.Published
+}
+
+// loadFeedSources populates feeds with the data of their SharedFeed
+func (db *DB) loadFeedSources(feeds []models.Feed) {
+	if len(feeds) == 0 {
+		return
+	}
+
+	ids := make([]uint, len(feeds))
+	for i, feed := range feeds {
+		ids[i] = feed.SharedFeedID
+	}
+
+	var sources []models.SharedFeed
+	for _, chunk := range chunkIDs(ids) {
+		var found []models.SharedFeed
+		db.db.Where("id in (?)", chunk).Find(&found)
+		sources = append(sources, found...)
+	}
+
+	byID := make(map[uint]*models.SharedFeed, len(sources))
+	for i := range sources {
+		byID[sources[i].ID] = &sources[i]
+	}
+
+	for i := range feeds {
+		if source, ok := byID[feeds[i].SharedFeedID]; ok {
+			setFeedSource(&feeds[i], source)
+		}
+	}
+}
+
+// loadFeedSource populates feed with the data of its SharedFeed
+func (db *DB) loadFeedSource(feed *models.Feed) {
+	source := models.SharedFeed{}
+	if !db.db.First(&source, feed.SharedFeedID).RecordNotFound() {
+		setFeedSource(feed, &source)
+	}
+}
+
+// loadEntryItem populates entry with the contents of its Item
+func (db *DB) loadEntryItem(entry *models.Entry) {
+	item := models.Item{}
+	if !db.db.First(&item, entry.ItemID).RecordNotFound() {
+		setEntryItem(entry, &item)
+	}
+}
+
+// loadEntryItems populates entries with the contents of their Item
+func (db *DB) loadEntryItems(entries []models.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	ids := make([]uint, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ItemID
+	}
+
+	var items []models.Item
+	for _, chunk := range chunkIDs(ids) {
+		var found []models.Item
+		db.db.Where("id in (?)", chunk).Find(&found)
+		items = append(items, found...)
+	}
+
+	byID := make(map[uint]*models.Item, len(items))
+	for i := range items {
+		byID[items[i].ID] = &items[i]
+	}
+
+	for i := range entries {
+		if item, ok := byID[entries[i].ItemID]; ok {
+			setEntryItem(&entries[i], item)
+		}
+	}
+}
+
+// newEntry creates an Entry for feed owned by user. The feed's Item with
+// the same GUID is reused if it exists, otherwise a new Item is created
+// and handed out to every other user subscribed to the same SharedFeed.
+func (db *DB) newEntry(entry *models.Entry, feed *models.Feed, user *models.User) error {
+	item, created, err := sharedItem(db.db, feed.SharedFeedID, entry)
+	if err != nil {
+		return err
+	}
+
+	if !created && !db.db.Unscoped().Where("feed_id = ? AND item_id = ?", feed.ID, item.ID).First(&models.Entry{}).RecordNotFound() {
+		return Conflict{"Entry already exists"}
+	}
+
+	entry.UUID = uuid.NewV4().String()
+	entry.Feed = *feed
+	entry.FeedID = feed.ID
+	entry.ItemID = item.ID
+
+	db.db.Model(user).Association("Entries").Append(entry)
+
+	if !created {
+		return nil
+	}
+
+	var subscriptions []models.Feed
+	db.db.Where("shared_feed_id = ? AND user_id != ?", feed.SharedFeedID, user.ID).Find(&subscriptions)
+	for _, subscription := range subscriptions {
+		db.db.Create(&models.Entry{
+			UUID:   uuid.NewV4().String(),
+			UserID: subscription.UserID,
+			FeedID: subscription.ID,
+			ItemID: item.ID,
+			Mark:   models.Unread,
+		})
+
+		db.events.Publish(subscription.UserID, events.EntriesNew, events.Data{Feed: subscription.UUID, NewEntries: 1})
+	}
+
+	return nil
+}
+
+// insertEntries creates entries for feed owned by user in bulk. Like
+// newEntry, Items are shared by GUID and new ones are handed out to every
+// other user subscribed to the feed. Entries that feed already has are skipped.
+// It returns the number of entries created for user and the Feeds of the
+// other users, with their User and the Entries handed out to them.
+func insertEntries(tx *gorm.DB, entries []models.Entry, feed *models.Feed, user *models.User) (int, []models.Feed, error) {
+	var guids []string
+	for _, entry := range entries {
+		if entry.GUID != "" {
+			guids = append(guids, entry.GUID)
+		}
+	}
+
+	itemIDs, err := sharedItemIDs(tx, feed.SharedFeedID, guids)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var ids []uint
+	for _, id := range itemIDs {
+		ids = append(ids, id)
+	}
+
+	subscribed := make(map[uint]bool)
+	for _, chunk := range chunkIDs(ids) {
+		var found []uint
+		err = tx.Table("entries").Where("feed_id = ? AND item_id in (?)", feed.ID, chunk).Pluck("item_id", &found).Error
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for _, id := range found {
+			subscribed[id] = true
+		}
+	}
+
+	now := time.Now()
+	var shared []models.Entry
+	var newGUIDs []string
+	var itemRows [][]interface{}
+	for _, entry := range entries {
+		if entry.GUID == "" {
+			continue
+		}
+		if _, ok := itemIDs[entry.GUID]; ok {
+			continue
+		}
+
+		itemIDs[entry.GUID] = 0
+		shared = append(shared, entry)
+		newGUIDs = append(newGUIDs, entry.GUID)
+		itemRows = append(itemRows, []interface{}{
+			now, now, feed.SharedFeedID, entry.GUID,
+			entry.Title, entry.Link, entry.Description, entry.Author, entry.Published,
+		})
+	}
+
+	err = insertRows(tx, "items", []string{
+		"created_at", "updated_at", "shared_feed_id", "guid",
+		"title", "link", "description", "author", "published",
+	}, itemRows)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	created, err := sharedItemIDs(tx, feed.SharedFeedID, newGUIDs)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var createdIDs []uint
+	for guid, id := range created {
+		itemIDs[guid] = id
+		createdIDs = append(createdIDs, id)
+	}
+
+	var entryRows [][]interface{}
+	for _, entry := range entries {
+		var itemID uint
+		if entry.GUID != "" {
+			itemID = itemIDs[entry.GUID]
+		} else {
+			item, _, err := sharedItem(tx, feed.SharedFeedID, &entry)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			itemID = item.ID
+			shared = append(shared, entry)
+			createdIDs = append(createdIDs, itemID)
+		}
+
+		if subscribed[itemID] {
+			continue
+		}
+
+		subscribed[itemID] = true
+		entryRows = append(entryRows, []interface{}{
+			uuid.NewV4().String(), now, now, user.ID, feed.ID, itemID, entry.Saved, entry.Mark,
+		})
+	}
+
+	added := len(entryRows)
+
+	var subscriptions []models.Feed
+	if len(createdIDs) > 0 {
+		tx.Preload("User").Where("shared_feed_id = ? AND user_id != ?", feed.SharedFeedID, user.ID).Find(&subscriptions)
+	}
+
+	for i, subscription := range subscriptions {
+		for _, itemID := range createdIDs {
+			entryRows = append(entryRows, []interface{}{
+				uuid.NewV4().String(), now, now, subscription.UserID, subscription.ID, itemID, false, models.Unread,
+			})
+		}
+
+		subscriptions[i].Entries = shared
+	}
+
+	err = insertRows(tx, "entries", []string{
+		"uuid", "created_at", "updated_at", "user_id", "feed_id", "item_id", "saved", "mark",
+	}, entryRows)
+	return added, subscriptions, err
+}
+
+// sharedItemIDs maps each of guids to the ID of the Item the
+// SharedFeed with sharedFeedID published with it, if any
+func sharedItemIDs(tx *gorm.DB, sharedFeedID uint, guids []string) (map[string]uint, error) {
+	ids := make(map[string]uint, len(guids))
+	if len(guids) == 0 {
+		return ids, nil
+	}
+
+	for _, chunk := range chunkStrings(guids) {
+		var items []models.Item
+		err := tx.Select("id, guid").Where("shared_feed_id = ? AND guid in (?)", sharedFeedID, chunk).Find(&items).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			ids[item.GUID] = item.ID
+		}
+	}
+
+	return ids, nil
+}
+
+// subscribeToItems gives feed an Entry for every Item its SharedFeed already has
+func (db *DB) subscribeToItems(feed *models.Feed, user *models.User) {
+	var items []models.Item
+	db.db.Where("shared_feed_id = ?", feed.SharedFeedID).Find(&items)
+	for _, item := range items {
+		db.db.Create(&models.Entry{
+			UUID:   uuid.NewV4().String(),
+			UserID: user.ID,
+			FeedID: feed.ID,
+			ItemID: item.ID,
+			Mark:   models.Unread,
+		})
+	}
+}
+
+// backfillItems gives feed an Entry for every Item its SharedFeed
+// published while feed was in the trash
+func (db *DB) backfillItems(feed *models.Feed) error {
+	var itemIDs []uint
+	db.db.Model(&models.Item{}).
+		Where("shared_feed_id = ? AND id NOT IN (?)", feed.SharedFeedID,
+			db.db.Table("entries").Select("item_id").Where("feed_id = ? AND item_id IS NOT NULL", feed.ID).QueryExpr()).
+		Pluck("id", &itemIDs)
+
+	now := time.Now()
+	rows := make([][]interface{}, len(itemIDs))
+	for i, itemID := range itemIDs {
+		rows[i] = []interface{}{
+			uuid.NewV4().String(), now, now, feed.UserID, feed.ID, itemID, false, models.Unread,
+		}
+	}
+
+	return insertRows(db.db, "entries", []string{
+		"uuid", "created_at", "updated_at", "user_id", "feed_id", "item_id", "saved", "mark",
+	}, rows)
+}
+
+// UpdateFeedSource updates the data shared by every user subscribed
+// to feed's subscription. The feed's Title is used as the source's title.
+func (db *DB) UpdateFeedSource(feed *models.Feed) error {
+	source := &models.SharedFeed{}
+	if db.db.Where("subscription = ?", feed.Subscription).First(source).RecordNotFound() {
+		return NotFound{"Feed does not exist"}
+	}
+
+	return db.db.Model(source).Updates(map[string]interface{}{
+		"title":        feed.Title,
+		"description":  feed.Description,
+		"source":       feed.Source,
+		"ttl":          feed.TTL,
+		"etag":         feed.Etag,
+		"last_updated": feed.LastUpdated,
+		"status":       feed.Status,
+	}).Error
+}
+
+// pruneShared deletes Items and SharedFeeds that no user refers to anymore
+func pruneShared(tx *gorm.DB) {
+	tx.Exec("DELETE FROM items WHERE " +
+		"id NOT IN (SELECT item_id FROM entries WHERE item_id IS NOT NULL) AND " +
+		"shared_feed_id NOT IN (SELECT shared_feed_id FROM feeds WHERE shared_feed_id IS NOT NULL)")
+	tx.Exec("DELETE FROM shared_feeds WHERE " +
+		"id NOT IN (SELECT shared_feed_id FROM feeds WHERE shared_feed_id IS NOT NULL) AND " +
+		"id NOT IN (SELECT shared_feed_id FROM items)")
+}
+
+type (
+	// legacyFeed holds the columns of a feed stored before
+	// feed sources were shared between users
+	legacyFeed struct {
+		ID           uint
+		Subscription string
+		Title        string
+		Description  string
+		Source       string
+		TTL          int
+		Etag         string
+		LastUpdated  time.Time
+		Status       string
+	}
+
+	// legacyEntry holds the columns of an entry stored before
+	// items were shared between users
+	legacyEntry struct {
+		ID          uint
+		FeedID      uint
+		GUID        string
+		Title       string
+		Link        string
+		Description string
+		Author      string
+		Published   time.Time
+	}
+)
+
+// migrateSharedFeeds moves feed sources and entry contents stored by
+// older versions into SharedFeeds and Items
+func (db *DB) migrateSharedFeeds() error {
+	if !db.db.Dialect().HasColumn("feeds", "subscription") {
+		return nil
+	}
+
+	var feeds []legacyFeed
+	err := db.db.Raw("SELECT id, subscription, title, description, source, ttl, etag, last_updated, status " +
+		"FROM feeds WHERE shared_feed_id IS NULL OR shared_feed_id = 0").Scan(&feeds).Error
+	if err != nil {
+		return err
+	}
+
+	var entries []legacyEntry
+	if db.db.Dialect().HasColumn("entries", "guid") {
+		err = db.db.Raw("SELECT id, feed_id, guid, title, link, description, author, published " +
+			"FROM entries WHERE item_id IS NULL OR item_id = 0").Scan(&entries).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(feeds) == 0 && len(entries) == 0 {
+		return nil
+	}
+
+	tx := db.db.Begin()
+	for _, legacy := range feeds {
+		source, _, err := sharedFeed(tx, &models.Feed{
+			Subscription: legacy.Subscription,
+			Title:        legacy.Title,
+			Description:  legacy.Description,
+			Source:       legacy.Source,
+			TTL:          legacy.TTL,
+			Etag:         legacy.Etag,
+			LastUpdated:  legacy.LastUpdated,
+			Status:       legacy.Status,
+		})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		tx.Exec("UPDATE feeds SET shared_feed_id = ? WHERE id = ?", source.ID, legacy.ID)
+	}
+
+	var subscriptions []models.Feed
+	tx.Unscoped().Select("id, shared_feed_id").Find(&subscriptions)
+
+	sharedFeedIDs := make(map[uint]uint, len(subscriptions))
+	for _, subscription := range subscriptions {
+		sharedFeedIDs[subscription.ID] = subscription.SharedFeedID
+	}
+
+	migrated := make(map[[2]uint]bool, len(entries))
+	for _, legacy := range entries {
+		item, _, err := sharedItem(tx, sharedFeedIDs[legacy.FeedID], &models.Entry{
+			GUID:        legacy.GUID,
+			Title:       legacy.Title,
+			Link:        legacy.Link,
+			Description: legacy.Description,
+			Author:      legacy.Author,
+			Published:   legacy.Published,
+		})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// A feed may hold the same item more than once, only the first copy is kept
+		key := [2]uint{legacy.FeedID, item.ID}
+		if migrated[key] {
+			tx.Exec("DELETE FROM entry_tags WHERE entry_id = ?", legacy.ID)
+			tx.Exec("DELETE FROM entries WHERE id = ?", legacy.ID)
+			continue
+		}
+
+		migrated[key] = true
+		tx.Exec("UPDATE entries SET item_id = ? WHERE id = ?", item.ID, legacy.ID)
+	}
+
+	// The copies kept by every user are no longer needed. The emptied
+	// columns are left in the schema since SQLite before 3.35 cannot
+	// drop columns without rebuilding the whole table.
+	tx.Exec("UPDATE feeds SET subscription = NULL, description = NULL, source = NULL, " +
+		"ttl = NULL, etag = NULL, last_updated = NULL, status = NULL")
+	if len(entries) != 0 {
+		tx.Exec("UPDATE entries SET guid = NULL, title = NULL, link = NULL, " +
+			"description = NULL, author = NULL, published = NULL")
+	}
+
+	return tx.Commit().Error
+}
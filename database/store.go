@@ -0,0 +1,210 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"time"
+
+	"github.com/chavamee/syndication/events"
+	"github.com/chavamee/syndication/models"
+)
+
+type (
+	// UserStore manages Users, the Invites used to register them, their
+	// APIKeys, RefreshTokens, personal access tokens and the Lockouts
+	// protecting their logins
+	UserStore interface {
+		NewUser(username, password string) error
+		NewUserWithInvite(username, password, code string) error
+		NewInvite(invite *models.Invite) error
+		Invites() []models.Invite
+		DeleteInvite(id string) error
+		DeleteUser(userID string) error
+		EditUser(userID string, changes ProfileChanges) (models.User, error)
+		ChangeUserName(userID, newName string) error
+		ChangeUserPassword(userID, newPassword string) error
+		SetUserRole(userID, role string) error
+		Users(fields ...string) []models.User
+		UserPrimaryKey(uuid string) (uint, error)
+		UserWithName(username string) (models.User, error)
+		UserWithUUID(uuid string) (models.User, error)
+		Authenticate(username, password string) (models.User, error)
+		LockedOut(username, ip string) (time.Time, bool)
+		RecordLoginFailure(username, ip string) error
+		ClearLoginFailures(username string) error
+		Lockouts() []models.Lockout
+		ClearLockout(kind, subject string) error
+		DeleteExpiredLockouts() error
+		NewAPIKey(secret string, key *models.APIKey, user *models.User) error
+		KeyBelongsToUser(key *models.APIKey, user *models.User) (bool, error)
+		APIKeys(user *models.User) []models.APIKey
+		DeleteAPIKey(id string, user *models.User) error
+		RevokeAPIKey(token string, user *models.User) error
+		RevokeOtherAPIKeys(token string, user *models.User) error
+		TouchAPIKey(token string, user *models.User) error
+		DeleteExpiredAPIKeys() error
+		NewRefreshToken(family string, user *models.User) (models.RefreshToken, error)
+		RefreshAPIKey(secret, token string) (models.APIKey, models.RefreshToken, error)
+		NewPersonalAccessToken(secret string, key *models.APIKey, user *models.User) error
+		PersonalAccessTokens(user *models.User) []models.APIKey
+		NewTOTP(issuer string, user *models.User) (secret, uri string, err error)
+		EnableTOTP(code string, user *models.User) ([]string, error)
+		DisableTOTP(userID string) error
+		CheckTOTP(code string, user *models.User) error
+		NewRecoveryCodes(user *models.User) ([]string, error)
+		RecoveryCodesLeft(user *models.User) int
+		UseRecoveryCode(code string, user *models.User) error
+		NewLoginChallenge(user *models.User) (models.LoginChallenge, error)
+		LoginChallengeUser(token string) (models.User, error)
+		DeleteLoginChallenge(token string) error
+		SetFeverPassword(password string, user *models.User) error
+		DisableFever(user *models.User) error
+		UserWithFeverKey(key string) (models.User, error)
+	}
+
+	// FeedStore manages Feeds owned by a user
+	FeedStore interface {
+		NewFeed(feed *models.Feed, user *models.User) error
+		Feeds(user *models.User) []models.Feed
+		FeedsFromCategory(categoryID string, user *models.User) ([]models.Feed, error)
+		Feed(id string, user *models.User) (models.Feed, error)
+		DeleteFeed(id string, user *models.User) error
+		EditFeed(feed *models.Feed, user *models.User) error
+		UpdateFeedSource(feed *models.Feed) error
+		MarkFeed(id string, marker models.Marker, before time.Time, user *models.User) error
+	}
+
+	// CategoryStore manages Categories owned by a user
+	CategoryStore interface {
+		NewCategory(ctg *models.Category, user *models.User) error
+		EditCategory(ctg *models.Category, user *models.User) error
+		DeleteCategory(id string, deleteFeeds bool, user *models.User) error
+		Category(id string, user *models.User) (models.Category, error)
+		Categories(user *models.User) []models.Category
+		ChangeFeedCategory(feedID string, ctgID string, user *models.User) error
+		MarkCategory(id string, marker models.Marker, before time.Time, user *models.User) error
+	}
+
+	// EntryStore manages Entries owned by a user
+	EntryStore interface {
+		NewEntry(entry *models.Entry, user *models.User) error
+		NewEntries(entries []models.Entry, feed models.Feed, user *models.User) ([]models.Feed, error)
+		Entry(id string, user *models.User) (models.Entry, error)
+		EntryWithGUIDExists(guid string, user *models.User) bool
+		ExistingEntryGUIDs(feedID string, guids []string, user *models.User) (map[string]bool, error)
+		EntriesWithGUIDs(feedID string, guids []string, user *models.User) ([]models.Entry, error)
+		Entries(orderByDesc bool, marker models.Marker, user *models.User) ([]models.Entry, error)
+		EntriesFromFeed(feedID string, orderByDesc bool, marker models.Marker, user *models.User) ([]models.Entry, error)
+		EntriesFromCategory(categoryID string, orderByDesc bool, marker models.Marker, user *models.User) ([]models.Entry, error)
+		SavedEntries(orderByDesc bool, marker models.Marker, user *models.User) ([]models.Entry, error)
+		MarkEntry(id string, marker models.Marker, user *models.User) error
+		SaveEntry(id string, user *models.User) error
+		UnsaveEntry(id string, user *models.User) error
+		SaveEntries(ids []string, user *models.User) error
+		UnsaveEntries(ids []string, user *models.User) error
+		EntryPage(sinceID, maxID uint, limit int, user *models.User) []models.Entry
+		EntriesWithPrimaryKeys(ids []uint, user *models.User) []models.Entry
+		EntryPrimaryKeys(marker models.Marker, saved bool, user *models.User) []uint
+		QueryEntries(query EntryQuery, user *models.User) ([]models.Entry, error)
+		MarkEntriesWithPrimaryKeys(ids []uint, marker models.Marker, user *models.User) error
+		MarkAllEntries(marker models.Marker, before time.Time, user *models.User) error
+	}
+
+	// TagStore manages Tags owned by a user
+	TagStore interface {
+		NewTag(tag *models.Tag, user *models.User) error
+		Tags(user *models.User) []models.Tag
+		Tag(id string, user *models.User) (models.Tag, error)
+		EditTag(tag *models.Tag, user *models.User) error
+		DeleteTag(id string, user *models.User) error
+		TagEntries(tagID string, entryIDs []string, user *models.User) error
+		UntagEntries(tagID string, entryIDs []string, user *models.User) error
+		EntriesFromTag(tagID string, orderByDesc bool, marker models.Marker, user *models.User) ([]models.Entry, error)
+	}
+
+	// PublicationStore manages the Publications of a user
+	PublicationStore interface {
+		NewPublication(pub *models.Publication, user *models.User) error
+		Publications(user *models.User) []models.Publication
+		Publication(id string, user *models.User) (models.Publication, error)
+		DeletePublication(id string, user *models.User) error
+		PublicationWithToken(token string) (models.Publication, models.User, error)
+	}
+
+	// WebhookStore manages the Webhooks of a user and the log of their deliveries
+	WebhookStore interface {
+		NewWebhook(hook *models.Webhook, user *models.User) error
+		Webhooks(user *models.User) []models.Webhook
+		Webhook(id string, user *models.User) (models.Webhook, error)
+		DeleteWebhook(id string, user *models.User) error
+		NewWebhookDelivery(delivery *models.WebhookDelivery, hook *models.Webhook) error
+		UpdateWebhookDelivery(delivery *models.WebhookDelivery) error
+		WebhookDeliveries(id string, user *models.User) ([]models.WebhookDelivery, error)
+	}
+
+	// StatsStore computes Stats over a user's Entries and the whole instance
+	StatsStore interface {
+		Stats(user *models.User) models.Stats
+		FeedStats(id string, user *models.User) (models.Stats, error)
+		CategoryStats(id string, user *models.User) (models.Stats, error)
+		TagStats(id string, user *models.User) (models.Stats, error)
+		StatsTree(user *models.User) (models.StatsTree, error)
+		InstanceStats() models.InstanceStats
+	}
+
+	// TrashStore manages deleted Feeds and Categories
+	TrashStore interface {
+		Trash(user *models.User) models.Trash
+		RestoreFromTrash(id string, user *models.User) error
+		PurgeTrash() error
+	}
+
+	// ArchiveStore exports and imports every object in a store
+	ArchiveStore interface {
+		Export() (Archive, error)
+		ExportUser(user *models.User) (Archive, error)
+		Import(archive Archive, progress Progress) error
+	}
+
+	// Store is the complete set of operations a storage backend
+	// provides. DB and MemoryDB are its implementations.
+	Store interface {
+		UserStore
+		FeedStore
+		CategoryStore
+		EntryStore
+		TagStore
+		PublicationStore
+		WebhookStore
+		StatsStore
+		TrashStore
+		ArchiveStore
+
+		DeleteAll()
+		Ping() error
+		Close() error
+
+		// Events returns the Bus that changes to the data of users are published on
+		Events() *events.Bus
+	}
+)
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemoryDB)(nil)
+)
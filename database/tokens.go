@@ -0,0 +1,216 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// DefaultRefreshTokenExpiration is how long a RefreshToken is valid for
+const DefaultRefreshTokenExpiration = time.Hour * 24 * 30
+
+// RefreshTokenBytes is the number of random bytes in a RefreshToken
+const RefreshTokenBytes = 32
+
+// DefaultPersonalAccessTokenExpiration is how long a personal access
+// token is valid for when no expiration is requested
+const DefaultPersonalAccessTokenExpiration = time.Hour * 24 * 365
+
+func newRefreshTokenValue() (token string, hash string, err error) {
+	b := make([]byte, RefreshTokenBytes)
+	if _, err = io.ReadFull(rand.Reader, b); err != nil {
+		return
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	hash = hashRefreshToken(token)
+	return
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewRefreshToken creates a new RefreshToken in family owned by user.
+// The plain token is only available in the returned RefreshToken.
+func (db *DB) NewRefreshToken(family string, user *models.User) (models.RefreshToken, error) {
+	token, hash, err := newRefreshTokenValue()
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+
+	refresh := models.RefreshToken{
+		Token:     token,
+		Hash:      hash,
+		Family:    family,
+		ExpiresAt: time.Now().Add(db.RefreshTokenExpiration),
+		UserID:    user.ID,
+	}
+
+	if err = db.db.Create(&refresh).Error; err != nil {
+		return models.RefreshToken{}, err
+	}
+
+	return refresh, nil
+}
+
+// RefreshAPIKey exchanges a RefreshToken for a new APIKey and a new RefreshToken.
+// Presenting a token that was already exchanged revokes every APIKey and
+// RefreshToken in its family, since either the client or an attacker
+// holds a stolen token.
+func (db *DB) RefreshAPIKey(secret, token string) (key models.APIKey, refresh models.RefreshToken, err error) {
+	found := models.RefreshToken{}
+	if db.db.Where("hash = ?", hashRefreshToken(token)).First(&found).RecordNotFound() {
+		err = Unauthorized{"Invalid refresh token"}
+		return
+	}
+
+	if found.Used {
+		db.revokeFamily(found.Family)
+		err = Unauthorized{"Refresh token was already used"}
+		return
+	}
+
+	if !found.ExpiresAt.After(time.Now()) {
+		err = Unauthorized{"Refresh token has expired"}
+		return
+	}
+
+	// Guards against the same token being exchanged concurrently
+	if db.db.Model(&found).Where("used = ?", false).UpdateColumn("used", true).RowsAffected == 0 {
+		db.revokeFamily(found.Family)
+		err = Unauthorized{"Refresh token was already used"}
+		return
+	}
+
+	user := models.User{}
+	if db.db.First(&user, found.UserID).RecordNotFound() {
+		err = Unauthorized{"Invalid refresh token"}
+		return
+	}
+
+	previous := models.APIKey{}
+	db.db.Where("family = ?", found.Family).Order("created_at DESC").First(&previous)
+	db.db.Where("family = ?", found.Family).Delete(&models.APIKey{})
+
+	key = models.APIKey{
+		Label:  previous.Label,
+		Device: previous.Device,
+		Family: found.Family,
+	}
+
+	if err = db.NewAPIKey(secret, &key, &user); err != nil {
+		return
+	}
+
+	refresh, err = db.NewRefreshToken(found.Family, &user)
+	return
+}
+
+// revokeFamily deletes every APIKey and RefreshToken in family
+func (db *DB) revokeFamily(family string) {
+	if family == "" {
+		return
+	}
+
+	db.db.Where("family = ?", family).Delete(&models.APIKey{})
+	db.db.Where("family = ?", family).Delete(&models.RefreshToken{})
+}
+
+func newFamily() string {
+	return uuid.NewV4().String()
+}
+
+// normalizeScope checks that every space separated scope in scope is
+// known and returns them without duplicates, in the order of models.Scopes
+func normalizeScope(scope string) (string, error) {
+	requested := map[string]bool{}
+	for _, name := range strings.Fields(scope) {
+		requested[name] = true
+	}
+
+	if len(requested) == 0 {
+		return "", BadRequest{"At least one scope is required"}
+	}
+
+	var scopes []string
+	for _, name := range models.Scopes {
+		if requested[name] {
+			scopes = append(scopes, name)
+			delete(requested, name)
+		}
+	}
+
+	for name := range requested {
+		return "", BadRequest{"Unknown scope " + name}
+	}
+
+	return strings.Join(scopes, " "), nil
+}
+
+// personalTokenExpiration returns when a personal access token
+// requested to expire at expiresAt should expire
+func personalTokenExpiration(expiresAt time.Time) (time.Time, error) {
+	if expiresAt.IsZero() {
+		return time.Now().Add(DefaultPersonalAccessTokenExpiration), nil
+	}
+
+	if !expiresAt.After(time.Now()) {
+		return time.Time{}, BadRequest{"Expiration must be in the future"}
+	}
+
+	return expiresAt, nil
+}
+
+// NewPersonalAccessToken creates a new APIKey owned by user that is
+// limited to key.Scope. The key expires at key.ExpiresAt or, if it
+// is not set, after DefaultPersonalAccessTokenExpiration.
+func (db *DB) NewPersonalAccessToken(secret string, key *models.APIKey, user *models.User) error {
+	scope, err := normalizeScope(key.Scope)
+	if err != nil {
+		return err
+	}
+
+	expiresAt, err := personalTokenExpiration(key.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	key.Personal = true
+	key.Scope = scope
+	key.Family = ""
+
+	return db.newAPIKey(secret, key, expiresAt, user)
+}
+
+// PersonalAccessTokens returns all personal access tokens owned by user that have not expired
+func (db *DB) PersonalAccessTokens(user *models.User) (keys []models.APIKey) {
+	db.db.Model(user).Where("personal = ? AND expires_at > ?", true, time.Now()).Order("created_at ASC").Related(&keys)
+	return
+}
@@ -0,0 +1,302 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// RecoveryCodeCount is the number of RecoveryCodes a user gets
+// when enabling two-factor authentication
+const RecoveryCodeCount = 10
+
+// RecoveryCodeBytes is the number of random bytes in a RecoveryCode
+const RecoveryCodeBytes = 10
+
+// DefaultLoginChallengeExpiration is how long a user has to
+// present a TOTP or recovery code after their password
+const DefaultLoginChallengeExpiration = time.Minute * 5
+
+// totpOptions are the parameters supported by authenticator apps
+var totpOptions = totp.ValidateOpts{
+	Period:    30,
+	Skew:      1,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// newTOTPKey generates a TOTP secret for user and the
+// otpauth URI authenticator apps enroll with
+func newTOTPKey(issuer string, user *models.User) (secret, uri string, err error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: user.Username,
+		Period:      totpOptions.Period,
+		Digits:      totpOptions.Digits,
+		Algorithm:   totpOptions.Algorithm,
+	})
+	if err != nil {
+		return
+	}
+
+	return key.Secret(), key.URL(), nil
+}
+
+// checkTOTP returns the time step of code if it is valid for secret at now.
+// Only steps after lastCounter are accepted so that a code cannot be used twice.
+func checkTOTP(secret, code string, lastCounter int64, now time.Time) (int64, error) {
+	period := int64(totpOptions.Period)
+	for skew := -int64(totpOptions.Skew); skew <= int64(totpOptions.Skew); skew++ {
+		counter := now.Unix()/period + skew
+		if counter <= lastCounter {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(counter*period, 0), totpOptions)
+		if err != nil {
+			return 0, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, nil
+		}
+	}
+
+	return 0, Unauthorized{"Invalid code"}
+}
+
+// newRecoveryCodes returns RecoveryCodeCount plain codes and their hashes
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, RecoveryCodeBytes)
+		if _, err = io.ReadFull(rand.Reader, b); err != nil {
+			return
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+		code = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return
+}
+
+// hashRecoveryCode hashes code ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashRefreshToken(code)
+}
+
+// NewTOTP starts enrolling user in two-factor authentication. It returns
+// a new secret and its otpauth URI, which EnableTOTP confirms.
+func (db *DB) NewTOTP(issuer string, user *models.User) (secret, uri string, err error) {
+	found := models.User{}
+	if db.db.First(&found, user.ID).RecordNotFound() {
+		err = NotFound{"User does not exist"}
+		return
+	}
+
+	if found.TOTPEnabled {
+		err = Conflict{"Two-factor authentication is already enabled"}
+		return
+	}
+
+	secret, uri, err = newTOTPKey(issuer, &found)
+	if err != nil {
+		return
+	}
+
+	err = db.db.Model(&found).UpdateColumn("totp_secret", secret).Error
+	return
+}
+
+// EnableTOTP enables two-factor authentication for user once code proves
+// the secret from NewTOTP was enrolled. It returns the new RecoveryCodes.
+func (db *DB) EnableTOTP(code string, user *models.User) ([]string, error) {
+	found := models.User{}
+	if db.db.First(&found, user.ID).RecordNotFound() {
+		return nil, NotFound{"User does not exist"}
+	}
+
+	if found.TOTPEnabled {
+		return nil, Conflict{"Two-factor authentication is already enabled"}
+	}
+
+	if found.TOTPSecret == "" {
+		return nil, BadRequest{"Two-factor authentication enrollment was not started"}
+	}
+
+	counter, err := checkTOTP(found.TOTPSecret, code, 0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.db.Model(&found).Updates(map[string]interface{}{
+		"totp_enabled":      true,
+		"totp_last_counter": counter,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return db.NewRecoveryCodes(&found)
+}
+
+// DisableTOTP turns off two-factor authentication for the user with userID
+// and deletes their RecoveryCodes
+func (db *DB) DisableTOTP(userID string) error {
+	user := &models.User{}
+	if db.db.Where("uuid = ?", userID).First(user).RecordNotFound() {
+		return NotFound{"User does not exist"}
+	}
+
+	tx := db.db.Begin()
+	tx.Model(user).Updates(map[string]interface{}{
+		"totp_secret":       "",
+		"totp_enabled":      false,
+		"totp_last_counter": 0,
+	})
+	tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{})
+	tx.Where("user_id = ?", user.ID).Delete(&models.LoginChallenge{})
+	return tx.Commit().Error
+}
+
+// CheckTOTP returns an Unauthorized error unless code is a TOTP code
+// for user that was not used before
+func (db *DB) CheckTOTP(code string, user *models.User) error {
+	found := models.User{}
+	if db.db.First(&found, user.ID).RecordNotFound() {
+		return NotFound{"User does not exist"}
+	}
+
+	if !found.TOTPEnabled {
+		return BadRequest{"Two-factor authentication is not enabled"}
+	}
+
+	counter, err := checkTOTP(found.TOTPSecret, code, found.TOTPLastCounter, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Guards against the same code being used concurrently
+	if db.db.Model(&found).Where("totp_last_counter < ?", counter).
+		UpdateColumn("totp_last_counter", counter).RowsAffected == 0 {
+		return Unauthorized{"Invalid code"}
+	}
+
+	return nil
+}
+
+// NewRecoveryCodes replaces the RecoveryCodes of user with new ones.
+// The plain codes are only available in the returned list.
+func (db *DB) NewRecoveryCodes(user *models.User) ([]string, error) {
+	found := models.User{}
+	if db.db.First(&found, user.ID).RecordNotFound() {
+		return nil, NotFound{"User does not exist"}
+	}
+
+	if !found.TOTPEnabled {
+		return nil, BadRequest{"Two-factor authentication is not enabled"}
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := db.db.Begin()
+	tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{})
+	for _, hash := range hashes {
+		if err = tx.Create(&models.RecoveryCode{Hash: hash, UserID: user.ID}).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit().Error
+}
+
+// RecoveryCodesLeft returns how many unused RecoveryCodes user has
+func (db *DB) RecoveryCodesLeft(user *models.User) (count int) {
+	db.db.Model(&models.RecoveryCode{}).Where("user_id = ?", user.ID).Count(&count)
+	return
+}
+
+// UseRecoveryCode deletes the RecoveryCode code of user, or
+// returns an Unauthorized error if user has no such code
+func (db *DB) UseRecoveryCode(code string, user *models.User) error {
+	if db.db.Where("user_id = ? AND hash = ?", user.ID, hashRecoveryCode(code)).
+		Delete(&models.RecoveryCode{}).RowsAffected == 0 {
+		return Unauthorized{"Invalid recovery code"}
+	}
+	return nil
+}
+
+// NewLoginChallenge creates a LoginChallenge for user.
+// The plain token is only available in the returned LoginChallenge.
+func (db *DB) NewLoginChallenge(user *models.User) (models.LoginChallenge, error) {
+	token, hash, err := newRefreshTokenValue()
+	if err != nil {
+		return models.LoginChallenge{}, err
+	}
+
+	challenge := models.LoginChallenge{
+		Token:     token,
+		Hash:      hash,
+		ExpiresAt: time.Now().Add(DefaultLoginChallengeExpiration),
+		UserID:    user.ID,
+	}
+
+	if err = db.db.Create(&challenge).Error; err != nil {
+		return models.LoginChallenge{}, err
+	}
+
+	return challenge, nil
+}
+
+// LoginChallengeUser returns the User a LoginChallenge with token was issued to
+func (db *DB) LoginChallengeUser(token string) (models.User, error) {
+	challenge := models.LoginChallenge{}
+	if db.db.Where("hash = ? AND expires_at > ?", hashRefreshToken(token), time.Now()).
+		First(&challenge).RecordNotFound() {
+		return models.User{}, Unauthorized{"Invalid or expired login challenge"}
+	}
+
+	user := models.User{}
+	if db.db.First(&user, challenge.UserID).RecordNotFound() {
+		return models.User{}, Unauthorized{"Invalid or expired login challenge"}
+	}
+
+	return user, nil
+}
+
+// DeleteLoginChallenge with token so that it cannot be used again
+func (db *DB) DeleteLoginChallenge(token string) error {
+	return db.db.Where("hash = ?", hashRefreshToken(token)).Delete(&models.LoginChallenge{}).Error
+}
@@ -0,0 +1,212 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// WebhookSecretBytes is the number of random bytes in the secret of a Webhook
+const WebhookSecretBytes = 32
+
+// WebhookDeliveryLogSize is the number of deliveries kept for each Webhook
+const WebhookDeliveryLogSize = 50
+
+// privateNetworks are the private, loopback, link-local and
+// unspecified address ranges
+var privateNetworks = func() (networks []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return
+}()
+
+// PrivateAddress returns true if ip is a private, loopback, link-local
+// or unspecified address, which Webhooks are not delivered to unless
+// private webhooks are allowed
+func PrivateAddress(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhook makes sure hook has a valid URL. Hosts that are private
+// addresses are rejected unless allowPrivate is set, those that resolve
+// to one are refused when delivering.
+func checkWebhook(hook *models.Webhook, allowPrivate bool) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return BadRequest{"Webhook should include a valid url"}
+	}
+
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	if !allowPrivate && (strings.EqualFold(host, "localhost") || (ip != nil && PrivateAddress(ip))) {
+		return BadRequest{"Webhook should not point to a private address"}
+	}
+
+	hook.Keyword = strings.TrimSpace(hook.Keyword)
+	return nil
+}
+
+// initWebhook fills in the id and secret of hook
+func initWebhook(hook *models.Webhook) error {
+	secret := make([]byte, WebhookSecretBytes)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return err
+	}
+
+	hook.UUID = uuid.NewV4().String()
+	hook.Secret = hex.EncodeToString(secret)
+	hook.LastStatus = 0
+	hook.LastDeliveredAt = nil
+	return nil
+}
+
+// NewWebhook creates a Webhook owned by user. The feed,
+// category and tag it filters on should be owned by user.
+func (db *DB) NewWebhook(hook *models.Webhook, user *models.User) error {
+	if err := checkWebhook(hook, db.AllowPrivateWebhooks); err != nil {
+		return err
+	}
+
+	if hook.FeedID != "" {
+		if _, err := db.Feed(hook.FeedID, user); err != nil {
+			return err
+		}
+	}
+
+	if hook.CategoryID != "" {
+		if _, err := db.Category(hook.CategoryID, user); err != nil {
+			return err
+		}
+	}
+
+	if hook.TagID != "" {
+		if _, err := db.Tag(hook.TagID, user); err != nil {
+			return err
+		}
+	}
+
+	if err := initWebhook(hook); err != nil {
+		return err
+	}
+
+	hook.UserID = user.ID
+	return db.db.Create(hook).Error
+}
+
+// Webhooks returns every Webhook owned by user
+func (db *DB) Webhooks(user *models.User) (hooks []models.Webhook) {
+	db.db.Where("user_id = ?", user.ID).Order("created_at ASC").Find(&hooks)
+	return
+}
+
+// Webhook returns the Webhook with id owned by user
+func (db *DB) Webhook(id string, user *models.User) (hook models.Webhook, err error) {
+	if db.db.Where("uuid = ? AND user_id = ?", id, user.ID).First(&hook).RecordNotFound() {
+		err = NotFound{"Webhook does not exist"}
+	}
+	return
+}
+
+// DeleteWebhook with id owned by user, along with its deliveries
+func (db *DB) DeleteWebhook(id string, user *models.User) error {
+	hook, err := db.Webhook(id, user)
+	if err != nil {
+		return err
+	}
+
+	tx := db.db.Begin()
+	tx.Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{})
+	tx.Delete(&hook)
+	return tx.Commit().Error
+}
+
+// NewWebhookDelivery logs a delivery of hook. Only the last
+// WebhookDeliveryLogSize deliveries of a Webhook are kept.
+func (db *DB) NewWebhookDelivery(delivery *models.WebhookDelivery, hook *models.Webhook) error {
+	delivery.UUID = uuid.NewV4().String()
+	delivery.WebhookID = hook.ID
+	if err := db.db.Create(delivery).Error; err != nil {
+		return err
+	}
+
+	var ids []uint
+	db.db.Model(&models.WebhookDelivery{}).Where("webhook_id = ?", hook.ID).Order("id DESC").Pluck("id", &ids)
+	if len(ids) > WebhookDeliveryLogSize {
+		db.db.Where("id in (?)", ids[WebhookDeliveryLogSize:]).Delete(&models.WebhookDelivery{})
+	}
+	return nil
+}
+
+// UpdateWebhookDelivery saves the outcome of the last attempt at
+// delivery, which becomes the last status of its Webhook. Deliveries
+// deleted along with their Webhook, or dropped from its log, are
+// not found.
+func (db *DB) UpdateWebhookDelivery(delivery *models.WebhookDelivery) error {
+	delivery.UpdatedAt = time.Now()
+	result := db.db.Model(&models.WebhookDelivery{}).Where("id = ?", delivery.ID).UpdateColumns(map[string]interface{}{
+		"attempts":   delivery.Attempts,
+		"status":     delivery.Status,
+		"error":      delivery.Error,
+		"updated_at": delivery.UpdatedAt,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return NotFound{"Webhook delivery does not exist"}
+	}
+
+	return db.db.Model(&models.Webhook{}).Where("id = ?", delivery.WebhookID).UpdateColumns(map[string]interface{}{
+		"last_status":       delivery.Status,
+		"last_delivered_at": delivery.UpdatedAt,
+	}).Error
+}
+
+// WebhookDeliveries returns the logged deliveries of the Webhook
+// with id owned by user, newest first
+func (db *DB) WebhookDeliveries(id string, user *models.User) (deliveries []models.WebhookDelivery, err error) {
+	hook, err := db.Webhook(id, user)
+	if err != nil {
+		return
+	}
+
+	db.db.Where("webhook_id = ?", hook.ID).Order("id DESC").Find(&deliveries)
+	return
+}
@@ -0,0 +1,191 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package events delivers changes to a user's feeds and entries,
+// as they happen, to the clients of that user
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of Events
+const (
+	EntriesNew     = "entries.new"
+	EntriesMarked  = "entries.marked"
+	EntriesSaved   = "entries.saved"
+	EntriesUnsaved = "entries.unsaved"
+	FeedAdded      = "feed.added"
+	FeedDeleted    = "feed.deleted"
+	SyncStarted    = "sync.started"
+	SyncProgress   = "sync.progress"
+	SyncFinished   = "sync.finished"
+
+	// Resync tells a subscriber that events it asked to resume from
+	// are no longer retained, and that it should fetch its data again
+	Resync = "resync"
+)
+
+// HistorySize is the number of past events a Bus retains for each
+// user, for their subscribers resuming from a previous event
+const HistorySize = 1000
+
+// SubscriptionBuffer is the number of events a subscriber can fall
+// behind by before it is dropped
+const SubscriptionBuffer = 64
+
+type (
+	// Event describes a change made to the data of a user
+	Event struct {
+		ID        uint64    `json:"id"`
+		Type      string    `json:"type"`
+		Data      Data      `json:"data"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// Data holds the objects an Event is about. Fields
+	// that do not apply to its type are left empty.
+	Data struct {
+		Feed       string   `json:"feed,omitempty"`
+		Category   string   `json:"category,omitempty"`
+		Title      string   `json:"title,omitempty"`
+		Entries    []string `json:"entries,omitempty"`
+		Marker     string   `json:"marker,omitempty"`
+		Done       int      `json:"done,omitempty"`
+		Total      int      `json:"total,omitempty"`
+		NewEntries int      `json:"new_entries,omitempty"`
+	}
+
+	// Subscription receives the events of a user on C. C is closed
+	// when the subscriber falls too far behind or unsubscribes.
+	Subscription struct {
+		C <-chan Event
+
+		events chan Event
+		userID uint
+	}
+
+	// Bus fans events out to the subscriptions of their user and retains
+	// the last HistorySize events of every user so subscribers can resume.
+	// Events of a busy user never push those of others out of history.
+	Bus struct {
+		lock          sync.Mutex
+		lastID        uint64
+		history       map[uint][]Event
+		forgotten     map[uint]uint64
+		subscriptions map[*Subscription]bool
+	}
+)
+
+// NewBus creates a Bus without any subscriptions
+func NewBus() *Bus {
+	return &Bus{
+		history:       map[uint][]Event{},
+		forgotten:     map[uint]uint64{},
+		subscriptions: map[*Subscription]bool{},
+	}
+}
+
+// Publish sends an event of type with data to the subscriptions of the
+// user with userID. Publishing on a nil Bus does nothing.
+func (b *Bus) Publish(userID uint, eventType string, data Data) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastID++
+	event := Event{
+		ID:        b.lastID,
+		Type:      eventType,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+
+	// Remember the last event dropped from history, subscribers
+	// resuming from before it missed events that are gone
+	history := append(b.history[userID], event)
+	if len(history) > HistorySize {
+		b.forgotten[userID] = history[len(history)-HistorySize-1].ID
+		history = history[len(history)-HistorySize:]
+	}
+	b.history[userID] = history
+
+	for sub := range b.subscriptions {
+		if sub.userID != userID {
+			continue
+		}
+
+		// Subscribers that fall behind are dropped instead of
+		// blocking publishers, they resume from their last event
+		select {
+		case sub.events <- event:
+		default:
+			b.unsubscribe(sub)
+		}
+	}
+}
+
+// Subscribe starts a subscription to the events of the user with userID.
+// Retained events after lastID are returned so that the subscriber can
+// resume, along with whether every one of them was still retained.
+func (b *Bus) Subscribe(userID uint, lastID uint64) (*Subscription, []Event, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	events := make(chan Event, SubscriptionBuffer)
+	sub := &Subscription{
+		C:      events,
+		events: events,
+		userID: userID,
+	}
+	b.subscriptions[sub] = true
+
+	if lastID == 0 {
+		return sub, nil, true
+	}
+
+	// IDs restart along with the server
+	complete := lastID <= b.lastID && lastID >= b.forgotten[userID]
+
+	var missed []Event
+	for _, event := range b.history[userID] {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+
+	return sub, missed, complete
+}
+
+// Unsubscribe ends sub and closes its channel
+func (b *Bus) Unsubscribe(sub *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.unsubscribe(sub)
+}
+
+func (b *Bus) unsubscribe(sub *Subscription) {
+	if b.subscriptions[sub] {
+		delete(b.subscriptions, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	bus := NewBus()
+	sub, missed, complete := bus.Subscribe(1, 0)
+	assert.Empty(t, missed)
+	assert.True(t, complete)
+
+	other, _, _ := bus.Subscribe(2, 0)
+
+	bus.Publish(1, FeedAdded, Data{Feed: "feed", Title: "Example"})
+
+	event := <-sub.C
+	assert.Equal(t, uint64(1), event.ID)
+	assert.Equal(t, FeedAdded, event.Type)
+	assert.Equal(t, "Example", event.Data.Title)
+	assert.False(t, event.CreatedAt.IsZero())
+
+	assert.Len(t, other.C, 0)
+
+	bus.Unsubscribe(sub)
+	_, ok := <-sub.C
+	assert.False(t, ok)
+}
+
+func TestPublishNilBus(t *testing.T) {
+	var bus *Bus
+	assert.NotPanics(t, func() {
+		bus.Publish(1, FeedAdded, Data{})
+	})
+}
+
+func TestResume(t *testing.T) {
+	bus := NewBus()
+	bus.Publish(1, FeedAdded, Data{Feed: "first"})
+	bus.Publish(2, FeedAdded, Data{Feed: "other"})
+	bus.Publish(1, FeedDeleted, Data{Feed: "first"})
+
+	sub, missed, complete := bus.Subscribe(1, 1)
+	defer bus.Unsubscribe(sub)
+
+	assert.True(t, complete)
+	require.Len(t, missed, 1)
+	assert.Equal(t, uint64(3), missed[0].ID)
+	assert.Equal(t, FeedDeleted, missed[0].Type)
+
+	_, missed, complete = bus.Subscribe(1, 3)
+	assert.True(t, complete)
+	assert.Empty(t, missed)
+
+	// IDs from before a restart are not known to the bus
+	_, _, complete = bus.Subscribe(1, 10)
+	assert.False(t, complete)
+}
+
+func TestResumeExpired(t *testing.T) {
+	bus := NewBus()
+	for i := 0; i < HistorySize+10; i++ {
+		bus.Publish(1, EntriesNew, Data{NewEntries: 1})
+	}
+
+	_, missed, complete := bus.Subscribe(1, 5)
+	assert.False(t, complete)
+	assert.Len(t, missed, HistorySize)
+
+	_, missed, complete = bus.Subscribe(1, 10)
+	assert.True(t, complete)
+	assert.Len(t, missed, HistorySize)
+}
+
+func TestResumeBusyUser(t *testing.T) {
+	bus := NewBus()
+	bus.Publish(1, FeedAdded, Data{Feed: "first"})
+	bus.Publish(1, FeedDeleted, Data{Feed: "first"})
+	for i := 0; i < HistorySize+10; i++ {
+		bus.Publish(2, EntriesNew, Data{NewEntries: 1})
+	}
+
+	// Events of another user do not push those of user 1 out of history
+	sub, missed, complete := bus.Subscribe(1, 1)
+	defer bus.Unsubscribe(sub)
+
+	assert.True(t, complete)
+	require.Len(t, missed, 1)
+	assert.Equal(t, uint64(2), missed[0].ID)
+
+	_, _, complete = bus.Subscribe(2, 5)
+	assert.False(t, complete)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	bus := NewBus()
+	sub, _, _ := bus.Subscribe(1, 0)
+
+	for i := 0; i < SubscriptionBuffer+1; i++ {
+		bus.Publish(1, EntriesNew, Data{NewEntries: 1})
+	}
+
+	received := 0
+	for range sub.C {
+		received++
+	}
+	assert.Equal(t, SubscriptionBuffer, received)
+
+	// Unsubscribing a dropped subscriber does nothing
+	assert.NotPanics(t, func() {
+		bus.Unsubscribe(sub)
+	})
+}
@@ -18,11 +18,14 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/chavamee/syndication/admin"
 	"github.com/chavamee/syndication/config"
 	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/opml"
 	"github.com/chavamee/syndication/server"
 	"github.com/chavamee/syndication/sync"
 	"github.com/fatih/color"
@@ -42,31 +45,286 @@ func findSystemConfig() (config.Config, error) {
 	return conf, nil
 }
 
-func startApp(c *cli.Context) error {
+func loadConfig(c *cli.Context) (config.Config, error) {
+	path := c.String("config")
+	if path == "" {
+		path = c.GlobalString("config")
+	}
+
 	var conf config.Config
 	var err error
 
-	if c.String("config") == "" {
+	if path == "" {
 		conf, err = findSystemConfig()
-		if err != nil {
-			color.Red(err.Error())
-			return err
-		}
 	} else {
-		conf, err = config.NewConfig(c.String("config"))
-		if err != nil {
-			color.Red(err.Error())
-			return err
+		conf, err = config.NewConfig(path)
+	}
+
+	if err != nil {
+		color.Red(err.Error())
+	}
+
+	return conf, err
+}
+
+func openDB(conf config.Config) (*database.DB, error) {
+	db, err := database.NewDBWithOptions(conf.Database.Type, conf.Database.Connection, database.Options{
+		MaxOpenConns:      conf.Database.MaxOpenConnections,
+		MaxIdleConns:      conf.Database.MaxIdleConnections,
+		ConnMaxLifetime:   time.Duration(conf.Database.ConnectionLifetimeSeconds) * time.Second,
+		ConnectRetries:    conf.Database.ConnectRetries,
+		ConnectBackoff:    time.Duration(conf.Database.ConnectBackoffSeconds) * time.Second,
+		SQLiteWAL:         conf.Database.WAL,
+		SQLiteBusyTimeout: time.Duration(conf.Database.BusyTimeoutMs) * time.Millisecond,
+		SQLiteForeignKeys: conf.Database.ForeignKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Database.TrashRetentionDays > 0 {
+		db.TrashRetention = time.Duration(conf.Database.TrashRetentionDays) * time.Hour * 24
+	}
+
+	if conf.Server.AccessTokenExpirationMinutes > 0 {
+		db.APIKeyExpiration = time.Duration(conf.Server.AccessTokenExpirationMinutes) * time.Minute
+	}
+
+	if conf.Server.RefreshTokenExpirationDays > 0 {
+		db.RefreshTokenExpiration = time.Duration(conf.Server.RefreshTokenExpirationDays) * time.Hour * 24
+	}
+
+	db.LockoutPolicy.AccountAttempts = loginAttempts(conf.Server.LoginAttempts, db.LockoutPolicy.AccountAttempts)
+	db.LockoutPolicy.IPAttempts = loginAttempts(conf.Server.LoginIPAttempts, db.LockoutPolicy.IPAttempts)
+	if conf.Server.LoginLockoutSeconds > 0 {
+		db.LockoutPolicy.Backoff = time.Duration(conf.Server.LoginLockoutSeconds) * time.Second
+	}
+	if conf.Server.LoginMaxLockoutSeconds > 0 {
+		db.LockoutPolicy.MaxBackoff = time.Duration(conf.Server.LoginMaxLockoutSeconds) * time.Second
+	}
+
+	if conf.Server.PasswordMinLength > 0 {
+		db.PasswordPolicy.MinLength = conf.Server.PasswordMinLength
+	}
+	db.PasswordPolicy.RequireLetter = conf.Server.PasswordRequireLetter
+	db.PasswordPolicy.RequireDigit = conf.Server.PasswordRequireDigit
+	db.PasswordPolicy.RequireSymbol = conf.Server.PasswordRequireSymbol
+
+	db.PasswordHashing = passwordHashing(conf.Server)
+	db.AllowPrivateWebhooks = conf.Server.AllowPrivateWebhooks
+
+	return db, nil
+}
+
+// passwordHashing returns the configured algorithm and costs new
+// password hashes are made with, where zero costs keep the defaults
+func passwordHashing(conf config.Server) database.HashParams {
+	if conf.PasswordHash == config.PasswordHashArgon2id {
+		params := database.DefaultArgon2idParams
+		if conf.Argon2Time > 0 {
+			params.Time = conf.Argon2Time
 		}
+		if conf.Argon2Memory > 0 {
+			params.Memory = conf.Argon2Memory
+		}
+		if conf.Argon2Threads > 0 {
+			params.Threads = conf.Argon2Threads
+		}
+		return params
 	}
 
-	db, err := database.NewDB(conf.Database.Type, conf.Database.Connection)
+	params := database.DefaultScryptParams
+	if conf.ScryptN > 0 {
+		params.N = conf.ScryptN
+	}
+	if conf.ScryptR > 0 {
+		params.R = conf.ScryptR
+	}
+	if conf.ScryptP > 0 {
+		params.P = conf.ScryptP
+	}
+	return params
+}
+
+// loginAttempts returns the configured number of failed logins allowed,
+// where zero keeps the default and a negative value disables the limit
+func loginAttempts(configured, fallback int) int {
+	if configured < 0 {
+		return 0
+	}
+	if configured == 0 {
+		return fallback
+	}
+	return configured
+}
+
+func backup(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Expected a path to write the backup to", 1)
+	}
+
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(conf)
 	if err != nil {
 		return err
 	}
+	defer db.Close()
+
+	file, err := os.Create(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive, err := database.Backup(db, file)
+	if err != nil {
+		color.Red(err.Error())
+		return err
+	}
+
+	color.Green("Backed up %d users and %d entries", len(archive.Users), len(archive.Entries))
+	return nil
+}
+
+func restore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Expected a path to a backup", 1)
+	}
+
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	file, err := os.Open(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive, err := database.Restore(db, file, func(done, total int) {
+		fmt.Printf("\rRestoring %d/%d", done, total)
+	})
+	fmt.Println()
+	if err != nil {
+		color.Red(err.Error())
+		return err
+	}
+
+	color.Green("Restored %d users and %d entries", len(archive.Users), len(archive.Entries))
+	return nil
+}
+
+func importOPML(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("Expected a username and a path to an OPML file", 1)
+	}
+
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	user, err := db.UserWithName(c.Args().Get(0))
+	if err != nil {
+		color.Red(err.Error())
+		return err
+	}
+
+	file, err := os.Open(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report, err := opml.Import(db, &user, file)
+	if err != nil {
+		color.Red(err.Error())
+		return err
+	}
+
+	for _, feed := range report.Feeds {
+		if feed.Error != "" {
+			color.Yellow("%s: %s (%s)", feed.Subscription, feed.Status, feed.Error)
+		} else {
+			fmt.Printf("%s: %s\n", feed.Subscription, feed.Status)
+		}
+	}
+
+	color.Green("Imported %d of %d feeds", report.Imported, len(report.Feeds))
+	return nil
+}
+
+func exportOPML(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("Expected a username and a path to write the OPML file to", 1)
+	}
+
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	user, err := db.UserWithName(c.Args().Get(0))
+	if err != nil {
+		color.Red(err.Error())
+		return err
+	}
+
+	file, err := os.Create(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = opml.Export(db, &user, file); err != nil {
+		color.Red(err.Error())
+		return err
+	}
+
+	color.Green("Exported the subscriptions of %s", user.Username)
+	return nil
+}
+
+func startApp(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(conf)
+	if err != nil {
+		return err
+	}
+
 	sync := sync.NewSync(db)
+	sync.Webhooks().AllowPrivate = conf.Server.AllowPrivateWebhooks
 	sync.Start()
 
+	defer sync.Stop()
+
 	admin, err := admin.NewAdmin(db, conf.Admin.SocketPath)
 	if err != nil {
 		return err
@@ -108,6 +366,33 @@ func main() {
 		},
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "backup",
+			Usage:     "Write a compressed archive of all users and their data",
+			ArgsUsage: "<path>",
+			Action:    backup,
+		},
+		{
+			Name:      "restore",
+			Usage:     "Restore an archive written by backup",
+			ArgsUsage: "<path>",
+			Action:    restore,
+		},
+		{
+			Name:      "import-opml",
+			Usage:     "Subscribe a user to the feeds of an OPML file",
+			ArgsUsage: "<username> <path>",
+			Action:    importOPML,
+		},
+		{
+			Name:      "export-opml",
+			Usage:     "Write a user's subscriptions to an OPML file",
+			ArgsUsage: "<username> <path>",
+			Action:    exportOPML,
+		},
+	}
+
 	app.Action = startApp
 
 	app.Run(os.Args)
@@ -18,6 +18,9 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"strings"
 	"time"
 )
@@ -38,6 +41,57 @@ const (
 	Saved         = "saved"
 )
 
+// Roles a User can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Subjects of a Lockout
+const (
+	LockoutAccount = "account"
+	LockoutIP      = "ip"
+)
+
+// Sources of a Publication
+const (
+	PublishCategory = "category"
+	PublishTag      = "tag"
+	PublishSaved    = "saved"
+)
+
+// Events a Webhook is delivered for
+const (
+	WebhookEntriesNew    = "entries.new"
+	WebhookEntriesTagged = "entries.tagged"
+	WebhookPing          = "ping"
+)
+
+// Scopes limit what a personal access token can be used for
+const (
+	ScopeFeedsRead   = "feeds:read"
+	ScopeFeedsWrite  = "feeds:write"
+	ScopeEntriesRead = "entries:read"
+	ScopeEntriesMark = "entries:mark"
+	ScopeTagsWrite   = "tags:write"
+	ScopeAdmin       = "admin"
+
+	ScopeWebhooksRead  = "webhooks:read"
+	ScopeWebhooksWrite = "webhooks:write"
+)
+
+// Scopes lists every scope a personal access token can be granted
+var Scopes = []string{
+	ScopeFeedsRead,
+	ScopeFeedsWrite,
+	ScopeEntriesRead,
+	ScopeEntriesMark,
+	ScopeTagsWrite,
+	ScopeWebhooksRead,
+	ScopeWebhooksWrite,
+	ScopeAdmin,
+}
+
 func MarkerFromString(marker string) Marker {
 	if len(marker) == 0 {
 		return None
@@ -53,6 +107,51 @@ func MarkerFromString(marker string) Marker {
 	return None
 }
 
+// String returns the name of marker, as accepted by MarkerFromString
+func (marker Marker) String() string {
+	switch marker {
+	case Read:
+		return "read"
+	case Unread:
+		return "unread"
+	case Any:
+		return "any"
+	}
+	return "none"
+}
+
+// Preferences are settings clients store for a User.
+// They are kept in the database as a JSON object.
+type Preferences map[string]string
+
+// Value implements driver.Valuer
+func (p Preferences) Value() (driver.Value, error) {
+	if p == nil {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(p)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner
+func (p *Preferences) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*p = Preferences{}
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return errors.New("Preferences must be stored as text")
+	}
+
+	return json.Unmarshal(b, p)
+}
+
 type (
 	User struct {
 		ID        uint       `json:"-" gorm:"primary_key"`
@@ -65,20 +164,30 @@ type (
 		Categories []Category `json:"categories,omitempty"`
 		Feeds      []Feed     `json:"feeds,omitempty"`
 		Entries    []Entry    `json:"entries,omitempty"`
+		Tags       []Tag      `json:"tags,omitempty"`
 		APIKeys    []APIKey   `json:"-"`
 
-		Username                  string `json:"username,required"`
-		Email                     string `json:"email,optional"`
-		PasswordHash              []byte `json:"-"`
-		PasswordSalt              []byte `json:"-"`
-		UncategorizedCategoryUUID string `json:"-"`
-		SavedCategoryUUID         string `json:"-"`
+		Username                  string      `json:"username,required"`
+		Email                     string      `json:"email,optional"`
+		Role                      string      `json:"role" gorm:"default:'user'"`
+		Timezone                  string      `json:"timezone,omitempty"`
+		Preferences               Preferences `json:"preferences,omitempty" gorm:"type:text"`
+		PasswordHash              []byte      `json:"-"`
+		PasswordSalt              []byte      `json:"-"`
+		PasswordParams            string      `json:"-"`
+		TOTPSecret                string      `json:"-"`
+		TOTPEnabled               bool        `json:"totp_enabled"`
+		TOTPLastCounter           int64       `json:"-"`
+		FeverKey                  string      `json:"-" sql:"index"`
+		UncategorizedCategoryUUID string      `json:"-"`
+		SavedCategoryUUID         string      `json:"-"`
 	}
 
 	Category struct {
-		ID        uint      `json:"-" gorm:"primary_key"`
-		CreatedAt time.Time `json:"created_at,omitempty"`
-		UpdatedAt time.Time `json:"updated_at,omitempty"`
+		ID        uint       `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time  `json:"created_at,omitempty"`
+		UpdatedAt time.Time  `json:"updated_at,omitempty"`
+		DeletedAt *time.Time `json:"deleted_at,omitempty" sql:"index"`
 
 		UUID string `json:"id"`
 
@@ -91,9 +200,10 @@ type (
 	}
 
 	Feed struct {
-		ID        uint      `json:"-" gorm:"primary_key"`
-		CreatedAt time.Time `json:"created_at"`
-		UpdatedAt time.Time `json:"updated_at"`
+		ID        uint       `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time  `json:"created_at"`
+		UpdatedAt time.Time  `json:"updated_at"`
+		DeletedAt *time.Time `json:"deleted_at,omitempty" sql:"index"`
 
 		UUID string `json:"id"`
 
@@ -103,16 +213,56 @@ type (
 		User   User `json:"-"`
 		UserID uint `json:"-"`
 
+		SharedFeedID uint `json:"-" sql:"index"`
+
 		Entries []Entry `json:"-"`
 
-		Title        string    `json:"title,optional"`
-		Description  string    `json:"description,omitempty"`
-		Subscription string    `json:"subscription,required"`
-		Source       string    `json:"source,omitempty"`
-		TTL          int       `json:"ttl,omitempty"`
+		// Title is the user's own title for the feed
+		Title string `json:"title,optional"`
+
+		// Fields below are stored in the SharedFeed
+		Description  string    `json:"description,omitempty" gorm:"-"`
+		Subscription string    `json:"subscription,required" gorm:"-"`
+		Source       string    `json:"source,omitempty" gorm:"-"`
+		TTL          int       `json:"ttl,omitempty" gorm:"-"`
+		Etag         string    `json:"-" gorm:"-"`
+		LastUpdated  time.Time `json:"-" gorm:"-"`
+		Status       string    `json:"status,omitempty" gorm:"-"`
+	}
+
+	// SharedFeed is a feed source shared by every user subscribed to it
+	SharedFeed struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"-"`
+		UpdatedAt time.Time `json:"-"`
+
+		Items []Item `json:"-"`
+
+		Subscription string    `json:"subscription" gorm:"unique_index"`
+		Title        string    `json:"title"`
+		Description  string    `json:"description"`
+		Source       string    `json:"source"`
+		TTL          int       `json:"ttl"`
 		Etag         string    `json:"-"`
 		LastUpdated  time.Time `json:"-"`
-		Status       string    `json:"status,omitempty"`
+		Status       string    `json:"status"`
+	}
+
+	// Item is a single item published by a SharedFeed.
+	// Each subscribed user holds their own Entry for it.
+	Item struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"-"`
+		UpdatedAt time.Time `json:"-"`
+
+		SharedFeedID uint `json:"-"`
+
+		GUID        string    `json:"-"`
+		Title       string    `json:"title"`
+		Link        string    `json:"link"`
+		Description string    `json:"description"`
+		Author      string    `json:"author"`
+		Published   time.Time `json:"published"`
 	}
 
 	Tag struct {
@@ -122,15 +272,19 @@ type (
 
 		UUID string `json:"id"`
 
-		EntryID uint `json:"-"`
+		User   User `json:"-"`
+		UserID uint `json:"-"`
 
-		Name string
+		Entries []Entry `json:"-" gorm:"many2many:entry_tags;"`
+
+		Name string `json:"name"`
 	}
 
 	Entry struct {
-		ID        uint      `json:"-" gorm:"primary_key"`
-		CreatedAt time.Time `json:"created_at"`
-		UpdatedAt time.Time `json:"updated_at"`
+		ID        uint       `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time  `json:"created_at"`
+		UpdatedAt time.Time  `json:"updated_at"`
+		DeletedAt *time.Time `json:"-" sql:"index"`
 
 		UUID string `json:"id"`
 
@@ -140,16 +294,20 @@ type (
 		Feed   Feed
 		FeedID uint `json:"-"`
 
-		Tags []Tag `json:"-"`
+		ItemID uint `json:"-" sql:"index"`
 
-		GUID        string    `json:"-"`
-		Title       string    `json:"title"`
-		Link        string    `json:"link"`
-		Description string    `json:"description"`
-		Author      string    `json:"author"`
-		Published   time.Time `json:"published"`
-		Saved       bool      `json:"isSaved"`
-		Mark        Marker    `json:"markedAs"`
+		Tags []Tag `json:"-" gorm:"many2many:entry_tags;"`
+
+		// Fields below are stored in the Item
+		GUID        string    `json:"-" gorm:"-"`
+		Title       string    `json:"title" gorm:"-"`
+		Link        string    `json:"link" gorm:"-"`
+		Description string    `json:"description" gorm:"-"`
+		Author      string    `json:"author" gorm:"-"`
+		Published   time.Time `json:"published" gorm:"-"`
+
+		Saved bool   `json:"isSaved"`
+		Mark  Marker `json:"markedAs"`
 	}
 
 	Stats struct {
@@ -159,12 +317,185 @@ type (
 		Total  int `json:"total"`
 	}
 
+	Trash struct {
+		Feeds      []Feed     `json:"feeds"`
+		Categories []Category `json:"categories"`
+	}
+
+	StatsTree struct {
+		Total      Stats            `json:"total"`
+		Categories map[string]Stats `json:"categories"`
+		Feeds      map[string]Stats `json:"feeds"`
+	}
+
+	// Lockout tracks failed logins for an account or an IP address.
+	// Once there are too many failures logging in is refused until LockedUntil.
+	Lockout struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"-"`
+
+		Kind          string    `json:"kind" gorm:"unique_index:idx_lockouts_kind_subject"`
+		Subject       string    `json:"subject" gorm:"unique_index:idx_lockouts_kind_subject"`
+		Failures      int       `json:"failures"`
+		LastFailureAt time.Time `json:"last_failure_at"`
+		LockedUntil   time.Time `json:"locked_until"`
+	}
+
+	// Invite lets someone register while registration is invite only.
+	// An Invite can be used MaxUses times, or any number of times if zero.
+	Invite struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"-"`
+
+		UUID      string    `json:"id"`
+		Code      string    `json:"code" gorm:"unique_index"`
+		MaxUses   int       `json:"max_uses"`
+		Uses      int       `json:"uses"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	// RecoveryCode can be used once instead of a TOTP code
+	// by a user with two-factor authentication
+	RecoveryCode struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"-"`
+
+		Hash string `json:"-" gorm:"unique_index"`
+
+		User   User `json:"-"`
+		UserID uint `json:"-" sql:"index"`
+	}
+
+	// LoginChallenge is handed to a user with two-factor authentication
+	// after their password is verified. It is exchanged, along with
+	// a TOTP or recovery code, for an APIKey.
+	LoginChallenge struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"-"`
+
+		Token     string    `json:"challenge" gorm:"-"`
+		Hash      string    `json:"-" gorm:"unique_index"`
+		ExpiresAt time.Time `json:"expires_at"`
+
+		User   User `json:"-"`
+		UserID uint `json:"-"`
+	}
+
+	// Publication republishes the entries in a category, a tag or the
+	// saved entries of a user as a feed. Anyone with its Token can read it.
+	Publication struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+
+		UUID  string `json:"id"`
+		Token string `json:"token" gorm:"unique_index"`
+		Title string `json:"title"`
+
+		// Source is one of PublishCategory, PublishTag or PublishSaved
+		// and SourceID the UUID of the category or tag
+		Source   string `json:"source"`
+		SourceID string `json:"source_id,omitempty"`
+
+		User   User `json:"-"`
+		UserID uint `json:"-"`
+	}
+
+	// Webhook is called with the entries a user receives, when they
+	// match its filter. Deliveries are signed with its Secret.
+	Webhook struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+
+		UUID   string `json:"id"`
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+
+		// Entries match the filter when they belong to the feed
+		// or category, and mention the keyword, that are set.
+		// Webhooks with a tag are called when entries are tagged.
+		FeedID     string `json:"feed_id,omitempty"`
+		CategoryID string `json:"category_id,omitempty"`
+		TagID      string `json:"tag_id,omitempty"`
+		Keyword    string `json:"keyword,omitempty"`
+
+		// LastStatus is the HTTP status of the last delivery attempt,
+		// zero if it could not be sent
+		LastStatus      int        `json:"last_status"`
+		LastDeliveredAt *time.Time `json:"last_delivered_at,omitempty"`
+
+		User   User `json:"-"`
+		UserID uint `json:"-"`
+	}
+
+	// WebhookDelivery records a call of a Webhook, over every attempt made
+	WebhookDelivery struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+
+		UUID     string `json:"id"`
+		Event    string `json:"event"`
+		Entries  int    `json:"entries"`
+		Attempts int    `json:"attempts"`
+		Status   int    `json:"status"`
+		Error    string `json:"error,omitempty"`
+
+		Webhook   Webhook `json:"-"`
+		WebhookID uint    `json:"-"`
+	}
+
+	// InstanceStats counts the objects stored by the whole instance
+	InstanceStats struct {
+		Users   int `json:"users"`
+		Feeds   int `json:"feeds"`
+		Sources int `json:"sources"`
+		Entries int `json:"entries"`
+		APIKeys int `json:"api_keys"`
+	}
+
 	APIKey struct {
+		ID        uint      `json:"-" gorm:"primary_key"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"-"`
+
+		UUID string `json:"id"`
+		Key  string `json:"token,omitempty" gorm:"-"`
+		Hash string `json:"-" gorm:"unique_index"`
+
+		Label      string     `json:"label,omitempty"`
+		Device     string     `json:"device,omitempty"`
+		ExpiresAt  time.Time  `json:"expires_at"`
+		LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+
+		// Personal access tokens are long lived and limited to
+		// the space separated scopes in Scope. Keys obtained by
+		// logging in have no scope and grant full access.
+		Personal bool   `json:"personal"`
+		Scope    string `json:"scope,omitempty"`
+
+		// Family is shared with the RefreshTokens of the same login
+		Family string `json:"-" sql:"index"`
+
+		User   User `json:"-"`
+		UserID uint `json:"-"`
+	}
+
+	// RefreshToken is a long lived token used to obtain new APIKeys.
+	// Tokens are rotated on every use and only their hash is stored.
+	RefreshToken struct {
 		ID        uint      `json:"-" gorm:"primary_key"`
 		CreatedAt time.Time `json:"-"`
 		UpdatedAt time.Time `json:"-"`
 
-		Key string `json:"token"`
+		Token     string    `json:"refresh_token" gorm:"-"`
+		Hash      string    `json:"-" gorm:"unique_index"`
+		Family    string    `json:"-" sql:"index"`
+		Used      bool      `json:"-"`
+		ExpiresAt time.Time `json:"refresh_expires_at"`
 
 		User   User `json:"-"`
 		UserID uint `json:"-"`
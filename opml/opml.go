@@ -0,0 +1,441 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package opml imports and exports a user's subscriptions
+// as OPML documents.
+package opml
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/sync"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the OPML documents written by Export
+const Version = "2.0"
+
+// MaxFeeds is the largest number of feeds a single import can hold
+const MaxFeeds = 1000
+
+// MaxDocumentSize is the largest document, in bytes, the server accepts for an import
+const MaxDocumentSize = 5 << 20
+
+// MaxConcurrentFetches is the number of feeds validated at once during an import
+const MaxConcurrentFetches = 4
+
+// ReportExpiration is how long the report of a finished import is kept
+const ReportExpiration = time.Hour
+
+// Statuses of a feed in an import Report
+const (
+	Pending     = "pending"
+	Imported    = "imported"
+	Duplicate   = "duplicate"
+	Unreachable = "unreachable"
+	Failed      = "failed"
+)
+
+var (
+	// ErrInvalidDocument is returned when an import is not an OPML document
+	ErrInvalidDocument = errors.New("Document is not valid OPML")
+
+	// ErrTooManyFeeds is returned when an import holds more than MaxFeeds feeds
+	ErrTooManyFeeds = errors.New("Document holds too many feeds")
+)
+
+type (
+	// Document is an OPML document
+	Document struct {
+		XMLName xml.Name `xml:"opml"`
+		Version string   `xml:"version,attr"`
+		Head    Head     `xml:"head"`
+		Body    Body     `xml:"body"`
+	}
+
+	// Head holds an OPML document's metadata
+	Head struct {
+		Title       string `xml:"title,omitempty"`
+		DateCreated string `xml:"dateCreated,omitempty"`
+	}
+
+	// Body holds an OPML document's outlines
+	Body struct {
+		Outlines []Outline `xml:"outline"`
+	}
+
+	// Outline is either a feed, when it has an XMLURL,
+	// or a folder of other outlines.
+	Outline struct {
+		Text     string    `xml:"text,attr"`
+		Title    string    `xml:"title,attr,omitempty"`
+		Type     string    `xml:"type,attr,omitempty"`
+		XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+		HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+		Outlines []Outline `xml:"outline,omitempty"`
+	}
+
+	// Report describes the progress and outcome of an import
+	Report struct {
+		ID        string       `json:"id"`
+		CreatedAt time.Time    `json:"created_at"`
+		Done      bool         `json:"done"`
+		Imported  int          `json:"imported"`
+		Failed    int          `json:"failed"`
+		Feeds     []FeedReport `json:"feeds"`
+
+		userID string
+	}
+
+	// FeedReport is the outcome of importing a single feed
+	FeedReport struct {
+		Subscription string `json:"subscription"`
+		Title        string `json:"title,omitempty"`
+		Category     string `json:"category,omitempty"`
+		FeedID       string `json:"feed_id,omitempty"`
+		Status       string `json:"status"`
+		Error        string `json:"error,omitempty"`
+	}
+
+	// Importer runs imports in the background and keeps
+	// their reports until they expire.
+	Importer struct {
+		db      database.Store
+		fetch   func(*models.Feed) error
+		lock    gosync.Mutex
+		reports map[string]*Report
+	}
+)
+
+// NewImporter creates an Importer that subscribes users to feeds in db
+func NewImporter(db database.Store) *Importer {
+	return &Importer{
+		db:      db,
+		fetch:   sync.FetchFeed,
+		reports: map[string]*Report{},
+	}
+}
+
+// Parse reads an OPML document from r
+func Parse(r io.Reader) (Document, error) {
+	doc := Document{}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return doc, ErrInvalidDocument
+	}
+
+	return doc, nil
+}
+
+// Export writes every feed owned by user to w as an OPML document.
+// Categories become folders and uncategorized feeds are kept at the top level.
+func Export(db database.Store, user *models.User, w io.Writer) (Document, error) {
+	doc := Document{
+		Version: Version,
+		Head: Head{
+			Title:       user.Username + "'s subscriptions",
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	for _, ctg := range db.Categories(user) {
+		if ctg.UUID == user.SavedCategoryUUID {
+			continue
+		}
+
+		feeds, err := db.FeedsFromCategory(ctg.UUID, user)
+		if err != nil {
+			return doc, err
+		}
+
+		outlines := make([]Outline, 0, len(feeds))
+		for _, feed := range feeds {
+			outlines = append(outlines, feedOutline(feed))
+		}
+
+		if ctg.UUID == user.UncategorizedCategoryUUID {
+			doc.Body.Outlines = append(doc.Body.Outlines, outlines...)
+		} else {
+			doc.Body.Outlines = append(doc.Body.Outlines, Outline{
+				Text:     ctg.Name,
+				Title:    ctg.Name,
+				Outlines: outlines,
+			})
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return doc, err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return doc, err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return doc, err
+}
+
+func feedOutline(feed models.Feed) Outline {
+	title := feed.Title
+	if title == "" {
+		title = feed.Subscription
+	}
+
+	return Outline{
+		Text:    title,
+		Title:   title,
+		Type:    "rss",
+		XMLURL:  feed.Subscription,
+		HTMLURL: feed.Source,
+	}
+}
+
+// Import is a shortcut for NewImporter(db).Import(user, r)
+func Import(db database.Store, user *models.User, r io.Reader) (Report, error) {
+	return NewImporter(db).Import(user, r)
+}
+
+// Import reads an OPML document from r and subscribes user to its
+// feeds. It blocks until every feed was validated.
+func (i *Importer) Import(user *models.User, r io.Reader) (Report, error) {
+	report, err := i.prepare(user, r)
+	if err != nil {
+		return Report{}, err
+	}
+
+	i.run(report, user)
+	return i.snapshot(report), nil
+}
+
+// Start reads an OPML document from r and returns the report of an
+// import that validates and subscribes user to its feeds in the background.
+func (i *Importer) Start(user *models.User, r io.Reader) (Report, error) {
+	report, err := i.prepare(user, r)
+	if err != nil {
+		return Report{}, err
+	}
+
+	i.lock.Lock()
+	i.pruneReports()
+	i.reports[report.ID] = report
+	i.lock.Unlock()
+
+	go i.run(report, user)
+	return i.snapshot(report), nil
+}
+
+// Report returns the report of an import started by user
+func (i *Importer) Report(id string, user *models.User) (Report, bool) {
+	i.lock.Lock()
+	report, ok := i.reports[id]
+	i.lock.Unlock()
+
+	if !ok || report.userID != user.UUID {
+		return Report{}, false
+	}
+
+	return i.snapshot(report), true
+}
+
+// prepare parses an import and creates the categories it needs,
+// leaving its feeds pending
+func (i *Importer) prepare(user *models.User, r io.Reader) (*Report, error) {
+	doc, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		ID:        uuid.NewV4().String(),
+		CreatedAt: time.Now(),
+		userID:    user.UUID,
+	}
+
+	collectFeeds(doc.Body.Outlines, "", report)
+	if len(report.Feeds) > MaxFeeds {
+		return nil, ErrTooManyFeeds
+	}
+
+	subscribed := map[string]bool{}
+	for _, feed := range i.db.Feeds(user) {
+		subscribed[feed.Subscription] = true
+	}
+
+	categories := map[string]string{}
+	var savedName string
+	for _, ctg := range i.db.Categories(user) {
+		if ctg.UUID == user.SavedCategoryUUID {
+			savedName = ctg.Name
+			continue
+		}
+		categories[ctg.Name] = ctg.UUID
+	}
+
+	for idx := range report.Feeds {
+		feed := &report.Feeds[idx]
+
+		if subscribed[feed.Subscription] {
+			feed.Status = Duplicate
+			continue
+		}
+		subscribed[feed.Subscription] = true
+
+		// Feeds cannot be put in the category of saved entries
+		if feed.Category == savedName {
+			feed.Category = ""
+		}
+
+		if feed.Category == "" {
+			continue
+		}
+
+		if _, ok := categories[feed.Category]; !ok {
+			ctg := models.Category{Name: feed.Category}
+			if err = i.db.NewCategory(&ctg, user); err != nil {
+				return nil, err
+			}
+			categories[ctg.Name] = ctg.UUID
+		}
+	}
+
+	return report, nil
+}
+
+// collectFeeds adds every feed under outlines to report. Feeds take
+// the name of the closest folder they are in as their category.
+func collectFeeds(outlines []Outline, category string, report *Report) {
+	for _, outline := range outlines {
+		name := strings.TrimSpace(outline.Text)
+		if name == "" {
+			name = strings.TrimSpace(outline.Title)
+		}
+
+		subscription := strings.TrimSpace(outline.XMLURL)
+		if subscription == "" {
+			collectFeeds(outline.Outlines, name, report)
+			continue
+		}
+
+		report.Feeds = append(report.Feeds, FeedReport{
+			Subscription: subscription,
+			Title:        name,
+			Category:     category,
+			Status:       Pending,
+		})
+	}
+}
+
+// run validates and subscribes user to every pending feed of report
+func (i *Importer) run(report *Report, user *models.User) {
+	categories := map[string]string{}
+	for _, ctg := range i.db.Categories(user) {
+		if ctg.UUID != user.SavedCategoryUUID {
+			categories[ctg.Name] = ctg.UUID
+		}
+	}
+
+	pending := make(chan int)
+	wg := gosync.WaitGroup{}
+
+	for w := 0; w < MaxConcurrentFetches; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range pending {
+				i.importFeed(report, idx, categories, user)
+			}
+		}()
+	}
+
+	for idx, feed := range report.Feeds {
+		if feed.Status == Pending {
+			pending <- idx
+		}
+	}
+	close(pending)
+	wg.Wait()
+
+	i.lock.Lock()
+	report.Done = true
+	i.lock.Unlock()
+
+	log.Infof("Imported %d of %d feeds for %s", report.Imported, len(report.Feeds), user.Username)
+}
+
+func (i *Importer) importFeed(report *Report, idx int, categories map[string]string, user *models.User) {
+	i.lock.Lock()
+	result := report.Feeds[idx]
+	i.lock.Unlock()
+
+	feed := models.Feed{
+		Title:        result.Title,
+		Subscription: result.Subscription,
+	}
+	feed.Category.UUID = categories[result.Category]
+
+	if err := i.fetch(&feed); err != nil {
+		result.Status = Unreachable
+		result.Error = err.Error()
+	} else if err = i.db.NewFeed(&feed, user); err != nil {
+		result.Status = Failed
+		result.Error = err.Error()
+	} else {
+		result.Status = Imported
+		result.FeedID = feed.UUID
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	report.Feeds[idx] = result
+	if result.Status == Imported {
+		report.Imported++
+	} else {
+		report.Failed++
+	}
+}
+
+// snapshot copies a report so it can be read while the import runs
+func (i *Importer) snapshot(report *Report) Report {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	copied := *report
+	copied.Feeds = append([]FeedReport(nil), report.Feeds...)
+	return copied
+}
+
+// pruneReports forgets finished imports that expired.
+// The lock must be held.
+func (i *Importer) pruneReports() {
+	for id, report := range i.reports {
+		if report.Done && time.Since(report.CreatedAt) > ReportExpiration {
+			delete(i.reports, id)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package opml
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/models"
+	"github.com/stretchr/testify/suite"
+)
+
+const TestDatabasePath = "/tmp/syndication-test-opml.db"
+
+const testDocument = `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="1.0">
+  <head><title>Subscriptions</title></head>
+  <body>
+    <outline text="Top" type="rss" xmlUrl="http://example.com/top.xml"/>
+    <outline text="News" title="News">
+      <outline text="World" type="rss" xmlUrl="http://example.com/world.xml"/>
+      <outline text="Broken" type="rss" xmlUrl="http://example.com/broken.xml"/>
+      <outline text="Local">
+        <outline title="Town" type="rss" xmlUrl="http://example.com/town.xml"/>
+      </outline>
+    </outline>
+    <outline text="Again" type="rss" xmlUrl="http://example.com/top.xml"/>
+  </body>
+</opml>`
+
+type OPMLTestSuite struct {
+	suite.Suite
+
+	db       database.Store
+	user     models.User
+	importer *Importer
+}
+
+func (suite *OPMLTestSuite) SetupTest() {
+	suite.Require().Nil(suite.db.NewUser("test", "golang123"))
+
+	var err error
+	suite.user, err = suite.db.UserWithName("test")
+	suite.Require().Nil(err)
+
+	suite.importer = NewImporter(suite.db)
+	suite.importer.fetch = func(feed *models.Feed) error {
+		if strings.Contains(feed.Subscription, "broken") {
+			return errors.New("unreachable")
+		}
+		feed.Source = "http://example.com"
+		return nil
+	}
+}
+
+func (suite *OPMLTestSuite) TearDownTest() {
+	suite.db.DeleteAll()
+}
+
+func (suite *OPMLTestSuite) TestImport() {
+	report, err := suite.importer.Import(&suite.user, strings.NewReader(testDocument))
+	suite.Require().Nil(err)
+
+	suite.True(report.Done)
+	suite.Equal(3, report.Imported)
+	suite.Equal(1, report.Failed)
+	suite.Require().Len(report.Feeds, 5)
+
+	suite.Equal(Imported, report.Feeds[0].Status)
+	suite.Empty(report.Feeds[0].Category)
+	suite.NotEmpty(report.Feeds[0].FeedID)
+	suite.Equal(Imported, report.Feeds[1].Status)
+	suite.Equal("News", report.Feeds[1].Category)
+	suite.Equal(Unreachable, report.Feeds[2].Status)
+	suite.Equal("unreachable", report.Feeds[2].Error)
+	suite.Equal(Imported, report.Feeds[3].Status)
+	suite.Equal("Local", report.Feeds[3].Category)
+	suite.Equal("Town", report.Feeds[3].Title)
+	suite.Equal(Duplicate, report.Feeds[4].Status)
+
+	feed, err := suite.db.Feed(report.Feeds[1].FeedID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal("World", feed.Title)
+	suite.Equal("News", feed.Category.Name)
+
+	feed, err = suite.db.Feed(report.Feeds[0].FeedID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal(suite.user.UncategorizedCategoryUUID, feed.Category.UUID)
+
+	// Feeds that are already subscribed to are skipped
+	suite.importer.fetch = func(feed *models.Feed) error { return nil }
+
+	report, err = suite.importer.Import(&suite.user, strings.NewReader(testDocument))
+	suite.Require().Nil(err)
+	suite.Equal(1, report.Imported)
+	suite.Equal(Duplicate, report.Feeds[0].Status)
+	suite.Equal(Imported, report.Feeds[2].Status)
+	suite.Len(suite.db.Feeds(&suite.user), 4)
+}
+
+func (suite *OPMLTestSuite) TestImportIntoSavedFolder() {
+	doc := `<opml version="2.0"><body>
+    <outline text="Saved">
+      <outline text="World" type="rss" xmlUrl="http://example.com/world.xml"/>
+    </outline>
+  </body></opml>`
+
+	report, err := suite.importer.Import(&suite.user, strings.NewReader(doc))
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, report.Imported)
+	suite.Empty(report.Feeds[0].Category)
+
+	feed, err := suite.db.Feed(report.Feeds[0].FeedID, &suite.user)
+	suite.Require().Nil(err)
+	suite.Equal(suite.user.UncategorizedCategoryUUID, feed.Category.UUID)
+}
+
+func (suite *OPMLTestSuite) TestImportInvalidDocument() {
+	_, err := suite.importer.Import(&suite.user, strings.NewReader("<rss></rss>"))
+	suite.Equal(ErrInvalidDocument, err)
+
+	_, err = suite.importer.Import(&suite.user, strings.NewReader("not xml"))
+	suite.Equal(ErrInvalidDocument, err)
+
+	var doc bytes.Buffer
+	doc.WriteString(`<opml version="2.0"><body>`)
+	for i := 0; i <= MaxFeeds; i++ {
+		doc.WriteString(`<outline text="Feed" xmlUrl="http://example.com/feed.xml"/>`)
+	}
+	doc.WriteString(`</body></opml>`)
+
+	_, err = suite.importer.Import(&suite.user, &doc)
+	suite.Equal(ErrTooManyFeeds, err)
+}
+
+func (suite *OPMLTestSuite) TestStart() {
+	report, err := suite.importer.Start(&suite.user, strings.NewReader(testDocument))
+	suite.Require().Nil(err)
+	suite.NotEmpty(report.ID)
+	suite.Len(report.Feeds, 5)
+
+	for i := 0; i < 100 && !report.Done; i++ {
+		time.Sleep(10 * time.Millisecond)
+
+		var ok bool
+		report, ok = suite.importer.Report(report.ID, &suite.user)
+		suite.Require().True(ok)
+	}
+
+	suite.True(report.Done)
+	suite.Equal(3, report.Imported)
+
+	other := models.User{UUID: "other"}
+	_, ok := suite.importer.Report(report.ID, &other)
+	suite.False(ok)
+
+	_, ok = suite.importer.Report("bogus", &suite.user)
+	suite.False(ok)
+}
+
+func (suite *OPMLTestSuite) TestExport() {
+	_, err := suite.importer.Import(&suite.user, strings.NewReader(testDocument))
+	suite.Require().Nil(err)
+
+	var buf bytes.Buffer
+	doc, err := Export(suite.db, &suite.user, &buf)
+	suite.Require().Nil(err)
+	suite.Equal(Version, doc.Version)
+
+	exported := buf.Bytes()
+	parsed, err := Parse(bytes.NewReader(exported))
+	suite.Require().Nil(err)
+
+	var folders []string
+	var feeds []string
+	for _, outline := range parsed.Body.Outlines {
+		if outline.XMLURL != "" {
+			feeds = append(feeds, outline.XMLURL)
+			continue
+		}
+
+		folders = append(folders, outline.Text)
+		for _, child := range outline.Outlines {
+			feeds = append(feeds, child.XMLURL)
+		}
+	}
+
+	suite.ElementsMatch([]string{"News", "Local"}, folders)
+	suite.ElementsMatch([]string{
+		"http://example.com/top.xml",
+		"http://example.com/world.xml",
+		"http://example.com/town.xml",
+	}, feeds)
+
+	// An export imports back without changes
+	report, err := suite.importer.Import(&suite.user, bytes.NewReader(exported))
+	suite.Require().Nil(err)
+	suite.Equal(0, report.Imported)
+}
+
+func TestOPMLTestSuite(t *testing.T) {
+	db, err := database.NewDB("sqlite3", TestDatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	suite.Run(t, &OPMLTestSuite{db: db})
+}
+
+func TestOPMLMemoryTestSuite(t *testing.T) {
+	suite.Run(t, &OPMLTestSuite{db: database.NewMemoryDB()})
+}
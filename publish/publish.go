@@ -0,0 +1,302 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package publish renders entries as RSS 2.0, Atom 1.0 and JSON Feed documents
+package publish
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"github.com/chavamee/syndication/models"
+)
+
+// Formats a Channel can be rendered in
+const (
+	RSS      = "rss"
+	Atom     = "atom"
+	JSONFeed = "json"
+)
+
+// MaxItems is the most entries rendered in a document
+const MaxItems = 50
+
+// Generator names the software that rendered a document
+const Generator = "Syndication"
+
+// JSONFeedVersion is the version of the JSON Feed format rendered
+const JSONFeedVersion = "https://jsonfeed.org/version/1.1"
+
+// ErrUnknownFormat is returned when rendering a format that is not supported
+var ErrUnknownFormat = errors.New("Unknown feed format")
+
+// Channel describes a rendered document
+type Channel struct {
+	// ID uniquely identifies the channel across formats
+	ID    string
+	Title string
+
+	// URL is where the document is served
+	URL     string
+	Updated time.Time
+}
+
+type (
+	rssDocument struct {
+		XMLName xml.Name   `xml:"rss"`
+		Version string     `xml:"version,attr"`
+		AtomNS  string     `xml:"xmlns:atom,attr"`
+		DCNS    string     `xml:"xmlns:dc,attr"`
+		Channel rssChannel `xml:"channel"`
+	}
+
+	rssChannel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		Generator     string    `xml:"generator"`
+		LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+		Self          atomLink  `xml:"atom:link"`
+		Items         []rssItem `xml:"item"`
+	}
+
+	rssItem struct {
+		Title       string  `xml:"title"`
+		Link        string  `xml:"link,omitempty"`
+		Description string  `xml:"description"`
+		Creator     string  `xml:"dc:creator,omitempty"`
+		GUID        rssGUID `xml:"guid"`
+		PubDate     string  `xml:"pubDate,omitempty"`
+	}
+
+	rssGUID struct {
+		IsPermaLink bool   `xml:"isPermaLink,attr"`
+		Value       string `xml:",chardata"`
+	}
+
+	atomFeed struct {
+		XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+		ID        string      `xml:"id"`
+		Title     string      `xml:"title"`
+		Updated   string      `xml:"updated"`
+		Generator string      `xml:"generator"`
+		Author    atomPerson  `xml:"author"`
+		Links     []atomLink  `xml:"link"`
+		Entries   []atomEntry `xml:"entry"`
+	}
+
+	atomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+		Type string `xml:"type,attr,omitempty"`
+	}
+
+	atomPerson struct {
+		Name string `xml:"name"`
+	}
+
+	atomEntry struct {
+		ID        string      `xml:"id"`
+		Title     string      `xml:"title"`
+		Updated   string      `xml:"updated"`
+		Published string      `xml:"published,omitempty"`
+		Author    *atomPerson `xml:"author,omitempty"`
+		Links     []atomLink  `xml:"link"`
+		Content   atomContent `xml:"content"`
+	}
+
+	atomContent struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	}
+
+	jsonFeed struct {
+		Version string         `json:"version"`
+		Title   string         `json:"title"`
+		FeedURL string         `json:"feed_url"`
+		Items   []jsonFeedItem `json:"items"`
+	}
+
+	jsonFeedItem struct {
+		ID            string           `json:"id"`
+		URL           string           `json:"url,omitempty"`
+		Title         string           `json:"title"`
+		ContentHTML   string           `json:"content_html"`
+		DatePublished string           `json:"date_published,omitempty"`
+		Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	}
+
+	jsonFeedAuthor struct {
+		Name string `json:"name"`
+	}
+)
+
+// ContentType returns the media type of documents in format
+func ContentType(format string) (string, error) {
+	switch format {
+	case RSS:
+		return "application/rss+xml; charset=utf-8", nil
+	case Atom:
+		return "application/atom+xml; charset=utf-8", nil
+	case JSONFeed:
+		return "application/feed+json; charset=utf-8", nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// Render returns channel, holding up to MaxItems of entries, as a document in format
+func Render(format string, channel Channel, entries []models.Entry) ([]byte, error) {
+	if len(entries) > MaxItems {
+		entries = entries[:MaxItems]
+	}
+
+	switch format {
+	case RSS:
+		return renderRSS(channel, entries)
+	case Atom:
+		return renderAtom(channel, entries)
+	case JSONFeed:
+		return renderJSONFeed(channel, entries)
+	}
+	return nil, ErrUnknownFormat
+}
+
+func renderRSS(channel Channel, entries []models.Entry) ([]byte, error) {
+	doc := rssDocument{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       channel.Title,
+			Link:        channel.URL,
+			Description: channel.Title,
+			Generator:   Generator,
+			Self: atomLink{
+				Href: channel.URL,
+				Rel:  "self",
+				Type: "application/rss+xml",
+			},
+			Items: make([]rssItem, len(entries)),
+		},
+	}
+
+	if !channel.Updated.IsZero() {
+		doc.Channel.LastBuildDate = channel.Updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for i, entry := range entries {
+		doc.Channel.Items[i] = rssItem{
+			Title:       entry.Title,
+			Link:        entry.Link,
+			Description: entry.Description,
+			Creator:     entry.Author,
+			GUID:        rssGUID{Value: "urn:uuid:" + entry.UUID},
+			PubDate:     published(entry).UTC().Format(time.RFC1123Z),
+		}
+	}
+
+	return marshalXML(doc)
+}
+
+func renderAtom(channel Channel, entries []models.Entry) ([]byte, error) {
+	feed := atomFeed{
+		ID:        "urn:uuid:" + channel.ID,
+		Title:     channel.Title,
+		Updated:   channel.Updated.UTC().Format(time.RFC3339),
+		Generator: Generator,
+		Author:    atomPerson{Name: Generator},
+		Links: []atomLink{{
+			Href: channel.URL,
+			Rel:  "self",
+			Type: "application/atom+xml",
+		}},
+		Entries: make([]atomEntry, len(entries)),
+	}
+
+	for i, entry := range entries {
+		atom := atomEntry{
+			ID:        "urn:uuid:" + entry.UUID,
+			Title:     entry.Title,
+			Updated:   published(entry).UTC().Format(time.RFC3339),
+			Published: published(entry).UTC().Format(time.RFC3339),
+			Content: atomContent{
+				Type:  "html",
+				Value: entry.Description,
+			},
+		}
+
+		if entry.Author != "" {
+			atom.Author = &atomPerson{Name: entry.Author}
+		}
+
+		if entry.Link != "" {
+			atom.Links = []atomLink{{Href: entry.Link, Rel: "alternate"}}
+		}
+
+		feed.Entries[i] = atom
+	}
+
+	return marshalXML(feed)
+}
+
+func renderJSONFeed(channel Channel, entries []models.Entry) ([]byte, error) {
+	feed := jsonFeed{
+		Version: JSONFeedVersion,
+		Title:   channel.Title,
+		FeedURL: channel.URL,
+		Items:   make([]jsonFeedItem, len(entries)),
+	}
+
+	for i, entry := range entries {
+		item := jsonFeedItem{
+			ID:            entry.UUID,
+			URL:           entry.Link,
+			Title:         entry.Title,
+			ContentHTML:   entry.Description,
+			DatePublished: published(entry).UTC().Format(time.RFC3339),
+		}
+
+		if entry.Author != "" {
+			item.Authors = []jsonFeedAuthor{{Name: entry.Author}}
+		}
+
+		feed.Items[i] = item
+	}
+
+	return json.MarshalIndent(feed, "", "  ")
+}
+
+func marshalXML(doc interface{}) ([]byte, error) {
+	buf := bytes.NewBufferString(xml.Header)
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// published returns when entry was published, or stored if its feed did not say
+func published(entry models.Entry) time.Time {
+	if entry.Published.IsZero() {
+		return entry.CreatedAt
+	}
+	return entry.Published
+}
@@ -0,0 +1,95 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package publish
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chavamee/syndication/models"
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntries(count int) []models.Entry {
+	published := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	entries := make([]models.Entry, count)
+	for i := range entries {
+		entries[i] = models.Entry{
+			UUID:        "00000000-0000-0000-0000-" + strconv.Itoa(100000000000+i),
+			Title:       "Item " + strconv.Itoa(i),
+			Link:        "http://example.com/" + strconv.Itoa(i),
+			Description: "<p>Body & more</p>",
+			Author:      "Jane",
+			Published:   published.Add(-time.Duration(i) * time.Hour),
+		}
+	}
+	return entries
+}
+
+func TestRender(t *testing.T) {
+	channel := Channel{
+		ID:      "11111111-1111-1111-1111-111111111111",
+		Title:   "News",
+		URL:     "http://localhost/published/token/rss",
+		Updated: time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	for _, format := range []string{RSS, Atom, JSONFeed} {
+		body, err := Render(format, channel, testEntries(2))
+		require.Nil(t, err, format)
+
+		feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+		require.Nil(t, err, format)
+
+		assert.Equal(t, "News", feed.Title, format)
+		require.Len(t, feed.Items, 2, format)
+		assert.Equal(t, "Item 0", feed.Items[0].Title, format)
+		assert.Equal(t, "http://example.com/0", feed.Items[0].Link, format)
+		assert.Contains(t, feed.Items[0].Content+feed.Items[0].Description, "<p>Body & more</p>", format)
+		require.NotNil(t, feed.Items[0].PublishedParsed, format)
+		assert.True(t, feed.Items[0].PublishedParsed.Equal(testEntries(1)[0].Published), format)
+		require.NotEmpty(t, feed.Items[0].Authors, format)
+		assert.Equal(t, "Jane", feed.Items[0].Authors[0].Name, format)
+	}
+}
+
+func TestRenderLimit(t *testing.T) {
+	body, err := Render(JSONFeed, Channel{Title: "News"}, testEntries(MaxItems+10))
+	require.Nil(t, err)
+
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	require.Nil(t, err)
+	assert.Len(t, feed.Items, MaxItems)
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	_, err := Render("opml", Channel{}, nil)
+	assert.Equal(t, ErrUnknownFormat, err)
+
+	_, err = ContentType("opml")
+	assert.Equal(t, ErrUnknownFormat, err)
+
+	contentType, err := ContentType(Atom)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/atom+xml; charset=utf-8", contentType)
+}
@@ -0,0 +1,124 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chavamee/syndication/events"
+
+	"github.com/labstack/echo"
+)
+
+// EventsKeepAlive is how often a comment is sent on idle event streams
+// so that proxies do not close them
+const EventsKeepAlive = 30 * time.Second
+
+// GetEvents streams the events of a user as Server-Sent Events. Clients
+// resume a stream by sending the id of the last event they received in
+// the Last-Event-ID header or the last_event_id query parameter.
+func (s *Server) GetEvents(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+
+	var lastID uint64
+	if lastEventID != "" {
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest)
+		}
+	}
+
+	bus := s.db.Events()
+	sub, missed, complete := bus.Subscribe(user.ID, lastID)
+	defer bus.Unsubscribe(sub)
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+
+	if complete {
+		for _, event := range missed {
+			if err = writeEvent(resp, event); err != nil {
+				return nil
+			}
+		}
+	} else {
+		// Clients refetch their data instead of replaying part of what
+		// they missed, and resume from the newest retained event after
+		resync := events.Event{Type: events.Resync}
+		if len(missed) > 0 {
+			resync.ID = missed[len(missed)-1].ID
+		}
+
+		if err = writeEvent(resp, resync); err != nil {
+			return nil
+		}
+	}
+	resp.Flush()
+
+	keepAlive := time.NewTicker(EventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				// The subscriber fell behind, it reconnects and resumes
+				return nil
+			}
+			err = writeEvent(resp, event)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(resp, ": keep-alive\n\n")
+		case <-c.Request().Context().Done():
+			return nil
+		case <-s.done:
+			return nil
+		}
+
+		if err != nil {
+			return nil
+		}
+		resp.Flush()
+	}
+}
+
+// writeEvent writes event in the text/event-stream format
+func writeEvent(resp *echo.Response, event events.Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -0,0 +1,372 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chavamee/syndication/models"
+
+	"github.com/labstack/echo"
+)
+
+// FeverAPIVersion is the version of the Fever API served at /fever/
+const FeverAPIVersion = 3
+
+// FeverItemsLimit is the most items returned by a single Fever request
+const FeverItemsLimit = 50
+
+type (
+	// FeverGroup is a Category as seen by Fever clients
+	FeverGroup struct {
+		ID    uint   `json:"id"`
+		Title string `json:"title"`
+	}
+
+	// FeverFeedsGroup lists the feeds in a FeverGroup as
+	// comma separated IDs
+	FeverFeedsGroup struct {
+		GroupID uint   `json:"group_id"`
+		FeedIDs string `json:"feed_ids"`
+	}
+
+	// FeverFeed is a Feed as seen by Fever clients
+	FeverFeed struct {
+		ID                uint   `json:"id"`
+		FaviconID         uint   `json:"favicon_id"`
+		Title             string `json:"title"`
+		URL               string `json:"url"`
+		SiteURL           string `json:"site_url"`
+		IsSpark           int    `json:"is_spark"`
+		LastUpdatedOnTime int64  `json:"last_updated_on_time"`
+	}
+
+	// FeverItem is an Entry as seen by Fever clients
+	FeverItem struct {
+		ID            uint   `json:"id"`
+		FeedID        uint   `json:"feed_id"`
+		Title         string `json:"title"`
+		Author        string `json:"author"`
+		HTML          string `json:"html"`
+		URL           string `json:"url"`
+		IsSaved       int    `json:"is_saved"`
+		IsRead        int    `json:"is_read"`
+		CreatedOnTime int64  `json:"created_on_time"`
+	}
+)
+
+// Fever serves the Fever API. Clients authenticate every request
+// with the api_key of a user who set a Fever password and select
+// what is returned, or marked, with query parameters.
+func (s *Server) Fever(c echo.Context) error {
+	resp := map[string]interface{}{
+		"api_version": FeverAPIVersion,
+		"auth":        0,
+	}
+
+	// Fever keys carry no username, so failures only count against the IP
+	ip := s.clientIP(c)
+	if until, locked := s.db.LockedOut("", ip); locked {
+		return lockedOut(c, until)
+	}
+
+	user, err := s.db.UserWithFeverKey(c.FormValue("api_key"))
+	if err != nil {
+		if err := s.db.RecordLoginFailure("", ip); err != nil {
+			return newError(err, &c)
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	resp["auth"] = 1
+
+	has := func(name string) bool {
+		_, ok := c.QueryParams()[name]
+		return ok
+	}
+
+	if mark := c.FormValue("mark"); mark != "" {
+		if err = s.feverMark(c, mark, &user); err != nil {
+			return newError(err, &c)
+		}
+
+		switch c.FormValue("as") {
+		case "saved", "unsaved":
+			resp["saved_item_ids"] = feverIDs(s.db.EntryPrimaryKeys(models.Any, true, &user))
+		default:
+			resp["unread_item_ids"] = feverIDs(s.db.EntryPrimaryKeys(models.Unread, false, &user))
+		}
+	}
+
+	feeds := s.db.Feeds(&user)
+
+	var lastRefreshed time.Time
+	for _, feed := range feeds {
+		if feed.LastUpdated.After(lastRefreshed) {
+			lastRefreshed = feed.LastUpdated
+		}
+	}
+	resp["last_refreshed_on_time"] = feverTime(lastRefreshed)
+
+	if has("groups") {
+		resp["groups"] = s.feverGroups(&user)
+		resp["feeds_groups"] = feverFeedsGroups(feeds)
+	}
+
+	if has("feeds") {
+		feverFeeds := make([]FeverFeed, len(feeds))
+		for i, feed := range feeds {
+			feverFeeds[i] = FeverFeed{
+				ID:                feed.ID,
+				Title:             feed.Title,
+				URL:               feed.Subscription,
+				SiteURL:           feed.Source,
+				LastUpdatedOnTime: feverTime(feed.LastUpdated),
+			}
+		}
+
+		resp["feeds"] = feverFeeds
+		resp["feeds_groups"] = feverFeedsGroups(feeds)
+	}
+
+	// Favicons and links are not supported
+	if has("favicons") {
+		resp["favicons"] = []struct{}{}
+	}
+
+	if has("links") {
+		resp["links"] = []struct{}{}
+	}
+
+	if has("items") {
+		var entries []models.Entry
+		if withIDs := c.QueryParam("with_ids"); withIDs != "" {
+			ids := parseFeverIDs(withIDs)
+			if len(ids) > FeverItemsLimit {
+				ids = ids[:FeverItemsLimit]
+			}
+			entries = s.db.EntriesWithPrimaryKeys(ids, &user)
+		} else {
+			sinceID, _ := strconv.ParseUint(c.QueryParam("since_id"), 10, 0)
+			maxID, _ := strconv.ParseUint(c.QueryParam("max_id"), 10, 0)
+			entries = s.db.EntryPage(uint(sinceID), uint(maxID), FeverItemsLimit, &user)
+		}
+
+		items := make([]FeverItem, len(entries))
+		for i, entry := range entries {
+			items[i] = feverItem(entry)
+		}
+
+		resp["items"] = items
+		resp["total_items"] = s.db.Stats(&user).Total
+	}
+
+	if has("unread_item_ids") {
+		resp["unread_item_ids"] = feverIDs(s.db.EntryPrimaryKeys(models.Unread, false, &user))
+	}
+
+	if has("saved_item_ids") {
+		resp["saved_item_ids"] = feverIDs(s.db.EntryPrimaryKeys(models.Any, true, &user))
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// feverMark applies a Fever mark request to an item, a feed or a group.
+// Feeds and groups are only marked read up to the before timestamp, so
+// that entries the client did not see yet stay unread.
+func (s *Server) feverMark(c echo.Context, mark string, user *models.User) error {
+	id, err := strconv.ParseInt(c.FormValue("id"), 10, 0)
+	if err != nil {
+		return nil
+	}
+
+	as := c.FormValue("as")
+
+	if mark == "item" {
+		entries := s.db.EntriesWithPrimaryKeys([]uint{uint(id)}, user)
+		if len(entries) == 0 {
+			return nil
+		}
+
+		switch as {
+		case "read":
+			return s.db.MarkEntry(entries[0].UUID, models.Read, user)
+		case "unread":
+			return s.db.MarkEntry(entries[0].UUID, models.Unread, user)
+		case "saved":
+			return s.db.SaveEntry(entries[0].UUID, user)
+		case "unsaved":
+			return s.db.UnsaveEntry(entries[0].UUID, user)
+		}
+		return nil
+	}
+
+	if as != "read" {
+		return nil
+	}
+
+	var before time.Time
+	if unix, _ := strconv.ParseInt(c.FormValue("before"), 10, 64); unix > 0 {
+		before = time.Unix(unix, 0)
+	}
+
+	switch mark {
+	case "feed":
+		for _, feed := range s.db.Feeds(user) {
+			if int64(feed.ID) == id {
+				return s.db.MarkFeed(feed.UUID, models.Read, before, user)
+			}
+		}
+	case "group":
+		// Group 0 holds every feed
+		if id == 0 {
+			return s.db.MarkAllEntries(models.Read, before, user)
+		}
+
+		for _, ctg := range s.db.Categories(user) {
+			if int64(ctg.ID) == id {
+				return s.db.MarkCategory(ctg.UUID, models.Read, before, user)
+			}
+		}
+	}
+
+	return nil
+}
+
+// feverGroups returns every Category of user but the saved one
+func (s *Server) feverGroups(user *models.User) []FeverGroup {
+	groups := []FeverGroup{}
+	for _, ctg := range s.db.Categories(user) {
+		if ctg.UUID == user.SavedCategoryUUID {
+			continue
+		}
+
+		groups = append(groups, FeverGroup{
+			ID:    ctg.ID,
+			Title: ctg.Name,
+		})
+	}
+	return groups
+}
+
+func feverFeedsGroups(feeds []models.Feed) []FeverFeedsGroup {
+	groups := []FeverFeedsGroup{}
+	index := map[uint]int{}
+	for _, feed := range feeds {
+		feedID := strconv.FormatUint(uint64(feed.ID), 10)
+
+		i, ok := index[feed.CategoryID]
+		if !ok {
+			index[feed.CategoryID] = len(groups)
+			groups = append(groups, FeverFeedsGroup{
+				GroupID: feed.CategoryID,
+				FeedIDs: feedID,
+			})
+			continue
+		}
+
+		groups[i].FeedIDs += "," + feedID
+	}
+	return groups
+}
+
+func feverItem(entry models.Entry) FeverItem {
+	item := FeverItem{
+		ID:            entry.ID,
+		FeedID:        entry.FeedID,
+		Title:         entry.Title,
+		Author:        entry.Author,
+		HTML:          entry.Description,
+		URL:           entry.Link,
+		CreatedOnTime: feverTime(entry.Published),
+	}
+
+	if item.CreatedOnTime == 0 {
+		item.CreatedOnTime = feverTime(entry.CreatedAt)
+	}
+
+	if entry.Saved {
+		item.IsSaved = 1
+	}
+
+	if entry.Mark == models.Read {
+		item.IsRead = 1
+	}
+
+	return item
+}
+
+// feverTime returns t as a Unix timestamp, or zero if t is not set
+func feverTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// feverIDs joins ids with commas
+func feverIDs(ids []uint) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(values, ",")
+}
+
+// parseFeverIDs splits a comma separated list of ids, skipping invalid ones
+func parseFeverIDs(list string) (ids []uint) {
+	for _, value := range strings.Split(list, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(value), 10, 0)
+		if err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return
+}
+
+// SetFeverPassword sets the password Fever clients log in with
+func (s *Server) SetFeverPassword(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	if err = s.db.SetFeverPassword(c.FormValue("password"), &user); err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// DisableFever stops Fever clients from logging in
+func (s *Server) DisableFever(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	if err = s.db.DisableFever(&user); err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/publish"
+
+	"github.com/labstack/echo"
+)
+
+// PublicationMaxAge is how long clients and proxies may cache a publication
+const PublicationMaxAge = 15 * time.Minute
+
+// NewPublication republishes a category, a tag or the saved entries of a user
+func (s *Server) NewPublication(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	pub := models.Publication{}
+	if err = c.Bind(&pub); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	err = s.db.NewPublication(&pub, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusCreated, pub)
+}
+
+// GetPublications returns the publications of a user
+func (s *Server) GetPublications(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	type Publications struct {
+		Publications []models.Publication `json:"publications"`
+	}
+
+	return c.JSON(http.StatusOK, Publications{
+		Publications: s.db.Publications(&user),
+	})
+}
+
+// GetPublication returns a publication with id
+func (s *Server) GetPublication(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	pub, err := s.db.Publication(c.Param("publicationID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, pub)
+}
+
+// DeletePublication revokes a publication with id. Its token stops working.
+func (s *Server) DeletePublication(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	err = s.db.DeletePublication(c.Param("publicationID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// Published serves the publication with a token as an RSS, Atom or
+// JSON Feed document. It does not need an API key, the token is the
+// only secret. Documents carry an ETag so that clients polling them
+// get a 304 response until their entries change.
+func (s *Server) Published(c echo.Context) error {
+	format := c.Param("format")
+	contentType, err := publish.ContentType(format)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	pub, user, err := s.db.PublicationWithToken(c.Param("token"))
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	query := database.EntryQuery{Limit: publish.MaxItems}
+	switch pub.Source {
+	case models.PublishCategory:
+		query.CategoryID = pub.SourceID
+	case models.PublishTag:
+		query.TagID = pub.SourceID
+	case models.PublishSaved:
+		query.Saved = true
+	}
+
+	// Entries of deleted categories and tags are no longer published
+	entries, err := s.db.QueryEntries(query, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	updated := pub.CreatedAt
+	for _, entry := range entries {
+		if entry.CreatedAt.After(updated) {
+			updated = entry.CreatedAt
+		}
+	}
+
+	req := c.Request()
+	channel := publish.Channel{
+		ID:      pub.UUID,
+		Title:   pub.Title,
+		URL:     c.Scheme() + "://" + req.Host + req.URL.Path,
+		Updated: updated,
+	}
+
+	body, err := publish.Render(format, channel, entries)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(PublicationMaxAge/time.Second)))
+
+	if req.Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.Blob(http.StatusOK, contentType, body)
+}
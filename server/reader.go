@@ -0,0 +1,847 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/sync"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReaderTokenLabel labels the personal access tokens handed
+// out to Google Reader clients on ClientLogin
+const ReaderTokenLabel = "Google Reader"
+
+// ReaderItemsLimit is the most items returned by a single stream request
+const ReaderItemsLimit = 1000
+
+// ReaderDefaultItems is the number of items returned by a stream
+// request that does not ask for a number
+const ReaderDefaultItems = 20
+
+// Google Reader identifies items, feeds, labels and states with
+// prefixed strings. The user part of labels and states is always "-".
+const (
+	readerItemPrefix  = "tag:google.com,2005:reader/item/"
+	readerFeedPrefix  = "feed/"
+	readerLabelPrefix = "user/-/label/"
+
+	readerReadingList = "user/-/state/com.google/reading-list"
+	readerRead        = "user/-/state/com.google/read"
+	readerKeptUnread  = "user/-/state/com.google/kept-unread"
+	readerStarred     = "user/-/state/com.google/starred"
+)
+
+// readerScope is granted to the tokens handed out on ClientLogin
+var readerScope = strings.Join([]string{
+	models.ScopeFeedsRead,
+	models.ScopeFeedsWrite,
+	models.ScopeEntriesRead,
+	models.ScopeEntriesMark,
+}, " ")
+
+type (
+	// ReaderCategory is a label as seen by Google Reader clients
+	ReaderCategory struct {
+		ID    string `json:"id"`
+		Label string `json:"label"`
+	}
+
+	// ReaderSubscription is a Feed as seen by Google Reader clients
+	ReaderSubscription struct {
+		ID         string           `json:"id"`
+		Title      string           `json:"title"`
+		Categories []ReaderCategory `json:"categories"`
+		URL        string           `json:"url"`
+		HTMLURL    string           `json:"htmlUrl"`
+		IconURL    string           `json:"iconUrl"`
+	}
+
+	// ReaderTag is a state or label entries and feeds can have
+	ReaderTag struct {
+		ID   string `json:"id"`
+		Type string `json:"type,omitempty"`
+	}
+
+	// ReaderLink points to the web page of an item
+	ReaderLink struct {
+		Href string `json:"href"`
+		Type string `json:"type,omitempty"`
+	}
+
+	// ReaderContent holds the body of an item
+	ReaderContent struct {
+		Direction string `json:"direction"`
+		Content   string `json:"content"`
+	}
+
+	// ReaderOrigin describes the feed an item comes from
+	ReaderOrigin struct {
+		StreamID string `json:"streamId"`
+		Title    string `json:"title"`
+		HTMLURL  string `json:"htmlUrl"`
+	}
+
+	// ReaderItem is an Entry as seen by Google Reader clients
+	ReaderItem struct {
+		ID            string        `json:"id"`
+		CrawlTimeMsec string        `json:"crawlTimeMsec"`
+		TimestampUsec string        `json:"timestampUsec"`
+		Published     int64         `json:"published"`
+		Updated       int64         `json:"updated"`
+		Title         string        `json:"title"`
+		Author        string        `json:"author,omitempty"`
+		Canonical     []ReaderLink  `json:"canonical"`
+		Alternate     []ReaderLink  `json:"alternate"`
+		Summary       ReaderContent `json:"summary"`
+		Categories    []string      `json:"categories"`
+		Origin        ReaderOrigin  `json:"origin"`
+	}
+
+	// ReaderStream is a page of the items in a stream
+	ReaderStream struct {
+		Direction    string       `json:"direction"`
+		ID           string       `json:"id,omitempty"`
+		Updated      int64        `json:"updated"`
+		Items        []ReaderItem `json:"items"`
+		Continuation string       `json:"continuation,omitempty"`
+	}
+
+	// ReaderItemRef identifies an item in a stream
+	ReaderItemRef struct {
+		ID              string   `json:"id"`
+		DirectStreamIDs []string `json:"directStreamIds"`
+		TimestampUsec   string   `json:"timestampUsec"`
+	}
+
+	// ReaderItemRefs is a page of the item ids in a stream
+	ReaderItemRefs struct {
+		ItemRefs     []ReaderItemRef `json:"itemRefs"`
+		Continuation string          `json:"continuation,omitempty"`
+	}
+
+	// readerIndex looks up the feed and label of entries
+	readerIndex struct {
+		feeds  map[uint]models.Feed
+		labels map[uint]string
+	}
+)
+
+// ClientLogin exchanges a username and password for a personal access
+// token that Google Reader clients send as "GoogleLogin auth=<token>".
+// Users with two-factor authentication log in with a personal access
+// token as their password instead.
+func (s *Server) ClientLogin(c echo.Context) error {
+	username := c.FormValue("Email")
+	password := c.FormValue("Passwd")
+	ip := s.clientIP(c)
+
+	if until, locked := s.db.LockedOut(username, ip); locked {
+		return lockedOut(c, until)
+	}
+
+	if token, err := s.parseReaderToken(password); err == nil {
+		c.Set("user", token)
+		if user, err := s.getUser(&c); err == nil && user.Username == username {
+			return readerAuthResponse(c, token.Raw)
+		}
+	}
+
+	user, err := s.db.Authenticate(username, password)
+	if err != nil {
+		if _, ok := err.(database.Unauthorized); ok {
+			log.Warnf("Failed Google Reader login for %s from %s", username, ip)
+			if err := s.db.RecordLoginFailure(username, ip); err != nil {
+				log.Error(err)
+			}
+		}
+		return c.String(http.StatusUnauthorized, "Error=BadAuthentication\n")
+	}
+
+	// Passwords alone do not satisfy two-factor authentication
+	if user.TOTPEnabled {
+		return c.String(http.StatusUnauthorized, "Error=BadAuthentication\nInfo=InvalidSecondFactor\n")
+	}
+
+	if err = s.db.ClearLoginFailures(username); err != nil {
+		log.Error(err)
+	}
+
+	key := models.APIKey{
+		Label:  ReaderTokenLabel,
+		Device: c.Request().UserAgent(),
+		Scope:  readerScope,
+	}
+
+	err = s.db.NewPersonalAccessToken(s.config.AuthSecret, &key, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return readerAuthResponse(c, key.Key)
+}
+
+func readerAuthResponse(c echo.Context, token string) error {
+	return c.String(http.StatusOK, "SID=null\nLSID=null\nAuth="+token+"\n")
+}
+
+// readerAuth authenticates Google Reader requests with the
+// token in their "Authorization: GoogleLogin auth=" header
+func (s *Server) readerAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(auth, "GoogleLogin auth=") {
+			return echo.ErrUnauthorized
+		}
+
+		token, err := s.parseReaderToken(strings.TrimPrefix(auth, "GoogleLogin auth="))
+		if err != nil {
+			return echo.ErrUnauthorized
+		}
+
+		c.Set("user", token)
+		return next(c)
+	}
+}
+
+func (s *Server) parseReaderToken(raw string) (*jwt.Token, error) {
+	return jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("unexpected signing method")
+		}
+		return []byte(s.config.AuthSecret), nil
+	})
+}
+
+// ReaderToken returns the token Google Reader clients send along with
+// edits. Requests are already authenticated by their header, so it is
+// never checked.
+func (s *Server) ReaderToken(c echo.Context) error {
+	if _, err := s.getUser(&c); err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	return c.String(http.StatusOK, jti)
+}
+
+// ReaderUserInfo returns the user making the request
+func (s *Server) ReaderUserInfo(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"userId":        user.UUID,
+		"userName":      user.Username,
+		"userProfileId": user.UUID,
+		"userEmail":     "",
+	})
+}
+
+// ReaderSubscriptions lists the feeds of a user along with their labels
+func (s *Server) ReaderSubscriptions(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	index := s.readerIndex(&user)
+
+	subscriptions := []ReaderSubscription{}
+	for _, feed := range s.db.Feeds(&user) {
+		subscription := ReaderSubscription{
+			ID:         readerFeedPrefix + feed.UUID,
+			Title:      feed.Title,
+			Categories: []ReaderCategory{},
+			URL:        feed.Subscription,
+			HTMLURL:    feed.Source,
+		}
+
+		if label, ok := index.labels[feed.CategoryID]; ok {
+			subscription.Categories = append(subscription.Categories, ReaderCategory{
+				ID:    readerLabelPrefix + label,
+				Label: label,
+			})
+		}
+
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ReaderSubscription{
+		"subscriptions": subscriptions,
+	})
+}
+
+// ReaderEditSubscription subscribes to, unsubscribes from, renames
+// or relabels a feed depending on the ac parameter
+func (s *Server) ReaderEditSubscription(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	stream := readerTag(c.FormValue("s"))
+	if !strings.HasPrefix(stream, readerFeedPrefix) {
+		return readerBadRequest("Request should include a feed stream")
+	}
+
+	feedID := strings.TrimPrefix(stream, readerFeedPrefix)
+	addLabel := strings.TrimPrefix(readerTag(c.FormValue("a")), readerLabelPrefix)
+	removeLabel := strings.TrimPrefix(readerTag(c.FormValue("r")), readerLabelPrefix)
+
+	switch c.FormValue("ac") {
+	case "subscribe":
+		_, err = s.readerSubscribe(feedID, c.FormValue("t"), addLabel, &user)
+	case "unsubscribe":
+		err = s.db.DeleteFeed(feedID, &user)
+	case "edit":
+		if title := c.FormValue("t"); title != "" {
+			err = s.db.EditFeed(&models.Feed{UUID: feedID, Title: title}, &user)
+			if err != nil {
+				break
+			}
+		}
+
+		if addLabel != "" {
+			var ctg models.Category
+			ctg, err = s.readerLabel(addLabel, &user)
+			if err == nil {
+				err = s.db.ChangeFeedCategory(feedID, ctg.UUID, &user)
+			}
+		} else if removeLabel != "" {
+			err = s.db.ChangeFeedCategory(feedID, user.UncategorizedCategoryUUID, &user)
+		}
+	default:
+		return readerBadRequest("Request should include a valid action")
+	}
+
+	if err != nil {
+		if httpErr, ok := err.(*echo.HTTPError); ok {
+			return httpErr
+		}
+		return newError(err, &c)
+	}
+
+	return c.String(http.StatusOK, "OK")
+}
+
+// ReaderQuickAdd subscribes to the feed at the quickadd URL
+func (s *Server) ReaderQuickAdd(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	subscription := strings.TrimPrefix(c.FormValue("quickadd"), readerFeedPrefix)
+	if subscription == "" {
+		return readerBadRequest("Request should include a feed URL")
+	}
+
+	feed, err := s.readerSubscribe(subscription, "", "", &user)
+	if err != nil {
+		if httpErr, ok := err.(*echo.HTTPError); ok {
+			return httpErr
+		}
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"numResults": 1,
+		"query":      subscription,
+		"streamId":   readerFeedPrefix + feed.UUID,
+		"streamName": feed.Title,
+	})
+}
+
+// readerSubscribe fetches and subscribes user to the feed at subscription,
+// in the category named label
+func (s *Server) readerSubscribe(subscription, title, label string, user *models.User) (models.Feed, error) {
+	feed := models.Feed{
+		Subscription: subscription,
+	}
+
+	if label != "" {
+		ctg, err := s.readerLabel(label, user)
+		if err != nil {
+			return feed, err
+		}
+		feed.Category = ctg
+	}
+
+	if err := sync.FetchFeed(&feed); err != nil {
+		return feed, echo.NewHTTPError(http.StatusBadRequest, ErrorResp{
+			Reason:  "UnreachableFeed",
+			Message: "The given feed could not be reached",
+		})
+	}
+
+	if title != "" {
+		feed.Title = title
+	}
+
+	err := s.db.NewFeed(&feed, user)
+	return feed, err
+}
+
+// readerLabel returns the category of user named label, creating it if needed
+func (s *Server) readerLabel(label string, user *models.User) (models.Category, error) {
+	if ctg, ok := s.readerCategory(label, user); ok {
+		return ctg, nil
+	}
+
+	ctg := models.Category{Name: label}
+	err := s.db.NewCategory(&ctg, user)
+	return ctg, err
+}
+
+// readerCategory returns the category of user named label. The
+// uncategorized and saved categories are not labels.
+func (s *Server) readerCategory(label string, user *models.User) (models.Category, bool) {
+	for _, ctg := range s.db.Categories(user) {
+		if ctg.Name == label && isReaderLabel(ctg, user) {
+			return ctg, true
+		}
+	}
+	return models.Category{}, false
+}
+
+// isReaderLabel tells whether ctg is shown to clients as a label
+func isReaderLabel(ctg models.Category, user *models.User) bool {
+	return ctg.UUID != user.SavedCategoryUUID && ctg.UUID != user.UncategorizedCategoryUUID
+}
+
+// ReaderTags lists the starred state and the labels of a user
+func (s *Server) ReaderTags(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	tags := []ReaderTag{{ID: readerStarred}}
+	for _, ctg := range s.db.Categories(&user) {
+		if isReaderLabel(ctg, &user) {
+			tags = append(tags, ReaderTag{
+				ID:   readerLabelPrefix + ctg.Name,
+				Type: "folder",
+			})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ReaderTag{
+		"tags": tags,
+	})
+}
+
+// ReaderStreamContents returns a page of the items in a stream, named
+// in the path or by the s parameter
+func (s *Server) ReaderStreamContents(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	streamID := c.Param("*")
+	if unescaped, err := url.PathUnescape(streamID); err == nil {
+		streamID = unescaped
+	}
+
+	if streamID == "" {
+		streamID = c.FormValue("s")
+	}
+
+	query, err := s.readerQuery(c, streamID, &user)
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.db.QueryEntries(query, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	stream := s.readerStream(entries, &user)
+	stream.ID = readerTag(streamID)
+	stream.Continuation = readerContinuation(entries, query)
+	return c.JSON(http.StatusOK, stream)
+}
+
+// ReaderStreamItemIDs returns a page of the item ids in a stream
+func (s *Server) ReaderStreamItemIDs(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	query, err := s.readerQuery(c, c.FormValue("s"), &user)
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.db.QueryEntries(query, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	index := s.readerIndex(&user)
+
+	refs := ReaderItemRefs{
+		ItemRefs:     make([]ReaderItemRef, len(entries)),
+		Continuation: readerContinuation(entries, query),
+	}
+
+	for i, entry := range entries {
+		refs.ItemRefs[i] = ReaderItemRef{
+			ID:              strconv.FormatUint(uint64(entry.ID), 10),
+			DirectStreamIDs: []string{readerFeedPrefix + index.feeds[entry.FeedID].UUID},
+			TimestampUsec:   strconv.FormatInt(entry.CreatedAt.UnixNano()/int64(time.Microsecond), 10),
+		}
+	}
+
+	return c.JSON(http.StatusOK, refs)
+}
+
+// ReaderStreamItemContents returns the items with the ids in i
+func (s *Server) ReaderStreamItemContents(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ids, err := readerItemIDs(c)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > ReaderItemsLimit {
+		ids = ids[:ReaderItemsLimit]
+	}
+
+	stream := s.readerStream(s.db.EntriesWithPrimaryKeys(ids, &user), &user)
+	return c.JSON(http.StatusOK, stream)
+}
+
+// ReaderEditTag adds or removes the read and starred states,
+// with the a and r parameters, of the items with the ids in i
+func (s *Server) ReaderEditTag(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ids, err := readerItemIDs(c)
+	if err != nil {
+		return err
+	}
+
+	entries := s.db.EntriesWithPrimaryKeys(ids, &user)
+	entryIDs := make([]string, len(entries))
+	for i, entry := range entries {
+		entryIDs[i] = entry.UUID
+	}
+
+	params, _ := c.FormParams()
+
+	for _, tag := range params["a"] {
+		switch readerTag(tag) {
+		case readerRead:
+			err = s.db.MarkEntriesWithPrimaryKeys(ids, models.Read, &user)
+		case readerKeptUnread:
+			err = s.db.MarkEntriesWithPrimaryKeys(ids, models.Unread, &user)
+		case readerStarred:
+			err = s.db.SaveEntries(entryIDs, &user)
+		}
+
+		if err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	for _, tag := range params["r"] {
+		switch readerTag(tag) {
+		case readerRead:
+			err = s.db.MarkEntriesWithPrimaryKeys(ids, models.Unread, &user)
+		case readerKeptUnread:
+			err = s.db.MarkEntriesWithPrimaryKeys(ids, models.Read, &user)
+		case readerStarred:
+			err = s.db.UnsaveEntries(entryIDs, &user)
+		}
+
+		if err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	return c.String(http.StatusOK, "OK")
+}
+
+// ReaderMarkAllAsRead marks every item in the stream s read,
+// up to the ts timestamp in microseconds when given
+func (s *Server) ReaderMarkAllAsRead(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	query, err := s.readerStreamQuery(c.FormValue("s"), &user)
+	if err != nil {
+		return err
+	}
+
+	query.Marker = models.Unread
+	if ts, err := strconv.ParseInt(c.FormValue("ts"), 10, 64); err == nil && ts > 0 {
+		query.OlderThan = time.Unix(0, ts*int64(time.Microsecond))
+	}
+
+	entries, err := s.db.QueryEntries(query, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	ids := make([]uint, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+
+	if err = s.db.MarkEntriesWithPrimaryKeys(ids, models.Read, &user); err != nil {
+		return newError(err, &c)
+	}
+
+	return c.String(http.StatusOK, "OK")
+}
+
+// readerQuery builds the query for a page of the stream with streamID,
+// limited and ordered by the request's parameters
+func (s *Server) readerQuery(c echo.Context, streamID string, user *models.User) (database.EntryQuery, error) {
+	query, err := s.readerStreamQuery(streamID, user)
+	if err != nil {
+		return query, err
+	}
+
+	query.Limit = ReaderDefaultItems
+	if n, err := strconv.Atoi(c.FormValue("n")); err == nil && n > 0 {
+		query.Limit = n
+	}
+
+	if query.Limit > ReaderItemsLimit {
+		query.Limit = ReaderItemsLimit
+	}
+
+	query.OldestFirst = c.FormValue("r") == "o"
+
+	if continuation, err := strconv.ParseUint(c.FormValue("c"), 10, 0); err == nil {
+		query.Continuation = uint(continuation)
+	}
+
+	if readerTag(c.FormValue("xt")) == readerRead {
+		query.Marker = models.Unread
+	}
+
+	if readerTag(c.FormValue("it")) == readerRead {
+		query.Marker = models.Read
+	}
+
+	if ot, err := strconv.ParseInt(c.FormValue("ot"), 10, 64); err == nil && ot > 0 {
+		query.NewerThan = time.Unix(ot, 0)
+	}
+
+	if nt, err := strconv.ParseInt(c.FormValue("nt"), 10, 64); err == nil && nt > 0 {
+		query.OlderThan = time.Unix(nt, 0)
+	}
+
+	return query, nil
+}
+
+// readerStreamQuery selects the entries in the stream with streamID
+func (s *Server) readerStreamQuery(streamID string, user *models.User) (database.EntryQuery, error) {
+	query := database.EntryQuery{}
+
+	streamID = readerTag(streamID)
+	switch {
+	case streamID == "", streamID == readerReadingList:
+	case streamID == readerStarred:
+		query.Saved = true
+	case streamID == readerRead:
+		query.Marker = models.Read
+	case strings.HasPrefix(streamID, readerFeedPrefix):
+		query.FeedID = strings.TrimPrefix(streamID, readerFeedPrefix)
+	case strings.HasPrefix(streamID, readerLabelPrefix):
+		ctg, ok := s.readerCategory(strings.TrimPrefix(streamID, readerLabelPrefix), user)
+		if !ok {
+			return query, echo.NewHTTPError(http.StatusNotFound, ErrorResp{
+				Reason:  "NotFound",
+				Message: "Label does not exist",
+			})
+		}
+		query.CategoryID = ctg.UUID
+	default:
+		return query, readerBadRequest("Unsupported stream " + streamID)
+	}
+
+	return query, nil
+}
+
+// readerStream converts entries into a stream page
+func (s *Server) readerStream(entries []models.Entry, user *models.User) ReaderStream {
+	index := s.readerIndex(user)
+
+	stream := ReaderStream{
+		Direction: "ltr",
+		Updated:   time.Now().Unix(),
+		Items:     make([]ReaderItem, len(entries)),
+	}
+
+	for i, entry := range entries {
+		stream.Items[i] = index.item(entry)
+	}
+
+	return stream
+}
+
+func (s *Server) readerIndex(user *models.User) readerIndex {
+	index := readerIndex{
+		feeds:  map[uint]models.Feed{},
+		labels: map[uint]string{},
+	}
+
+	for _, ctg := range s.db.Categories(user) {
+		if isReaderLabel(ctg, user) {
+			index.labels[ctg.ID] = ctg.Name
+		}
+	}
+
+	for _, feed := range s.db.Feeds(user) {
+		index.feeds[feed.ID] = feed
+	}
+
+	return index
+}
+
+func (index readerIndex) item(entry models.Entry) ReaderItem {
+	feed := index.feeds[entry.FeedID]
+
+	published := entry.Published
+	if published.IsZero() {
+		published = entry.CreatedAt
+	}
+
+	item := ReaderItem{
+		ID:            fmt.Sprintf("%s%016x", readerItemPrefix, entry.ID),
+		CrawlTimeMsec: strconv.FormatInt(entry.CreatedAt.UnixNano()/int64(time.Millisecond), 10),
+		TimestampUsec: strconv.FormatInt(entry.CreatedAt.UnixNano()/int64(time.Microsecond), 10),
+		Published:     published.Unix(),
+		Updated:       entry.UpdatedAt.Unix(),
+		Title:         entry.Title,
+		Author:        entry.Author,
+		Canonical:     []ReaderLink{{Href: entry.Link}},
+		Alternate:     []ReaderLink{{Href: entry.Link, Type: "text/html"}},
+		Summary: ReaderContent{
+			Direction: "ltr",
+			Content:   entry.Description,
+		},
+		Categories: []string{readerReadingList},
+		Origin: ReaderOrigin{
+			StreamID: readerFeedPrefix + feed.UUID,
+			Title:    feed.Title,
+			HTMLURL:  feed.Source,
+		},
+	}
+
+	if entry.Mark == models.Read {
+		item.Categories = append(item.Categories, readerRead)
+	}
+
+	if entry.Saved {
+		item.Categories = append(item.Categories, readerStarred)
+	}
+
+	if label, ok := index.labels[feed.CategoryID]; ok {
+		item.Categories = append(item.Categories, readerLabelPrefix+label)
+	}
+
+	return item
+}
+
+// readerContinuation returns the continuation to the page after
+// entries, or nothing if entries is the last page
+func readerContinuation(entries []models.Entry, query database.EntryQuery) string {
+	if len(entries) == 0 || len(entries) < query.Limit {
+		return ""
+	}
+	return strconv.FormatUint(uint64(entries[len(entries)-1].ID), 10)
+}
+
+// readerItemIDs parses the item ids in the i parameters, which are
+// either in their long hexadecimal form or their short decimal one
+func readerItemIDs(c echo.Context) ([]uint, error) {
+	params, err := c.FormParams()
+	if err != nil {
+		return nil, readerBadRequest("Request should include item ids")
+	}
+
+	var ids []uint
+	for _, value := range params["i"] {
+		var id uint64
+		if strings.HasPrefix(value, readerItemPrefix) {
+			id, err = strconv.ParseUint(strings.TrimPrefix(value, readerItemPrefix), 16, 64)
+		} else {
+			id, err = strconv.ParseUint(value, 10, 64)
+		}
+
+		if err != nil {
+			return nil, readerBadRequest("Invalid item id " + value)
+		}
+		ids = append(ids, uint(id))
+	}
+
+	if len(ids) == 0 {
+		return nil, readerBadRequest("Request should include item ids")
+	}
+	return ids, nil
+}
+
+// readerTag replaces the user id in states and labels with "-"
+func readerTag(tag string) string {
+	parts := strings.SplitN(tag, "/", 3)
+	if len(parts) == 3 && parts[0] == "user" {
+		parts[1] = "-"
+		return strings.Join(parts, "/")
+	}
+	return tag
+}
+
+func readerBadRequest(message string) error {
+	return echo.NewHTTPError(http.StatusBadRequest, ErrorResp{
+		Reason:  "BadRequest",
+		Message: message,
+	})
+}
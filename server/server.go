@@ -21,19 +21,26 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"image/png"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/chavamee/syndication/config"
 	"github.com/chavamee/syndication/database"
 	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/opml"
 	"github.com/chavamee/syndication/sync"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
+	"github.com/pquerna/otp"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -43,6 +50,12 @@ const DefaultPort = "80"
 // DefaultTLSPort server binds to if TLS is enabled
 const DefaultTLSPort = "443"
 
+// TOTPIssuer names the server in authenticator apps
+const TOTPIssuer = "Syndication"
+
+// TOTPQRCodeSize is the width and height, in pixels, of enrollment QR codes
+const TOTPQRCodeSize = 256
+
 type (
 	// EntryQueryParams maps query parameters used when GETting entries resources
 	EntryQueryParams struct {
@@ -55,10 +68,18 @@ type (
 	// needed for the REST API handlers.
 	Server struct {
 		handle        *echo.Echo
-		db            *database.DB
+		db            database.Store
 		sync          *sync.Sync
+		importer      *opml.Importer
 		config        config.Server
 		versionGroups map[string]*echo.Group
+
+		// trustedProxies are the networks whose forwarding headers
+		// are believed when finding out where a request came from
+		trustedProxies []*net.IPNet
+
+		// done is closed when the server stops, ending event streams
+		done chan struct{}
 	}
 
 	// ErrorResp represents a common format for error responses returned by a Server
@@ -66,16 +87,47 @@ type (
 		Reason  string `json:"reason"`
 		Message string `json:"message"`
 	}
+
+	// Session is returned on login and when refreshing tokens. It holds a
+	// short lived API key and the refresh token used to obtain the next one.
+	Session struct {
+		models.APIKey
+		models.RefreshToken
+	}
+
+	// Challenge is returned on login instead of a Session to users with
+	// two-factor authentication. It is exchanged for a Session along
+	// with a TOTP or recovery code.
+	Challenge struct {
+		models.LoginChallenge
+		TOTPRequired bool `json:"totp_required"`
+	}
+
+	// RecoveryCodes are handed to a user once, when created
+	RecoveryCodes struct {
+		Codes []string `json:"recovery_codes"`
+	}
+
+	// TOTPEnrollment holds the secret a user adds to their authenticator
+	// app, as an otpauth URI and as a PNG image of its QR code
+	TOTPEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+		QRCode []byte `json:"qr_code"`
+	}
 )
 
 // NewServer creates a new server instance
-func NewServer(db *database.DB, sync *sync.Sync, config config.Server) *Server {
+func NewServer(db database.Store, sync *sync.Sync, config config.Server) *Server {
 	server := Server{
-		handle:        echo.New(),
-		db:            db,
-		sync:          sync,
-		config:        config,
-		versionGroups: map[string]*echo.Group{},
+		handle:         echo.New(),
+		db:             db,
+		sync:           sync,
+		importer:       opml.NewImporter(db),
+		config:         config,
+		versionGroups:  map[string]*echo.Group{},
+		trustedProxies: parseTrustedProxies(config.TrustedProxies),
+		done:           make(chan struct{}),
 	}
 
 	server.versionGroups["v1"] = server.handle.Group("v1")
@@ -123,6 +175,8 @@ func (s *Server) Start() error {
 func (s *Server) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout*time.Second)
 	defer cancel()
+
+	close(s.done)
 	return s.handle.Shutdown(ctx)
 }
 
@@ -130,124 +184,129 @@ func (s *Server) Stop() error {
 func (s *Server) Login(c echo.Context) error {
 	username := c.FormValue("username")
 	password := c.FormValue("password")
+	ip := s.clientIP(c)
 
-	user, err := s.db.Authenticate(username, password)
-
-	if err != nil {
-		return newError(err, &c)
+	if until, locked := s.db.LockedOut(username, ip); locked {
+		return lockedOut(c, until)
 	}
 
-	key, err := s.db.NewAPIKey(s.config.AuthSecret, &user)
+	user, err := s.db.Authenticate(username, password)
 	if err != nil {
+		if _, ok := err.(database.Unauthorized); ok {
+			log.Warnf("Failed login for %s from %s", username, ip)
+			if err := s.db.RecordLoginFailure(username, ip); err != nil {
+				log.Error(err)
+			}
+		}
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusOK, key)
-}
+	// Failures are only cleared once every factor is verified
+	if user.TOTPEnabled {
+		challenge, err := s.db.NewLoginChallenge(&user)
+		if err != nil {
+			return newError(err, &c)
+		}
 
-// Register a user
-func (s *Server) Register(c echo.Context) error {
-	err := s.db.NewUser(c.FormValue("username"), c.FormValue("password"))
-	if err != nil {
-		return newError(err, &c)
+		return c.JSON(http.StatusOK, Challenge{challenge, true})
 	}
 
-	return echo.NewHTTPError(http.StatusNoContent)
+	if err = s.db.ClearLoginFailures(username); err != nil {
+		log.Error(err)
+	}
+
+	return s.newSession(c, &user)
 }
 
-// NewFeed creates a new feed
-func (s *Server) NewFeed(c echo.Context) error {
-	user, err := s.getUser(&c)
+// LoginTOTP completes the login of a user with two-factor authentication
+// by exchanging a login challenge and a TOTP or recovery code for a session
+func (s *Server) LoginTOTP(c echo.Context) error {
+	challenge := c.FormValue("challenge")
+	user, err := s.db.LoginChallengeUser(challenge)
 	if err != nil {
-		return echo.ErrUnauthorized
+		return newError(err, &c)
 	}
 
-	feed := models.Feed{}
-	if err = c.Bind(&feed); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest)
+	ip := s.clientIP(c)
+	if until, locked := s.db.LockedOut(user.Username, ip); locked {
+		return lockedOut(c, until)
 	}
 
-	err = sync.FetchFeed(&feed)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResp{
-			Reason:  "UnreachableFeed",
-			Message: "The given feed could not be reached",
-		})
+	if code := c.FormValue("recovery_code"); code != "" {
+		err = s.db.UseRecoveryCode(code, &user)
+	} else {
+		err = s.db.CheckTOTP(c.FormValue("code"), &user)
 	}
 
-	err = s.db.NewFeed(&feed, &user)
 	if err != nil {
+		if _, ok := err.(database.Unauthorized); ok {
+			log.Warnf("Failed second factor for %s from %s", user.Username, ip)
+			if err := s.db.RecordLoginFailure(user.Username, ip); err != nil {
+				log.Error(err)
+			}
+		}
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusCreated, feed)
-}
-
-// GetFeeds returns a list of subscribed feeds
-func (s *Server) GetFeeds(c echo.Context) error {
-	user, err := s.getUser(&c)
-	if err != nil {
-		return echo.ErrUnauthorized
+	if err = s.db.DeleteLoginChallenge(challenge); err != nil {
+		return newError(err, &c)
 	}
 
-	feeds := s.db.Feeds(&user)
-
-	type Feeds struct {
-		Feeds []models.Feed `json:"feeds"`
+	if err = s.db.ClearLoginFailures(user.Username); err != nil {
+		log.Error(err)
 	}
 
-	return c.JSON(http.StatusOK, Feeds{
-		Feeds: feeds,
-	})
+	return s.newSession(c, &user)
 }
 
-// GetFeed with id
-func (s *Server) GetFeed(c echo.Context) error {
-	user, err := s.getUser(&c)
-	if err != nil {
-		return echo.ErrUnauthorized
+// newSession creates an API key and a refresh token for user
+func (s *Server) newSession(c echo.Context, user *models.User) error {
+	key := models.APIKey{
+		Label:  c.FormValue("label"),
+		Device: c.FormValue("device"),
 	}
 
-	feed, err := s.db.Feed(c.Param("feedID"), &user)
+	if key.Device == "" {
+		key.Device = c.Request().UserAgent()
+	}
+
+	err := s.db.NewAPIKey(s.config.AuthSecret, &key, user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusOK, feed)
-}
-
-// EditFeed with id
-func (s *Server) EditFeed(c echo.Context) error {
-	user, err := s.getUser(&c)
+	refresh, err := s.db.NewRefreshToken(key.Family, user)
 	if err != nil {
-		return echo.ErrUnauthorized
+		return newError(err, &c)
 	}
 
-	feed := models.Feed{}
+	return c.JSON(http.StatusOK, Session{key, refresh})
+}
 
-	if err = c.Bind(&feed); err != nil {
+// RefreshToken exchanges a refresh token for a new API key and refresh token
+func (s *Server) RefreshToken(c echo.Context) error {
+	token := c.FormValue("refresh_token")
+	if token == "" {
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
 
-	feed.UUID = c.Param("feedID")
-
-	err = s.db.EditFeed(&feed, &user)
+	key, refresh, err := s.db.RefreshAPIKey(s.config.AuthSecret, token)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return echo.NewHTTPError(http.StatusNoContent)
+	return c.JSON(http.StatusOK, Session{key, refresh})
 }
 
-// DeleteFeed with id
-func (s *Server) DeleteFeed(c echo.Context) error {
+// Logout revokes the API key used to make the request
+func (s *Server) Logout(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	feedID := c.Param("feedID")
-	err = s.db.DeleteFeed(feedID, &user)
+	token := c.Get("user").(*jwt.Token)
+	err = s.db.RevokeAPIKey(token.Raw, &user)
 	if err != nil {
 		return newError(err, &c)
 	}
@@ -255,266 +314,314 @@ func (s *Server) DeleteFeed(c echo.Context) error {
 	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// GetCategories returns a list of Categories owned by a user
-func (s *Server) GetCategories(c echo.Context) error {
+// GetKeys returns the active API keys of a user
+func (s *Server) GetKeys(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctgs := s.db.Categories(&user)
+	keys := s.db.APIKeys(&user)
 
-	type Categories struct {
-		Categories []models.Category `json:"categories"`
+	type Keys struct {
+		Keys []models.APIKey `json:"keys"`
 	}
 
-	return c.JSON(http.StatusOK, Categories{
-		Categories: ctgs,
+	return c.JSON(http.StatusOK, Keys{
+		Keys: keys,
 	})
 }
 
-// GetCategory with id
-func (s *Server) GetCategory(c echo.Context) error {
+// DeleteKey revokes an API key with id
+func (s *Server) DeleteKey(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctg, err := s.db.Category(c.Param("categoryID"), &user)
+	err = s.db.DeleteAPIKey(c.Param("keyID"), &user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusOK, ctg)
+	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// GetEntriesFromFeed returns a list of entries provided from a feed
-func (s *Server) GetEntriesFromFeed(c echo.Context) error {
+// NewToken creates a personal access token limited to the requested scopes
+func (s *Server) NewToken(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	params := new(EntryQueryParams)
-	if err = c.Bind(params); err != nil {
-		return newError(err, &c)
-	}
-
-	feed, err := s.db.Feed(c.Param("feedID"), &user)
+	params, err := c.FormParams()
 	if err != nil {
-		return newError(err, &c)
+		return echo.NewHTTPError(http.StatusBadRequest)
 	}
 
-	withMarker := models.MarkerFromString(params.Marker)
-	if withMarker == models.None {
-		withMarker = models.Any
+	key := models.APIKey{
+		Label: c.FormValue("label"),
+		Scope: strings.Join(params["scope"], " "),
 	}
 
-	if params.Update && params.Saved == true && withMarker == models.Unread {
-		err = s.sync.SyncFeed(&feed, &user)
-		if err != nil {
-			return newError(err, &c)
+	if expiresIn := c.FormValue("expires_in"); expiresIn != "" {
+		days, err := strconv.Atoi(expiresIn)
+		if err != nil || days <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest)
 		}
+
+		key.ExpiresAt = time.Now().AddDate(0, 0, days)
 	}
 
-	entries, err := s.db.EntriesFromFeed(feed.UUID, true, withMarker, &user)
+	err = s.db.NewPersonalAccessToken(s.config.AuthSecret, &key, &user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	type Entries struct {
-		Entries []models.Entry
+	return c.JSON(http.StatusCreated, key)
+}
+
+// GetTokens returns the personal access tokens of a user
+func (s *Server) GetTokens(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
 	}
 
-	return c.JSON(http.StatusOK, Entries{
-		Entries: entries,
+	tokens := s.db.PersonalAccessTokens(&user)
+
+	type Tokens struct {
+		Tokens []models.APIKey `json:"tokens"`
+	}
+
+	return c.JSON(http.StatusOK, Tokens{
+		Tokens: tokens,
 	})
 }
 
-// GetEntriesFromCategory returns a list of Entries
-// that belong to a Feed that belongs to a Category
-func (s *Server) GetEntriesFromCategory(c echo.Context) error {
+// GetMe returns the profile of the user making the request
+func (s *Server) GetMe(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	params := new(EntryQueryParams)
-	if err = c.Bind(params); err != nil {
-		return newError(err, &c)
+	return c.JSON(http.StatusOK, user)
+}
+
+// EditMe changes the username, email, timezone or preferences
+// of the user making the request
+func (s *Server) EditMe(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
 	}
 
-	ctg, err := s.db.Category(c.Param("categoryID"), &user)
+	changes := database.ProfileChanges{}
+	if err = c.Bind(&changes); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	edited, err := s.db.EditUser(user.UUID, changes)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	withMarker := models.MarkerFromString(params.Marker)
-	if withMarker == models.None {
-		withMarker = models.Any
+	return c.JSON(http.StatusOK, edited)
+}
+
+// ChangeMyPassword changes the password of the user making the request
+// and logs out every other session
+func (s *Server) ChangeMyPassword(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
 	}
 
-	if params.Update && params.Saved == true && withMarker == models.Unread {
-		err = s.sync.SyncCategory(&ctg, &user)
-		if err != nil {
-			return newError(err, &c)
-		}
+	if err = s.confirmPassword(c, &user, c.FormValue("current_password")); err != nil {
+		return err
 	}
 
-	entries, err := s.db.EntriesFromCategory(c.Param("categoryID"), true, withMarker, &user)
+	err = s.db.ChangeUserPassword(user.UUID, c.FormValue("new_password"))
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	type Entries struct {
-		Entries []models.Entry
+	token := c.Get("user").(*jwt.Token)
+	err = s.db.RevokeOtherAPIKeys(token.Raw, &user)
+	if err != nil {
+		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusOK, Entries{
-		Entries: entries,
-	})
+	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// GetFeedsFromCategory returns a list of Feeds that belong to a Category
-func (s *Server) GetFeedsFromCategory(c echo.Context) error {
+// ExportMe returns everything owned by the user making the request
+func (s *Server) ExportMe(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	feeds, err := s.db.FeedsFromCategory(c.Param("categoryID"), &user)
+	archive, err := s.db.ExportUser(&user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	type Feeds struct {
-		Feeds []models.Feed `json:"feeds"`
+	archive.Version = database.ArchiveVersion
+	archive.CreatedAt = time.Now().UTC()
+
+	for i := range archive.Users {
+		archive.Users[i].PasswordHash = nil
+		archive.Users[i].PasswordSalt = nil
+		archive.Users[i].TOTPSecret = ""
+		archive.Users[i].RecoveryCodes = nil
+		archive.Users[i].FeverKey = ""
+	}
+	for i := range archive.Publications {
+		archive.Publications[i].Token = ""
+	}
+	for i := range archive.Webhooks {
+		archive.Webhooks[i].Secret = ""
 	}
 
-	return c.JSON(http.StatusOK, Feeds{
-		Feeds: feeds,
-	})
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\"syndication-"+user.Username+".json\"")
+	return c.JSON(http.StatusOK, archive)
 }
 
-// NewCategory creates a new Category
-func (s *Server) NewCategory(c echo.Context) error {
+// DeleteMe permanently deletes the user making the request and everything it owns
+func (s *Server) DeleteMe(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctg := models.Category{}
-	if err = c.Bind(&ctg); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest)
+	password, err := passwordFromBody(c)
+	if err != nil {
+		return err
 	}
 
-	err = s.db.NewCategory(&ctg, &user)
+	if err = s.confirmPassword(c, &user, password); err != nil {
+		return err
+	}
+
+	err = s.db.DeleteUser(user.UUID)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusCreated, ctg)
+	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// EditCategory with id
-func (s *Server) EditCategory(c echo.Context) error {
+// GetTOTP reports whether two-factor authentication is enabled for the
+// user making the request and how many recovery codes they have left
+func (s *Server) GetTOTP(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctg := models.Category{}
-	ctg.UUID = c.Param("categoryID")
-
-	if err = c.Bind(&ctg); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest)
-	}
-
-	err = s.db.EditCategory(&ctg, &user)
-	if err != nil {
-		return newError(err, &c)
+	type TOTPStatus struct {
+		Enabled           bool `json:"enabled"`
+		RecoveryCodesLeft int  `json:"recovery_codes_left"`
 	}
 
-	return echo.NewHTTPError(http.StatusNoContent)
+	return c.JSON(http.StatusOK, TOTPStatus{
+		Enabled:           user.TOTPEnabled,
+		RecoveryCodesLeft: s.db.RecoveryCodesLeft(&user),
+	})
 }
 
-// AddFeedsToCategory adds a Feed to a Category with id
-func (s *Server) AddFeedsToCategory(c echo.Context) error {
+// NewTOTP starts enrolling the user making the request in two-factor authentication
+func (s *Server) NewTOTP(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctgID := c.Param("categoryID")
-
-	type FeedIds struct {
-		Feeds []string `json:"feeds"`
+	if err = s.confirmPassword(c, &user, c.FormValue("password")); err != nil {
+		return err
 	}
 
-	feedIds := new(FeedIds)
-	if err = c.Bind(feedIds); err != nil {
+	secret, uri, err := s.db.NewTOTP(TOTPIssuer, &user)
+	if err != nil {
 		return newError(err, &c)
 	}
 
-	for _, id := range feedIds.Feeds {
-		err = s.db.ChangeFeedCategory(id, ctgID, &user)
-		if err != nil {
-			return newError(err, &c)
-		}
+	key, err := otp.NewKeyFromURL(uri)
+	if err != nil {
+		return err
 	}
 
-	return echo.NewHTTPError(http.StatusNoContent)
+	img, err := key.Image(TOTPQRCodeSize, TOTPQRCodeSize)
+	if err != nil {
+		return err
+	}
+
+	qrCode := new(bytes.Buffer)
+	if err = png.Encode(qrCode, img); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, TOTPEnrollment{
+		Secret: secret,
+		URI:    uri,
+		QRCode: qrCode.Bytes(),
+	})
 }
 
-// DeleteCategory with id
-func (s *Server) DeleteCategory(c echo.Context) error {
+// EnableTOTP confirms the enrollment of the user making the request with
+// a code from their authenticator app and returns their recovery codes
+func (s *Server) EnableTOTP(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctgID := c.Param("categoryID")
-
-	err = s.db.DeleteCategory(ctgID, &user)
+	codes, err := s.db.EnableTOTP(c.FormValue("code"), &user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return echo.NewHTTPError(http.StatusNoContent)
+	return c.JSON(http.StatusOK, RecoveryCodes{codes})
 }
 
-// GetStatsForCategory returns statistics related to a Category
-func (s *Server) GetStatsForCategory(c echo.Context) error {
+// NewRecoveryCodes replaces the recovery codes of the user making the request
+func (s *Server) NewRecoveryCodes(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctgID := c.Param("categoryID")
+	if err = s.confirmPassword(c, &user, c.FormValue("password")); err != nil {
+		return err
+	}
 
-	marks, err := s.db.CategoryStats(ctgID, &user)
+	codes, err := s.db.NewRecoveryCodes(&user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusOK, marks)
+	return c.JSON(http.StatusOK, RecoveryCodes{codes})
 }
 
-// MarkCategory applies a Marker to a Category
-func (s *Server) MarkCategory(c echo.Context) error {
+// DisableTOTP turns off two-factor authentication for the user making the request
+func (s *Server) DisableTOTP(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	ctgID := c.Param("categoryID")
+	password, err := passwordFromBody(c)
+	if err != nil {
+		return err
+	}
 
-	marker := models.MarkerFromString(c.FormValue("as"))
-	if marker == models.None {
-		return echo.NewHTTPError(http.StatusBadRequest, "'as' parameter is required")
+	if err = s.confirmPassword(c, &user, password); err != nil {
+		return err
 	}
 
-	err = s.db.MarkCategory(ctgID, marker, &user)
+	err = s.db.DisableTOTP(user.UUID)
 	if err != nil {
 		return newError(err, &c)
 	}
@@ -522,62 +629,870 @@ func (s *Server) MarkCategory(c echo.Context) error {
 	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// MarkFeed applies a Marker to a Feed
-func (s *Server) MarkFeed(c echo.Context) error {
-	user, err := s.getUser(&c)
-	if err != nil {
-		return echo.ErrUnauthorized
+// passwordFromBody returns the password sent in the JSON body of a
+// DELETE request, since their bodies are not parsed as forms
+func passwordFromBody(c echo.Context) (string, error) {
+	confirmation := struct {
+		Password string `json:"password"`
+	}{}
+	if err := c.Bind(&confirmation); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest)
 	}
 
-	feedID := c.Param("feedID")
+	return confirmation.Password, nil
+}
 
-	marker := models.MarkerFromString(c.FormValue("as"))
-	if marker == models.None {
-		return echo.NewHTTPError(http.StatusBadRequest, "'as' parameter is required")
+// confirmPassword checks that password belongs to user before a sensitive
+// change to their account. Wrong passwords count towards login lockouts.
+func (s *Server) confirmPassword(c echo.Context, user *models.User, password string) error {
+	ip := s.clientIP(c)
+	if until, locked := s.db.LockedOut(user.Username, ip); locked {
+		return lockedOut(c, until)
 	}
 
-	err = s.db.MarkFeed(feedID, marker, &user)
-	if err != nil {
-		return newError(err, &c)
+	_, err := s.db.Authenticate(user.Username, password)
+	if err == nil {
+		return nil
+	}
+
+	dbErr, ok := err.(database.DBError)
+	if !ok {
+		return err
+	}
+
+	if _, ok := err.(database.Unauthorized); ok {
+		log.Warnf("Failed password confirmation for %s from %s", user.Username, ip)
+		if err := s.db.RecordLoginFailure(user.Username, ip); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return echo.NewHTTPError(dbErr.Code(), ErrorResp{
+		Reason:  dbErr.String(),
+		Message: dbErr.Error(),
+	})
+}
+
+// Register a user. Depending on the server's configuration anyone
+// can register, only those with an invite code, or no one.
+func (s *Server) Register(c echo.Context) error {
+	username := c.FormValue("username")
+	password := c.FormValue("password")
+
+	var err error
+	switch s.config.Registration {
+	case config.RegistrationDisabled:
+		return echo.NewHTTPError(http.StatusForbidden)
+	case config.RegistrationInvite:
+		err = s.db.NewUserWithInvite(username, password, c.FormValue("invite"))
+	default:
+		err = s.db.NewUser(username, password)
+	}
+
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// Health reports whether the server can reach its database
+func (s *Server) Health(c echo.Context) error {
+	if err := s.db.Ping(); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResp{
+			Reason:  "DatabaseUnavailable",
+			Message: "The database could not be reached",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"status": "ok",
+	})
+}
+
+// NewFeed creates a new feed
+func (s *Server) NewFeed(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feed := models.Feed{}
+	if err = c.Bind(&feed); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	err = sync.FetchFeed(&feed)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResp{
+			Reason:  "UnreachableFeed",
+			Message: "The given feed could not be reached",
+		})
+	}
+
+	err = s.db.NewFeed(&feed, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusCreated, feed)
+}
+
+// GetFeeds returns a list of subscribed feeds
+func (s *Server) GetFeeds(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feeds := s.db.Feeds(&user)
+
+	type Feeds struct {
+		Feeds []models.Feed `json:"feeds"`
+	}
+
+	return c.JSON(http.StatusOK, Feeds{
+		Feeds: feeds,
+	})
+}
+
+// GetFeed with id
+func (s *Server) GetFeed(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feed, err := s.db.Feed(c.Param("feedID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, feed)
+}
+
+// EditFeed with id
+func (s *Server) EditFeed(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feed := models.Feed{}
+
+	if err = c.Bind(&feed); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	feed.UUID = c.Param("feedID")
+
+	err = s.db.EditFeed(&feed, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// DeleteFeed with id
+func (s *Server) DeleteFeed(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feedID := c.Param("feedID")
+	err = s.db.DeleteFeed(feedID, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// ImportOPML subscribes to the feeds of an OPML document. The feeds
+// are validated in the background and the returned report tracks them.
+func (s *Server) ImportOPML(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, opml.MaxDocumentSize)
+
+	body := c.Request().Body
+	if file, err := c.FormFile("file"); err == nil {
+		src, err := file.Open()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest)
+		}
+		defer src.Close()
+		body = src
+	}
+
+	report, err := s.importer.Start(&user, body)
+	if err == opml.ErrInvalidDocument || err == opml.ErrTooManyFeeds {
+		return c.JSON(http.StatusBadRequest, ErrorResp{
+			Reason:  "BadRequest",
+			Message: err.Error(),
+		})
+	} else if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusAccepted, report)
+}
+
+// GetOPMLImport returns the report of an import with id
+func (s *Server) GetOPMLImport(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	report, ok := s.importer.Report(c.Param("importID"), &user)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrorResp{
+			Reason:  "NotFound",
+			Message: "Import does not exist",
+		})
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// ExportOPML returns every feed and category as an OPML document
+func (s *Server) ExportOPML(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	var buf bytes.Buffer
+	if _, err = opml.Export(s.db, &user, &buf); err != nil {
+		return newError(err, &c)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="subscriptions.opml"`)
+	return c.Blob(http.StatusOK, "text/x-opml; charset=UTF-8", buf.Bytes())
+}
+
+// GetCategories returns a list of Categories owned by a user
+func (s *Server) GetCategories(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctgs := s.db.Categories(&user)
+
+	type Categories struct {
+		Categories []models.Category `json:"categories"`
+	}
+
+	return c.JSON(http.StatusOK, Categories{
+		Categories: ctgs,
+	})
+}
+
+// GetCategory with id
+func (s *Server) GetCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctg, err := s.db.Category(c.Param("categoryID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, ctg)
+}
+
+// GetEntriesFromFeed returns a list of entries provided from a feed
+func (s *Server) GetEntriesFromFeed(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	params := new(EntryQueryParams)
+	if err = c.Bind(params); err != nil {
+		return newError(err, &c)
+	}
+
+	feed, err := s.db.Feed(c.Param("feedID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	withMarker := models.MarkerFromString(params.Marker)
+	if withMarker == models.None {
+		withMarker = models.Any
+	}
+
+	if params.Update && withMarker == models.Unread {
+		err = s.sync.SyncFeed(&feed, &user)
+		if err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	entries, err := s.db.EntriesFromFeed(feed.UUID, true, withMarker, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	type Entries struct {
+		Entries []models.Entry
+	}
+
+	return c.JSON(http.StatusOK, Entries{
+		Entries: entries,
+	})
+}
+
+// GetEntriesFromCategory returns a list of Entries
+// that belong to a Feed that belongs to a Category
+func (s *Server) GetEntriesFromCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	params := new(EntryQueryParams)
+	if err = c.Bind(params); err != nil {
+		return newError(err, &c)
+	}
+
+	ctg, err := s.db.Category(c.Param("categoryID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	withMarker := models.MarkerFromString(params.Marker)
+	if withMarker == models.None {
+		withMarker = models.Any
+	}
+
+	if params.Update && withMarker == models.Unread {
+		err = s.sync.SyncCategory(&ctg, &user)
+		if err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	entries, err := s.db.EntriesFromCategory(c.Param("categoryID"), true, withMarker, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	type Entries struct {
+		Entries []models.Entry
+	}
+
+	return c.JSON(http.StatusOK, Entries{
+		Entries: entries,
+	})
+}
+
+// GetFeedsFromCategory returns a list of Feeds that belong to a Category
+func (s *Server) GetFeedsFromCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feeds, err := s.db.FeedsFromCategory(c.Param("categoryID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	type Feeds struct {
+		Feeds []models.Feed `json:"feeds"`
+	}
+
+	return c.JSON(http.StatusOK, Feeds{
+		Feeds: feeds,
+	})
+}
+
+// NewCategory creates a new Category
+func (s *Server) NewCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctg := models.Category{}
+	if err = c.Bind(&ctg); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	err = s.db.NewCategory(&ctg, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusCreated, ctg)
+}
+
+// EditCategory with id
+func (s *Server) EditCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctg := models.Category{}
+	ctg.UUID = c.Param("categoryID")
+
+	if err = c.Bind(&ctg); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	err = s.db.EditCategory(&ctg, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// AddFeedsToCategory adds a Feed to a Category with id
+func (s *Server) AddFeedsToCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctgID := c.Param("categoryID")
+
+	type FeedIds struct {
+		Feeds []string `json:"feeds"`
+	}
+
+	feedIds := new(FeedIds)
+	if err = c.Bind(feedIds); err != nil {
+		return newError(err, &c)
+	}
+
+	for _, id := range feedIds.Feeds {
+		err = s.db.ChangeFeedCategory(id, ctgID, &user)
+		if err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// DeleteCategory with id
+func (s *Server) DeleteCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctgID := c.Param("categoryID")
+	deleteFeeds, _ := strconv.ParseBool(c.QueryParam("deleteFeeds"))
+
+	err = s.db.DeleteCategory(ctgID, deleteFeeds, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// GetStatsForCategory returns statistics related to a Category
+func (s *Server) GetStatsForCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctgID := c.Param("categoryID")
+
+	marks, err := s.db.CategoryStats(ctgID, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, marks)
+}
+
+// MarkCategory applies a Marker to a Category
+func (s *Server) MarkCategory(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	ctgID := c.Param("categoryID")
+
+	marker := models.MarkerFromString(c.FormValue("as"))
+	if marker == models.None {
+		return echo.NewHTTPError(http.StatusBadRequest, "'as' parameter is required")
+	}
+
+	err = s.db.MarkCategory(ctgID, marker, time.Time{}, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// MarkFeed applies a Marker to a Feed
+func (s *Server) MarkFeed(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feedID := c.Param("feedID")
+
+	marker := models.MarkerFromString(c.FormValue("as"))
+	if marker == models.None {
+		return echo.NewHTTPError(http.StatusBadRequest, "'as' parameter is required")
+	}
+
+	err = s.db.MarkFeed(feedID, marker, time.Time{}, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// GetStatsForFeed provides statistics related to a Feed
+func (s *Server) GetStatsForFeed(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	feedID := c.Param("feedID")
+
+	marks, err := s.db.FeedStats(feedID, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, marks)
+}
+
+// GetEntry with id
+func (s *Server) GetEntry(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	entry, err := s.db.Entry(c.Param("entryID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, entry)
+}
+
+// GetEntries returns a list of entries that belong to a user
+func (s *Server) GetEntries(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	params := new(EntryQueryParams)
+	if err = c.Bind(params); err != nil {
+		return newError(err, &c)
+	}
+
+	withMarker := models.MarkerFromString(params.Marker)
+	if withMarker == models.None {
+		withMarker = models.Any
+	}
+	if params.Update && withMarker == models.Unread {
+		err = s.sync.SyncUser(&user)
+		if err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	var entries []models.Entry
+	if params.Saved {
+		entries, err = s.db.SavedEntries(true, withMarker, &user)
+	} else {
+		entries, err = s.db.Entries(true, withMarker, &user)
+	}
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	type Entries struct {
+		Entries []models.Entry
+	}
+
+	return c.JSON(http.StatusOK, Entries{
+		Entries: entries,
+	})
+}
+
+// MarkEntry applies a Marker to an Entry
+func (s *Server) MarkEntry(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	entryID := c.Param("entryID")
+
+	marker := models.MarkerFromString(c.FormValue("as"))
+	if marker == models.None {
+		return echo.NewHTTPError(http.StatusBadRequest, "'as' parameter is required")
+	}
+
+	err = s.db.MarkEntry(entryID, marker, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// SaveEntry marks an Entry as saved
+func (s *Server) SaveEntry(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	err = s.db.SaveEntry(c.Param("entryID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// UnsaveEntry removes the saved mark from an Entry
+func (s *Server) UnsaveEntry(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	err = s.db.UnsaveEntry(c.Param("entryID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// SaveEntries marks a list of Entries as saved
+func (s *Server) SaveEntries(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	type EntryIds struct {
+		Entries []string `json:"entries"`
+	}
+
+	entryIds := new(EntryIds)
+	if err = c.Bind(entryIds); err != nil {
+		return newError(err, &c)
+	}
+
+	err = s.db.SaveEntries(entryIds.Entries, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// UnsaveEntries removes the saved mark from a list of Entries
+func (s *Server) UnsaveEntries(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	type EntryIds struct {
+		Entries []string `json:"entries"`
+	}
+
+	entryIds := new(EntryIds)
+	if err = c.Bind(entryIds); err != nil {
+		return newError(err, &c)
+	}
+
+	err = s.db.UnsaveEntries(entryIds.Entries, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// GetStatsForEntries provides statistics related to Entries
+func (s *Server) GetStatsForEntries(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	return c.JSON(http.StatusOK, s.db.Stats(&user))
+}
+
+// NewTag creates a new Tag
+func (s *Server) NewTag(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	tag := models.Tag{}
+	if err = c.Bind(&tag); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	err = s.db.NewTag(&tag, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusCreated, tag)
+}
+
+// GetTags returns a list of Tags owned by a user
+func (s *Server) GetTags(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	tags := s.db.Tags(&user)
+
+	type Tags struct {
+		Tags []models.Tag `json:"tags"`
+	}
+
+	return c.JSON(http.StatusOK, Tags{
+		Tags: tags,
+	})
+}
+
+// GetTag with id
+func (s *Server) GetTag(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	tag, err := s.db.Tag(c.Param("tagID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// EditTag with id
+func (s *Server) EditTag(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	tag := models.Tag{}
+	if err = c.Bind(&tag); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	tag.UUID = c.Param("tagID")
+
+	err = s.db.EditTag(&tag, &user)
+	if err != nil {
+		return newError(err, &c)
 	}
 
 	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// GetStatsForFeed provides statistics related to a Feed
-func (s *Server) GetStatsForFeed(c echo.Context) error {
+// DeleteTag with id
+func (s *Server) DeleteTag(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	feedID := c.Param("feedID")
+	err = s.db.DeleteTag(c.Param("tagID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
 
-	marks, err := s.db.FeedStats(feedID, &user)
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// TagEntries adds a Tag to a list of Entries
+func (s *Server) TagEntries(c echo.Context) error {
+	user, err := s.getUser(&c)
 	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	type EntryIds struct {
+		Entries []string `json:"entries"`
+	}
+
+	entryIds := new(EntryIds)
+	if err = c.Bind(entryIds); err != nil {
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusOK, marks)
+	err = s.db.TagEntries(c.Param("tagID"), entryIds.Entries, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	s.sync.Webhooks().EntriesTagged(c.Param("tagID"), entryIds.Entries, &user)
+	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// GetEntry with id
-func (s *Server) GetEntry(c echo.Context) error {
+// UntagEntries removes a Tag from a list of Entries
+func (s *Server) UntagEntries(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	entry, err := s.db.Entry(c.Param("entryID"), &user)
+	type EntryIds struct {
+		Entries []string `json:"entries"`
+	}
+
+	entryIds := new(EntryIds)
+	if err = c.Bind(entryIds); err != nil {
+		return newError(err, &c)
+	}
+
+	err = s.db.UntagEntries(c.Param("tagID"), entryIds.Entries, &user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return c.JSON(http.StatusOK, entry)
+	return echo.NewHTTPError(http.StatusNoContent)
 }
 
-// GetEntries returns a list of entries that belong to a user
-func (s *Server) GetEntries(c echo.Context) error {
+// GetEntriesFromTag returns a list of Entries
+// that are tagged by a Tag
+func (s *Server) GetEntriesFromTag(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
@@ -592,14 +1507,8 @@ func (s *Server) GetEntries(c echo.Context) error {
 	if withMarker == models.None {
 		withMarker = models.Any
 	}
-	if params.Update && params.Saved == true && withMarker == models.Unread {
-		err = s.sync.SyncUser(&user)
-		if err != nil {
-			return newError(err, &c)
-		}
-	}
 
-	entries, err := s.db.Entries(true, withMarker, &user)
+	entries, err := s.db.EntriesFromTag(c.Param("tagID"), true, withMarker, &user)
 	if err != nil {
 		return newError(err, &c)
 	}
@@ -613,36 +1522,235 @@ func (s *Server) GetEntries(c echo.Context) error {
 	})
 }
 
-// MarkEntry applies a Marker to an Entry
-func (s *Server) MarkEntry(c echo.Context) error {
+// GetStatsForTag returns statistics related to a Tag
+func (s *Server) GetStatsForTag(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	entryID := c.Param("entryID")
+	marks, err := s.db.TagStats(c.Param("tagID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
 
-	marker := models.MarkerFromString(c.FormValue("as"))
-	if marker == models.None {
-		return echo.NewHTTPError(http.StatusBadRequest, "'as' parameter is required")
+	return c.JSON(http.StatusOK, marks)
+}
+
+// GetStatsTree provides statistics for every Feed and Category
+// owned by a user in a single response
+func (s *Server) GetStatsTree(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
 	}
 
-	err = s.db.MarkEntry(entryID, marker, &user)
+	tree, err := s.db.StatsTree(&user)
 	if err != nil {
 		return newError(err, &c)
 	}
 
-	return echo.NewHTTPError(http.StatusNoContent)
+	return c.JSON(http.StatusOK, tree)
 }
 
-// GetStatsForEntries provides statistics related to Entries
-func (s *Server) GetStatsForEntries(c echo.Context) error {
+// GetTrash returns feeds and categories that were deleted but not yet purged
+func (s *Server) GetTrash(c echo.Context) error {
 	user, err := s.getUser(&c)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 
-	return c.JSON(http.StatusOK, s.db.Stats(&user))
+	return c.JSON(http.StatusOK, s.db.Trash(&user))
+}
+
+// RestoreFromTrash restores a deleted feed or category
+func (s *Server) RestoreFromTrash(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	err = s.db.RestoreFromTrash(c.Param("itemID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// GetUsers returns every user of the instance
+func (s *Server) GetUsers(c echo.Context) error {
+	type Users struct {
+		Users []models.User `json:"users"`
+	}
+
+	return c.JSON(http.StatusOK, Users{
+		Users: s.db.Users("created_at,updated_at,username,email,role"),
+	})
+}
+
+// NewUser creates a user with an optional role
+func (s *Server) NewUser(c echo.Context) error {
+	role := c.FormValue("role")
+	if role != "" && role != models.RoleUser && role != models.RoleAdmin {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	username := c.FormValue("username")
+	err := s.db.NewUser(username, c.FormValue("password"))
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	user, err := s.db.UserWithName(username)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	if role != "" {
+		if err = s.db.SetUserRole(user.UUID, role); err != nil {
+			return newError(err, &c)
+		}
+		user.Role = role
+	}
+
+	return c.JSON(http.StatusCreated, user)
+}
+
+// GetUser returns a user with id
+func (s *Server) GetUser(c echo.Context) error {
+	user, err := s.db.UserWithUUID(c.Param("userID"))
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// EditUser changes the name, password or role of a user with id
+func (s *Server) EditUser(c echo.Context) error {
+	userID := c.Param("userID")
+	if _, err := s.db.UserWithUUID(userID); err != nil {
+		return newError(err, &c)
+	}
+
+	if username := c.FormValue("username"); username != "" {
+		if err := s.db.ChangeUserName(userID, username); err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	if password := c.FormValue("password"); password != "" {
+		if err := s.db.ChangeUserPassword(userID, password); err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	if role := c.FormValue("role"); role != "" {
+		if err := s.db.SetUserRole(userID, role); err != nil {
+			return newError(err, &c)
+		}
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// DeleteUser permanently deletes a user with id and everything it owns
+func (s *Server) DeleteUser(c echo.Context) error {
+	err := s.db.DeleteUser(c.Param("userID"))
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// NewInvite creates an invite code that allows registering
+func (s *Server) NewInvite(c echo.Context) error {
+	invite := models.Invite{MaxUses: 1}
+
+	if maxUses := c.FormValue("max_uses"); maxUses != "" {
+		uses, err := strconv.Atoi(maxUses)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest)
+		}
+		invite.MaxUses = uses
+	}
+
+	if expiresIn := c.FormValue("expires_in"); expiresIn != "" {
+		days, err := strconv.Atoi(expiresIn)
+		if err != nil || days <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest)
+		}
+		invite.ExpiresAt = time.Now().AddDate(0, 0, days)
+	}
+
+	if err := s.db.NewInvite(&invite); err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusCreated, invite)
+}
+
+// GetInvites returns every invite code
+func (s *Server) GetInvites(c echo.Context) error {
+	type Invites struct {
+		Invites []models.Invite `json:"invites"`
+	}
+
+	return c.JSON(http.StatusOK, Invites{
+		Invites: s.db.Invites(),
+	})
+}
+
+// DeleteInvite revokes an invite code with id
+func (s *Server) DeleteInvite(c echo.Context) error {
+	err := s.db.DeleteInvite(c.Param("inviteID"))
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// GetInstanceStats returns counts over the whole instance
+func (s *Server) GetInstanceStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.db.InstanceStats())
+}
+
+// SyncUsers starts syncing the feeds of every user, or only the user with
+// the given id. Syncing happens in the background.
+func (s *Server) SyncUsers(c echo.Context) error {
+	userID := c.FormValue("user")
+	if userID == "" {
+		go s.sync.SyncUsers()
+		return echo.NewHTTPError(http.StatusAccepted)
+	}
+
+	user, err := s.db.UserWithUUID(userID)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	go s.sync.SyncUser(&user)
+	return echo.NewHTTPError(http.StatusAccepted)
+}
+
+// Prune permanently deletes expired trash, API keys and lockouts
+func (s *Server) Prune(c echo.Context) error {
+	if err := s.db.PurgeTrash(); err != nil {
+		return newError(err, &c)
+	}
+
+	if err := s.db.DeleteExpiredAPIKeys(); err != nil {
+		return newError(err, &c)
+	}
+
+	if err := s.db.DeleteExpiredLockouts(); err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
 }
 
 func (s *Server) getUser(c *echo.Context) (models.User, error) {
@@ -657,7 +1765,15 @@ func (s *Server) getUser(c *echo.Context) (models.User, error) {
 		Key: userClaim.Raw,
 	}
 	found, err := s.db.KeyBelongsToUser(key, &user)
-	if err != nil || !found {
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if !found {
+		return models.User{}, echo.ErrUnauthorized
+	}
+
+	if err = s.db.TouchAPIKey(key.Key, &user); err != nil {
 		return models.User{}, err
 	}
 
@@ -680,13 +1796,15 @@ func (s *Server) registerMiddleware() {
 
 		group.Use(middleware.JWTWithConfig(middleware.JWTConfig{
 			Skipper: func(c echo.Context) bool {
-				if c.Path() == "/"+version+"/login" || c.Path() == "/"+version+"/register" {
+				if c.Path() == "/"+version+"/login" || c.Path() == "/"+version+"/login/totp" || c.Path() == "/"+version+"/register" ||
+					c.Path() == "/"+version+"/health" || c.Path() == "/"+version+"/token/refresh" {
 					return true
 				}
-				return false
+				return c.Path() == "/"+version+"/events" && eventsQueryToken(c)
 			},
 			SigningKey:    []byte(s.config.AuthSecret),
 			SigningMethod: "HS256",
+			ErrorHandler:  jwtError,
 		}))
 
 		if s.config.EnableRequestLogs {
@@ -695,36 +1813,344 @@ func (s *Server) registerMiddleware() {
 	}
 }
 
+// eventsQueryToken reports whether the API key of an events request is
+// sent as the access_token query parameter, since browsers cannot set
+// headers on an EventSource
+func eventsQueryToken(c echo.Context) bool {
+	return c.Request().Header.Get(echo.HeaderAuthorization) == "" && c.QueryParam("access_token") != ""
+}
+
 func (s *Server) registerHandlers() {
 	v1 := s.versionGroups["v1"]
 
 	v1.POST("/login", s.Login)
+	v1.POST("/login/totp", s.LoginTOTP)
 	v1.POST("/register", s.Register)
+	v1.GET("/health", s.Health)
+	v1.POST("/logout", s.Logout)
+	v1.POST("/token/refresh", s.RefreshToken)
+
+	v1.GET("/keys", s.GetKeys, requireSession)
+	v1.DELETE("/keys/:keyID", s.DeleteKey, requireSession)
+
+	v1.GET("/me", s.GetMe, requireSession)
+	v1.PUT("/me", s.EditMe, requireSession)
+	v1.PUT("/me/password", s.ChangeMyPassword, requireSession)
+	v1.GET("/me/export", s.ExportMe, requireSession)
+	v1.DELETE("/me", s.DeleteMe, requireSession)
+	v1.GET("/me/totp", s.GetTOTP, requireSession)
+	v1.POST("/me/totp", s.NewTOTP, requireSession)
+	v1.POST("/me/totp/enable", s.EnableTOTP, requireSession)
+	v1.POST("/me/totp/recovery_codes", s.NewRecoveryCodes, requireSession)
+	v1.DELETE("/me/totp", s.DisableTOTP, requireSession)
+	v1.PUT("/me/fever", s.SetFeverPassword, requireSession)
+	v1.DELETE("/me/fever", s.DisableFever, requireSession)
+
+	v1.POST("/tokens", s.NewToken, requireSession)
+	v1.GET("/tokens", s.GetTokens, requireSession)
+	v1.DELETE("/tokens/:keyID", s.DeleteKey, requireSession)
+
+	feedsRead := requireScope(models.ScopeFeedsRead)
+	feedsWrite := requireScope(models.ScopeFeedsWrite)
+	entriesRead := requireScope(models.ScopeEntriesRead)
+	entriesMark := requireScope(models.ScopeEntriesMark)
+	tagsWrite := requireScope(models.ScopeTagsWrite)
+
+	v1.POST("/feeds", s.NewFeed, feedsWrite)
+	v1.GET("/feeds", s.GetFeeds, feedsRead)
+	v1.GET("/feeds/:feedID", s.GetFeed, feedsRead)
+	v1.PUT("/feeds/:feedID", s.EditFeed, feedsWrite)
+	v1.DELETE("/feeds/:feedID", s.DeleteFeed, feedsWrite)
+	v1.GET("/feeds/:feedID/entries", s.GetEntriesFromFeed, entriesRead)
+	v1.PUT("/feeds/:feedID/mark", s.MarkFeed, entriesMark)
+	v1.GET("/feeds/:feedID/stats", s.GetStatsForFeed, feedsRead)
+
+	v1.POST("/opml", s.ImportOPML, feedsWrite)
+	v1.GET("/opml", s.ExportOPML, feedsRead)
+	v1.GET("/opml/imports/:importID", s.GetOPMLImport, feedsRead)
+
+	v1.POST("/categories", s.NewCategory, feedsWrite)
+	v1.GET("/categories", s.GetCategories, feedsRead)
+	v1.DELETE("/categories/:categoryID", s.DeleteCategory, feedsWrite)
+	v1.PUT("/categories/:categoryID", s.EditCategory, feedsWrite)
+	v1.GET("/categories/:categoryID", s.GetCategory, feedsRead)
+	v1.PUT("/categories/:categoryID/feeds", s.AddFeedsToCategory, feedsWrite)
+	v1.GET("/categories/:categoryID/feeds", s.GetFeedsFromCategory, feedsRead)
+	v1.GET("/categories/:categoryID/entries", s.GetEntriesFromCategory, entriesRead)
+	v1.PUT("/categories/:categoryID/mark", s.MarkCategory, entriesMark)
+	v1.GET("/categories/:categoryID/stats", s.GetStatsForCategory, feedsRead)
+
+	v1.GET("/entries", s.GetEntries, entriesRead)
+	v1.GET("/entries/:entryID", s.GetEntry, entriesRead)
+	v1.PUT("/entries/:entryID/mark", s.MarkEntry, entriesMark)
+	v1.PUT("/entries/:entryID/save", s.SaveEntry, entriesMark)
+	v1.PUT("/entries/:entryID/unsave", s.UnsaveEntry, entriesMark)
+	v1.PUT("/entries/save", s.SaveEntries, entriesMark)
+	v1.PUT("/entries/unsave", s.UnsaveEntries, entriesMark)
+	v1.GET("/entries/stats", s.GetStatsForEntries, entriesRead)
+
+	v1.GET("/stats/tree", s.GetStatsTree, feedsRead)
+
+	v1.GET("/trash", s.GetTrash, feedsRead)
+	v1.POST("/trash/:itemID/restore", s.RestoreFromTrash, feedsWrite)
+
+	v1.POST("/tags", s.NewTag, tagsWrite)
+	v1.GET("/tags", s.GetTags, entriesRead)
+	v1.GET("/tags/:tagID", s.GetTag, entriesRead)
+	v1.PUT("/tags/:tagID", s.EditTag, tagsWrite)
+	v1.DELETE("/tags/:tagID", s.DeleteTag, tagsWrite)
+	v1.PUT("/tags/:tagID/entries", s.TagEntries, entriesMark)
+	v1.DELETE("/tags/:tagID/entries", s.UntagEntries, entriesMark)
+	v1.GET("/tags/:tagID/entries", s.GetEntriesFromTag, entriesRead)
+	v1.GET("/tags/:tagID/stats", s.GetStatsForTag, entriesRead)
+
+	// Only event streams take the API key from the query string
+	eventsToken := middleware.JWTWithConfig(middleware.JWTConfig{
+		Skipper: func(c echo.Context) bool {
+			return !eventsQueryToken(c)
+		},
+		SigningKey:    []byte(s.config.AuthSecret),
+		SigningMethod: "HS256",
+		TokenLookup:   "query:access_token",
+		ErrorHandler:  jwtError,
+	})
+	v1.GET("/events", s.GetEvents, eventsToken, entriesRead)
+
+	v1.POST("/publications", s.NewPublication, feedsWrite)
+	v1.GET("/publications", s.GetPublications, feedsRead)
+	v1.GET("/publications/:publicationID", s.GetPublication, feedsRead)
+	v1.DELETE("/publications/:publicationID", s.DeletePublication, feedsWrite)
+
+	// Webhooks send entries out of the server, so feed scopes do not cover them
+	webhooksRead := requireScope(models.ScopeWebhooksRead)
+	webhooksWrite := requireScope(models.ScopeWebhooksWrite)
+	v1.POST("/webhooks", s.NewWebhook, webhooksWrite)
+	v1.GET("/webhooks", s.GetWebhooks, webhooksRead)
+	v1.GET("/webhooks/:webhookID", s.GetWebhook, webhooksRead)
+	v1.DELETE("/webhooks/:webhookID", s.DeleteWebhook, webhooksWrite)
+	v1.GET("/webhooks/:webhookID/deliveries", s.GetWebhookDeliveries, webhooksRead)
+	v1.POST("/webhooks/:webhookID/test", s.TestWebhook, webhooksWrite)
+
+	admin := v1.Group("/admin", requireScope(models.ScopeAdmin), s.requireAdmin)
+	admin.GET("/users", s.GetUsers)
+	admin.POST("/users", s.NewUser)
+	admin.GET("/users/:userID", s.GetUser)
+	admin.PUT("/users/:userID", s.EditUser)
+	admin.DELETE("/users/:userID", s.DeleteUser)
+	admin.POST("/invites", s.NewInvite)
+	admin.GET("/invites", s.GetInvites)
+	admin.DELETE("/invites/:inviteID", s.DeleteInvite)
+	admin.GET("/stats", s.GetInstanceStats)
+	admin.POST("/sync", s.SyncUsers)
+	admin.POST("/prune", s.Prune)
+
+	recoverer := middleware.RecoverWithConfig(middleware.RecoverConfig{
+		StackSize:         1 << 10, // 1 KB
+		DisablePrintStack: s.config.EnablePanicPrintStack,
+	})
+
+	// Publications are read by anyone holding their token
+	s.handle.GET("/published/:token/:format", s.Published, recoverer)
+
+	// Fever clients authenticate with their own API key instead of a JWT
+	if s.config.EnableFever {
+		fever := s.handle.Group("/fever", recoverer)
+		fever.Match([]string{echo.GET, echo.POST}, "/", s.Fever)
+	}
+
+	// Google Reader clients send their token in a GoogleLogin header
+	if s.config.EnableGoogleReader {
+		s.handle.POST("/accounts/ClientLogin", s.ClientLogin, recoverer)
+
+		reader := s.handle.Group("/reader/api/0", recoverer, s.readerAuth)
+		reader.GET("/token", s.ReaderToken)
+		reader.GET("/user-info", s.ReaderUserInfo)
+		reader.GET("/subscription/list", s.ReaderSubscriptions, feedsRead)
+		reader.POST("/subscription/edit", s.ReaderEditSubscription, feedsWrite)
+		reader.POST("/subscription/quickadd", s.ReaderQuickAdd, feedsWrite)
+		reader.GET("/tag/list", s.ReaderTags, feedsRead)
+		reader.GET("/stream/contents", s.ReaderStreamContents, entriesRead)
+		reader.GET("/stream/contents/*", s.ReaderStreamContents, entriesRead)
+		reader.GET("/stream/items/ids", s.ReaderStreamItemIDs, entriesRead)
+		reader.Match([]string{echo.GET, echo.POST}, "/stream/items/contents", s.ReaderStreamItemContents, entriesRead)
+		reader.POST("/edit-tag", s.ReaderEditTag, entriesMark)
+		reader.POST("/mark-all-as-read", s.ReaderMarkAllAsRead, entriesMark)
+	}
+}
+
+// requireAdmin rejects requests from users that are not administrators.
+// The role is read from the database rather than the token's admin
+// claim, which only reflects the role when the token was issued.
+func (s *Server) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := s.getUser(&c)
+		if err != nil {
+			return echo.ErrUnauthorized
+		}
+
+		if user.Role != models.RoleAdmin {
+			return echo.NewHTTPError(http.StatusForbidden, ErrorResp{
+				Reason:  "Forbidden",
+				Message: "Only administrators can access this resource",
+			})
+		}
+
+		return next(c)
+	}
+}
+
+// tokenScope returns the scopes granted to the token a request was made
+// with. Only personal access tokens are limited to a scope.
+func tokenScope(c echo.Context) (scope []string, personal bool) {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return nil, false
+	}
+
+	claim, personal := token.Claims.(jwt.MapClaims)["scope"].(string)
+	return strings.Fields(claim), personal
+}
+
+// requireScope rejects requests made with a personal access token
+// that was not granted scope
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			granted, personal := tokenScope(c)
+			if !personal {
+				return next(c)
+			}
+
+			for _, name := range granted {
+				if name == scope {
+					return next(c)
+				}
+			}
+
+			return echo.NewHTTPError(http.StatusForbidden, ErrorResp{
+				Reason:  "InsufficientScope",
+				Message: "The access token requires the " + scope + " scope",
+			})
+		}
+	}
+}
+
+// requireSession rejects requests made with a personal access token,
+// so that tokens cannot be used to create or revoke other tokens
+// or to change the account they belong to
+func requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, personal := tokenScope(c); personal {
+			return echo.NewHTTPError(http.StatusForbidden, ErrorResp{
+				Reason:  "InsufficientScope",
+				Message: "Personal access tokens cannot manage the account or its API keys",
+			})
+		}
+
+		return next(c)
+	}
+}
+
+// jwtError tells clients apart whose access token expired, and should
+// be refreshed, from those that sent an invalid one
+func jwtError(err error) error {
+	if err == middleware.ErrJWTMissing {
+		return err
+	}
 
-	v1.POST("/feeds", s.NewFeed)
-	v1.GET("/feeds", s.GetFeeds)
-	v1.GET("/feeds/:feedID", s.GetFeed)
-	v1.PUT("/feeds/:feedID", s.EditFeed)
-	v1.DELETE("/feeds/:feedID", s.DeleteFeed)
-	v1.GET("/feeds/:feedID/entries", s.GetEntriesFromFeed)
-	v1.PUT("/feeds/:feedID/mark", s.MarkFeed)
-	v1.GET("/feeds/:feedID/stats", s.GetStatsForFeed)
-
-	v1.POST("/categories", s.NewCategory)
-	v1.GET("/categories", s.GetCategories)
-	v1.DELETE("/categories/:categoryID", s.DeleteCategory)
-	v1.PUT("/categories/:categoryID", s.EditCategory)
-	v1.GET("/categories/:categoryID", s.GetCategory)
-	v1.PUT("/categories/:categoryID/feeds", s.AddFeedsToCategory)
-	v1.GET("/categories/:categoryID/feeds", s.GetFeedsFromCategory)
-	v1.GET("/categories/:categoryID/entries", s.GetEntriesFromCategory)
-	v1.PUT("/categories/:categoryID/mark", s.MarkCategory)
-	v1.GET("/categories/:categoryID/stats", s.GetStatsForCategory)
-
-	v1.GET("/entries", s.GetEntries)
-	v1.GET("/entries/:entryID", s.GetEntry)
-	v1.PUT("/entries/:entryID/mark", s.MarkEntry)
-	v1.GET("/entries/stats", s.GetStatsForEntries)
+	if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+		return echo.NewHTTPError(http.StatusUnauthorized, ErrorResp{
+			Reason:  "TokenExpired",
+			Message: "The access token has expired",
+		})
+	}
+
+	return echo.NewHTTPError(http.StatusUnauthorized, ErrorResp{
+		Reason:  "InvalidToken",
+		Message: "The access token is invalid",
+	})
+}
+
+// parseTrustedProxies returns the networks of the addresses and CIDR
+// ranges in proxies, a single address being a network of its own
+func parseTrustedProxies(proxies []string) (networks []*net.IPNet) {
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return
+}
+
+func (s *Server) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range s.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request came from. The X-Forwarded-For
+// and X-Real-IP headers are only believed when the request comes from a
+// trusted proxy, since any client can set them.
+func (s *Server) clientIP(c echo.Context) string {
+	req := c.Request()
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	if !s.trustedProxy(ip) {
+		return ip
+	}
+
+	// Every proxy appends the address it got the request from, so the
+	// client is the last address that is not one of our proxies
+	if forwarded := req.Header[echo.HeaderXForwardedFor]; len(forwarded) != 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			ip = hop
+			if !s.trustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+
+	if realIP := req.Header.Get(echo.HeaderXRealIP); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// lockedOut refuses a login attempt until the lockout ends
+func lockedOut(c echo.Context, until time.Time) error {
+	retryAfter := int(time.Until(until)/time.Second) + 1
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	return echo.NewHTTPError(http.StatusTooManyRequests, ErrorResp{
+		Reason:  "TooManyAttempts",
+		Message: "Too many failed logins, try again later",
+	})
 }
 
 func newError(err error, c *echo.Context) error {
@@ -18,21 +18,31 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	gosync "sync"
 	"testing"
 	"time"
 
 	"github.com/chavamee/syndication/config"
 	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/events"
 	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/opml"
 	"github.com/chavamee/syndication/sync"
+	"github.com/chavamee/syndication/webhooks"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -57,6 +67,8 @@ func (suite *ServerTestSuite) SetupTest() {
 	conf := config.DefaultConfig
 	conf.Server.HTTPPort = 8080
 	conf.Server.AuthSecret = "secret"
+	conf.Server.EnableFever = true
+	conf.Server.EnableGoogleReader = true
 
 	var err error
 	suite.db, err = database.NewDB("sqlite3", TestDBPath)
@@ -997,6 +1009,1832 @@ func (suite *ServerTestSuite) TestGetStatsForCategory() {
 	suite.Equal(10, respStats.Total)
 }
 
+func (suite *ServerTestSuite) TestNewTag() {
+	payload := []byte(`{"name": "Tech"}`)
+	req, err := http.NewRequest("POST", "http://localhost:8080/v1/tags", bytes.NewBuffer(payload))
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(201, resp.StatusCode)
+
+	respTag := new(models.Tag)
+	err = json.NewDecoder(resp.Body).Decode(respTag)
+	suite.Require().Nil(err)
+
+	suite.Require().NotEmpty(respTag.UUID)
+	suite.Equal("Tech", respTag.Name)
+
+	dbTag, err := suite.db.Tag(respTag.UUID, &suite.user)
+	suite.Nil(err)
+	suite.Equal(dbTag.Name, respTag.Name)
+}
+
+func (suite *ServerTestSuite) TestTagEntries() {
+	feed := models.Feed{
+		Subscription: suite.ts.URL,
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.server.sync.SyncFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	tag := models.Tag{Name: "Tech"}
+	err = suite.db.NewTag(&tag, &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err := suite.db.EntriesFromFeed(feed.UUID, true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 5)
+
+	payload := []byte(`{"entries": ["` + entries[0].UUID + `", "` + entries[1].UUID + `"]}`)
+	req, err := http.NewRequest("PUT", "http://localhost:8080/v1/tags/"+tag.UUID+"/entries", bytes.NewBuffer(payload))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/tags/"+tag.UUID+"/entries", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	type Entries struct {
+		Entries []models.Entry `json:"entries"`
+	}
+
+	respEntries := new(Entries)
+	err = json.NewDecoder(resp.Body).Decode(respEntries)
+	suite.Require().Nil(err)
+	suite.Len(respEntries.Entries, 2)
+}
+
+func (suite *ServerTestSuite) TestSaveEntry() {
+	feed := models.Feed{
+		Subscription: suite.ts.URL,
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.server.sync.SyncFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entries, err := suite.db.EntriesFromFeed(feed.UUID, true, models.Any, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().Len(entries, 5)
+
+	req, err := http.NewRequest("PUT", "http://localhost:8080/v1/entries/"+entries[0].UUID+"/save", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/entries?saved=true", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	type Entries struct {
+		Entries []models.Entry `json:"entries"`
+	}
+
+	respEntries := new(Entries)
+	err = json.NewDecoder(resp.Body).Decode(respEntries)
+	suite.Require().Nil(err)
+	suite.Require().Len(respEntries.Entries, 1)
+	suite.Equal(entries[0].UUID, respEntries.Entries[0].UUID)
+	suite.True(respEntries.Entries[0].Saved)
+}
+
+func (suite *ServerTestSuite) TestGetStatsTree() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+	suite.Require().NotEmpty(feed.UUID)
+
+	for i := 0; i < 10; i++ {
+		entry := models.Entry{
+			Title:  "Item",
+			Link:   "http://example.com",
+			Feed:   feed,
+			FeedID: feed.ID,
+			Mark:   models.Unread,
+		}
+
+		if i < 3 {
+			entry.Mark = models.Read
+			entry.Saved = true
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+	}
+
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/stats/tree", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	respTree := new(models.StatsTree)
+	err = json.NewDecoder(resp.Body).Decode(respTree)
+	suite.Require().Nil(err)
+
+	suite.Equal(10, respTree.Total.Total)
+	suite.Equal(7, respTree.Feeds[feed.UUID].Unread)
+	suite.Equal(7, respTree.Categories[suite.user.UncategorizedCategoryUUID].Unread)
+	suite.Equal(3, respTree.Categories[suite.user.SavedCategoryUUID].Saved)
+}
+
+func (suite *ServerTestSuite) TestRestoreFromTrash() {
+	feed := models.Feed{
+		Title:        "News",
+		Subscription: "http://example.com",
+	}
+
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	err = suite.db.DeleteFeed(feed.UUID, &suite.user)
+	suite.Require().Nil(err)
+
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/trash", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	respTrash := new(models.Trash)
+	err = json.NewDecoder(resp.Body).Decode(respTrash)
+	suite.Require().Nil(err)
+	suite.Require().Len(respTrash.Feeds, 1)
+	suite.Equal(feed.UUID, respTrash.Feeds[0].UUID)
+
+	req, err = http.NewRequest("POST", "http://localhost:8080/v1/trash/"+feed.UUID+"/restore", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	_, err = suite.db.Feed(feed.UUID, &suite.user)
+	suite.Nil(err)
+}
+
+func (suite *ServerTestSuite) TestHealth() {
+	resp, err := http.Get("http://localhost:8080/v1/health")
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestLogout() {
+	req, err := http.NewRequest("POST", "http://localhost:8080/v1/logout", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/feeds", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(401, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestGetAndDeleteKeys() {
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/keys", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	type Keys struct {
+		Keys []models.APIKey `json:"keys"`
+	}
+
+	respKeys := new(Keys)
+	err = json.NewDecoder(resp.Body).Decode(respKeys)
+	suite.Require().Nil(err)
+	suite.Require().Len(respKeys.Keys, 1)
+	suite.Empty(respKeys.Keys[0].Key)
+	suite.NotEmpty(respKeys.Keys[0].UUID)
+	suite.NotNil(respKeys.Keys[0].LastUsedAt)
+
+	req, err = http.NewRequest("DELETE", "http://localhost:8080/v1/keys/"+respKeys.Keys[0].UUID, nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+	suite.Empty(suite.db.APIKeys(&suite.user))
+}
+
+func (suite *ServerTestSuite) TestRefreshToken() {
+	resp, err := http.PostForm("http://localhost:8080/v1/login",
+		url.Values{"username": {"GoTest"}, "password": {"testtesttest"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	session := new(Session)
+	err = json.NewDecoder(resp.Body).Decode(session)
+	suite.Require().Nil(err)
+	suite.Require().NotEmpty(session.Token)
+	suite.Require().NotEmpty(session.Key)
+
+	resp, err = http.PostForm("http://localhost:8080/v1/token/refresh",
+		url.Values{"refresh_token": {session.Token}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	refreshed := new(Session)
+	err = json.NewDecoder(resp.Body).Decode(refreshed)
+	suite.Require().Nil(err)
+	suite.NotEmpty(refreshed.Key)
+	suite.NotEqual(session.Token, refreshed.Token)
+
+	// Reusing a refresh token is rejected
+	resp, err = http.PostForm("http://localhost:8080/v1/token/refresh",
+		url.Values{"refresh_token": {session.Token}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(401, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestExpiredAccessToken() {
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["id"] = suite.user.UUID
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+
+	signed, err := token.SignedString([]byte("secret"))
+	suite.Require().Nil(err)
+
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/feeds", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+signed)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(401, resp.StatusCode)
+
+	errResp := new(ErrorResp)
+	err = json.NewDecoder(resp.Body).Decode(errResp)
+	suite.Require().Nil(err)
+	suite.Equal("TokenExpired", errResp.Reason)
+}
+
+func (suite *ServerTestSuite) TestPersonalAccessTokens() {
+	req, err := http.NewRequest("POST", "http://localhost:8080/v1/tokens", bytes.NewBufferString(url.Values{
+		"label": {"Dashboard"},
+		"scope": {"feeds:read", "entries:read"},
+	}.Encode()))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Require().Equal(201, resp.StatusCode)
+
+	token := new(models.APIKey)
+	err = json.NewDecoder(resp.Body).Decode(token)
+	suite.Require().Nil(err)
+	suite.Require().NotEmpty(token.Key)
+	suite.True(token.Personal)
+	suite.Equal("feeds:read entries:read", token.Scope)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/feeds", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+token.Key)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	req, err = http.NewRequest("DELETE", "http://localhost:8080/v1/feeds/1", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+token.Key)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(403, resp.StatusCode)
+
+	errResp := new(ErrorResp)
+	err = json.NewDecoder(resp.Body).Decode(errResp)
+	suite.Require().Nil(err)
+	suite.Equal("InsufficientScope", errResp.Reason)
+
+	// Tokens cannot manage other tokens
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/tokens", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+token.Key)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(403, resp.StatusCode)
+
+	req, err = http.NewRequest("DELETE", "http://localhost:8080/v1/tokens/"+token.UUID, nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/feeds", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+token.Key)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(401, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestWebhookScopes() {
+	newToken := func(scope ...string) string {
+		req, err := http.NewRequest("POST", "http://localhost:8080/v1/tokens", bytes.NewBufferString(url.Values{
+			"label": {"Integration"},
+			"scope": scope,
+		}.Encode()))
+		suite.Require().Nil(err)
+
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp, err := http.DefaultClient.Do(req)
+		suite.Require().Nil(err)
+		defer resp.Body.Close()
+		suite.Require().Equal(201, resp.StatusCode)
+
+		token := new(models.APIKey)
+		err = json.NewDecoder(resp.Body).Decode(token)
+		suite.Require().Nil(err)
+		return token.Key
+	}
+
+	newWebhook := func(token string) int {
+		req, err := http.NewRequest("POST", "http://localhost:8080/v1/webhooks",
+			bytes.NewBufferString(`{"url": "http://example.com/hook"}`))
+		suite.Require().Nil(err)
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		suite.Require().Nil(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Feed scopes do not allow sending entries elsewhere
+	suite.Equal(403, newWebhook(newToken("feeds:read", "feeds:write")))
+	suite.Equal(201, newWebhook(newToken("webhooks:write")))
+}
+
+func (suite *ServerTestSuite) TestNewTokenWithBadScope() {
+	req, err := http.NewRequest("POST", "http://localhost:8080/v1/tokens", bytes.NewBufferString(url.Values{
+		"scope": {"feeds:delete"},
+	}.Encode()))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(400, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestAdminRoutes() {
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/admin/users", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(403, resp.StatusCode)
+
+	// The role is checked in the database, not in the token
+	err = suite.db.SetUserRole(suite.user.UUID, models.RoleAdmin)
+	suite.Require().Nil(err)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	type Users struct {
+		Users []models.User `json:"users"`
+	}
+
+	users := new(Users)
+	err = json.NewDecoder(resp.Body).Decode(users)
+	suite.Require().Nil(err)
+	suite.Require().Len(users.Users, 1)
+	suite.Equal(models.RoleAdmin, users.Users[0].Role)
+
+	req, err = http.NewRequest("POST", "http://localhost:8080/v1/admin/users", bytes.NewBufferString(url.Values{
+		"username": {"other"},
+		"password": {"testtesttest"},
+	}.Encode()))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Require().Equal(201, resp.StatusCode)
+
+	other := new(models.User)
+	err = json.NewDecoder(resp.Body).Decode(other)
+	suite.Require().Nil(err)
+	suite.Equal("other", other.Username)
+	suite.Equal(models.RoleUser, other.Role)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/admin/stats", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	stats := new(models.InstanceStats)
+	err = json.NewDecoder(resp.Body).Decode(stats)
+	suite.Require().Nil(err)
+	suite.Equal(2, stats.Users)
+
+	req, err = http.NewRequest("DELETE", "http://localhost:8080/v1/admin/users/"+other.UUID, nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	_, err = suite.db.UserWithName("other")
+	suite.NotNil(err)
+
+	req, err = http.NewRequest("POST", "http://localhost:8080/v1/admin/prune", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	// Demoted admins lose access right away
+	err = suite.db.SetUserRole(suite.user.UUID, models.RoleUser)
+	suite.Require().Nil(err)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/admin/stats", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(403, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestLoginLockout() {
+	db := suite.server.db.(*database.DB)
+	policy := db.LockoutPolicy
+	defer func() { db.LockoutPolicy = policy }()
+
+	db.LockoutPolicy = database.LockoutPolicy{
+		AccountAttempts: 2,
+		IPAttempts:      10,
+		Backoff:         time.Minute,
+		MaxBackoff:      time.Hour,
+	}
+
+	// Unknown users and bad passwords are rejected alike
+	resp, err := http.PostForm("http://localhost:8080/v1/login",
+		url.Values{"username": {"nobody"}, "password": {"testtesttest"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(401, resp.StatusCode)
+
+	unknownUser := new(ErrorResp)
+	err = json.NewDecoder(resp.Body).Decode(unknownUser)
+	suite.Require().Nil(err)
+
+	for i := 0; i < 2; i++ {
+		resp, err = http.PostForm("http://localhost:8080/v1/login",
+			url.Values{"username": {"GoTest"}, "password": {"wrong"}})
+		suite.Require().Nil(err)
+		defer resp.Body.Close()
+
+		suite.Equal(401, resp.StatusCode)
+	}
+
+	badPassword := new(ErrorResp)
+	err = json.NewDecoder(resp.Body).Decode(badPassword)
+	suite.Require().Nil(err)
+	suite.Equal(unknownUser, badPassword)
+
+	resp, err = http.PostForm("http://localhost:8080/v1/login",
+		url.Values{"username": {"GoTest"}, "password": {"testtesttest"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(429, resp.StatusCode)
+	suite.NotEmpty(resp.Header.Get("Retry-After"))
+
+	err = db.ClearLockout(models.LockoutAccount, "GoTest")
+	suite.Require().Nil(err)
+
+	resp, err = http.PostForm("http://localhost:8080/v1/login",
+		url.Values{"username": {"GoTest"}, "password": {"testtesttest"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestFeverLockout() {
+	db := suite.server.db.(*database.DB)
+	policy := db.LockoutPolicy
+	defer func() { db.LockoutPolicy = policy }()
+
+	db.LockoutPolicy = database.LockoutPolicy{
+		AccountAttempts: 2,
+		IPAttempts:      2,
+		Backoff:         time.Minute,
+		MaxBackoff:      time.Hour,
+	}
+
+	err := db.SetFeverPassword("feverpass", &suite.user)
+	suite.Require().Nil(err)
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.PostForm("http://localhost:8080/fever/?api",
+			url.Values{"api_key": {database.FeverKey("GoTest", "wrong")}})
+		suite.Require().Nil(err)
+		resp.Body.Close()
+
+		suite.Equal(200, resp.StatusCode)
+	}
+
+	resp, err := http.PostForm("http://localhost:8080/fever/?api",
+		url.Values{"api_key": {database.FeverKey("GoTest", "feverpass")}})
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(429, resp.StatusCode)
+	suite.NotEmpty(resp.Header.Get("Retry-After"))
+
+	err = db.ClearLockout(models.LockoutIP, "127.0.0.1")
+	suite.Require().Nil(err)
+
+	resp, err = http.PostForm("http://localhost:8080/fever/?api",
+		url.Values{"api_key": {database.FeverKey("GoTest", "feverpass")}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	fever := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&fever)
+	suite.Require().Nil(err)
+	suite.EqualValues(1, fever["auth"])
+}
+
+func (suite *ServerTestSuite) TestRegistrationModes() {
+	conf := config.DefaultConfig.Server
+	conf.AuthSecret = "secret"
+
+	register := func(server *Server, values url.Values) int {
+		req := httptest.NewRequest("POST", "/v1/register", bytes.NewBufferString(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rec := httptest.NewRecorder()
+		server.handle.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	conf.Registration = config.RegistrationDisabled
+	disabled := NewServer(suite.db, suite.sync, conf)
+	suite.Equal(403, register(disabled, url.Values{"username": {"newbie"}, "password": {"testtesttest"}}))
+
+	conf.Registration = config.RegistrationInvite
+	inviteOnly := NewServer(suite.db, suite.sync, conf)
+	suite.Equal(401, register(inviteOnly, url.Values{"username": {"newbie"}, "password": {"testtesttest"}}))
+
+	invite := models.Invite{MaxUses: 1}
+	err := suite.db.NewInvite(&invite)
+	suite.Require().Nil(err)
+
+	suite.Equal(400, register(inviteOnly, url.Values{"username": {"newbie"}, "password": {"short"}, "invite": {invite.Code}}))
+	suite.Equal(204, register(inviteOnly, url.Values{"username": {"newbie"}, "password": {"testtesttest"}, "invite": {invite.Code}}))
+	suite.Equal(401, register(inviteOnly, url.Values{"username": {"another"}, "password": {"testtesttest"}, "invite": {invite.Code}}))
+
+	_, err = suite.db.UserWithName("newbie")
+	suite.Nil(err)
+}
+
+func (suite *ServerTestSuite) TestRegisterWithBadUsername() {
+	resp, err := http.PostForm("http://localhost:8080/v1/register",
+		url.Values{"username": {""}, "password": {"testtesttest"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(400, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestEditMe() {
+	profile := []byte(`{"email": "gotest@example.com", "timezone": "America/New_York", "preferences": {"theme": "dark"}, "role": "admin"}`)
+	req, err := http.NewRequest("PUT", "http://localhost:8080/v1/me", bytes.NewBuffer(profile))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	edited := new(models.User)
+	err = json.NewDecoder(resp.Body).Decode(edited)
+	suite.Require().Nil(err)
+	suite.Equal(suite.user.UUID, edited.UUID)
+	suite.Equal("GoTest", edited.Username)
+	suite.Equal("gotest@example.com", edited.Email)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/me", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	me := new(models.User)
+	err = json.NewDecoder(resp.Body).Decode(me)
+	suite.Require().Nil(err)
+	suite.Equal(suite.user.UUID, me.UUID)
+	suite.Equal("GoTest", me.Username)
+	suite.Equal("gotest@example.com", me.Email)
+	suite.Equal("America/New_York", me.Timezone)
+	suite.Equal(models.Preferences{"theme": "dark"}, me.Preferences)
+	suite.Equal(models.RoleUser, me.Role)
+
+	req, err = http.NewRequest("PUT", "http://localhost:8080/v1/me", bytes.NewBufferString(`{"email": ""}`))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	edited = new(models.User)
+	err = json.NewDecoder(resp.Body).Decode(edited)
+	suite.Require().Nil(err)
+	suite.Empty(edited.Email)
+	suite.Equal("America/New_York", edited.Timezone)
+
+	req, err = http.NewRequest("PUT", "http://localhost:8080/v1/me", bytes.NewBufferString(`{"timezone": "Nowhere"}`))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(400, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestChangeMyPassword() {
+	resp, err := http.PostForm("http://localhost:8080/v1/login",
+		url.Values{"username": {"GoTest"}, "password": {"testtesttest"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	other := new(Session)
+	err = json.NewDecoder(resp.Body).Decode(other)
+	suite.Require().Nil(err)
+
+	changePassword := func(current, new string) int {
+		values := url.Values{"current_password": {current}, "new_password": {new}}
+		req, err := http.NewRequest("PUT", "http://localhost:8080/v1/me/password", bytes.NewBufferString(values.Encode()))
+		suite.Require().Nil(err)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := http.DefaultClient.Do(req)
+		suite.Require().Nil(err)
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	suite.Equal(401, changePassword("wrong", "newpassword123"))
+	suite.Equal(400, changePassword("testtesttest", "short"))
+	suite.Equal(204, changePassword("testtesttest", "newpassword123"))
+
+	_, err = suite.db.Authenticate("GoTest", "newpassword123")
+	suite.Nil(err)
+
+	found, err := suite.db.KeyBelongsToUser(&models.APIKey{Key: suite.token}, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(found)
+
+	found, err = suite.db.KeyBelongsToUser(&other.APIKey, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(found)
+}
+
+func (suite *ServerTestSuite) TestExportAndDeleteMe() {
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/me/export", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+	suite.Contains(resp.Header.Get("Content-Disposition"), "attachment")
+
+	archive := new(database.Archive)
+	err = json.NewDecoder(resp.Body).Decode(archive)
+	suite.Require().Nil(err)
+	suite.Require().Len(archive.Users, 1)
+	suite.Equal(suite.user.UUID, archive.Users[0].UUID)
+	suite.Empty(archive.Users[0].PasswordHash)
+	suite.Require().Len(archive.Feeds, 1)
+	suite.Equal(feed.UUID, archive.Feeds[0].UUID)
+
+	deleteMe := func(password string) int {
+		body, err := json.Marshal(map[string]string{"password": password})
+		suite.Require().Nil(err)
+
+		req, err := http.NewRequest("DELETE", "http://localhost:8080/v1/me", bytes.NewBuffer(body))
+		suite.Require().Nil(err)
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := client.Do(req)
+		suite.Require().Nil(err)
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	suite.Equal(401, deleteMe("wrong"))
+	suite.Equal(204, deleteMe("testtesttest"))
+
+	_, err = suite.db.UserWithName("GoTest")
+	suite.IsType(database.NotFound{}, err)
+}
+
+func (suite *ServerTestSuite) TestFever() {
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	var entries []models.Entry
+	for i := 0; i < 3; i++ {
+		entry := models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			Feed:  feed,
+			Mark:  models.Unread,
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+
+		entries = append(entries, entry)
+	}
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("PUT", "http://localhost:8080/v1/me/fever", bytes.NewBufferString("password=feverpass"))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Require().Equal(204, resp.StatusCode)
+
+	type FeverResponse struct {
+		APIVersion    int               `json:"api_version"`
+		Auth          int               `json:"auth"`
+		Groups        []FeverGroup      `json:"groups"`
+		FeedsGroups   []FeverFeedsGroup `json:"feeds_groups"`
+		Feeds         []FeverFeed       `json:"feeds"`
+		Items         []FeverItem       `json:"items"`
+		TotalItems    int               `json:"total_items"`
+		UnreadItemIDs string            `json:"unread_item_ids"`
+		SavedItemIDs  string            `json:"saved_item_ids"`
+	}
+
+	fever := func(query string, form url.Values) FeverResponse {
+		resp, err := http.PostForm("http://localhost:8080/fever/?api&"+query, form)
+		suite.Require().Nil(err)
+		defer resp.Body.Close()
+
+		suite.Require().Equal(200, resp.StatusCode)
+
+		feverResp := FeverResponse{}
+		err = json.NewDecoder(resp.Body).Decode(&feverResp)
+		suite.Require().Nil(err)
+		return feverResp
+	}
+
+	key := database.FeverKey("GoTest", "feverpass")
+
+	feverResp := fever("groups&feeds", url.Values{"api_key": {"bogus"}})
+	suite.Equal(3, feverResp.APIVersion)
+	suite.Equal(0, feverResp.Auth)
+	suite.Empty(feverResp.Feeds)
+
+	feverResp = fever("groups&feeds", url.Values{"api_key": {key}})
+	suite.Equal(1, feverResp.Auth)
+	suite.Require().Len(feverResp.Feeds, 1)
+	suite.Equal("Example", feverResp.Feeds[0].Title)
+	suite.Equal("http://example.com", feverResp.Feeds[0].URL)
+	suite.Require().Len(feverResp.FeedsGroups, 1)
+	suite.Equal(strconv.Itoa(int(feverResp.Feeds[0].ID)), feverResp.FeedsGroups[0].FeedIDs)
+
+	var groupTitles []string
+	for _, group := range feverResp.Groups {
+		groupTitles = append(groupTitles, group.Title)
+	}
+	suite.Contains(groupTitles, models.Uncategorized)
+	suite.NotContains(groupTitles, models.Saved)
+
+	feverResp = fever("items", url.Values{"api_key": {key}})
+	suite.Require().Len(feverResp.Items, 3)
+	suite.Equal(3, feverResp.TotalItems)
+	suite.Equal("Item 0", feverResp.Items[0].Title)
+	suite.Equal(0, feverResp.Items[0].IsRead)
+
+	itemIDs := make([]string, len(feverResp.Items))
+	for i, item := range feverResp.Items {
+		itemIDs[i] = strconv.Itoa(int(item.ID))
+	}
+
+	feverResp = fever("items&since_id="+itemIDs[0], url.Values{"api_key": {key}})
+	suite.Require().Len(feverResp.Items, 2)
+	suite.Equal("Item 1", feverResp.Items[0].Title)
+
+	feverResp = fever("items&max_id="+itemIDs[2], url.Values{"api_key": {key}})
+	suite.Require().Len(feverResp.Items, 2)
+	suite.Equal("Item 1", feverResp.Items[0].Title)
+
+	feverResp = fever("items&with_ids="+itemIDs[2]+","+itemIDs[0], url.Values{"api_key": {key}})
+	suite.Len(feverResp.Items, 2)
+
+	feverResp = fever("", url.Values{"api_key": {key}, "mark": {"item"}, "as": {"read"}, "id": {itemIDs[0]}})
+	suite.Equal(itemIDs[1]+","+itemIDs[2], feverResp.UnreadItemIDs)
+
+	feverResp = fever("", url.Values{"api_key": {key}, "mark": {"item"}, "as": {"saved"}, "id": {itemIDs[1]}})
+	suite.Equal(itemIDs[1], feverResp.SavedItemIDs)
+
+	entry, err := suite.db.Entry(entries[1].UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.True(entry.Saved)
+
+	// Entries newer than before stay unread
+	before := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	feverResp = fever("", url.Values{"api_key": {key}, "mark": {"group"}, "as": {"read"}, "id": {"0"}, "before": {before}})
+	suite.Equal(itemIDs[1]+","+itemIDs[2], feverResp.UnreadItemIDs)
+
+	before = strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	feverResp = fever("unread_item_ids&saved_item_ids", url.Values{"api_key": {key}, "mark": {"feed"}, "as": {"read"}, "id": {strconv.Itoa(int(entry.FeedID))}, "before": {before}})
+	suite.Empty(feverResp.UnreadItemIDs)
+	suite.Equal(itemIDs[1], feverResp.SavedItemIDs)
+
+	req, err = http.NewRequest("DELETE", "http://localhost:8080/v1/me/fever", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(204, resp.StatusCode)
+
+	feverResp = fever("feeds", url.Values{"api_key": {key}})
+	suite.Equal(0, feverResp.Auth)
+}
+
+func (suite *ServerTestSuite) TestGoogleReader() {
+	ctg := models.Category{Name: "News"}
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com", Category: ctg}
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	var entries []models.Entry
+	for i := 0; i < 3; i++ {
+		entry := models.Entry{
+			Title: "Item " + strconv.Itoa(i),
+			Feed:  feed,
+			Mark:  models.Unread,
+		}
+
+		err = suite.db.NewEntry(&entry, &suite.user)
+		suite.Require().Nil(err)
+
+		entries = append(entries, entry)
+	}
+
+	resp, err := http.PostForm("http://localhost:8080/accounts/ClientLogin",
+		url.Values{"Email": {"GoTest"}, "Passwd": {"wrongpassword"}})
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(401, resp.StatusCode)
+
+	resp, err = http.PostForm("http://localhost:8080/accounts/ClientLogin",
+		url.Values{"Email": {"GoTest"}, "Passwd": {"testtesttest"}})
+	suite.Require().Nil(err)
+
+	suite.Require().Equal(200, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	var auth string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "Auth=") {
+			auth = strings.TrimPrefix(line, "Auth=")
+		}
+	}
+	suite.Require().NotEmpty(auth)
+
+	// The token can be used as a password
+	resp, err = http.PostForm("http://localhost:8080/accounts/ClientLogin",
+		url.Values{"Email": {"GoTest"}, "Passwd": {auth}})
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+
+	client := &http.Client{}
+
+	reader := func(method, path string, form url.Values, value interface{}) int {
+		req, err := http.NewRequest(method, "http://localhost:8080/reader/api/0/"+path, strings.NewReader(form.Encode()))
+		suite.Require().Nil(err)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "GoogleLogin auth="+auth)
+
+		resp, err := client.Do(req)
+		suite.Require().Nil(err)
+		defer resp.Body.Close()
+
+		if value != nil && resp.StatusCode == 200 {
+			err = json.NewDecoder(resp.Body).Decode(value)
+			suite.Require().Nil(err)
+		}
+		return resp.StatusCode
+	}
+
+	subscriptions := struct {
+		Subscriptions []ReaderSubscription `json:"subscriptions"`
+	}{}
+	suite.Require().Equal(200, reader("GET", "subscription/list", nil, &subscriptions))
+	suite.Require().Len(subscriptions.Subscriptions, 1)
+	suite.Equal("feed/"+feed.UUID, subscriptions.Subscriptions[0].ID)
+	suite.Equal("Example", subscriptions.Subscriptions[0].Title)
+	suite.Require().Len(subscriptions.Subscriptions[0].Categories, 1)
+	suite.Equal("user/-/label/News", subscriptions.Subscriptions[0].Categories[0].ID)
+
+	tags := struct {
+		Tags []ReaderTag `json:"tags"`
+	}{}
+	suite.Require().Equal(200, reader("GET", "tag/list", nil, &tags))
+	suite.Contains(tags.Tags, ReaderTag{ID: "user/-/state/com.google/starred"})
+	suite.Contains(tags.Tags, ReaderTag{ID: "user/-/label/News", Type: "folder"})
+
+	stream := ReaderStream{}
+	suite.Require().Equal(200, reader("GET", "stream/contents/user/-/state/com.google/reading-list?n=2", nil, &stream))
+	suite.Require().Len(stream.Items, 2)
+	suite.Equal("Item 2", stream.Items[0].Title)
+	suite.Equal("feed/"+feed.UUID, stream.Items[0].Origin.StreamID)
+	suite.Contains(stream.Items[0].Categories, "user/-/label/News")
+	suite.Require().NotEmpty(stream.Continuation)
+
+	next := ReaderStream{}
+	suite.Require().Equal(200, reader("GET", "stream/contents/feed/"+feed.UUID+"?n=2&c="+stream.Continuation, nil, &next))
+	suite.Require().Len(next.Items, 1)
+	suite.Equal("Item 0", next.Items[0].Title)
+	suite.Empty(next.Continuation)
+
+	refs := ReaderItemRefs{}
+	suite.Require().Equal(200, reader("GET", "stream/items/ids?s=user/-/label/News&r=o", nil, &refs))
+	suite.Require().Len(refs.ItemRefs, 3)
+	suite.Equal(strconv.Itoa(int(entries[0].ID)), refs.ItemRefs[0].ID)
+
+	suite.Equal(404, reader("GET", "stream/items/ids?s=user/-/label/Missing", nil, nil))
+
+	// Items can be named by their short or long id
+	longID := next.Items[0].ID
+	suite.Equal(200, reader("POST", "edit-tag", url.Values{
+		"i": {longID, refs.ItemRefs[1].ID},
+		"a": {"user/-/state/com.google/read", "user/-/state/com.google/starred"},
+	}, nil))
+
+	suite.Require().Equal(200, reader("GET", "stream/items/ids?s=user/-/state/com.google/reading-list&xt=user/-/state/com.google/read", nil, &refs))
+	suite.Require().Len(refs.ItemRefs, 1)
+	suite.Equal(strconv.Itoa(int(entries[2].ID)), refs.ItemRefs[0].ID)
+
+	suite.Require().Equal(200, reader("POST", "stream/items/contents", url.Values{"i": {longID}}, &stream))
+	suite.Require().Len(stream.Items, 1)
+	suite.Contains(stream.Items[0].Categories, "user/-/state/com.google/starred")
+	suite.Contains(stream.Items[0].Categories, "user/-/state/com.google/read")
+
+	suite.Equal(200, reader("POST", "edit-tag", url.Values{
+		"i": {longID},
+		"r": {"user/-/state/com.google/starred"},
+	}, nil))
+
+	entry, err := suite.db.Entry(entries[0].UUID, &suite.user)
+	suite.Require().Nil(err)
+	suite.False(entry.Saved)
+	suite.EqualValues(models.Read, entry.Mark)
+
+	suite.Equal(200, reader("POST", "mark-all-as-read", url.Values{"s": {"feed/" + feed.UUID}}, nil))
+	suite.Equal(0, suite.db.Stats(&suite.user).Unread)
+
+	suite.Equal(200, reader("POST", "subscription/edit", url.Values{
+		"ac": {"subscribe"},
+		"s":  {"feed/" + suite.ts.URL},
+		"t":  {"Test site"},
+		"a":  {"user/-/label/Tech"},
+	}, nil))
+
+	suite.Require().Equal(200, reader("GET", "subscription/list", nil, &subscriptions))
+	suite.Require().Len(subscriptions.Subscriptions, 2)
+
+	var subscribed ReaderSubscription
+	for _, subscription := range subscriptions.Subscriptions {
+		if subscription.URL == suite.ts.URL {
+			subscribed = subscription
+		}
+	}
+	suite.Equal("Test site", subscribed.Title)
+	suite.Require().Len(subscribed.Categories, 1)
+	suite.Equal("Tech", subscribed.Categories[0].Label)
+
+	suite.Equal(200, reader("POST", "subscription/edit", url.Values{
+		"ac": {"unsubscribe"},
+		"s":  {subscribed.ID},
+	}, nil))
+	suite.Len(suite.db.Feeds(&suite.user), 1)
+
+	// Personal access tokens without the required scope are rejected
+	key := models.APIKey{Scope: models.ScopeFeedsRead}
+	err = suite.db.NewPersonalAccessToken("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	auth = key.Key
+	suite.Equal(200, reader("GET", "subscription/list", nil, nil))
+	suite.Equal(403, reader("GET", "stream/contents", nil, nil))
+
+	auth = "bogus"
+	suite.Equal(401, reader("GET", "user-info", nil, nil))
+}
+
+func (suite *ServerTestSuite) TestPublications() {
+	ctg := models.Category{Name: "News"}
+	err := suite.db.NewCategory(&ctg, &suite.user)
+	suite.Require().Nil(err)
+
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com", Category: ctg}
+	err = suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{Title: "Published item", Feed: feed, Mark: models.Unread}
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	payload := []byte(`{"source": "category", "source_id": "` + ctg.UUID + `"}`)
+	req, err := http.NewRequest("POST", "http://localhost:8080/v1/publications", bytes.NewBuffer(payload))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+
+	suite.Require().Equal(201, resp.StatusCode)
+
+	pub := models.Publication{}
+	err = json.NewDecoder(resp.Body).Decode(&pub)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal("News", pub.Title)
+	suite.Require().NotEmpty(pub.Token)
+
+	for format, contentType := range map[string]string{
+		"rss":  "application/rss+xml; charset=utf-8",
+		"atom": "application/atom+xml; charset=utf-8",
+		"json": "application/feed+json; charset=utf-8",
+	} {
+		resp, err = http.Get("http://localhost:8080/published/" + pub.Token + "/" + format)
+		suite.Require().Nil(err)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		suite.Require().Nil(err)
+		resp.Body.Close()
+
+		suite.Require().Equal(200, resp.StatusCode, format)
+		suite.Equal(contentType, resp.Header.Get("Content-Type"))
+		suite.NotEmpty(resp.Header.Get("Last-Modified"))
+		suite.Contains(resp.Header.Get("Cache-Control"), "max-age=")
+		suite.Contains(string(body), "Published item")
+
+		etag := resp.Header.Get("ETag")
+		suite.Require().NotEmpty(etag)
+
+		req, err = http.NewRequest("GET", "http://localhost:8080/published/"+pub.Token+"/"+format, nil)
+		suite.Require().Nil(err)
+		req.Header.Set("If-None-Match", etag)
+
+		resp, err = http.DefaultClient.Do(req)
+		suite.Require().Nil(err)
+		resp.Body.Close()
+
+		suite.Equal(304, resp.StatusCode, format)
+	}
+
+	resp, err = http.Get("http://localhost:8080/published/" + pub.Token + "/opml")
+	suite.Require().Nil(err)
+	resp.Body.Close()
+	suite.Equal(404, resp.StatusCode)
+
+	resp, err = http.Get("http://localhost:8080/published/bogus/rss")
+	suite.Require().Nil(err)
+	resp.Body.Close()
+	suite.Equal(404, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/publications", nil)
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+
+	pubs := struct {
+		Publications []models.Publication `json:"publications"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&pubs)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+	suite.Len(pubs.Publications, 1)
+
+	req, err = http.NewRequest("DELETE", "http://localhost:8080/v1/publications/"+pub.UUID, nil)
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+	suite.Equal(204, resp.StatusCode)
+
+	// Revoked tokens stop working
+	resp, err = http.Get("http://localhost:8080/published/" + pub.Token + "/rss")
+	suite.Require().Nil(err)
+	resp.Body.Close()
+	suite.Equal(404, resp.StatusCode)
+}
+
+// readEvent returns the id, type and data of the next event on an event stream
+func readEvent(reader *bufio.Reader) (id, eventType, data string, err error) {
+	for {
+		var line string
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if eventType != "" {
+				return
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func (suite *ServerTestSuite) openEvents(lastEventID string) *http.Response {
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/events", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	suite.Require().Equal(200, resp.StatusCode)
+	suite.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	return resp
+}
+
+func (suite *ServerTestSuite) TestEvents() {
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	entry := models.Entry{Title: "Item", Feed: feed, Mark: models.Unread}
+	err = suite.db.NewEntry(&entry, &suite.user)
+	suite.Require().Nil(err)
+
+	stream := suite.openEvents("")
+	reader := bufio.NewReader(stream.Body)
+
+	req, err := http.NewRequest("PUT", "http://localhost:8080/v1/entries/"+entry.UUID+"/mark?as=read", nil)
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+	suite.Require().Equal(204, resp.StatusCode)
+
+	id, eventType, data, err := readEvent(reader)
+	suite.Require().Nil(err)
+	stream.Body.Close()
+
+	suite.Equal(events.EntriesMarked, eventType)
+
+	marked := events.Data{}
+	err = json.Unmarshal([]byte(data), &marked)
+	suite.Require().Nil(err)
+	suite.Equal([]string{entry.UUID}, marked.Entries)
+	suite.Equal("read", marked.Marker)
+
+	lastID, err := strconv.ParseUint(id, 10, 64)
+	suite.Require().Nil(err)
+
+	// Resuming from before the mark replays it
+	stream = suite.openEvents(strconv.FormatUint(lastID-1, 10))
+	resumedID, eventType, _, err := readEvent(bufio.NewReader(stream.Body))
+	suite.Require().Nil(err)
+	stream.Body.Close()
+
+	suite.Equal(id, resumedID)
+	suite.Equal(events.EntriesMarked, eventType)
+
+	// Events that were never published cannot be resumed from
+	stream = suite.openEvents(strconv.FormatUint(lastID+100, 10))
+	_, eventType, _, err = readEvent(bufio.NewReader(stream.Body))
+	suite.Require().Nil(err)
+	stream.Body.Close()
+
+	suite.Equal(events.Resync, eventType)
+}
+
+func (suite *ServerTestSuite) TestEventsQueryToken() {
+	resp, err := http.Get("http://localhost:8080/v1/events?access_token=" + suite.token)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+	suite.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	resp, err = http.Get("http://localhost:8080/v1/events?access_token=bogus")
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(401, resp.StatusCode)
+
+	// Other endpoints only take the API key from the header
+	resp, err = http.Get("http://localhost:8080/v1/feeds?access_token=" + suite.token)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(400, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestWebhooks() {
+	// The receiver listens on a loopback address
+	db := suite.server.db.(*database.DB)
+	dispatcher := suite.server.sync.Webhooks()
+	db.AllowPrivateWebhooks, dispatcher.AllowPrivate = true, true
+	defer func() { db.AllowPrivateWebhooks, dispatcher.AllowPrivate = false, false }()
+
+	var lock gosync.Mutex
+	var payloads []webhooks.Payload
+	var signatures []string
+	var bodies [][]byte
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		payload := webhooks.Payload{}
+		json.Unmarshal(body, &payload)
+
+		lock.Lock()
+		payloads = append(payloads, payload)
+		signatures = append(signatures, r.Header.Get(webhooks.SignatureHeader))
+		bodies = append(bodies, body)
+		lock.Unlock()
+	}))
+	defer recv.Close()
+
+	feed := models.Feed{Subscription: suite.ts.URL}
+	err := suite.db.NewFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+
+	payload := []byte(`{"url": "` + recv.URL + `", "feed_id": "` + feed.UUID + `", "keyword": "item 3"}`)
+	req, err := http.NewRequest("POST", "http://localhost:8080/v1/webhooks", bytes.NewBuffer(payload))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	suite.Require().Equal(201, resp.StatusCode)
+
+	hook := models.Webhook{}
+	err = json.NewDecoder(resp.Body).Decode(&hook)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Require().NotEmpty(hook.UUID)
+	suite.Require().NotEmpty(hook.Secret)
+
+	err = suite.server.sync.SyncFeed(&feed, &suite.user)
+	suite.Require().Nil(err)
+	suite.server.sync.Webhooks().Wait()
+
+	suite.Require().Len(payloads, 1)
+	suite.Equal(models.WebhookEntriesNew, payloads[0].Event)
+	suite.Require().Len(payloads[0].Entries, 1)
+	suite.Equal("Item 3", payloads[0].Entries[0].Title)
+	suite.Equal(webhooks.Sign(hook.Secret, bodies[0]), signatures[0])
+
+	req, err = http.NewRequest("POST", "http://localhost:8080/v1/webhooks/"+hook.UUID+"/test", nil)
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	suite.Require().Equal(200, resp.StatusCode)
+
+	delivery := models.WebhookDelivery{}
+	err = json.NewDecoder(resp.Body).Decode(&delivery)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(models.WebhookPing, delivery.Event)
+	suite.Equal(200, delivery.Status)
+	suite.Require().Len(payloads, 2)
+	suite.Equal(delivery.UUID, payloads[1].Delivery)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/webhooks/"+hook.UUID+"/deliveries", nil)
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	suite.Require().Equal(200, resp.StatusCode)
+
+	type Deliveries struct {
+		Deliveries []models.WebhookDelivery `json:"deliveries"`
+	}
+
+	deliveries := Deliveries{}
+	err = json.NewDecoder(resp.Body).Decode(&deliveries)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Require().Len(deliveries.Deliveries, 2)
+	suite.Equal(delivery.UUID, deliveries.Deliveries[0].UUID)
+	suite.Equal(models.WebhookEntriesNew, deliveries.Deliveries[1].Event)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/webhooks/"+hook.UUID, nil)
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	suite.Require().Equal(200, resp.StatusCode)
+
+	found := models.Webhook{}
+	err = json.NewDecoder(resp.Body).Decode(&found)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+
+	suite.Equal(200, found.LastStatus)
+	suite.NotNil(found.LastDeliveredAt)
+
+	req, err = http.NewRequest("DELETE", "http://localhost:8080/v1/webhooks/"+hook.UUID, nil)
+	suite.Require().Nil(err)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	resp.Body.Close()
+	suite.Equal(204, resp.StatusCode)
+
+	suite.Empty(suite.db.Webhooks(&suite.user))
+}
+
+func (suite *ServerTestSuite) TestOPML() {
+	document := `<opml version="2.0"><body>
+		<outline text="Tech">
+			<outline text="Test" type="rss" xmlUrl="` + suite.ts.URL + `"/>
+		</outline>
+		<outline text="Missing" type="rss" xmlUrl="http://localhost:9/missing.xml"/>
+	</body></opml>`
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/v1/opml", bytes.NewBufferString(document))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Require().Equal(202, resp.StatusCode)
+
+	report := new(opml.Report)
+	err = json.NewDecoder(resp.Body).Decode(report)
+	suite.Require().Nil(err)
+	suite.Require().Len(report.Feeds, 2)
+
+	for i := 0; i < 50 && !report.Done; i++ {
+		time.Sleep(100 * time.Millisecond)
+
+		req, err = http.NewRequest("GET", "http://localhost:8080/v1/opml/imports/"+report.ID, nil)
+		suite.Require().Nil(err)
+
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := client.Do(req)
+		suite.Require().Nil(err)
+
+		suite.Require().Equal(200, resp.StatusCode)
+		err = json.NewDecoder(resp.Body).Decode(report)
+		suite.Require().Nil(err)
+		resp.Body.Close()
+	}
+
+	suite.Require().True(report.Done)
+	suite.Equal(opml.Imported, report.Feeds[0].Status)
+	suite.Equal("Tech", report.Feeds[0].Category)
+	suite.Equal(opml.Unreachable, report.Feeds[1].Status)
+	suite.NotEmpty(report.Feeds[1].Error)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/opml", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(200, resp.StatusCode)
+	suite.Contains(resp.Header.Get("Content-Disposition"), "attachment")
+
+	exported, err := opml.Parse(resp.Body)
+	suite.Require().Nil(err)
+	suite.Require().Len(exported.Body.Outlines, 1)
+	suite.Equal("Tech", exported.Body.Outlines[0].Text)
+	suite.Require().Len(exported.Body.Outlines[0].Outlines, 1)
+	suite.Equal(suite.ts.URL, exported.Body.Outlines[0].Outlines[0].XMLURL)
+
+	req, err = http.NewRequest("POST", "http://localhost:8080/v1/opml", bytes.NewBufferString("<rss></rss>"))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(400, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", "http://localhost:8080/v1/opml/imports/bogus", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(404, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestMeRequiresSession() {
+	key := models.APIKey{Scope: models.ScopeFeedsRead}
+	err := suite.db.NewPersonalAccessToken("secret", &key, &suite.user)
+	suite.Require().Nil(err)
+
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/me", nil)
+	suite.Require().Nil(err)
+
+	req.Header.Set("Authorization", "Bearer "+key.Key)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	suite.Equal(403, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestTOTPLogin() {
+	client := &http.Client{}
+	post := func(path string, values url.Values) *http.Response {
+		req, err := http.NewRequest("POST", "http://localhost:8080/v1"+path, bytes.NewBufferString(values.Encode()))
+		suite.Require().Nil(err)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := client.Do(req)
+		suite.Require().Nil(err)
+		return resp
+	}
+
+	resp := post("/me/totp", nil)
+	defer resp.Body.Close()
+	suite.Equal(401, resp.StatusCode)
+
+	resp = post("/me/totp", url.Values{"password": {"testtesttest"}})
+	defer resp.Body.Close()
+	suite.Equal(201, resp.StatusCode)
+
+	enrollment := new(TOTPEnrollment)
+	err := json.NewDecoder(resp.Body).Decode(enrollment)
+	suite.Require().Nil(err)
+	suite.Contains(enrollment.URI, enrollment.Secret)
+	suite.Equal([]byte("\x89PNG"), enrollment.QRCode[:4])
+
+	now := time.Now()
+	code, err := totp.GenerateCode(enrollment.Secret, now)
+	suite.Require().Nil(err)
+
+	resp = post("/me/totp/enable", url.Values{"code": {code}})
+	defer resp.Body.Close()
+	suite.Equal(200, resp.StatusCode)
+
+	recovery := new(RecoveryCodes)
+	err = json.NewDecoder(resp.Body).Decode(recovery)
+	suite.Require().Nil(err)
+	suite.Require().Len(recovery.Codes, database.RecoveryCodeCount)
+
+	login := func() string {
+		resp, err := http.PostForm("http://localhost:8080/v1/login",
+			url.Values{"username": {"GoTest"}, "password": {"testtesttest"}})
+		suite.Require().Nil(err)
+		defer resp.Body.Close()
+
+		suite.Equal(200, resp.StatusCode)
+
+		challenge := new(Challenge)
+		err = json.NewDecoder(resp.Body).Decode(challenge)
+		suite.Require().Nil(err)
+		suite.True(challenge.TOTPRequired)
+		suite.Require().NotEmpty(challenge.Token)
+		return challenge.Token
+	}
+
+	challenge := login()
+
+	resp, err = http.PostForm("http://localhost:8080/v1/login/totp",
+		url.Values{"challenge": {challenge}, "code": {"000000"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(401, resp.StatusCode)
+
+	next, err := totp.GenerateCode(enrollment.Secret, now.Add(30*time.Second))
+	suite.Require().Nil(err)
+
+	resp, err = http.PostForm("http://localhost:8080/v1/login/totp",
+		url.Values{"challenge": {challenge}, "code": {next}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(200, resp.StatusCode)
+
+	session := new(Session)
+	err = json.NewDecoder(resp.Body).Decode(session)
+	suite.Require().Nil(err)
+	suite.NotEmpty(session.Key)
+
+	// Challenges can only be used once
+	resp, err = http.PostForm("http://localhost:8080/v1/login/totp",
+		url.Values{"challenge": {challenge}, "recovery_code": {recovery.Codes[0]}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(401, resp.StatusCode)
+
+	resp, err = http.PostForm("http://localhost:8080/v1/login/totp",
+		url.Values{"challenge": {login()}, "recovery_code": {recovery.Codes[0]}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(200, resp.StatusCode)
+
+	body, err := json.Marshal(map[string]string{"password": "testtesttest"})
+	suite.Require().Nil(err)
+
+	req, err := http.NewRequest("DELETE", "http://localhost:8080/v1/me/totp", bytes.NewBuffer(body))
+	suite.Require().Nil(err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = client.Do(req)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(204, resp.StatusCode)
+
+	resp, err = http.PostForm("http://localhost:8080/v1/login",
+		url.Values{"username": {"GoTest"}, "password": {"testtesttest"}})
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+
+	session = new(Session)
+	err = json.NewDecoder(resp.Body).Decode(session)
+	suite.Require().Nil(err)
+	suite.NotEmpty(session.Key)
+}
+
 func (suite *ServerTestSuite) TestAddFeedsToCategory() {
 
 }
@@ -1093,6 +2931,35 @@ func TestServerLogin(t *testing.T) {
 	server.Stop()
 }
 
+func TestClientIP(t *testing.T) {
+	server := &Server{trustedProxies: parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})}
+
+	clientIP := func(remoteAddr string, headers map[string]string) string {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return server.clientIP(echo.New().NewContext(req, httptest.NewRecorder()))
+	}
+
+	// Forwarding headers from clients are ignored
+	assert.Equal(t, "203.0.113.7", clientIP("203.0.113.7:4000", map[string]string{
+		echo.HeaderXForwardedFor: "198.51.100.1",
+		echo.HeaderXRealIP:       "198.51.100.2",
+	}))
+
+	assert.Equal(t, "198.51.100.1", clientIP("10.0.0.1:4000", map[string]string{
+		echo.HeaderXForwardedFor: "198.51.100.9, 198.51.100.1, 192.168.1.1",
+	}))
+
+	assert.Equal(t, "198.51.100.2", clientIP("192.168.4.4:4000", map[string]string{
+		echo.HeaderXRealIP: "198.51.100.2",
+	}))
+
+	assert.Equal(t, "10.0.0.1", clientIP("10.0.0.1:4000", nil))
+}
+
 func TestServerTestSuite(t *testing.T) {
 	serverSuite := new(ServerTestSuite)
 	suite.Run(t, serverSuite)
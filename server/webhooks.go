@@ -0,0 +1,134 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/chavamee/syndication/models"
+
+	"github.com/labstack/echo"
+)
+
+// NewWebhook registers a webhook for the entries of a user
+func (s *Server) NewWebhook(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	hook := models.Webhook{}
+	if err = c.Bind(&hook); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	err = s.db.NewWebhook(&hook, &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusCreated, hook)
+}
+
+// GetWebhooks returns the webhooks of a user
+func (s *Server) GetWebhooks(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	type Webhooks struct {
+		Webhooks []models.Webhook `json:"webhooks"`
+	}
+
+	return c.JSON(http.StatusOK, Webhooks{
+		Webhooks: s.db.Webhooks(&user),
+	})
+}
+
+// GetWebhook returns a webhook with id
+func (s *Server) GetWebhook(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	hook, err := s.db.Webhook(c.Param("webhookID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return c.JSON(http.StatusOK, hook)
+}
+
+// DeleteWebhook with id, along with the log of its deliveries
+func (s *Server) DeleteWebhook(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	err = s.db.DeleteWebhook(c.Param("webhookID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	return echo.NewHTTPError(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the last deliveries of a webhook with id
+func (s *Server) GetWebhookDeliveries(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	deliveries, err := s.db.WebhookDeliveries(c.Param("webhookID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	type Deliveries struct {
+		Deliveries []models.WebhookDelivery `json:"deliveries"`
+	}
+
+	return c.JSON(http.StatusOK, Deliveries{
+		Deliveries: deliveries,
+	})
+}
+
+// TestWebhook sends a ping event to a webhook with id and
+// returns the delivery, whether it succeeded or not
+func (s *Server) TestWebhook(c echo.Context) error {
+	user, err := s.getUser(&c)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	hook, err := s.db.Webhook(c.Param("webhookID"), &user)
+	if err != nil {
+		return newError(err, &c)
+	}
+
+	delivery, err := s.sync.Webhooks().Ping(hook, &user)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, delivery)
+}
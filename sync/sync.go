@@ -23,7 +23,9 @@ import (
 	"time"
 
 	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/events"
 	"github.com/chavamee/syndication/models"
+	"github.com/chavamee/syndication/webhooks"
 
 	"github.com/jasonlvhit/gocron"
 	"github.com/mmcdole/gofeed"
@@ -34,7 +36,8 @@ import (
 type Sync struct {
 	scheduler   *gocron.Scheduler
 	cronChannel chan bool
-	db          *database.DB
+	db          database.Store
+	webhooks    *webhooks.Dispatcher
 }
 
 func (s *Sync) checkForUpdates(feed *models.Feed, user *models.User) ([]models.Entry, error) {
@@ -78,21 +81,27 @@ func (s *Sync) checkForUpdates(feed *models.Feed, user *models.User) ([]models.E
 		return nil, nil
 	}
 
-	var entries []models.Entry
-	for _, item := range fetchedFeed.Items {
-		var itemGUID string
-		if item.GUID != "" {
-			itemGUID = item.GUID
-		} else {
+	guids := make([]string, len(fetchedFeed.Items))
+	for i, item := range fetchedFeed.Items {
+		if item.GUID == "" {
 			itemHash := md5.Sum([]byte(item.Title + item.Link))
-			itemGUID = string(itemHash[:md5.Size])
-			item.GUID = itemGUID
+			item.GUID = string(itemHash[:md5.Size])
 		}
+		guids[i] = item.GUID
+	}
+
+	existing, err := s.db.ExistingEntryGUIDs(feed.UUID, guids, user)
+	if err != nil {
+		return nil, err
+	}
 
-		if s.db.EntryWithGUIDExists(itemGUID, user) {
+	var entries []models.Entry
+	for _, item := range fetchedFeed.Items {
+		if existing[item.GUID] {
 			continue
 		}
 
+		existing[item.GUID] = true
 		entries = append(entries, convertItemsToEntries(*feed, item))
 	}
 
@@ -176,25 +185,39 @@ func (s *Sync) SyncUsers() {
 
 // SyncFeed owned by user
 func (s *Sync) SyncFeed(feed *models.Feed, user *models.User) error {
+	_, err := s.syncFeed(feed, user)
+	return err
+}
+
+// syncFeed returns the number of new entries it found in feed
+func (s *Sync) syncFeed(feed *models.Feed, user *models.User) (int, error) {
 	if !time.Now().After(feed.LastUpdated.Add(time.Minute)) {
-		return nil
+		return 0, nil
 	}
 
 	entries, err := s.checkForUpdates(feed, user)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	err = s.db.NewEntries(entries, *feed, user)
+	subscriptions, err := s.db.NewEntries(entries, *feed, user)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	err = s.db.EditFeed(feed, user)
+	err = s.db.UpdateFeedSource(feed)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	s.webhooks.EntriesAdded(*feed, entries, user)
+
+	// Other users subscribed to the same source received new entries too
+	for _, subscription := range subscriptions {
+		owner := subscription.User
+		s.webhooks.EntriesAdded(subscription, subscription.Entries, &owner)
+	}
+	return len(entries), nil
 }
 
 // SyncCategory owned by user.
@@ -216,34 +239,79 @@ func (s *Sync) SyncCategory(category *models.Category, user *models.User) error
 	return nil
 }
 
-// SyncUser sync's all feeds owned by user
+// SyncUser sync's all feeds owned by user.
+// Its progress is published on the events Bus of the database.
 func (s *Sync) SyncUser(user *models.User) error {
+	bus := s.db.Events()
 	feeds := s.db.Feeds(user)
-	for _, feed := range feeds {
-		if err := s.SyncFeed(&feed, user); err != nil {
+	bus.Publish(user.ID, events.SyncStarted, events.Data{Total: len(feeds)})
+
+	newEntries := 0
+	for i, feed := range feeds {
+		added, err := s.syncFeed(&feed, user)
+		if err != nil {
 			log.Error(err)
 		}
+
+		newEntries += added
+		bus.Publish(user.ID, events.SyncProgress, events.Data{
+			Feed:  feed.UUID,
+			Done:  i + 1,
+			Total: len(feeds),
+		})
 	}
 
+	bus.Publish(user.ID, events.SyncFinished, events.Data{Total: len(feeds), NewEntries: newEntries})
 	return nil
 }
 
+// PurgeTrash permanently deletes expired trash items.
+func (s *Sync) PurgeTrash() {
+	if err := s.db.PurgeTrash(); err != nil {
+		log.Error(err)
+	}
+}
+
+// DeleteExpiredAPIKeys permanently deletes API keys that expired.
+func (s *Sync) DeleteExpiredAPIKeys() {
+	if err := s.db.DeleteExpiredAPIKeys(); err != nil {
+		log.Error(err)
+	}
+}
+
+// DeleteExpiredLockouts permanently deletes failed logins that are forgotten.
+func (s *Sync) DeleteExpiredLockouts() {
+	if err := s.db.DeleteExpiredLockouts(); err != nil {
+		log.Error(err)
+	}
+}
+
 // Start a syncer
 func (s *Sync) Start() {
 	s.scheduler.Every(5).Minutes().Do(s.SyncUsers)
+	s.scheduler.Every(1).Hour().Do(s.PurgeTrash)
+	s.scheduler.Every(1).Hour().Do(s.DeleteExpiredAPIKeys)
+	s.scheduler.Every(1).Hour().Do(s.DeleteExpiredLockouts)
 	s.scheduler.RunAll()
 	s.cronChannel = s.scheduler.Start()
 }
 
-// Stop a syncer
+// Stop a syncer, giving up on the retries of webhook deliveries
 func (s *Sync) Stop() {
 	s.cronChannel <- true
+	s.webhooks.Stop()
 }
 
 // NewSync creates a new Sync object
-func NewSync(db *database.DB) *Sync {
+func NewSync(db database.Store) *Sync {
 	return &Sync{
 		db:        db,
 		scheduler: gocron.NewScheduler(),
+		webhooks:  webhooks.NewDispatcher(db),
 	}
 }
+
+// Webhooks returns the Dispatcher synced entries are delivered with
+func (s *Sync) Webhooks() *webhooks.Dispatcher {
+	return s.webhooks
+}
@@ -58,7 +58,7 @@ func (suite *SyncTestSuite) SetupTest() {
 	suite.db, err = database.NewDB("sqlite3", TestDatabasePath)
 	suite.Require().Nil(err)
 
-	err = suite.db.NewUser("test", "golang")
+	err = suite.db.NewUser("test", "golang123")
 	suite.Require().Nil(err)
 
 	suite.user, err = suite.db.UserWithName("test")
@@ -0,0 +1,399 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package webhooks delivers the entries a user receives to the
+// Webhooks whose filter they match, as signed JSON requests
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers sent along with every delivery
+const (
+	EventHeader     = "X-Syndication-Event"
+	DeliveryHeader  = "X-Syndication-Delivery"
+	SignatureHeader = "X-Syndication-Signature"
+)
+
+// Timeout is how long a receiver has to respond to a delivery attempt
+const Timeout = 10 * time.Second
+
+// DefaultBackoff is how long a Dispatcher waits before each retry
+// of a delivery that failed
+var DefaultBackoff = []time.Duration{
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+}
+
+// ErrPrivateAddress is the error of deliveries to hosts that resolve
+// to a private address when the Dispatcher does not AllowPrivate
+var ErrPrivateAddress = errors.New("Webhook destination is a private address")
+
+type (
+	// Payload is the body of a delivery
+	Payload struct {
+		Event    string         `json:"event"`
+		Webhook  string         `json:"webhook"`
+		Delivery string         `json:"delivery"`
+		Entries  []models.Entry `json:"entries"`
+		SentAt   time.Time      `json:"sent_at"`
+	}
+
+	// Dispatcher delivers entries to the Webhooks of their user. Deliveries
+	// that fail are retried after each duration in Backoff.
+	Dispatcher struct {
+		Backoff []time.Duration
+
+		// AllowPrivate lets deliveries reach private, loopback and
+		// link-local addresses, such as receivers on the same host
+		AllowPrivate bool
+
+		db       database.Store
+		client   *http.Client
+		pending  sync.WaitGroup
+		stop     chan struct{}
+		stopOnce sync.Once
+	}
+)
+
+// NewDispatcher creates a Dispatcher for the Webhooks in db
+func NewDispatcher(db database.Store) *Dispatcher {
+	d := &Dispatcher{
+		Backoff: DefaultBackoff,
+		db:      db,
+		stop:    make(chan struct{}),
+	}
+
+	// Addresses are checked once resolved so that a host cannot
+	// pass as public when created and resolve to a private one later
+	dialer := &net.Dialer{Timeout: Timeout, Control: d.checkAddress}
+	d.client = &http.Client{
+		Timeout:   Timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	return d
+}
+
+// Sign returns the signature of body with secret, as sent in SignatureHeader.
+// Receivers compute the HMAC-SHA256 of the body they receive to verify it.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Matches returns true if entry, published in feed, matches the
+// filter of hook. feed should include its Category.
+func Matches(hook models.Webhook, feed models.Feed, entry models.Entry) bool {
+	if hook.FeedID != "" && hook.FeedID != feed.UUID {
+		return false
+	}
+
+	if hook.CategoryID != "" && hook.CategoryID != feed.Category.UUID {
+		return false
+	}
+
+	if hook.Keyword != "" {
+		keyword := strings.ToLower(hook.Keyword)
+		text := strings.ToLower(entry.Title + "\n" + entry.Description)
+		if !strings.Contains(text, keyword) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EntriesAdded delivers entries, just added to feed, to the Webhooks
+// of user they match. Webhooks filtering on a tag are skipped.
+func (d *Dispatcher) EntriesAdded(feed models.Feed, entries []models.Entry, user *models.User) {
+	var hooks []models.Webhook
+	for _, hook := range d.db.Webhooks(user) {
+		if hook.TagID == "" {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	if len(hooks) == 0 || len(entries) == 0 {
+		return
+	}
+
+	feed, err := d.db.Feed(feed.UUID, user)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	guids := make([]string, len(entries))
+	for i, entry := range entries {
+		guids[i] = entry.GUID
+	}
+
+	stored, err := d.db.EntriesWithGUIDs(feed.UUID, guids, user)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for i := range stored {
+		stored[i].Feed = feed
+	}
+
+	for _, hook := range hooks {
+		var matched []models.Entry
+		for _, entry := range stored {
+			if Matches(hook, feed, entry) {
+				matched = append(matched, entry)
+			}
+		}
+
+		if len(matched) > 0 {
+			d.dispatch(hook, models.WebhookEntriesNew, matched, user)
+		}
+	}
+}
+
+// EntriesTagged delivers the entries with ids, just tagged with the
+// tag with tagID, to the Webhooks of user filtering on that tag
+func (d *Dispatcher) EntriesTagged(tagID string, ids []string, user *models.User) {
+	var hooks []models.Webhook
+	for _, hook := range d.db.Webhooks(user) {
+		if hook.TagID == tagID {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	var entries []models.Entry
+	feeds := map[string]models.Feed{}
+	for _, id := range ids {
+		entry, err := d.db.Entry(id, user)
+		if err != nil {
+			continue
+		}
+
+		feed, ok := feeds[entry.Feed.UUID]
+		if !ok {
+			if feed, err = d.db.Feed(entry.Feed.UUID, user); err != nil {
+				continue
+			}
+			feeds[feed.UUID] = feed
+		}
+
+		entry.Feed = feed
+		entries = append(entries, entry)
+	}
+
+	for _, hook := range hooks {
+		var matched []models.Entry
+		for _, entry := range entries {
+			if Matches(hook, entry.Feed, entry) {
+				matched = append(matched, entry)
+			}
+		}
+
+		if len(matched) > 0 {
+			d.dispatch(hook, models.WebhookEntriesTagged, matched, user)
+		}
+	}
+}
+
+// Ping delivers a test event without entries to hook, owned by user,
+// and returns the outcome of that single attempt, which is not retried
+func (d *Dispatcher) Ping(hook models.Webhook, user *models.User) (models.WebhookDelivery, error) {
+	return d.deliver(hook, models.WebhookPing, []models.Entry{}, 1, *user)
+}
+
+// Wait blocks until every delivery in progress is done retrying
+func (d *Dispatcher) Wait() {
+	d.pending.Wait()
+}
+
+// Stop gives up on the retries of deliveries in progress and waits
+// for their current attempt to finish
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	d.pending.Wait()
+}
+
+func (d *Dispatcher) dispatch(hook models.Webhook, event string, entries []models.Entry, user *models.User) {
+	owner := *user
+
+	d.pending.Add(1)
+	go func() {
+		defer d.pending.Done()
+
+		if _, err := d.deliver(hook, event, entries, len(d.Backoff)+1, owner); err != nil {
+			log.Error(err)
+		}
+	}()
+}
+
+// wait blocks for delay and returns false if the Dispatcher stops first
+func (d *Dispatcher) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-d.stop:
+		return false
+	}
+}
+
+// reload replaces hook with its stored version and
+// returns false if it was deleted since
+func (d *Dispatcher) reload(hook *models.Webhook, user *models.User) (bool, error) {
+	stored, err := d.db.Webhook(hook.UUID, user)
+	if _, ok := err.(database.NotFound); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	*hook = stored
+	return true, nil
+}
+
+// deliver sends entries to hook, owned by user, making up to attempts
+// attempts, and logs the delivery along with its outcome. It gives up
+// once hook is deleted or the Dispatcher stops.
+func (d *Dispatcher) deliver(hook models.Webhook, event string, entries []models.Entry, attempts int, user models.User) (models.WebhookDelivery, error) {
+	delivery := models.WebhookDelivery{
+		Event:   event,
+		Entries: len(entries),
+	}
+
+	if found, err := d.reload(&hook, &user); !found {
+		return delivery, err
+	}
+
+	if err := d.db.NewWebhookDelivery(&delivery, &hook); err != nil {
+		return delivery, err
+	}
+
+	body, err := json.Marshal(Payload{
+		Event:    event,
+		Webhook:  hook.UUID,
+		Delivery: delivery.UUID,
+		Entries:  entries,
+		SentAt:   time.Now(),
+	})
+	if err != nil {
+		return delivery, err
+	}
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if !d.wait(d.Backoff[attempt-2]) {
+				break
+			}
+
+			if found, err := d.reload(&hook, &user); !found {
+				return delivery, err
+			}
+		}
+
+		delivery.Attempts = attempt
+		delivery.Status, err = d.post(hook, event, delivery.UUID, body)
+		delivery.Error = ""
+		if err != nil {
+			delivery.Error = err.Error()
+		} else if delivery.Status < 200 || delivery.Status > 299 {
+			delivery.Error = "Receiver responded with " + strconv.Itoa(delivery.Status)
+		}
+
+		if err = d.db.UpdateWebhookDelivery(&delivery); err != nil {
+			// Deleted along with its webhook, or dropped from the log
+			if _, ok := err.(database.NotFound); ok {
+				return delivery, nil
+			}
+			return delivery, err
+		}
+
+		if delivery.Error == "" {
+			break
+		}
+	}
+
+	return delivery, nil
+}
+
+// checkAddress refuses connections to private addresses, once the
+// host of a delivery is resolved, unless the Dispatcher AllowPrivate
+func (d *Dispatcher) checkAddress(network, address string, conn syscall.RawConn) error {
+	if d.AllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || database.PrivateAddress(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// post sends body to hook and returns the status it responded with
+func (d *Dispatcher) post(hook models.Webhook, event, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Syndication-Webhooks")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
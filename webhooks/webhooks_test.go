@@ -0,0 +1,370 @@
+/*
+  Copyright (C) 2017 Jorge Martinez Hernandez
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chavamee/syndication/database"
+	"github.com/chavamee/syndication/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receiver struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	statuses []int
+	payloads []Payload
+	headers  []http.Header
+}
+
+// newReceiver responds to each request with the next of statuses,
+// and with 200 once they run out
+func newReceiver(t *testing.T, secret *string, statuses ...int) *receiver {
+	recv := &receiver{statuses: statuses}
+	recv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		assert.Equal(t, Sign(*secret, body), r.Header.Get(SignatureHeader))
+
+		payload := Payload{}
+		require.Nil(t, json.Unmarshal(body, &payload))
+
+		recv.lock.Lock()
+		defer recv.lock.Unlock()
+
+		recv.payloads = append(recv.payloads, payload)
+		recv.headers = append(recv.headers, r.Header)
+
+		status := http.StatusOK
+		if len(recv.statuses) > 0 {
+			status, recv.statuses = recv.statuses[0], recv.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return recv
+}
+
+func setup(t *testing.T) (*database.MemoryDB, models.User, models.Feed) {
+	db := database.NewMemoryDB()
+	db.AllowPrivateWebhooks = true
+	err := db.NewUser("GoTest", "testtesttest")
+	require.Nil(t, err)
+
+	user, err := db.UserWithName("GoTest")
+	require.Nil(t, err)
+
+	ctg := models.Category{Name: "News"}
+	require.Nil(t, db.NewCategory(&ctg, &user))
+
+	feed := models.Feed{Title: "Example", Subscription: "http://example.com", Category: ctg}
+	require.Nil(t, db.NewFeed(&feed, &user))
+
+	return db, user, feed
+}
+
+func TestSign(t *testing.T) {
+	assert.Equal(t,
+		"sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		Sign("key", []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestMatches(t *testing.T) {
+	feed := models.Feed{UUID: "feed", Category: models.Category{UUID: "category"}}
+	entry := models.Entry{Title: "Go 1.10 is released", Description: "Release notes"}
+
+	assert.True(t, Matches(models.Webhook{}, feed, entry))
+	assert.True(t, Matches(models.Webhook{FeedID: "feed", CategoryID: "category"}, feed, entry))
+	assert.True(t, Matches(models.Webhook{Keyword: "RELEASED"}, feed, entry))
+	assert.True(t, Matches(models.Webhook{Keyword: "notes"}, feed, entry))
+	assert.False(t, Matches(models.Webhook{FeedID: "other"}, feed, entry))
+	assert.False(t, Matches(models.Webhook{CategoryID: "other"}, feed, entry))
+	assert.False(t, Matches(models.Webhook{Keyword: "rust"}, feed, entry))
+}
+
+func TestEntriesAdded(t *testing.T) {
+	db, user, feed := setup(t)
+
+	var secret string
+	recv := newReceiver(t, &secret)
+	defer recv.Close()
+
+	hook := models.Webhook{URL: recv.URL, FeedID: feed.UUID, Keyword: "golang"}
+	require.Nil(t, db.NewWebhook(&hook, &user))
+	secret = hook.Secret
+
+	tag := models.Tag{Name: "Later"}
+	require.Nil(t, db.NewTag(&tag, &user))
+
+	tagged := models.Webhook{URL: recv.URL, TagID: tag.UUID}
+	require.Nil(t, db.NewWebhook(&tagged, &user))
+
+	entries := []models.Entry{
+		{Title: "All about golang", GUID: "1"},
+		{Title: "Something else", GUID: "2"},
+	}
+	_, err := db.NewEntries(entries, feed, &user)
+	require.Nil(t, err)
+
+	dispatcher := NewDispatcher(db)
+	dispatcher.AllowPrivate = true
+	dispatcher.EntriesAdded(feed, entries, &user)
+	dispatcher.Wait()
+
+	require.Len(t, recv.payloads, 1)
+	payload := recv.payloads[0]
+	assert.Equal(t, models.WebhookEntriesNew, payload.Event)
+	assert.Equal(t, hook.UUID, payload.Webhook)
+	require.Len(t, payload.Entries, 1)
+	assert.Equal(t, "All about golang", payload.Entries[0].Title)
+	assert.NotEmpty(t, payload.Entries[0].UUID)
+	assert.Equal(t, models.WebhookEntriesNew, recv.headers[0].Get(EventHeader))
+	assert.Equal(t, payload.Delivery, recv.headers[0].Get(DeliveryHeader))
+
+	deliveries, err := db.WebhookDeliveries(hook.UUID, &user)
+	require.Nil(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, payload.Delivery, deliveries[0].UUID)
+	assert.Equal(t, 200, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Entries)
+
+	// Webhooks filtering on a tag are only called when entries are tagged
+	secret = tagged.Secret
+	require.Nil(t, db.TagEntries(tag.UUID, []string{payload.Entries[0].UUID}, &user))
+	dispatcher.EntriesTagged(tag.UUID, []string{payload.Entries[0].UUID}, &user)
+	dispatcher.Wait()
+
+	require.Len(t, recv.payloads, 2)
+	assert.Equal(t, models.WebhookEntriesTagged, recv.payloads[1].Event)
+	assert.Equal(t, tagged.UUID, recv.payloads[1].Webhook)
+}
+
+func TestRetry(t *testing.T) {
+	db, user, feed := setup(t)
+
+	var secret string
+	recv := newReceiver(t, &secret, http.StatusInternalServerError, http.StatusBadGateway)
+	defer recv.Close()
+
+	hook := models.Webhook{URL: recv.URL}
+	require.Nil(t, db.NewWebhook(&hook, &user))
+	secret = hook.Secret
+
+	entries := []models.Entry{{Title: "Item", GUID: "1"}}
+	_, err := db.NewEntries(entries, feed, &user)
+	require.Nil(t, err)
+
+	dispatcher := NewDispatcher(db)
+	dispatcher.AllowPrivate = true
+	dispatcher.Backoff = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+	dispatcher.EntriesAdded(feed, entries, &user)
+	dispatcher.Wait()
+
+	require.Len(t, recv.payloads, 3)
+	assert.Equal(t, recv.payloads[0].Delivery, recv.payloads[2].Delivery)
+
+	deliveries, err := db.WebhookDeliveries(hook.UUID, &user)
+	require.Nil(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, 200, deliveries[0].Status)
+	assert.Empty(t, deliveries[0].Error)
+
+	hook, err = db.Webhook(hook.UUID, &user)
+	require.Nil(t, err)
+	assert.Equal(t, 200, hook.LastStatus)
+	assert.NotNil(t, hook.LastDeliveredAt)
+}
+
+func TestPing(t *testing.T) {
+	db, user, _ := setup(t)
+
+	var secret string
+	recv := newReceiver(t, &secret, http.StatusNotFound)
+	defer recv.Close()
+
+	hook := models.Webhook{URL: recv.URL}
+	require.Nil(t, db.NewWebhook(&hook, &user))
+	secret = hook.Secret
+
+	dispatcher := NewDispatcher(db)
+	dispatcher.AllowPrivate = true
+
+	delivery, err := dispatcher.Ping(hook, &user)
+	require.Nil(t, err)
+
+	assert.Equal(t, models.WebhookPing, delivery.Event)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusNotFound, delivery.Status)
+	assert.NotEmpty(t, delivery.Error)
+
+	require.Len(t, recv.payloads, 1)
+	assert.Empty(t, recv.payloads[0].Entries)
+}
+
+func TestPrivateAddress(t *testing.T) {
+	db, user, _ := setup(t)
+
+	var secret string
+	recv := newReceiver(t, &secret)
+	defer recv.Close()
+
+	hook := models.Webhook{URL: recv.URL}
+	require.Nil(t, db.NewWebhook(&hook, &user))
+
+	// The receiver listens on a loopback address
+	delivery, err := NewDispatcher(db).Ping(hook, &user)
+	require.Nil(t, err)
+
+	assert.Zero(t, delivery.Status)
+	assert.Contains(t, delivery.Error, ErrPrivateAddress.Error())
+	assert.Empty(t, recv.payloads)
+}
+
+func TestStop(t *testing.T) {
+	db, user, feed := setup(t)
+
+	var secret string
+	recv := newReceiver(t, &secret, http.StatusInternalServerError)
+	defer recv.Close()
+
+	hook := models.Webhook{URL: recv.URL}
+	require.Nil(t, db.NewWebhook(&hook, &user))
+	secret = hook.Secret
+
+	entries := []models.Entry{{Title: "Item", GUID: "1"}}
+	_, err := db.NewEntries(entries, feed, &user)
+	require.Nil(t, err)
+
+	dispatcher := NewDispatcher(db)
+	dispatcher.AllowPrivate = true
+	dispatcher.Backoff = []time.Duration{time.Hour}
+	dispatcher.EntriesAdded(feed, entries, &user)
+
+	require.Eventually(t, func() bool {
+		recv.lock.Lock()
+		defer recv.lock.Unlock()
+		return len(recv.payloads) == 1
+	}, time.Second, time.Millisecond)
+
+	// Stopping does not wait for the retry
+	stopped := time.Now()
+	dispatcher.Stop()
+	assert.True(t, time.Since(stopped) < time.Second)
+
+	deliveries, err := db.WebhookDeliveries(hook.UUID, &user)
+	require.Nil(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+}
+
+func TestDeletedDuringRetry(t *testing.T) {
+	db, user, feed := setup(t)
+
+	var secret string
+	recv := newReceiver(t, &secret, http.StatusInternalServerError)
+	defer recv.Close()
+
+	hook := models.Webhook{URL: recv.URL}
+	require.Nil(t, db.NewWebhook(&hook, &user))
+	secret = hook.Secret
+
+	entries := []models.Entry{{Title: "Item", GUID: "1"}}
+	_, err := db.NewEntries(entries, feed, &user)
+	require.Nil(t, err)
+
+	dispatcher := NewDispatcher(db)
+	dispatcher.AllowPrivate = true
+	dispatcher.Backoff = []time.Duration{100 * time.Millisecond}
+	dispatcher.EntriesAdded(feed, entries, &user)
+
+	require.Eventually(t, func() bool {
+		recv.lock.Lock()
+		defer recv.lock.Unlock()
+		return len(recv.payloads) == 1
+	}, time.Second, time.Millisecond)
+
+	require.Nil(t, db.DeleteWebhook(hook.UUID, &user))
+	dispatcher.Wait()
+
+	assert.Len(t, recv.payloads, 1)
+}
+
+func TestEntriesAddedToSubscribers(t *testing.T) {
+	// Feeds are only shared between users by the sql backend
+	dir, err := ioutil.TempDir("", "syndication-webhooks")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := database.NewDB("sqlite3", filepath.Join(dir, "syndication.db"))
+	require.Nil(t, err)
+	defer db.Close()
+	db.AllowPrivateWebhooks = true
+
+	var users []models.User
+	var feeds []models.Feed
+	for _, name := range []string{"GoTest", "Other"} {
+		require.Nil(t, db.NewUser(name, "testtesttest"))
+
+		user, err := db.UserWithName(name)
+		require.Nil(t, err)
+
+		feed := models.Feed{Title: "Example", Subscription: "http://example.com"}
+		require.Nil(t, db.NewFeed(&feed, &user))
+
+		users = append(users, user)
+		feeds = append(feeds, feed)
+	}
+
+	var secret string
+	recv := newReceiver(t, &secret)
+	defer recv.Close()
+
+	hook := models.Webhook{URL: recv.URL}
+	require.Nil(t, db.NewWebhook(&hook, &users[1]))
+	secret = hook.Secret
+
+	entries := []models.Entry{{Title: "Item", GUID: "1"}}
+	subscriptions, err := db.NewEntries(entries, feeds[0], &users[0])
+	require.Nil(t, err)
+	require.Len(t, subscriptions, 1)
+	assert.Equal(t, feeds[1].UUID, subscriptions[0].UUID)
+	assert.Equal(t, users[1].UUID, subscriptions[0].User.UUID)
+	require.Len(t, subscriptions[0].Entries, 1)
+
+	dispatcher := NewDispatcher(db)
+	dispatcher.AllowPrivate = true
+	dispatcher.EntriesAdded(feeds[0], entries, &users[0])
+	dispatcher.EntriesAdded(subscriptions[0], subscriptions[0].Entries, &subscriptions[0].User)
+	dispatcher.Wait()
+
+	require.Len(t, recv.payloads, 1)
+	assert.Equal(t, hook.UUID, recv.payloads[0].Webhook)
+	require.Len(t, recv.payloads[0].Entries, 1)
+	assert.Equal(t, "Item", recv.payloads[0].Entries[0].Title)
+}